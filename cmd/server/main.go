@@ -1,19 +1,37 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"maps"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"database_firewall/internal/admin"
+	"database_firewall/internal/allowlist"
+	"database_firewall/internal/ban"
+	"database_firewall/internal/cluster"
 	"database_firewall/internal/config"
+	"database_firewall/internal/ipfilter"
 	"database_firewall/internal/logging"
-	"database_firewall/internal/proxy"
+	"database_firewall/internal/metrics"
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/rules"
+	"database_firewall/internal/server"
+	"database_firewall/internal/upgrade"
 )
 
 var configFlag = flag.String("config", "", "to set config file path")
+var watchFlag = flag.Duration("watch", 0, "poll the config file at this interval and reload on change")
+
+// upgradeTimeout bounds how long SIGUSR2 waits for the new process.
+const upgradeTimeout = 30 * time.Second
 
 func main() {
 	flag.Parse()
@@ -27,64 +45,231 @@ func main() {
 		log.Fatal(err)
 	}
 
-	pcfg, ccfg, rcfg := c.SplitConfig()
+	routes, rulesCfg := c.SplitConfig()
 
-	connReg := proxy.NewConnectionRegister(ccfg)
-	rateLimiter := proxy.NewTokenBucketLimiter(rcfg)
-	admissionController := proxy.AdmissionController{
-		RateLimiter: rateLimiter,
-		ConnReg:     connReg,
+	ruleEngine, err := rules.NewEngine(rulesCfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hooks := protocol.Hooks{ruleEngine}
+	if rulesCfg.Mode != allowlist.ModeOff {
+		al, err := allowlist.New(rulesCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer al.Close()
+		log.Printf("Allowlist %s mode with %d known statements", rulesCfg.Mode, al.Len())
+		hooks = append(hooks, al)
 	}
 
-	log.Println("Starting service...")
-
-	laddr, err := net.ResolveTCPAddr("tcp", pcfg.LocalAddress)
+	blocklists, err := ipfilter.NewBlocklists(c.Blocklists)
 	if err != nil {
-		log.Fatalf("Failed to resolve local address: %s", err)
+		log.Fatal(err)
 	}
-	raddr, err := net.ResolveTCPAddr("tcp", pcfg.RemoteAddress)
+	defer blocklists.Close()
+
+	bans, err := ban.New(c.Bans)
 	if err != nil {
-		log.Fatalf("Failed to resolve remote address: %s", err)
+		log.Fatal(err)
 	}
+	defer bans.Close()
 
-	ln, err := net.ListenTCP("tcp", laddr)
+	store, err := cluster.New(c.Cluster)
 	if err != nil {
-		log.Fatalf("Failed to open local port to listen: %s", err)
+		log.Fatal(err)
+	}
+	if store != nil {
+		defer store.Close()
 	}
 
-	go handleShutdown(ln)
+	reg := metrics.NewRegistry()
+	bans.SetMetrics(reg)
+	var listeners []*server.Listener
+	for _, route := range routes {
+		l, err := server.NewListener(route, hooks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		l.SetMetrics(reg)
+		l.SetBlocklists(blocklists)
+		l.SetBans(bans)
+		if store != nil {
+			l.SetCluster(store)
+		}
+		listeners = append(listeners, l)
+	}
+	bans.OnBan(func(ip net.IP) {
+		for _, l := range listeners {
+			l.ConnReg.KillIP(ip, "banned")
+		}
+	})
 
-	for {
-		conn, err := ln.AcceptTCP()
+	httpSockets := serveHTTP(c, reg, listeners, bans, store)
+
+	log.Println("Starting service...")
+
+	for _, l := range listeners {
+		if err := l.Listen(); err != nil {
+			log.Fatalf("Failed to open local port to listen: %s", err)
+		}
+	}
+
+	r := &reloader{current: c, listeners: listeners, rules: ruleEngine, blocklists: blocklists, bans: bans}
+	go r.handleSignals()
+	if *watchFlag > 0 {
+		path, err := config.Path()
 		if err != nil {
-			log.Printf("Accept stopped: %s", err)
-			break
+			log.Fatal(err)
 		}
-		remoteIP := net.IP(conn.RemoteAddr().(*net.TCPAddr).IP)
-		ok, msg := admissionController.Admit(remoteIP)
-		if !ok {
-			conn.Close()
-			logging.LogEvent("WARN", "connection_rejected", map[string]any{
-				"client_ip": remoteIP.String(),
-				"reason":    msg,
-			})
-		} else {
-			logging.LogEvent("INFO", "connection_accepted", map[string]any{
-				"client_ip":          remoteIP.String(),
-				"active_connections": connReg.ActiveConnectionsCount() + 1,
-			})
-			p := proxy.NewProxy(pcfg, remoteIP, conn, laddr, raddr)
-			go p.Start(connReg)
+		go r.watch(path, *watchFlag)
+	}
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Serve()
+		}()
+	}
+	served := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(served)
+	}()
+
+	if upgrade.Inherited() {
+		log.Println("Took over listening sockets from the previous process")
+	}
+	if err := upgrade.Ready(); err != nil {
+		log.Printf("Failed to notify the previous process: %s", err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt, syscall.SIGUSR2)
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGUSR2 && !handOver(listeners, httpSockets, bans) {
+				continue
+			}
+			handleShutdown(listeners, c.ShutdownGrace(), sig)
+			return
+		case <-served:
+			return
 		}
 	}
+}
 
+// handOver starts the upgraded binary on the current listening sockets,
+// saving the bans first for it to load and leaving the state file to it
+// from then on. It reports false, leaving this process serving, if the
+// child does not come up.
+func handOver(listeners []*server.Listener, httpSockets map[string]*net.TCPListener, bans *ban.Manager) bool {
+	if err := bans.Detach(); err != nil {
+		logging.LogEvent("WARN", "ban_state_save_failed", map[string]any{"error": err.Error()})
+	}
+	sockets := maps.Clone(httpSockets)
+	for _, l := range listeners {
+		addr, ln := l.Socket()
+		sockets[addr] = ln
+	}
+	pid, err := upgrade.Upgrade(sockets, upgradeTimeout)
+	if err != nil {
+		logging.LogEvent("ERROR", "upgrade_failed", map[string]any{"error": err.Error()})
+		bans.Attach()
+		return false
+	}
+	logging.LogEvent("INFO", "upgrade_handed_over", map[string]any{"pid": pid, "sockets": len(sockets)})
+	return true
 }
 
-func handleShutdown(ln *net.TCPListener) {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+// serveHTTP starts the metrics, admin and peer sync endpoints, sharing one
+// server when they are configured on the same address, and returns their
+// sockets.
+func serveHTTP(c config.Config, reg *metrics.Registry, listeners []*server.Listener, bans *ban.Manager, store cluster.Store) map[string]*net.TCPListener {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	if c.Metrics.Address != "" {
+		path := c.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+		mux(c.Metrics.Address).Handle("GET "+path, reg.Handler())
+		log.Printf("Serving metrics on %s%s", c.Metrics.Address, path)
+	}
+	if c.Admin.Address != "" {
+		a := admin.New(c.Admin, listeners)
+		a.SetBans(bans)
+		a.Register(mux(c.Admin.Address))
+		log.Printf("Serving admin API on %s", c.Admin.Address)
+	}
+	if peers, ok := store.(*cluster.Peers); ok {
+		peers.Register(mux(c.Cluster.Peers.Listen))
+		log.Printf("Syncing limits with %d peers on %s", len(c.Cluster.Peers.Addresses), c.Cluster.Peers.Listen)
+	}
+
+	sockets := make(map[string]*net.TCPListener)
+	for addr, m := range muxes {
+		ln, err := upgrade.Listen(addr)
+		if err != nil {
+			log.Fatalf("HTTP server on %s failed: %s", addr, err)
+		}
+		sockets[addr] = ln
+		go http.Serve(ln, m)
+	}
+	return sockets
+}
+
+// handleShutdown drains every listener for up to grace; a second signal
+// cuts the wait short.
+func handleShutdown(listeners []*server.Listener, grace time.Duration, sig <-chan os.Signal) {
+	log.Printf("Shutting down, draining connections for up to %s...", grace)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	<-sig
-	log.Println("Shutting down...")
-	ln.Close()
+	results := make([]server.DrainResult, len(listeners))
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = l.Drain(ctx)
+		}()
+	}
+	wg.Wait()
+
+	var total server.DrainResult
+	for i, r := range results {
+		logging.LogEvent("INFO", "listener_drained", map[string]any{
+			"listener":    listeners[i].Name(),
+			"active":      r.Active,
+			"closed_idle": r.Idle,
+			"forced":      r.Forced,
+		})
+		total.Active += r.Active
+		total.Idle += r.Idle
+		total.Forced += r.Forced
+	}
+	logging.LogEvent("INFO", "shutdown_complete", map[string]any{
+		"active":      total.Active,
+		"finished":    max(total.Active-total.Idle-total.Forced, 0),
+		"closed_idle": total.Idle,
+		"forced":      total.Forced,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"database_firewall/internal/ban"
+	"database_firewall/internal/config"
+	"database_firewall/internal/ipfilter"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/rules"
+	"database_firewall/internal/server"
+)
+
+// reloader re-reads the configuration on SIGHUP or when the file changes
+// and applies IP lists, blocklists, ban settings, connection limits, rate
+// limiters and rules to the running listeners. Changes to anything else
+// are logged as needing a restart.
+type reloader struct {
+	mu         sync.Mutex
+	current    config.Config
+	listeners  []*server.Listener
+	rules      *rules.Engine
+	blocklists *ipfilter.Blocklists
+	bans       *ban.Manager
+}
+
+func (r *reloader) handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		r.reload("sighup")
+	}
+}
+
+// watch polls the configuration file and reloads when its size or
+// modification time changes.
+func (r *reloader) watch(path string, every time.Duration) {
+	last, _ := os.Stat(path)
+	for range time.Tick(every) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+			last = fi
+			r.reload("file_watch")
+		}
+	}
+}
+
+func (r *reloader) reload(trigger string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, err := config.LoadConfig()
+	if err == nil {
+		err = config.ValidateConfig(c)
+	}
+	if err != nil {
+		logging.LogEvent("ERROR", "config_reload_failed", map[string]any{
+			"trigger": trigger,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	changes := config.Diff(r.current, c)
+	if len(changes) == 0 {
+		return
+	}
+
+	apply, err := r.prepare(c)
+	if err != nil {
+		logging.LogEvent("ERROR", "config_reload_failed", map[string]any{
+			"trigger": trigger,
+			"error":   err.Error(),
+		})
+		return
+	}
+	apply()
+
+	restart := 0
+	for _, ch := range changes {
+		level, event := "INFO", "config_changed"
+		if !ch.Reloadable() {
+			level, event = "WARN", "config_change_needs_restart"
+			restart++
+		}
+		logging.LogEvent(level, event, map[string]any{
+			"setting": ch.Path,
+			"old":     ch.Old,
+			"new":     ch.New,
+		})
+	}
+	logging.LogEvent("INFO", "config_reloaded", map[string]any{
+		"trigger":          trigger,
+		"changes":          len(changes),
+		"restart_required": restart,
+	})
+	r.current = c
+}
+
+// prepare builds the rules, blocklists, ban settings and listener settings
+// of c and returns a function that swaps them all in. On error nothing is
+// swapped in, so the running configuration stays as it was.
+func (r *reloader) prepare(c config.Config) (func(), error) {
+	var applies []func()
+	add := func(apply func(), err error) error {
+		applies = append(applies, apply)
+		return err
+	}
+
+	routes, rulesCfg := c.SplitConfig()
+	if err := add(r.rules.Prepare(rulesCfg)); err != nil {
+		return nil, err
+	}
+	if err := add(r.blocklists.Prepare(c.Blocklists)); err != nil {
+		return nil, err
+	}
+	if err := add(r.bans.Prepare(c.Bans)); err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		for _, l := range r.listeners {
+			if l.Name() != route.Proxy.Name {
+				continue
+			}
+			if err := add(l.Prepare(route)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return func() {
+		for _, apply := range applies {
+			apply()
+		}
+	}, nil
+}
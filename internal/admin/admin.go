@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"database_firewall/internal/ban"
+	"database_firewall/internal/config"
+	"database_firewall/internal/proxy"
+	"database_firewall/internal/server"
+)
+
+// API serves live connection inspection and control for a set of
+// listeners. With a token configured every request must carry it as a
+// bearer token.
+type API struct {
+	listeners []*server.Listener
+	bans      *ban.Manager
+	token     string
+}
+
+type ipCount struct {
+	Listener    string `json:"listener"`
+	IP          string `json:"ip"`
+	Connections int64  `json:"connections"`
+}
+
+func New(cfg config.AdminC, listeners []*server.Listener) *API {
+	return &API{listeners: listeners, token: cfg.Token}
+}
+
+// SetBans serves the bans of b. It must be called before Register.
+func (a *API) SetBans(b *ban.Manager) {
+	a.bans = b
+}
+
+// Register adds the admin routes to mux:
+//
+//	GET    /connections       live connections, filtered by ?listener= and ?ip=
+//	DELETE /connections/{id}  kill one connection
+//	GET    /ips               connection counts per listener and client IP
+//	DELETE /ips/{ip}          kill every connection from an IP
+//	GET    /bans              client IPs currently banned
+//	DELETE /bans/{ip}         lift the ban on an IP
+func (a *API) Register(mux *http.ServeMux) {
+	mux.Handle("GET /connections", a.auth(a.connections))
+	mux.Handle("DELETE /connections/{id}", a.auth(a.killConnection))
+	mux.Handle("GET /ips", a.auth(a.ips))
+	mux.Handle("DELETE /ips/{ip}", a.auth(a.killIP))
+	if a.bans != nil {
+		mux.Handle("GET /bans", a.auth(a.listBans))
+		mux.Handle("DELETE /bans/{ip}", a.auth(a.liftBan))
+	}
+}
+
+func (a *API) auth(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+a.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, "missing or invalid token")
+				return
+			}
+		}
+		h(w, r)
+	})
+}
+
+func (a *API) connections(w http.ResponseWriter, r *http.Request) {
+	name, ip := r.URL.Query().Get("listener"), r.URL.Query().Get("ip")
+	conns := []proxy.ConnInfo{}
+	for _, l := range a.listeners {
+		if name != "" && l.Name() != name {
+			continue
+		}
+		for _, c := range l.ConnReg.Connections() {
+			if ip == "" || c.ClientIP == ip {
+				conns = append(conns, c)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (a *API) killConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	for _, l := range a.listeners {
+		if l.ConnReg.Kill(id, "admin") {
+			writeJSON(w, http.StatusOK, map[string]int{"killed": 1})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "no such connection")
+}
+
+func (a *API) ips(w http.ResponseWriter, r *http.Request) {
+	counts := []ipCount{}
+	for _, l := range a.listeners {
+		for ip, n := range l.ConnReg.ConnectionsPerIP() {
+			counts = append(counts, ipCount{Listener: l.Name(), IP: ip, Connections: n})
+		}
+	}
+	slices.SortFunc(counts, func(a, b ipCount) int {
+		return cmp.Or(cmp.Compare(a.Listener, b.Listener), cmp.Compare(a.IP, b.IP))
+	})
+	writeJSON(w, http.StatusOK, counts)
+}
+
+func (a *API) killIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "invalid ip")
+		return
+	}
+	killed := 0
+	for _, l := range a.listeners {
+		killed += l.ConnReg.KillIP(ip, "admin")
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"killed": killed})
+}
+
+func (a *API) listBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.bans.Bans())
+}
+
+func (a *API) liftBan(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "invalid ip")
+		return
+	}
+	if !a.bans.Lift(ip) {
+		writeError(w, http.StatusNotFound, "ip is not banned")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"lifted": 1})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
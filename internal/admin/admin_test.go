@@ -0,0 +1,209 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"database_firewall/internal/ban"
+	"database_firewall/internal/config"
+	"database_firewall/internal/proxy"
+	"database_firewall/internal/server"
+)
+
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startListener(t *testing.T, name string) *server.Listener {
+	t.Helper()
+	c := config.Config{Listeners: []config.ListenerC{{
+		Name:                 name,
+		LocalAddress:         "127.0.0.1:0",
+		RemoteAddress:        startEcho(t),
+		ConnectionLimit:      10,
+		PerIPConnectionLimit: 10,
+	}}}
+	routes, _ := c.SplitConfig()
+	l, err := server.NewListener(routes[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func connect(t *testing.T, l *server.Listener) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("hi"))
+	if _, err := io.ReadFull(c, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func call(t *testing.T, srv *httptest.Server, method, path, token string, out any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func expectClosed(t *testing.T, c net.Conn) {
+	t.Helper()
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected killed connection to be closed, got %v", err)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: live connections are listed and can be killed
+by ID or by client IP
+-------------------------------------------------
+*/
+func TestAPI_ListsAndKillsConnections(t *testing.T) {
+	a, b := startListener(t, "a"), startListener(t, "b")
+	mux := http.NewServeMux()
+	New(config.AdminC{}, []*server.Listener{a, b}).Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ca1, ca2, cb := connect(t, a), connect(t, a), connect(t, b)
+
+	var conns []proxy.ConnInfo
+	call(t, srv, "GET", "/connections?listener=a", "", &conns)
+	if len(conns) != 2 || conns[0].ClientIP != "127.0.0.1" || conns[0].Upstream == "" || conns[0].BytesIn == 0 {
+		t.Fatalf("unexpected connections %+v", conns)
+	}
+
+	var ips []ipCount
+	call(t, srv, "GET", "/ips", "", &ips)
+	if len(ips) != 2 || ips[0] != (ipCount{Listener: "a", IP: "127.0.0.1", Connections: 2}) {
+		t.Fatalf("unexpected counts %+v", ips)
+	}
+
+	var killed map[string]int
+	if code := call(t, srv, "DELETE", fmt.Sprintf("/connections/%d", conns[0].ID), "", &killed); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	expectClosed(t, ca1)
+	if code := call(t, srv, "DELETE", "/connections/999999", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+
+	call(t, srv, "DELETE", "/ips/127.0.0.1", "", &killed)
+	expectClosed(t, ca2)
+	expectClosed(t, cb)
+	if killed["killed"] != 2 {
+		t.Fatalf("expected 2 killed, got %v", killed)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: bans are listed and can be lifted
+-------------------------------------------------
+*/
+func TestAPI_ListsAndLiftsBans(t *testing.T) {
+	bans, err := ban.New(config.BansC{Thresholds: config.BanThresholdsC{AuthFailure: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bans.Close()
+	bans.Record(net.ParseIP("192.0.2.1"), ban.AuthFailure)
+
+	mux := http.NewServeMux()
+	a := New(config.AdminC{}, nil)
+	a.SetBans(bans)
+	a.Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var list []ban.Ban
+	call(t, srv, "GET", "/bans", "", &list)
+	if len(list) != 1 || list[0].IP != "192.0.2.1" || list[0].Reason != ban.AuthFailure || list[0].Count != 1 {
+		t.Fatalf("unexpected bans %+v", list)
+	}
+
+	if code := call(t, srv, "DELETE", "/bans/192.0.2.1", "", nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := call(t, srv, "DELETE", "/bans/192.0.2.1", "", nil); code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", code)
+	}
+	if code := call(t, srv, "DELETE", "/bans/nope", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	call(t, srv, "GET", "/bans", "", &list)
+	if len(list) != 0 || bans.Check(net.ParseIP("192.0.2.1")) != "" {
+		t.Fatalf("expected the ban to be lifted, got %+v", list)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: a configured token is required
+-------------------------------------------------
+*/
+func TestAPI_RequiresToken(t *testing.T) {
+	mux := http.NewServeMux()
+	New(config.AdminC{Token: "s3cret"}, nil).Register(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	if code := call(t, srv, "GET", "/connections", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", code)
+	}
+	if code := call(t, srv, "GET", "/connections", "wrong", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", code)
+	}
+	if code := call(t, srv, "GET", "/connections", "s3cret", nil); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+}
@@ -0,0 +1,171 @@
+package allowlist
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/protocol"
+)
+
+const (
+	ModeOff     = ""
+	ModeLearn   = "learn"
+	ModeEnforce = "enforce"
+)
+
+var _ protocol.Hook = (*Allowlist)(nil)
+
+// Entry is one line of the allowlist file. Query is the fingerprint text,
+// kept so the file can be reviewed by hand before enforcing it.
+type Entry struct {
+	ClientIP    string `json:"client_ip"`
+	User        string `json:"user"`
+	Fingerprint string `json:"fingerprint"`
+	Query       string `json:"query,omitempty"`
+}
+
+func (e Entry) key() Entry {
+	e.Query = ""
+	return e
+}
+
+// Allowlist records the statement fingerprints each client IP and user has
+// sent. In learn mode new fingerprints are appended to the file and every
+// statement passes; in enforce mode statements with a fingerprint not in
+// the file are rejected.
+type Allowlist struct {
+	mode string
+	path string
+
+	mu      sync.Mutex
+	entries map[Entry]bool
+	file    *os.File
+}
+
+func New(cfg *config.RulesConfig) (*Allowlist, error) {
+	a := &Allowlist{
+		mode:    cfg.Mode,
+		path:    cfg.AllowlistFile,
+		entries: make(map[Entry]bool),
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	if a.mode == ModeLearn {
+		f, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	return a, nil
+}
+
+func (a *Allowlist) load() error {
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) && a.mode == ModeLearn {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", a.path, line, err)
+		}
+		a.entries[e.key()] = true
+	}
+	return sc.Err()
+}
+
+func (a *Allowlist) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.entries)
+}
+
+func (a *Allowlist) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// Inspect implements protocol.Hook. Executions of prepared statements are
+// covered by the fingerprint of the statement they execute.
+func (a *Allowlist) Inspect(st *protocol.Statement) error {
+	if st.Kind == protocol.KindExecute || len(st.Tokens()) == 0 {
+		return nil
+	}
+
+	e := Entry{ClientIP: st.ClientIP.String(), User: st.User, Fingerprint: st.FingerprintHash()}
+	a.mu.Lock()
+	known := a.entries[e]
+	var err error
+	if !known && a.mode == ModeLearn {
+		// marked known only once written, so a failed write is retried
+		// by the next statement with the fingerprint
+		learned := e
+		learned.Query = st.Fingerprint()
+		if err = a.append(learned); err == nil {
+			a.entries[e] = true
+		}
+	}
+	a.mu.Unlock()
+	if known {
+		return nil
+	}
+
+	fields := map[string]any{
+		"client_ip":   e.ClientIP,
+		"user":        e.User,
+		"database":    st.Database,
+		"fingerprint": e.Fingerprint,
+		"query":       truncate(st.Fingerprint(), 200),
+	}
+	if a.mode == ModeLearn {
+		if err != nil {
+			fields["error"] = err.Error()
+			logging.LogEvent("ERROR", "allowlist_write_failed", fields)
+			return nil
+		}
+		logging.LogEvent("INFO", "query_learned", fields)
+		return nil
+	}
+
+	logging.LogEvent("WARN", "query_unknown", fields)
+	return &protocol.DenyError{
+		Reason:  "allowlist",
+		Message: "statement is not in the firewall allowlist",
+	}
+}
+
+// append writes e to the file. a.mu must be held.
+func (a *Allowlist) append(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(b, '\n'))
+	return err
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
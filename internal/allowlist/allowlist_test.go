@@ -0,0 +1,117 @@
+package allowlist
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/protocol"
+)
+
+func stmt(ip, user, text string) *protocol.Statement {
+	return &protocol.Statement{
+		Info: protocol.Info{Protocol: "postgres", ClientIP: net.ParseIP(ip), User: user},
+		Kind: protocol.KindQuery,
+		Text: text,
+	}
+}
+
+func open(t *testing.T, mode, path string) *Allowlist {
+	t.Helper()
+	a, err := New(&config.RulesConfig{Mode: mode, AllowlistFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestAllowlist_LearnThenEnforce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.jsonl")
+
+	learn := open(t, ModeLearn, path)
+	for _, q := range []string{
+		"SELECT * FROM orders WHERE id = 1",
+		"SELECT * FROM orders WHERE id = 2",
+		"UPDATE orders SET state = 'paid' WHERE id = 7",
+	} {
+		if err := learn.Inspect(stmt("10.0.0.1", "app", q)); err != nil {
+			t.Fatalf("learn mode rejected %q: %v", q, err)
+		}
+	}
+	if err := learn.Inspect(stmt("10.0.0.2", "app", "DELETE FROM orders")); err != nil {
+		t.Fatal(err)
+	}
+	learn.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 3 {
+		t.Fatalf("expected 3 learned entries, got %d:\n%s", lines, b)
+	}
+
+	enforce := open(t, ModeEnforce, path)
+	if err := enforce.Inspect(stmt("10.0.0.1", "app", "select *  from ORDERS where id = 99")); err != nil {
+		t.Fatalf("expected learned fingerprint to pass, got %v", err)
+	}
+
+	var deny *protocol.DenyError
+	unknown := []*protocol.Statement{
+		stmt("10.0.0.1", "app", "DELETE FROM orders"),
+		stmt("10.0.0.1", "admin", "SELECT * FROM orders WHERE id = 1"),
+		stmt("10.0.0.3", "app", "SELECT * FROM orders WHERE id = 1"),
+	}
+	for _, st := range unknown {
+		if err := enforce.Inspect(st); !errors.As(err, &deny) || deny.Reason != "allowlist" {
+			t.Errorf("%s %s %q: expected allowlist deny, got %v", st.ClientIP, st.User, st.Text, err)
+		}
+	}
+}
+
+func TestAllowlist_EnforceNeedsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.jsonl")
+	if _, err := New(&config.RulesConfig{Mode: ModeEnforce, AllowlistFile: path}); err == nil {
+		t.Fatal("expected error for missing allowlist in enforce mode")
+	}
+
+	if err := os.WriteFile(path, []byte("{not json}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(&config.RulesConfig{Mode: ModeEnforce, AllowlistFile: path}); err == nil {
+		t.Fatal("expected error for malformed allowlist")
+	}
+}
+
+func TestAllowlist_LearnRetriesFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.jsonl")
+	learn := open(t, ModeLearn, path)
+	learn.file.Close()
+	if err := learn.Inspect(stmt("10.0.0.1", "app", "SELECT 1")); err != nil {
+		t.Fatalf("learn mode rejected a statement it failed to write: %v", err)
+	}
+	if learn.Len() != 0 {
+		t.Fatal("expected the unwritten fingerprint not to be known")
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	learn.file = f
+	if err := learn.Inspect(stmt("10.0.0.1", "app", "SELECT 2")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if learn.Len() != 1 || strings.Count(string(b), "\n") != 1 {
+		t.Fatalf("expected the fingerprint to be learned on retry, got %d known:\n%s", learn.Len(), b)
+	}
+}
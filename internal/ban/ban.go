@@ -0,0 +1,447 @@
+package ban
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/ipfilter"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/metrics"
+)
+
+// Kinds of rejection a client is to blame for, counted towards a ban.
+const (
+	RateLimit   = "rate_limit"
+	PerIPLimit  = "per_ip_limit"
+	AuthFailure = "auth_failure"
+	DeniedQuery = "denied_query"
+)
+
+// ReasonBanned is the reason connections from a banned address are
+// rejected with.
+const ReasonBanned = "ip_banned"
+
+const (
+	defaultWindow = 10 * time.Minute
+	defaultBan    = 5 * time.Minute
+	defaultMaxBan = 24 * time.Hour
+	defaultFactor = 2
+	defaultReset  = 24 * time.Hour
+	// sweepInterval is how often expired bans and rejections are dropped
+	// and changed bans written to the state file.
+	sweepInterval = 10 * time.Second
+)
+
+// Ban is a banned address. Count is how many times in a row it has been
+// banned, which decides how long the next ban lasts.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+	Count  int       `json:"count"`
+}
+
+// Manager counts the rejections of each client address and bans the ones
+// rejected too often, fail2ban style. It keeps each address's last ban
+// until the escalation is reset, so a client banned again soon after is
+// banned for longer.
+type Manager struct {
+	path     string
+	saveMu   sync.Mutex // serialises writes of the state file
+	detached bool       // the state file belongs to another process
+
+	mu      sync.Mutex
+	s       settings
+	clients map[string]*client
+	dirty   bool // bans changed since the state file was written
+	onBan   func(net.IP)
+	banned  *metrics.CounterVec
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type settings struct {
+	thresholds                 map[string]int
+	window, ban, maxBan, reset time.Duration
+	factor                     float64
+	ignore                     *ipfilter.Trie
+}
+
+type client struct {
+	hits   map[string][]time.Time // recent rejections by kind, oldest first
+	ban    Ban                    // the last ban, zero if none
+	active bool                   // ban has not been logged as expired
+}
+
+// New loads the bans saved in the state file, if any, and starts expiring
+// them.
+func New(cfg config.BansC) (*Manager, error) {
+	m := &Manager{path: cfg.StateFile, clients: make(map[string]*client), done: make(chan struct{})}
+	if err := m.Reload(cfg); err != nil {
+		return nil, err
+	}
+	if err := m.load(); err != nil {
+		return nil, fmt.Errorf("bans: %w", err)
+	}
+	m.wg.Add(1)
+	go m.run()
+	return m, nil
+}
+
+// Reload applies the thresholds, durations and ignore list of cfg. Bans
+// already imposed keep their end time. On error nothing changes.
+func (m *Manager) Reload(cfg config.BansC) error {
+	apply, err := m.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare checks the settings of cfg and returns a function that applies
+// them.
+func (m *Manager) Prepare(cfg config.BansC) (func(), error) {
+	s := settings{
+		thresholds: map[string]int{
+			RateLimit:   cfg.Thresholds.RateLimit,
+			PerIPLimit:  cfg.Thresholds.PerIPLimit,
+			AuthFailure: cfg.Thresholds.AuthFailure,
+			DeniedQuery: cfg.Thresholds.DeniedQuery,
+		},
+		window: seconds(cfg.WindowSeconds, defaultWindow),
+		ban:    seconds(cfg.BanSeconds, defaultBan),
+		maxBan: seconds(cfg.MaxBanSeconds, defaultMaxBan),
+		factor: cmp.Or(cfg.Factor, defaultFactor),
+		reset:  seconds(cfg.ResetSeconds, defaultReset),
+		ignore: &ipfilter.Trie{},
+	}
+	s.maxBan = max(s.maxBan, s.ban)
+	for _, e := range cfg.Ignore {
+		n, err := config.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("bans: ignore: %w", err)
+		}
+		s.ignore.Insert(n)
+	}
+	return func() {
+		m.mu.Lock()
+		m.s = s
+		m.mu.Unlock()
+	}, nil
+}
+
+func seconds(n int64, def time.Duration) time.Duration {
+	if n <= 0 {
+		return def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// SetMetrics registers the ban instruments in reg. It must be called
+// before the first ban.
+func (m *Manager) SetMetrics(reg *metrics.Registry) {
+	reg.Gauge("warden_bans_active", "Client addresses currently banned.").
+		Func(func() float64 { return float64(len(m.Bans())) })
+	m.banned = reg.Counter("warden_bans_total", "Bans imposed, by the kind of rejection that triggered them.", "reason")
+}
+
+// OnBan calls fn with every address banned, outside the manager's lock,
+// e.g. to close its open connections. It must be called before the first
+// ban.
+func (m *Manager) OnBan(fn func(net.IP)) {
+	m.onBan = fn
+}
+
+// Check returns ReasonBanned while ip is banned, or "".
+func (m *Manager) Check(ip net.IP) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c := m.clients[ip.String()]; c != nil && time.Now().Before(c.ban.Until) && !m.s.ignore.Contains(ip) {
+		return ReasonBanned
+	}
+	return ""
+}
+
+// Record counts a rejection of kind against ip, banning it once the
+// threshold for kind is reached within the window. Rejections while it is
+// banned are not counted.
+func (m *Manager) Record(ip net.IP, kind string) {
+	now := time.Now()
+	key := ip.String()
+
+	m.mu.Lock()
+	s := m.s
+	limit := s.thresholds[kind]
+	if limit <= 0 || s.ignore.Contains(ip) {
+		m.mu.Unlock()
+		return
+	}
+	c := m.clients[key]
+	if c == nil {
+		c = &client{}
+		m.clients[key] = c
+	}
+	if now.Before(c.ban.Until) {
+		m.mu.Unlock()
+		return
+	}
+	if c.hits == nil {
+		c.hits = make(map[string][]time.Time)
+	}
+	hits := append(recent(c.hits[kind], now.Add(-s.window)), now)
+	if len(hits) < limit {
+		c.hits[kind] = hits
+		m.mu.Unlock()
+		return
+	}
+
+	count := 1
+	if c.ban.Count > 0 && now.Sub(c.ban.Until) < s.reset {
+		count = c.ban.Count + 1
+	}
+	d := time.Duration(min(float64(s.ban)*math.Pow(s.factor, float64(count-1)), float64(s.maxBan)))
+	c.ban = Ban{IP: key, Reason: kind, Since: now, Until: now.Add(d), Count: count}
+	c.hits, c.active = nil, true
+	m.dirty = true
+	onBan := m.onBan
+	m.mu.Unlock()
+
+	logging.LogEvent("WARN", "client_banned", map[string]any{
+		"client_ip":     key,
+		"reason":        kind,
+		"count":         count,
+		"duration_secs": int64(d.Seconds()),
+	})
+	if m.banned != nil {
+		m.banned.With(kind).Inc()
+	}
+	if onBan != nil {
+		onBan(ip)
+	}
+}
+
+// recent drops the times before since.
+func recent(hits []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && hits[i].Before(since) {
+		i++
+	}
+	return hits[i:]
+}
+
+// Bans returns the bans in force, oldest first.
+func (m *Manager) Bans() []Ban {
+	now := time.Now()
+	m.mu.Lock()
+	bans := []Ban{}
+	for _, c := range m.clients {
+		if now.Before(c.ban.Until) {
+			bans = append(bans, c.ban)
+		}
+	}
+	m.mu.Unlock()
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return cmp.Or(a.Since.Compare(b.Since), cmp.Compare(a.IP, b.IP))
+	})
+	return bans
+}
+
+// Lift ends the ban on ip and forgets its rejections and past bans. It
+// reports whether ip was banned.
+func (m *Manager) Lift(ip net.IP) bool {
+	key := ip.String()
+	m.mu.Lock()
+	c := m.clients[key]
+	banned := c != nil && time.Now().Before(c.ban.Until)
+	if c != nil {
+		delete(m.clients, key)
+		m.dirty = m.dirty || c.ban.Count > 0
+	}
+	m.mu.Unlock()
+
+	if banned {
+		logging.LogEvent("INFO", "ban_lifted", map[string]any{"client_ip": key})
+	}
+	m.flush()
+	return banned
+}
+
+// Close stops expiring bans and saves them, unless detached.
+func (m *Manager) Close() error {
+	close(m.done)
+	m.wg.Wait()
+	return m.Save()
+}
+
+//--------expiry--------
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.sweep(time.Now())
+			m.flush()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// sweep logs the bans that ended and drops the clients with no recent
+// rejections whose escalation has been reset.
+func (m *Manager) sweep(now time.Time) {
+	var expired []string
+	m.mu.Lock()
+	for key, c := range m.clients {
+		if c.active && !now.Before(c.ban.Until) {
+			c.active = false
+			expired = append(expired, key)
+		}
+		for kind, hits := range c.hits {
+			if hits = recent(hits, now.Add(-m.s.window)); len(hits) > 0 {
+				c.hits[kind] = hits
+			} else {
+				delete(c.hits, kind)
+			}
+		}
+		if len(c.hits) == 0 && (c.ban.Count == 0 || now.Sub(c.ban.Until) >= m.s.reset) {
+			delete(m.clients, key)
+			m.dirty = m.dirty || c.ban.Count > 0
+		}
+	}
+	m.mu.Unlock()
+
+	for _, key := range expired {
+		logging.LogEvent("INFO", "ban_expired", map[string]any{"client_ip": key})
+	}
+}
+
+//--------persistence--------
+
+// Save writes the bans, including past ones still counting towards the
+// next, to the state file. It is a no-op without one or once detached.
+func (m *Manager) Save() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	return m.save()
+}
+
+// Detach saves the bans one last time and stops writing the state file,
+// for the process taking over to own it. Attach resumes writing it.
+func (m *Manager) Detach() error {
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	err := m.save()
+	m.detached = true
+	return err
+}
+
+func (m *Manager) Attach() {
+	m.saveMu.Lock()
+	m.detached = false
+	m.saveMu.Unlock()
+	m.flush()
+}
+
+// save is Save with saveMu held.
+func (m *Manager) save() error {
+	if m.path == "" || m.detached {
+		return nil
+	}
+
+	m.mu.Lock()
+	bans := []Ban{}
+	for _, c := range m.clients {
+		if c.ban.Count > 0 {
+			bans = append(bans, c.ban)
+		}
+	}
+	m.dirty = false
+	m.mu.Unlock()
+	slices.SortFunc(bans, func(a, b Ban) int { return cmp.Compare(a.IP, b.IP) })
+
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	// written beside the file and renamed over it, so a crash never
+	// leaves it half written
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+// flush saves the bans if they changed, logging a failure.
+func (m *Manager) flush() {
+	m.mu.Lock()
+	dirty := m.dirty
+	m.mu.Unlock()
+	if !dirty {
+		return
+	}
+	if err := m.Save(); err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+		logging.LogEvent("WARN", "ban_state_save_failed", map[string]any{
+			"file":  m.path,
+			"error": err.Error(),
+		})
+	}
+}
+
+// load restores the saved bans whose escalation has not been reset.
+func (m *Manager) load() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return fmt.Errorf("%s: %w", m.path, err)
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, b := range bans {
+		ip := net.ParseIP(b.IP)
+		if ip == nil || b.Count <= 0 || now.Sub(b.Until) >= m.s.reset {
+			continue
+		}
+		b.IP = ip.String()
+		m.clients[b.IP] = &client{ban: b, active: now.Before(b.Until)}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package ban
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"database_firewall/internal/config"
+)
+
+func newManager(t *testing.T, cfg config.BansC) *Manager {
+	t.Helper()
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+// expire moves ip's ban and recorded rejections d into the past.
+func expire(m *Manager, ip string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.clients[ip]
+	c.ban.Since, c.ban.Until = c.ban.Since.Add(-d), c.ban.Until.Add(-d)
+	for _, hits := range c.hits {
+		for i := range hits {
+			hits[i] = hits[i].Add(-d)
+		}
+	}
+}
+
+/*
+-------------------------------------------------
+Test: reaching a threshold within the window bans
+the address, each ban twice as long as the last
+-------------------------------------------------
+*/
+func TestManager_BansAndEscalates(t *testing.T) {
+	m := newManager(t, config.BansC{
+		Thresholds:    config.BanThresholdsC{AuthFailure: 3},
+		WindowSeconds: 60,
+		BanSeconds:    100,
+		MaxBanSeconds: 300,
+		Ignore:        []string{"10.9.0.0/16"},
+	})
+	var kicked []string
+	m.OnBan(func(ip net.IP) { kicked = append(kicked, ip.String()) })
+
+	ip := net.ParseIP("10.0.0.1")
+	banLength := func(count int, want time.Duration) {
+		t.Helper()
+		for i := range 3 {
+			if got := m.Check(ip); got != "" {
+				t.Fatalf("ban %d: expected no ban after %d failures, got %q", count, i, got)
+			}
+			m.Record(ip, AuthFailure)
+		}
+		if got := m.Check(ip); got != ReasonBanned {
+			t.Fatalf("ban %d: expected %q, got %q", count, ReasonBanned, got)
+		}
+		bans := m.Bans()
+		if len(bans) != 1 || bans[0].Count != count || bans[0].Reason != AuthFailure || bans[0].Until.Sub(bans[0].Since) != want {
+			t.Fatalf("ban %d: expected one %s ban, got %+v", count, want, bans)
+		}
+	}
+
+	banLength(1, 100*time.Second)
+	m.Record(ip, AuthFailure) // not counted while banned
+	expire(m, "10.0.0.1", 100*time.Second)
+	banLength(2, 200*time.Second)
+	expire(m, "10.0.0.1", 200*time.Second)
+	banLength(3, 300*time.Second)
+	if len(kicked) != 3 {
+		t.Fatalf("expected OnBan for every ban, got %v", kicked)
+	}
+
+	other := net.ParseIP("10.0.0.2")
+	m.Record(other, AuthFailure)
+	m.Record(other, AuthFailure)
+	expire(m, "10.0.0.2", time.Minute)
+	m.Record(other, AuthFailure)
+	if m.Check(other) != "" {
+		t.Fatal("expected failures outside the window not to count")
+	}
+	for range 10 {
+		m.Record(other, DeniedQuery)
+		m.Record(net.ParseIP("10.9.1.1"), AuthFailure)
+	}
+	if m.Check(other) != "" || m.Check(net.ParseIP("10.9.1.1")) != "" {
+		t.Fatal("expected kinds without a threshold and ignored addresses never to be banned")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: bans survive a restart through the state
+file, and lifting one clears its escalation
+-------------------------------------------------
+*/
+func TestManager_PersistsAndLifts(t *testing.T) {
+	cfg := config.BansC{
+		Thresholds: config.BanThresholdsC{PerIPLimit: 1},
+		StateFile:  filepath.Join(t.TempDir(), "bans.json"),
+	}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Record(net.ParseIP("192.0.2.1"), PerIPLimit)
+	m.Record(net.ParseIP("2001:db8::1"), PerIPLimit)
+	expire(m, "2001:db8::1", time.Hour)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newManager(t, cfg)
+	if m.Check(net.ParseIP("192.0.2.1")) != ReasonBanned {
+		t.Fatal("expected the ban to be restored")
+	}
+	if m.Check(net.ParseIP("2001:db8::1")) != "" {
+		t.Fatal("expected the expired ban not to be in force")
+	}
+	m.Record(net.ParseIP("2001:db8::1"), PerIPLimit)
+	if bans := m.Bans(); len(bans) != 2 || bans[1].Count != 2 {
+		t.Fatalf("expected the restored escalation to lengthen the next ban, got %+v", bans)
+	}
+
+	if !m.Lift(net.ParseIP("192.0.2.1")) || m.Lift(net.ParseIP("192.0.2.1")) {
+		t.Fatal("expected the ban to be lifted once")
+	}
+	m = newManager(t, cfg)
+	if m.Check(net.ParseIP("192.0.2.1")) != "" || len(m.Bans()) != 1 {
+		t.Fatalf("expected the lifted ban to be saved, got %+v", m.Bans())
+	}
+}
+
+/*
+-------------------------------------------------
+Test: once detached for a new process, the state
+file is no longer written
+-------------------------------------------------
+*/
+func TestManager_DetachStopsSaving(t *testing.T) {
+	cfg := config.BansC{
+		Thresholds: config.BanThresholdsC{PerIPLimit: 1},
+		StateFile:  filepath.Join(t.TempDir(), "bans.json"),
+	}
+	old, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Record(net.ParseIP("192.0.2.1"), PerIPLimit)
+	if err := old.Detach(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new process lifts the ban while the old one bans another address
+	m := newManager(t, cfg)
+	m.Lift(net.ParseIP("192.0.2.1"))
+	old.Record(net.ParseIP("192.0.2.2"), PerIPLimit)
+	old.sweep(time.Now())
+	old.flush()
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = newManager(t, cfg)
+	if bans := m.Bans(); len(bans) != 0 {
+		t.Fatalf("expected the detached manager not to overwrite the state file, got %+v", bans)
+	}
+}
@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/logging"
+)
+
+// Store shares counters between the replicas of a deployment. Every
+// replica owns a share of each counter and totals add up the shares of
+// the replicas that are alive, so a replica that goes away takes its
+// share with it.
+type Store interface {
+	// Add adds delta to this replica's share of key and returns the
+	// total. A share with a ttl expires ttl after its last update; one
+	// without is kept for as long as the replica is alive.
+	Add(key string, delta int64, ttl time.Duration) (int64, error)
+	// AddTotal is Add that also returns the total of other, in one call
+	// to the backend.
+	AddTotal(key string, delta int64, ttl time.Duration, other string) (int64, int64, error)
+	// Total returns the total of key.
+	Total(key string) (int64, error)
+	Close() error
+}
+
+// New returns the store configured by cfg, or nil when state is not
+// shared.
+func New(cfg config.ClusterC) (Store, error) {
+	id, err := replicaID(cfg)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.Redis.Address != "":
+		return NewRedis(cfg.Redis, id), nil
+	case cfg.Peers.Listen != "":
+		return NewPeers(cfg.Peers, id), nil
+	}
+	return nil, nil
+}
+
+// replicaID tells this process apart from other replicas, and from the
+// one it replaces during an upgrade.
+func replicaID(cfg config.ClusterC) (string, error) {
+	name := cfg.ReplicaID
+	if name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("replica_id: %w", err)
+		}
+		name = host
+	}
+	return fmt.Sprintf("%s-%d", name, os.Getpid()), nil
+}
+
+// health logs when a backend becomes unreachable and when it recovers,
+// rather than every failed call.
+type health struct {
+	mu      sync.Mutex
+	backend string
+	down    bool
+}
+
+func (h *health) report(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case err != nil && !h.down:
+		h.down = true
+		logging.LogEvent("ERROR", "shared_state_unavailable", map[string]any{
+			"backend": h.backend,
+			"error":   err.Error(),
+		})
+	case err == nil && h.down:
+		h.down = false
+		logging.LogEvent("INFO", "shared_state_recovered", map[string]any{
+			"backend": h.backend,
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"database_firewall/internal/config"
+)
+
+const defaultSync = 500 * time.Millisecond
+
+// Peers keeps shares in memory and pushes a snapshot of this replica's
+// to every peer each sync interval. Totals add up the latest snapshot of
+// each peer heard from within three intervals, so they lag the peers by
+// up to one interval plus the network delay.
+type Peers struct {
+	cfg    config.PeersC
+	id     string
+	every  time.Duration
+	client *http.Client
+
+	mu     sync.Mutex
+	local  map[string]share
+	remote map[string]snapshot
+	health map[string]*health
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type share struct {
+	value   int64
+	expires time.Time
+}
+
+type snapshot struct {
+	shares map[string]int64
+	at     time.Time
+}
+
+// Sync requests are refused above maxStateSize bytes, and shares outside
+// 0 to maxShare.
+const (
+	maxStateSize = 4 << 20
+	maxShare     = 1 << 40
+)
+
+// peerState is the body of a sync request.
+type peerState struct {
+	Replica string           `json:"replica"`
+	Shares  map[string]int64 `json:"shares"`
+}
+
+func NewPeers(cfg config.PeersC, id string) *Peers {
+	every := time.Duration(cfg.SyncMillis) * time.Millisecond
+	if every == 0 {
+		every = defaultSync
+	}
+	p := &Peers{
+		cfg:    cfg,
+		id:     id,
+		every:  every,
+		client: &http.Client{Timeout: every},
+		local:  make(map[string]share),
+		remote: make(map[string]snapshot),
+		health: make(map[string]*health),
+		done:   make(chan struct{}),
+	}
+	for _, addr := range cfg.Addresses {
+		p.health[addr] = &health{backend: "peer " + addr}
+	}
+	p.wg.Add(1)
+	go p.sync()
+	return p
+}
+
+//--------store--------
+
+func (p *Peers) Add(key string, delta int64, ttl time.Duration) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	s := p.live(key, now)
+	s.value += delta
+	s.expires = time.Time{}
+	if ttl > 0 {
+		s.expires = now.Add(ttl)
+	}
+	if s.value == 0 {
+		delete(p.local, key)
+	} else {
+		p.local[key] = s
+	}
+	return p.total(key, now), nil
+}
+
+func (p *Peers) AddTotal(key string, delta int64, ttl time.Duration, other string) (int64, int64, error) {
+	total, _ := p.Add(key, delta, ttl)
+	otherTotal, _ := p.Total(other)
+	return total, otherTotal, nil
+}
+
+func (p *Peers) Total(key string) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total(key, time.Now()), nil
+}
+
+// live returns this replica's share of key, zero once it has expired.
+func (p *Peers) live(key string, now time.Time) share {
+	s := p.local[key]
+	if !s.expires.IsZero() && now.After(s.expires) {
+		return share{}
+	}
+	return s
+}
+
+func (p *Peers) total(key string, now time.Time) int64 {
+	total := p.live(key, now).value
+	for _, snap := range p.remote {
+		if now.Sub(snap.at) <= 3*p.every {
+			total += snap.shares[key]
+		}
+	}
+	return total
+}
+
+// Close stops syncing and tells the peers this replica holds nothing.
+func (p *Peers) Close() error {
+	close(p.done)
+	p.wg.Wait()
+	p.mu.Lock()
+	clear(p.local)
+	p.mu.Unlock()
+	p.push()
+	return nil
+}
+
+//--------sync--------
+
+func (p *Peers) sync() {
+	defer p.wg.Done()
+	t := time.NewTicker(p.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.push()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// push sends this replica's live shares to every peer and forgets the
+// expired ones and the peers that have gone quiet.
+func (p *Peers) push() {
+	p.mu.Lock()
+	now := time.Now()
+	state := peerState{Replica: p.id, Shares: make(map[string]int64, len(p.local))}
+	for key := range p.local {
+		if s := p.live(key, now); s.value != 0 {
+			state.Shares[key] = s.value
+		} else {
+			delete(p.local, key)
+		}
+	}
+	for id, snap := range p.remote {
+		if now.Sub(snap.at) > 3*p.every {
+			delete(p.remote, id)
+		}
+	}
+	p.mu.Unlock()
+
+	body, _ := json.Marshal(state)
+	var wg sync.WaitGroup
+	for _, addr := range p.cfg.Addresses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.health[addr].report(p.send(addr, body))
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Peers) send(addr string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/cluster/state", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.cfg.Token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Register serves the sync endpoint peers push their state to.
+func (p *Peers) Register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /cluster/state", p.receive)
+}
+
+func (p *Peers) receive(w http.ResponseWriter, req *http.Request) {
+	if p.cfg.Token != "" {
+		got := req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+p.cfg.Token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	var state peerState
+	body := http.MaxBytesReader(w, req.Body, maxStateSize)
+	if err := json.NewDecoder(body).Decode(&state); err != nil || state.Replica == "" {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+	for _, v := range state.Shares {
+		if v < 0 || v > maxShare {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+			return
+		}
+	}
+	if state.Replica != p.id {
+		p.mu.Lock()
+		p.remote[state.Replica] = snapshot{shares: state.Shares, at: time.Now()}
+		p.mu.Unlock()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"database_firewall/internal/config"
+)
+
+// startPeers runs n replicas syncing with each other over HTTP.
+func startPeers(t *testing.T, n int, token string) []*Peers {
+	t.Helper()
+	muxes := make([]*http.ServeMux, n)
+	addrs := make([]string, n)
+	for i := range muxes {
+		muxes[i] = http.NewServeMux()
+		srv := httptest.NewServer(muxes[i])
+		t.Cleanup(srv.Close)
+		addrs[i] = strings.TrimPrefix(srv.URL, "http://")
+	}
+	peers := make([]*Peers, n)
+	for i := range peers {
+		var others []string
+		for j, addr := range addrs {
+			if j != i {
+				others = append(others, addr)
+			}
+		}
+		cfg := config.PeersC{Listen: addrs[i], Addresses: others, Token: token, SyncMillis: 20}
+		peers[i] = NewPeers(cfg, string(rune('a'+i)))
+		peers[i].Register(muxes[i])
+	}
+	return peers
+}
+
+/*
+-------------------------------------------------
+Test: peers sum each other's shares and drop a
+peer's share once it closes
+-------------------------------------------------
+*/
+func TestPeers_SyncShares(t *testing.T) {
+	peers := startPeers(t, 3, "secret")
+	defer peers[0].Close()
+	defer peers[1].Close()
+
+	peers[0].Add("conn", 2, 0)
+	peers[1].Add("conn", 3, 0)
+	peers[2].Add("conn", 1, 0)
+	peers[2].Add("window", 4, 50*time.Millisecond)
+	for _, p := range peers {
+		expectTotal(t, p, "conn", 6)
+	}
+	expectTotal(t, peers[0], "window", 0)
+
+	peers[2].Close()
+	expectTotal(t, peers[0], "conn", 5)
+	expectTotal(t, peers[1], "conn", 5)
+}
+
+/*
+-------------------------------------------------
+Test: state pushed without the token is refused
+-------------------------------------------------
+*/
+func TestPeers_RejectsWrongToken(t *testing.T) {
+	p := NewPeers(config.PeersC{Listen: "127.0.0.1:0", Token: "secret"}, "a")
+	defer p.Close()
+	mux := http.NewServeMux()
+	p.Register(mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/cluster/state", strings.NewReader(`{"replica":"b","shares":{"conn":5}}`))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+	if n, _ := p.Total("conn"); n != 0 {
+		t.Fatalf("expected the refused state to be ignored, got %d", n)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: oversized state and out of range shares are
+refused
+-------------------------------------------------
+*/
+func TestPeers_RejectsInvalidState(t *testing.T) {
+	p := NewPeers(config.PeersC{Listen: "127.0.0.1:0"}, "a")
+	defer p.Close()
+	mux := http.NewServeMux()
+	p.Register(mux)
+
+	for name, body := range map[string]string{
+		"negative": `{"replica":"b","shares":{"conn":-5}}`,
+		"too big":  `{"replica":"b","shares":{"conn":1000000000000000}}`,
+		"oversize": `{"replica":"b","shares":{"conn":1,"` + strings.Repeat("x", maxStateSize) + `":1}}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/cluster/state", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, rec.Code)
+		}
+	}
+	if n, _ := p.Total("conn"); n != 0 {
+		t.Fatalf("expected the refused state to be ignored, got %d", n)
+	}
+}
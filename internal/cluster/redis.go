@@ -0,0 +1,420 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"database_firewall/internal/config"
+)
+
+const (
+	redisTimeout = 500 * time.Millisecond
+	// redisRetry is how long calls fail fast after a failed connect or a
+	// timed out call, so an unreachable or stalled server does not hold up
+	// every admission.
+	redisRetry = time.Second
+	// redisConns caps the connections a replica opens, so concurrent
+	// calls do not queue behind one another's round trips.
+	redisConns = 8
+	// defaultHeartbeat is how often a replica announces itself and renews
+	// its shares; both lapse after three missed heartbeats.
+	defaultHeartbeat = time.Second
+)
+
+// Redis keeps each replica's share of a counter under its own key,
+// prefix:counter:replica, and the live replicas in a sorted set scored by
+// their last heartbeat, so totals only count replicas that are alive.
+// Calls run on a small pool of connections, one round trip each.
+type Redis struct {
+	cfg       config.RedisC
+	id        string
+	heartbeat time.Duration
+	health    health
+
+	slots chan struct{}   // one per connection in use
+	idle  chan *redisConn // connections free for the next call
+
+	mu       sync.Mutex
+	retryAt  time.Time // calls fail fast with lastErr until then
+	lastErr  error
+	replicas []string
+	held     map[string]int64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewRedis(cfg config.RedisC, id string) *Redis {
+	return newRedis(cfg, id, defaultHeartbeat)
+}
+
+func newRedis(cfg config.RedisC, id string, heartbeat time.Duration) *Redis {
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "warden"
+	}
+	r := &Redis{
+		cfg:       cfg,
+		id:        id,
+		heartbeat: heartbeat,
+		health:    health{backend: "redis " + cfg.Address},
+		replicas:  []string{id},
+		held:      make(map[string]int64),
+		slots:     make(chan struct{}, redisConns),
+		idle:      make(chan *redisConn, redisConns),
+		done:      make(chan struct{}),
+	}
+	r.wg.Add(1)
+	go r.beat()
+	return r
+}
+
+func (r *Redis) lease() time.Duration {
+	return 3 * r.heartbeat
+}
+
+func (r *Redis) shareKey(key, replica string) string {
+	return r.cfg.KeyPrefix + ":" + key + ":" + replica
+}
+
+func (r *Redis) replicasKey() string {
+	return r.cfg.KeyPrefix + ":replicas"
+}
+
+func millis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+//--------heartbeat--------
+
+func (r *Redis) beat() {
+	defer r.wg.Done()
+	t := time.NewTicker(r.heartbeat)
+	defer t.Stop()
+	for {
+		r.health.report(r.renew())
+		select {
+		case <-t.C:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// renew announces this replica, drops replicas that missed their
+// heartbeats and rewrites the shares held for as long as this replica is
+// alive, restoring them if they lapsed while the server was unreachable.
+func (r *Redis) renew() error {
+	r.mu.Lock()
+	now := time.Now().UnixMilli()
+	cmds := [][]string{
+		{"ZADD", r.replicasKey(), strconv.FormatInt(now, 10), r.id},
+		{"ZREMRANGEBYSCORE", r.replicasKey(), "-inf", strconv.FormatInt(now-r.lease().Milliseconds(), 10)},
+		{"ZRANGE", r.replicasKey(), "0", "-1"},
+	}
+	for key, v := range r.held {
+		cmds = append(cmds, []string{"SET", key, strconv.FormatInt(v, 10), "PX", millis(r.lease())})
+	}
+	r.mu.Unlock()
+	replies, err := r.do(cmds...)
+	if err != nil {
+		return err
+	}
+	members, _ := replies[2].([]any)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicas = r.replicas[:0]
+	seen := false
+	for _, m := range members {
+		if s, ok := m.(string); ok {
+			r.replicas = append(r.replicas, s)
+			seen = seen || s == r.id
+		}
+	}
+	if !seen {
+		r.replicas = append(r.replicas, r.id)
+	}
+	return nil
+}
+
+//--------store--------
+
+func (r *Redis) Add(key string, delta int64, ttl time.Duration) (int64, error) {
+	replies, err := r.add(key, delta, ttl)
+	if err != nil {
+		return 0, err
+	}
+	return sum(replies[2])
+}
+
+// AddTotal sends the increment and both totals in one pipeline.
+func (r *Redis) AddTotal(key string, delta int64, ttl time.Duration, other string) (int64, int64, error) {
+	replies, err := r.add(key, delta, ttl, other)
+	if err != nil {
+		return 0, 0, err
+	}
+	total, err := sum(replies[2])
+	if err != nil {
+		return 0, 0, err
+	}
+	otherTotal, err := sum(replies[3])
+	return total, otherTotal, err
+}
+
+// add adds delta to this replica's share of key and reads the shares of
+// key and of others.
+func (r *Redis) add(key string, delta int64, ttl time.Duration, others ...string) ([]any, error) {
+	r.mu.Lock()
+	share := r.shareKey(key, r.id)
+	expiry := ttl
+	if expiry == 0 {
+		expiry = r.lease()
+	}
+	if ttl == 0 {
+		// kept even if the call fails, so renew restores the share
+		if v := r.held[share] + delta; v != 0 {
+			r.held[share] = v
+		} else {
+			delete(r.held, share)
+		}
+	}
+	cmds := [][]string{
+		{"INCRBY", share, strconv.FormatInt(delta, 10)},
+		{"PEXPIRE", share, millis(expiry)},
+		r.mget(key),
+	}
+	for _, other := range others {
+		cmds = append(cmds, r.mget(other))
+	}
+	r.mu.Unlock()
+	replies, err := r.do(cmds...)
+	r.health.report(err)
+	return replies, err
+}
+
+func (r *Redis) Total(key string) (int64, error) {
+	r.mu.Lock()
+	cmd := r.mget(key)
+	r.mu.Unlock()
+	replies, err := r.do(cmd)
+	r.health.report(err)
+	if err != nil {
+		return 0, err
+	}
+	return sum(replies[0])
+}
+
+// mget reads the shares of key. The caller holds r.mu.
+func (r *Redis) mget(key string) []string {
+	cmd := []string{"MGET"}
+	for _, replica := range r.replicas {
+		cmd = append(cmd, r.shareKey(key, replica))
+	}
+	return cmd
+}
+
+func sum(reply any) (int64, error) {
+	values, _ := reply.([]any)
+	var total int64
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("redis: counter is not a number: %q", s)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Close stops the heartbeat and withdraws this replica and its shares.
+func (r *Redis) Close() error {
+	close(r.done)
+	r.wg.Wait()
+	r.mu.Lock()
+	cmds := [][]string{{"ZREM", r.replicasKey(), r.id}}
+	for key := range r.held {
+		cmds = append(cmds, []string{"DEL", key})
+	}
+	r.mu.Unlock()
+	_, err := r.do(cmds...)
+	for {
+		select {
+		case c := <-r.idle:
+			c.conn.Close()
+		default:
+			return err
+		}
+	}
+}
+
+//--------protocol--------
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// do sends cmds in one pipeline on a free connection and reads their
+// replies. A server error reply to any of them is returned after all
+// replies are read. An I/O error or timeout drops the connection and
+// makes calls fail fast for redisRetry.
+func (r *Redis) do(cmds ...[]string) ([]any, error) {
+	r.mu.Lock()
+	if time.Now().Before(r.retryAt) {
+		err := r.lastErr
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.mu.Unlock()
+
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		t := time.NewTimer(redisTimeout)
+		defer t.Stop()
+		select {
+		case r.slots <- struct{}{}:
+		case <-t.C:
+			return nil, errors.New("redis: no connection free")
+		}
+	}
+	defer func() { <-r.slots }()
+
+	var c *redisConn
+	select {
+	case c = <-r.idle:
+	default:
+		var err error
+		if c, err = r.connect(); err != nil {
+			r.trip(err)
+			return nil, err
+		}
+	}
+	replies, err := c.roundTrip(cmds)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.conn.Close()
+		r.trip(err)
+		return nil, err
+	}
+	r.idle <- c
+	return replies, err
+}
+
+// trip makes calls fail fast with err for redisRetry.
+func (r *Redis) trip(err error) {
+	r.mu.Lock()
+	r.retryAt, r.lastErr = time.Now().Add(redisRetry), err
+	r.mu.Unlock()
+}
+
+func (r *Redis) connect() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.cfg.Address, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	var setup [][]string
+	if r.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", r.cfg.Password})
+	}
+	if r.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.cfg.DB)})
+	}
+	if len(setup) == 0 {
+		return c, nil
+	}
+	if _, err := c.roundTrip(setup); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *redisConn) roundTrip(cmds [][]string) ([]any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	var replyErr error
+	for i := range cmds {
+		reply, err := readReply(c.rd)
+		if err != nil {
+			return nil, err
+		}
+		if rerr, ok := reply.(redisError); ok && replyErr == nil {
+			replyErr = rerr
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+// readReply decodes one RESP reply: simple strings and bulk strings as
+// string, integers as int64, arrays as []any, nil bulk strings and arrays
+// as nil and errors as redisError.
+func readReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
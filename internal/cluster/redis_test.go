@@ -0,0 +1,298 @@
+package cluster
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"database_firewall/internal/config"
+)
+
+// fakeRedis is a local stand-in for a Redis server implementing the
+// commands the store sends.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	zsets   map[string]map[string]int64
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		zsets:    make(map[string]map[string]int64),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		req, err := readReply(rd)
+		if err != nil {
+			return
+		}
+		items, _ := req.([]any)
+		args := make([]string, len(items))
+		for i, it := range items {
+			args[i], _ = it.(string)
+		}
+		var reply string
+		switch {
+		case len(args) == 0:
+			reply = "-ERR empty command\r\n"
+		case strings.ToUpper(args[0]) == "AUTH":
+			if authed = args[1] == f.password; authed {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.exec(args)
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for k, at := range f.expires {
+		if now.After(at) {
+			delete(f.values, k)
+			delete(f.expires, k)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "INCRBY":
+		n, _ := strconv.ParseInt(f.values[args[1]], 10, 64)
+		d, _ := strconv.ParseInt(args[2], 10, 64)
+		f.values[args[1]] = strconv.FormatInt(n+d, 10)
+		return fmt.Sprintf(":%d\r\n", n+d)
+	case "SET":
+		f.values[args[1]] = args[2]
+		delete(f.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[args[1]] = now.Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "PEXPIRE":
+		if _, ok := f.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = now.Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "MGET":
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(args)-1)
+		for _, k := range args[1:] {
+			if v, ok := f.values[k]; ok {
+				fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				b.WriteString("$-1\r\n")
+			}
+		}
+		return b.String()
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := f.values[k]; ok {
+				n++
+			}
+			delete(f.values, k)
+			delete(f.expires, k)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "ZADD":
+		if f.zsets[args[1]] == nil {
+			f.zsets[args[1]] = make(map[string]int64)
+		}
+		score, _ := strconv.ParseInt(args[2], 10, 64)
+		f.zsets[args[1]][args[3]] = score
+		return ":1\r\n"
+	case "ZREMRANGEBYSCORE":
+		max, _ := strconv.ParseInt(args[3], 10, 64)
+		for m, score := range f.zsets[args[1]] {
+			if score <= max {
+				delete(f.zsets[args[1]], m)
+			}
+		}
+		return ":0\r\n"
+	case "ZREM":
+		delete(f.zsets[args[1]], args[2])
+		return ":1\r\n"
+	case "ZRANGE":
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(f.zsets[args[1]]))
+		for m := range f.zsets[args[1]] {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(m), m)
+		}
+		return b.String()
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// flush drops every key, as a restarted server would.
+func (f *fakeRedis) flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.values)
+	clear(f.expires)
+	clear(f.zsets)
+}
+
+func expectTotal(t *testing.T, s Store, key string, want int64) {
+	t.Helper()
+	var got int64
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, err = s.Total(key); err == nil && got == want {
+			return
+		}
+	}
+	t.Fatalf("expected %s total %d, got %d (%v)", key, want, got, err)
+}
+
+/*
+-------------------------------------------------
+Test: replicas add up their shares and a closed
+replica takes its share with it
+-------------------------------------------------
+*/
+func TestRedis_SharesCountersBetweenReplicas(t *testing.T) {
+	f := startFakeRedis(t, "secret")
+	cfg := config.RedisC{Address: f.ln.Addr().String(), Password: "secret", DB: 1}
+	a := newRedis(cfg, "a", 50*time.Millisecond)
+	defer a.Close()
+	b := newRedis(cfg, "b", 50*time.Millisecond)
+
+	if _, err := a.Add("conn", 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add("conn", 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectTotal(t, a, "conn", 5)
+	expectTotal(t, b, "conn", 5)
+	if n, other, err := a.AddTotal("window", 4, time.Minute, "conn"); err != nil || n != 4 || other != 5 {
+		t.Fatalf("expected totals 4 and 5 in one call, got %d and %d (%v)", n, other, err)
+	}
+
+	b.Close()
+	expectTotal(t, a, "conn", 2)
+}
+
+/*
+-------------------------------------------------
+Test: shares with a ttl expire, held ones are
+renewed and restored after the server loses them
+-------------------------------------------------
+*/
+func TestRedis_ExpiresAndRenewsShares(t *testing.T) {
+	f := startFakeRedis(t, "")
+	a := newRedis(config.RedisC{Address: f.ln.Addr().String()}, "a", 50*time.Millisecond)
+	defer a.Close()
+
+	a.Add("window", 1, 100*time.Millisecond)
+	a.Add("conn", 1, 0)
+	time.Sleep(300 * time.Millisecond)
+
+	expectTotal(t, a, "window", 0)
+	expectTotal(t, a, "conn", 1)
+
+	f.flush()
+	expectTotal(t, a, "conn", 1)
+}
+
+/*
+-------------------------------------------------
+Test: an unreachable or refusing server is an
+error, not a hang
+-------------------------------------------------
+*/
+func TestRedis_ReportsUnavailableServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	down := newRedis(config.RedisC{Address: addr}, "a", time.Minute)
+	defer down.Close()
+	start := time.Now()
+	if _, err := down.Add("conn", 1, 0); err == nil {
+		t.Fatal("expected an error from an unreachable server")
+	}
+	if _, err := down.Total("conn"); err == nil || time.Since(start) > time.Second {
+		t.Fatalf("expected a fast failure, got %v after %s", err, time.Since(start))
+	}
+
+	// a server that accepts but never answers times out once, then calls
+	// fail fast until the retry
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			c, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	slow := newRedis(config.RedisC{Address: stalled.Addr().String()}, "a", time.Minute)
+	defer slow.Close()
+	slow.Total("conn") // the heartbeat may have tripped it already
+	start = time.Now()
+	if _, _, err := slow.AddTotal("window", 1, time.Second, "previous"); err == nil || time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("expected a timed out server to fail fast, got %v after %s", err, time.Since(start))
+	}
+
+	f := startFakeRedis(t, "secret")
+	wrong := newRedis(config.RedisC{Address: f.ln.Addr().String(), Password: "nope"}, "a", time.Minute)
+	defer wrong.Close()
+	if _, err := wrong.Add("conn", 1, 0); err == nil {
+		t.Fatal("expected a wrong password to be an error")
+	}
+}
@@ -1,37 +1,357 @@
 package config
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
 
 type Config struct {
-	LocalAddress         string       `yaml:"local_address"`
-	RemoteAddress        string       `yaml:"remote_address"`
-	ConnectionLimit      int64        `yaml:"connection_limit"`
-	PerIPConnectionLimit int64        `yaml:"per_ip_connection_limit"`
-	IdleTimeoutSeconds   int64        `yaml:"idle_timeout_secs"`
-	RateLimiter          RateLimiterC `yaml:"rate_limiter"`
+	LocalAddress         string          `yaml:"local_address"`
+	RemoteAddress        string          `yaml:"remote_address"`
+	Protocol             string          `yaml:"protocol"`
+	TLS                  TLSC            `yaml:"tls"`
+	UpstreamTLS          UpstreamTLSC    `yaml:"upstream_tls"`
+	Upstream             UpstreamC       `yaml:"upstream"`
+	ReadWriteSplit       ReadWriteSplitC `yaml:"read_write_split"`
+	IPAllowlist          []string        `yaml:"ip_allowlist"`
+	IPDenylist           []string        `yaml:"ip_denylist"`
+	ConnectionLimit      int64           `yaml:"connection_limit"`
+	PerIPConnectionLimit int64           `yaml:"per_ip_connection_limit"`
+	IdleTimeoutSeconds   int64           `yaml:"idle_timeout_secs"`
+	RateLimiter          RateLimiterC    `yaml:"rate_limiter"`
+	SubnetRateLimiter    SubnetLimiterC  `yaml:"subnet_rate_limiter"`
+	GlobalRateLimiter    RateLimiterC    `yaml:"global_rate_limiter"`
+	QueryRateLimiter     QueryLimiterC   `yaml:"query_rate_limiter"`
+	Rules                []RuleC         `yaml:"rules"`
+	Injection            InjectionC      `yaml:"injection"`
+	Mode                 string          `yaml:"mode"`
+	AllowlistFile        string          `yaml:"allowlist_file"`
+	Blocklists           []BlocklistC    `yaml:"blocklists"`
+	Bans                 BansC           `yaml:"bans"`
+	Listeners            []ListenerC     `yaml:"listeners"`
+	Metrics              MetricsC        `yaml:"metrics"`
+	Admin                AdminC          `yaml:"admin"`
+	ShutdownGraceSeconds int64           `yaml:"shutdown_grace_secs"`
+	Cluster              ClusterC        `yaml:"cluster"`
 }
 
+// ListenerC is one listener and the upstream it routes to. Zero valued
+// limits, IP lists, rate limiters and TLS settings and an unset idle
+// timeout fall back to the top level ones; idle_timeout_secs: 0 and a
+// rate limiter, tls or upstream_tls with enabled: false turn off the
+// inherited ones. Only postgres and mysql listeners inherit
+// read_write_split.
+// IPAllowlist and IPDenylist hold IP addresses or CIDR blocks.
+type ListenerC struct {
+	Name                 string          `yaml:"name"`
+	LocalAddress         string          `yaml:"local_address"`
+	RemoteAddress        string          `yaml:"remote_address"`
+	Protocol             string          `yaml:"protocol"`
+	TLS                  TLSC            `yaml:"tls"`
+	UpstreamTLS          UpstreamTLSC    `yaml:"upstream_tls"`
+	Upstream             UpstreamC       `yaml:"upstream"`
+	ReadWriteSplit       ReadWriteSplitC `yaml:"read_write_split"`
+	IPAllowlist          []string        `yaml:"ip_allowlist"`
+	IPDenylist           []string        `yaml:"ip_denylist"`
+	ConnectionLimit      int64           `yaml:"connection_limit"`
+	PerIPConnectionLimit int64           `yaml:"per_ip_connection_limit"`
+	IdleTimeoutSeconds   *int64          `yaml:"idle_timeout_secs"`
+	RateLimiter          RateLimiterC    `yaml:"rate_limiter"`
+	SubnetRateLimiter    SubnetLimiterC  `yaml:"subnet_rate_limiter"`
+	GlobalRateLimiter    RateLimiterC    `yaml:"global_rate_limiter"`
+	QueryRateLimiter     QueryLimiterC   `yaml:"query_rate_limiter"`
+}
+
+// RateLimiterC selects the connection rate limiting algorithm by which of
+// its blocks is set; at most one may be. Without any, connections are not
+// rate limited, and Enabled set to false turns the limiter off whatever
+// its blocks say. MaxTrackedKeys caps the clients the limiter keeps state
+// for, dropping the least recently seen beyond it.
 type RateLimiterC struct {
-	TokenBucketLimiter TokenBucketLimiterC `yaml:"token_bucket_limiter"`
+	Enabled                     *bool               `yaml:"enabled"`
+	MaxTrackedKeys              int64               `yaml:"max_tracked_keys"`
+	TokenBucketLimiter          TokenBucketLimiterC `yaml:"token_bucket_limiter"`
+	SlidingWindowLogLimiter     WindowLimiterC      `yaml:"sliding_window_log_limiter"`
+	SlidingWindowCounterLimiter WindowLimiterC      `yaml:"sliding_window_counter_limiter"`
+	FixedWindowLimiter          WindowLimiterC      `yaml:"fixed_window_limiter"`
 }
 
+// SubnetLimiterC rate limits client networks as a whole, grouping IPv4
+// addresses by their first IPv4Prefix bits (default 24) and IPv6
+// addresses by IPv6Prefix (default 64), with any of the algorithms of
+// RateLimiterC.
+type SubnetLimiterC struct {
+	IPv4Prefix   int `yaml:"ipv4_prefix"`
+	IPv6Prefix   int `yaml:"ipv6_prefix"`
+	RateLimiterC `yaml:",inline"`
+}
+
+// QueryLimiterC rate limits the statements clients run on admitted
+// connections, per database user (User), per client IP (IP) and per query
+// fingerprint across all clients (Fingerprint), with any of the
+// algorithms of RateLimiterC. Executions of prepared statements count,
+// preparing them does not.
+type QueryLimiterC struct {
+	User        RateLimiterC `yaml:"user"`
+	IP          RateLimiterC `yaml:"ip"`
+	Fingerprint RateLimiterC `yaml:"fingerprint"`
+}
+
+const (
+	DefaultIPv4Prefix = 24
+	DefaultIPv6Prefix = 64
+)
+
+// Rate limiting algorithms, as returned by RateLimiterC.Algorithm.
+const (
+	TokenBucket          = "token_bucket"
+	SlidingWindowLog     = "sliding_window_log"
+	SlidingWindowCounter = "sliding_window_counter"
+	FixedWindow          = "fixed_window"
+)
+
 type TokenBucketLimiterC struct {
 	Rate     int64 `yaml:"rate"`
 	Capacity int64 `yaml:"capacity"`
 }
 
+// WindowLimiterC allows Limit connections per client IP in any window of
+// WindowMillis.
+type WindowLimiterC struct {
+	Limit        int64 `yaml:"limit"`
+	WindowMillis int64 `yaml:"window_ms"`
+}
+
+// effective returns r, or the zero RateLimiterC, which limits nothing,
+// when r is turned off.
+func (r RateLimiterC) effective() RateLimiterC {
+	if r.Enabled != nil && !*r.Enabled {
+		return RateLimiterC{}
+	}
+	return r
+}
+
+// Algorithm returns the configured algorithm, token_bucket when none is.
+func (r RateLimiterC) Algorithm() string {
+	switch {
+	case r.SlidingWindowLogLimiter != (WindowLimiterC{}):
+		return SlidingWindowLog
+	case r.SlidingWindowCounterLimiter != (WindowLimiterC{}):
+		return SlidingWindowCounter
+	case r.FixedWindowLimiter != (WindowLimiterC{}):
+		return FixedWindow
+	}
+	return TokenBucket
+}
+
+type RuleC struct {
+	Name      string   `yaml:"name"`
+	Action    string   `yaml:"action"`
+	Verbs     []string `yaml:"verbs"`
+	Tables    []string `yaml:"tables"`
+	Pattern   string   `yaml:"pattern"`
+	ClientIPs []string `yaml:"client_ips"`
+	Users     []string `yaml:"users"`
+	Message   string   `yaml:"message"`
+}
+
+// TLSC configures TLS on the local listener. It is enabled when CertFile
+// is set, unless Enabled is set to false; setting ClientCAFile
+// additionally requires clients to present a certificate signed by that
+// CA.
+type TLSC struct {
+	Enabled      *bool    `yaml:"enabled"`
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	MinVersion   string   `yaml:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+	ClientCAFile string   `yaml:"client_ca_file"`
+}
+
+// UpstreamTLSC configures TLS towards remote_address once Enabled is set
+// to true. ServerName defaults to the host of remote_address; CAFile
+// replaces the system roots and CertFile/KeyFile present a client
+// certificate.
+type UpstreamTLSC struct {
+	Enabled            *bool  `yaml:"enabled"`
+	ServerName         string `yaml:"server_name"`
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	MinVersion         string `yaml:"min_version"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// On reports whether upstream TLS is enabled.
+func (c UpstreamTLSC) On() bool {
+	return c.Enabled != nil && *c.Enabled
+}
+
+// UpstreamC groups the backends of a listener. Backends defaults to
+// remote_address alone; Balance is failover (the default), round_robin or
+// least_connections. A backend failing MaxFails dials in a row is ejected
+// for EjectSeconds.
+type UpstreamC struct {
+	Backends     []string     `yaml:"backends"`
+	Balance      string       `yaml:"balance"`
+	MaxFails     int          `yaml:"max_fails"`
+	EjectSeconds int64        `yaml:"eject_secs"`
+	HealthCheck  HealthCheckC `yaml:"health_check"`
+}
+
+// HealthCheckC enables active checks when IntervalSeconds is set. A check
+// is a TCP connect, plus a protocol handshake probe when Protocol is set.
+// Backends go down after Fall failed checks and up after Rise passing ones.
+type HealthCheckC struct {
+	IntervalSeconds int64 `yaml:"interval_secs"`
+	TimeoutMillis   int64 `yaml:"timeout_ms"`
+	Protocol        bool  `yaml:"protocol"`
+	Rise            int   `yaml:"rise"`
+	Fall            int   `yaml:"fall"`
+}
+
+// ReadWriteSplitC routes read-only statements to Replicas. The firewall
+// logs into replicas as User with Password whoever the client logged in
+// as, so SingleIdentity must be set to confirm every client may read with
+// User's privileges. ReadVerbs lists the leading keywords of statements
+// that may go to a replica (default SELECT, WITH and SHOW); StickySeconds
+// (default 1) keeps a session's reads on the primary for that long after
+// it sends anything else, and for good once it changes its state.
+type ReadWriteSplitC struct {
+	Replicas       UpstreamC `yaml:"replicas"`
+	User           string    `yaml:"user"`
+	Password       string    `yaml:"password"`
+	SingleIdentity bool      `yaml:"single_identity"`
+	ReadVerbs      []string  `yaml:"read_verbs"`
+	StickySeconds  *int64    `yaml:"sticky_secs"`
+}
+
+const defaultStickySeconds = 1
+
+// InjectionC sets the injection score (0-100) at or above which a statement
+// is logged or blocked. Zero disables the respective action.
+type InjectionC struct {
+	AlertThreshold int `yaml:"alert_threshold"`
+	BlockThreshold int `yaml:"block_threshold"`
+}
+
+// MetricsC serves Prometheus metrics over HTTP on Address when it is set.
+// Path defaults to /metrics.
+type MetricsC struct {
+	Address string `yaml:"address"`
+	Path    string `yaml:"path"`
+}
+
+// AdminC serves the admin API over HTTP on Address when it is set. With
+// Token set, requests must send it as a bearer token; it may only be left
+// out on a loopback address. Address may be shared with metrics.
+type AdminC struct {
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+}
+
+// ClusterC shares rate limits and connection limits between replicas,
+// through Redis or by syncing state with the other replicas directly. At
+// most one of the two may be set. Replicas are told apart by ReplicaID,
+// which defaults to the host name.
+type ClusterC struct {
+	ReplicaID string `yaml:"replica_id"`
+	Redis     RedisC `yaml:"redis"`
+	Peers     PeersC `yaml:"peers"`
+}
+
+type RedisC struct {
+	Address   string `yaml:"address"`
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// PeersC syncs state with the replicas at Addresses every SyncMillis
+// (default 500), accepting theirs on Listen, which may be shared with the
+// metrics or admin address. Peers must send Token as a bearer token; it
+// may only be left empty when Listen is a loopback address.
+type PeersC struct {
+	Listen     string   `yaml:"listen"`
+	Addresses  []string `yaml:"addresses"`
+	Token      string   `yaml:"token"`
+	SyncMillis int64    `yaml:"sync_ms"`
+}
+
+// Enabled reports whether state is shared with other replicas.
+func (c ClusterC) Enabled() bool {
+	return c.Redis.Address != "" || c.Peers.Listen != ""
+}
+
 type ProxyConfig struct {
+	Name               string
 	LocalAddress       string
 	RemoteAddress      string
+	Protocol           string
 	IdleTimeoutSeconds int64
+	TLS                TLSC
+	UpstreamTLS        UpstreamTLSC
+	Upstream           UpstreamC
+	ReadWriteSplit     ReadWriteSplitC
+}
+
+// BlocklistC is a deny list applied to every listener, read from File or
+// fetched from URL, one of which must be set. It holds one IP address or
+// CIDR block per line, with # and ; starting comments, or a JSON array of
+// addresses or of objects with an ip or cidr field. It is checked for
+// changes every RefreshSeconds (default 300): files by modification time
+// and size, URLs with conditional requests. Name defaults to the source.
+type BlocklistC struct {
+	Name           string `yaml:"name"`
+	File           string `yaml:"file"`
+	URL            string `yaml:"url"`
+	RefreshSeconds int64  `yaml:"refresh_secs"`
+}
+
+// BansC bans client addresses rejected too often: reaching a threshold of
+// rejections of one kind within WindowSeconds (default 600) bans the
+// address from every listener for BanSeconds (default 300). Each further
+// ban lasts Factor (default 2) times longer, up to MaxBanSeconds (default
+// 86400), until the address goes ResetSeconds (default 86400) without
+// one. A zero threshold never bans for that kind. Addresses in Ignore are
+// never banned. Bans are kept in StateFile across restarts when it is set.
+type BansC struct {
+	Thresholds    BanThresholdsC `yaml:"thresholds"`
+	WindowSeconds int64          `yaml:"window_secs"`
+	BanSeconds    int64          `yaml:"ban_secs"`
+	MaxBanSeconds int64          `yaml:"max_ban_secs"`
+	Factor        float64        `yaml:"factor"`
+	ResetSeconds  int64          `yaml:"reset_secs"`
+	Ignore        []string       `yaml:"ignore"`
+	StateFile     string         `yaml:"state_file"`
+}
+
+// BanThresholdsC counts connections refused by the per IP rate limiter
+// (RateLimit, along with statements refused by the per user and per IP
+// query rate limiters) or the per IP connection limit, logins the server
+// refused and statements denied by policy.
+type BanThresholdsC struct {
+	RateLimit   int `yaml:"rate_limit"`
+	PerIPLimit  int `yaml:"per_ip_limit"`
+	AuthFailure int `yaml:"auth_failure"`
+	DeniedQuery int `yaml:"denied_query"`
+}
+
+// IPFilterConfig restricts which client addresses may connect: only those
+// in Allow when it is not empty, and never those in Deny.
+type IPFilterConfig struct {
+	Allow []string
+	Deny  []string
 }
 
 type ConnectionConfig struct {
@@ -39,23 +359,168 @@ type ConnectionConfig struct {
 	PerIPConnectionLimit int64
 }
 
+// RateLimiterConfig holds the rate limiting tiers of a listener:
+// RateLimiter per client IP, Subnet per client network and Global for all
+// clients together, and the Query tiers applied to statements.
 type RateLimiterConfig struct {
 	RateLimiter RateLimiterC
+	Subnet      SubnetLimiterC
+	Global      RateLimiterC
+	Query       QueryLimiterC
 }
 
-func (c *Config) SplitConfig() (*ProxyConfig, *ConnectionConfig, *RateLimiterConfig) {
-	return &ProxyConfig{
-			LocalAddress:       c.LocalAddress,
-			RemoteAddress:      c.RemoteAddress,
-			IdleTimeoutSeconds: c.IdleTimeoutSeconds,
-		},
-		&ConnectionConfig{
-			ConnectionLimit:      c.ConnectionLimit,
-			PerIPConnectionLimit: c.PerIPConnectionLimit,
-		},
-		&RateLimiterConfig{
-			RateLimiter: c.RateLimiter,
-		}
+type RulesConfig struct {
+	Rules         []RuleC
+	Injection     InjectionC
+	Mode          string
+	AllowlistFile string
+}
+
+// RouteConfig holds the runtime configuration of one listener.
+type RouteConfig struct {
+	Proxy       *ProxyConfig
+	IPFilter    *IPFilterConfig
+	Connection  *ConnectionConfig
+	RateLimiter *RateLimiterConfig
+}
+
+// Routes returns the configured listeners with top level defaults applied.
+// Without a listeners list the top level addresses form the only one.
+func (c *Config) Routes() []ListenerC {
+	if len(c.Listeners) == 0 {
+		l := ListenerC{LocalAddress: c.LocalAddress, RemoteAddress: c.RemoteAddress, Upstream: c.Upstream, ReadWriteSplit: c.ReadWriteSplit}
+		return []ListenerC{l.withDefaults(c)}
+	}
+	routes := make([]ListenerC, len(c.Listeners))
+	for i, l := range c.Listeners {
+		routes[i] = l.withDefaults(c)
+	}
+	return routes
+}
+
+func (l ListenerC) withDefaults(c *Config) ListenerC {
+	if l.Name == "" {
+		l.Name = l.LocalAddress
+	}
+	if l.Protocol == "" {
+		l.Protocol = c.Protocol
+	}
+	switch {
+	case l.TLS.Enabled != nil && !*l.TLS.Enabled:
+		l.TLS = TLSC{}
+	case l.TLS.CertFile == "":
+		l.TLS = c.TLS
+	}
+	if l.UpstreamTLS.Enabled == nil {
+		l.UpstreamTLS = c.UpstreamTLS
+	}
+	l.Upstream = l.Upstream.withDefaults(c.Upstream)
+	if len(l.Upstream.Backends) == 0 && l.RemoteAddress != "" {
+		l.Upstream.Backends = []string{l.RemoteAddress}
+	}
+	if len(l.ReadWriteSplit.Replicas.Backends) == 0 && (l.Protocol == "postgres" || l.Protocol == "mysql") {
+		l.ReadWriteSplit = c.ReadWriteSplit
+	}
+	l.ReadWriteSplit.Replicas = l.ReadWriteSplit.Replicas.withDefaults(l.Upstream)
+	if l.ReadWriteSplit.StickySeconds == nil {
+		sticky := int64(defaultStickySeconds)
+		l.ReadWriteSplit.StickySeconds = &sticky
+	}
+	if len(l.IPAllowlist) == 0 {
+		l.IPAllowlist = c.IPAllowlist
+	}
+	if len(l.IPDenylist) == 0 {
+		l.IPDenylist = c.IPDenylist
+	}
+	if l.ConnectionLimit == 0 {
+		l.ConnectionLimit = c.ConnectionLimit
+	}
+	if l.PerIPConnectionLimit == 0 {
+		l.PerIPConnectionLimit = c.PerIPConnectionLimit
+	}
+	if l.IdleTimeoutSeconds == nil {
+		idle := c.IdleTimeoutSeconds
+		l.IdleTimeoutSeconds = &idle
+	}
+	if l.RateLimiter == (RateLimiterC{}) {
+		l.RateLimiter = c.RateLimiter
+	}
+	l.RateLimiter = l.RateLimiter.effective()
+	if l.SubnetRateLimiter == (SubnetLimiterC{}) {
+		l.SubnetRateLimiter = c.SubnetRateLimiter
+	}
+	l.SubnetRateLimiter.RateLimiterC = l.SubnetRateLimiter.RateLimiterC.effective()
+	if l.SubnetRateLimiter.IPv4Prefix == 0 {
+		l.SubnetRateLimiter.IPv4Prefix = DefaultIPv4Prefix
+	}
+	if l.SubnetRateLimiter.IPv6Prefix == 0 {
+		l.SubnetRateLimiter.IPv6Prefix = DefaultIPv6Prefix
+	}
+	if l.GlobalRateLimiter == (RateLimiterC{}) {
+		l.GlobalRateLimiter = c.GlobalRateLimiter
+	}
+	l.GlobalRateLimiter = l.GlobalRateLimiter.effective()
+	if l.QueryRateLimiter == (QueryLimiterC{}) {
+		l.QueryRateLimiter = c.QueryRateLimiter
+	}
+	q := &l.QueryRateLimiter
+	q.User, q.IP, q.Fingerprint = q.User.effective(), q.IP.effective(), q.Fingerprint.effective()
+	return l
+}
+
+func (u UpstreamC) withDefaults(d UpstreamC) UpstreamC {
+	if u.Balance == "" {
+		u.Balance = d.Balance
+	}
+	if u.MaxFails == 0 {
+		u.MaxFails = d.MaxFails
+	}
+	if u.EjectSeconds == 0 {
+		u.EjectSeconds = d.EjectSeconds
+	}
+	if u.HealthCheck == (HealthCheckC{}) {
+		u.HealthCheck = d.HealthCheck
+	}
+	return u
+}
+
+func (c *Config) SplitConfig() ([]RouteConfig, *RulesConfig) {
+	var routes []RouteConfig
+	for _, l := range c.Routes() {
+		routes = append(routes, RouteConfig{
+			Proxy: &ProxyConfig{
+				Name:               l.Name,
+				LocalAddress:       l.LocalAddress,
+				RemoteAddress:      l.RemoteAddress,
+				Protocol:           l.Protocol,
+				IdleTimeoutSeconds: *l.IdleTimeoutSeconds,
+				TLS:                l.TLS,
+				UpstreamTLS:        l.UpstreamTLS,
+				Upstream:           l.Upstream,
+				ReadWriteSplit:     l.ReadWriteSplit,
+			},
+			IPFilter: &IPFilterConfig{
+				Allow: l.IPAllowlist,
+				Deny:  l.IPDenylist,
+			},
+			Connection: &ConnectionConfig{
+				ConnectionLimit:      l.ConnectionLimit,
+				PerIPConnectionLimit: l.PerIPConnectionLimit,
+			},
+			RateLimiter: &RateLimiterConfig{
+				RateLimiter: l.RateLimiter,
+				Subnet:      l.SubnetRateLimiter,
+				Global:      l.GlobalRateLimiter,
+				Query:       l.QueryRateLimiter,
+			},
+		})
+	}
+	return routes, &RulesConfig{
+		Rules:         c.Rules,
+		Injection:     c.Injection,
+		Mode:          c.Mode,
+		AllowlistFile: c.AllowlistFile,
+	}
 }
 
 func LoadConfig() (Config, error) {
@@ -87,6 +552,23 @@ func LoadConfig() (Config, error) {
 
 }
 
+// defaultShutdownGrace is how long shutdown waits for open connections
+// when shutdown_grace_secs is not set.
+const defaultShutdownGrace = 30 * time.Second
+
+// ShutdownGrace returns how long shutdown waits for open connections.
+func (c *Config) ShutdownGrace() time.Duration {
+	if c.ShutdownGraceSeconds == 0 {
+		return defaultShutdownGrace
+	}
+	return time.Duration(c.ShutdownGraceSeconds) * time.Second
+}
+
+// Path returns the configuration file LoadConfig reads.
+func Path() (string, error) {
+	return resolveConfig()
+}
+
 func resolveConfig() (string, error) {
 	if p := flag.Lookup("config"); p != nil {
 		if v := p.Value.String(); v != "" {
@@ -109,39 +591,455 @@ func resolveConfig() (string, error) {
 }
 
 func ValidateConfig(cfg Config) error {
-	if cfg.LocalAddress == "" {
-		return fmt.Errorf("local_address must be set")
+	if len(cfg.Listeners) > 0 && (cfg.LocalAddress != "" || cfg.RemoteAddress != "" || len(cfg.Upstream.Backends) > 0) {
+		return fmt.Errorf("local_address, remote_address and upstream.backends cannot be combined with listeners")
+	}
+
+	names := make(map[string]bool)
+	addrs := make(map[string]bool)
+	for i, l := range cfg.Routes() {
+		if err := validateListener(l); err != nil {
+			if len(cfg.Listeners) == 0 {
+				return err
+			}
+			return fmt.Errorf("listeners[%d]: %w", i, err)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listeners[%d]: duplicate name %q", i, l.Name)
+		}
+		if addrs[l.LocalAddress] {
+			return fmt.Errorf("listeners[%d]: duplicate local_address %q", i, l.LocalAddress)
+		}
+		names[l.Name], addrs[l.LocalAddress] = true, true
+	}
+
+	for i, r := range cfg.Rules {
+		if err := validateRule(r); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+	}
+
+	for i, b := range cfg.Blocklists {
+		if err := validateBlocklist(b); err != nil {
+			return fmt.Errorf("blocklists[%d]: %w", i, err)
+		}
+	}
+
+	if err := validateBans(cfg.Bans); err != nil {
+		return fmt.Errorf("bans: %w", err)
+	}
+
+	if err := validateInjection(cfg.Injection); err != nil {
+		return fmt.Errorf("injection: %w", err)
 	}
-	if cfg.RemoteAddress == "" {
-		return fmt.Errorf("remote_address must be set")
+
+	switch cfg.Mode {
+	case "":
+	case "learn", "enforce":
+		if cfg.AllowlistFile == "" {
+			return fmt.Errorf("allowlist_file must be set in %s mode", cfg.Mode)
+		}
+	default:
+		return fmt.Errorf("mode must be learn or enforce")
+	}
+
+	if cfg.ShutdownGraceSeconds < 0 {
+		return fmt.Errorf("shutdown_grace_secs must not be negative")
+	}
+
+	if err := validateMetrics(cfg.Metrics); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	if cfg.Admin.Address != "" {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.Admin.Address); err != nil {
+			return fmt.Errorf("admin: invalid address: %w", err)
+		}
+		if cfg.Admin.Token == "" && !loopback(cfg.Admin.Address) {
+			return fmt.Errorf("admin: token must be set unless address is a loopback address")
+		}
 	}
-	if cfg.LocalAddress == cfg.RemoteAddress {
-		return fmt.Errorf("local_address and remote_address must not be the same")
+	if err := validateCluster(cfg.Cluster); err != nil {
+		return fmt.Errorf("cluster: %w", err)
 	}
 
-	if _, err := net.ResolveTCPAddr("tcp", cfg.LocalAddress); err != nil {
+	return nil
+}
+
+// loopback reports whether addr only listens on the loopback interface.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func validateCluster(c ClusterC) error {
+	if c.Redis.Address != "" && c.Peers.Listen != "" {
+		return fmt.Errorf("redis and peers cannot be combined")
+	}
+	if c.Redis.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Redis.Address); err != nil {
+			return fmt.Errorf("redis: invalid address: %w", err)
+		}
+		if c.Redis.DB < 0 {
+			return fmt.Errorf("redis: db must not be negative")
+		}
+	}
+	if c.Peers.Listen == "" {
+		if len(c.Peers.Addresses) > 0 {
+			return fmt.Errorf("peers: listen must be set")
+		}
+		return nil
+	}
+	if _, err := net.ResolveTCPAddr("tcp", c.Peers.Listen); err != nil {
+		return fmt.Errorf("peers: invalid listen address: %w", err)
+	}
+	if c.Peers.Token == "" && !loopback(c.Peers.Listen) {
+		return fmt.Errorf("peers: token must be set unless listen is a loopback address")
+	}
+	for _, a := range c.Peers.Addresses {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("peers: invalid address %q: %w", a, err)
+		}
+	}
+	if c.Peers.SyncMillis < 0 {
+		return fmt.Errorf("peers: sync_ms must not be negative")
+	}
+	return nil
+}
+
+func validateBlocklist(b BlocklistC) error {
+	if (b.File == "") == (b.URL == "") {
+		return fmt.Errorf("exactly one of file and url must be set")
+	}
+	if b.URL != "" {
+		u, err := url.Parse(b.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url must be an http or https URL")
+		}
+	}
+	if b.RefreshSeconds < 0 {
+		return fmt.Errorf("refresh_secs must not be negative")
+	}
+	return nil
+}
+
+func validateBans(b BansC) error {
+	t := b.Thresholds
+	if t.RateLimit < 0 || t.PerIPLimit < 0 || t.AuthFailure < 0 || t.DeniedQuery < 0 {
+		return fmt.Errorf("thresholds must not be negative")
+	}
+	if b.WindowSeconds < 0 || b.BanSeconds < 0 || b.MaxBanSeconds < 0 || b.ResetSeconds < 0 {
+		return fmt.Errorf("window_secs, ban_secs, max_ban_secs and reset_secs must not be negative")
+	}
+	if b.BanSeconds > 0 && b.MaxBanSeconds > 0 && b.BanSeconds > b.MaxBanSeconds {
+		return fmt.Errorf("ban_secs must not exceed max_ban_secs")
+	}
+	if b.Factor != 0 && b.Factor < 1 {
+		return fmt.Errorf("factor must be at least 1")
+	}
+	for _, s := range b.Ignore {
+		if _, err := ParseCIDR(s); err != nil {
+			return fmt.Errorf("ignore: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateRateLimiter(r RateLimiterC) error {
+	if r.MaxTrackedKeys < 0 {
+		return fmt.Errorf("max_tracked_keys must not be negative")
+	}
+	set := 0
+	if r.TokenBucketLimiter != (TokenBucketLimiterC{}) {
+		set++
+		if r.TokenBucketLimiter.Rate < 0 || r.TokenBucketLimiter.Capacity < 0 {
+			return fmt.Errorf("token_bucket_limiter: rate and capacity must not be negative")
+		}
+	}
+	windows := map[string]WindowLimiterC{
+		"sliding_window_log_limiter":     r.SlidingWindowLogLimiter,
+		"sliding_window_counter_limiter": r.SlidingWindowCounterLimiter,
+		"fixed_window_limiter":           r.FixedWindowLimiter,
+	}
+	for name, w := range windows {
+		if w == (WindowLimiterC{}) {
+			continue
+		}
+		set++
+		if w.Limit < 0 {
+			return fmt.Errorf("%s: limit must not be negative", name)
+		}
+		if w.WindowMillis <= 0 {
+			return fmt.Errorf("%s: window_ms must be > 0", name)
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("only one limiter may be configured")
+	}
+	return nil
+}
+
+func validateMetrics(m MetricsC) error {
+	if m.Address == "" {
+		return nil
+	}
+	if _, err := net.ResolveTCPAddr("tcp", m.Address); err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	if m.Path != "" && !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	return nil
+}
+
+func validateListener(l ListenerC) error {
+	if l.LocalAddress == "" {
+		return fmt.Errorf("local_address must be set")
+	}
+	if len(l.Upstream.Backends) == 0 {
+		return fmt.Errorf("remote_address or upstream.backends must be set")
+	}
+	if l.RemoteAddress != "" && (len(l.Upstream.Backends) != 1 || l.Upstream.Backends[0] != l.RemoteAddress) {
+		return fmt.Errorf("remote_address cannot be combined with upstream.backends")
+	}
+	if _, err := net.ResolveTCPAddr("tcp", l.LocalAddress); err != nil {
 		return fmt.Errorf("invalid local_address: %w", err)
 	}
-	if _, err := net.ResolveTCPAddr("tcp", cfg.RemoteAddress); err != nil {
-		return fmt.Errorf("invalid remote_address: %w", err)
+	if err := validateUpstream(l.LocalAddress, l.Upstream); err != nil {
+		return fmt.Errorf("upstream: %w", err)
+	}
+
+	switch l.Protocol {
+	case "", "tcp", "postgres", "mysql":
+	default:
+		return fmt.Errorf("unsupported protocol %q", l.Protocol)
+	}
+
+	if err := validateReadWriteSplit(l); err != nil {
+		return fmt.Errorf("read_write_split: %w", err)
+	}
+
+	for _, s := range l.IPAllowlist {
+		if _, err := ParseCIDR(s); err != nil {
+			return fmt.Errorf("ip_allowlist: %w", err)
+		}
+	}
+	for _, s := range l.IPDenylist {
+		if _, err := ParseCIDR(s); err != nil {
+			return fmt.Errorf("ip_denylist: %w", err)
+		}
+	}
+
+	if err := validateTLS(l.TLS); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if err := validateUpstreamTLS(l.UpstreamTLS); err != nil {
+		return fmt.Errorf("upstream_tls: %w", err)
 	}
 
-	if cfg.ConnectionLimit <= 0 {
+	if err := validateRateLimiter(l.RateLimiter); err != nil {
+		return fmt.Errorf("rate_limiter: %w", err)
+	}
+	if err := validateRateLimiter(l.SubnetRateLimiter.RateLimiterC); err != nil {
+		return fmt.Errorf("subnet_rate_limiter: %w", err)
+	}
+	if p := l.SubnetRateLimiter.IPv4Prefix; p < 0 || p > 32 {
+		return fmt.Errorf("subnet_rate_limiter: ipv4_prefix must be between 0 and 32")
+	}
+	if p := l.SubnetRateLimiter.IPv6Prefix; p < 0 || p > 128 {
+		return fmt.Errorf("subnet_rate_limiter: ipv6_prefix must be between 0 and 128")
+	}
+	if err := validateRateLimiter(l.GlobalRateLimiter); err != nil {
+		return fmt.Errorf("global_rate_limiter: %w", err)
+	}
+	q := l.QueryRateLimiter
+	for name, r := range map[string]RateLimiterC{"user": q.User, "ip": q.IP, "fingerprint": q.Fingerprint} {
+		if err := validateRateLimiter(r); err != nil {
+			return fmt.Errorf("query_rate_limiter: %s: %w", name, err)
+		}
+	}
+
+	if l.ConnectionLimit <= 0 {
 		return fmt.Errorf("connection_limit must be > 0")
 	}
-	if cfg.PerIPConnectionLimit <= 0 {
+	if l.PerIPConnectionLimit <= 0 {
 		return fmt.Errorf("per_ip_connection_limit must be > 0")
 	}
-	if cfg.PerIPConnectionLimit > cfg.ConnectionLimit {
+	if l.PerIPConnectionLimit > l.ConnectionLimit {
 		return fmt.Errorf("per_ip_connection_limit cannot exceed connection_limit")
 	}
 
-	if cfg.IdleTimeoutSeconds < 0 {
+	if *l.IdleTimeoutSeconds < 0 {
 		return fmt.Errorf("idle_timeout_seconds must be >= 0")
 	}
-	if cfg.IdleTimeoutSeconds > 0 && cfg.IdleTimeoutSeconds < 1 {
+	if *l.IdleTimeoutSeconds > 0 && *l.IdleTimeoutSeconds < 1 {
 		return fmt.Errorf("idle_timeout_seconds must be >= 1 when enabled")
 	}
+	return nil
+}
+
+func validateUpstream(local string, u UpstreamC) error {
+	for _, b := range u.Backends {
+		if b == local {
+			return fmt.Errorf("backend %q is the local_address", b)
+		}
+		if _, err := net.ResolveTCPAddr("tcp", b); err != nil {
+			return fmt.Errorf("invalid backend: %w", err)
+		}
+	}
+	switch u.Balance {
+	case "", "failover", "round_robin", "least_connections":
+	default:
+		return fmt.Errorf("balance must be failover, round_robin or least_connections")
+	}
+	if u.MaxFails < 0 || u.EjectSeconds < 0 {
+		return fmt.Errorf("max_fails and eject_secs must be >= 0")
+	}
+	hc := u.HealthCheck
+	if hc.IntervalSeconds < 0 || hc.TimeoutMillis < 0 || hc.Rise < 0 || hc.Fall < 0 {
+		return fmt.Errorf("health_check values must be >= 0")
+	}
+	return nil
+}
+
+func validateReadWriteSplit(l ListenerC) error {
+	rw := l.ReadWriteSplit
+	if len(rw.Replicas.Backends) == 0 {
+		return nil
+	}
+	if l.Protocol != "postgres" && l.Protocol != "mysql" {
+		return fmt.Errorf("requires protocol postgres or mysql")
+	}
+	if rw.User == "" {
+		return fmt.Errorf("user must be set")
+	}
+	if !rw.SingleIdentity {
+		return fmt.Errorf("single_identity must be set: replicas are read as user, not as each client")
+	}
+	if *rw.StickySeconds < 0 {
+		return fmt.Errorf("sticky_secs must be >= 0")
+	}
+	if err := validateUpstream(l.LocalAddress, rw.Replicas); err != nil {
+		return fmt.Errorf("replicas: %w", err)
+	}
+	return nil
+}
+
+func validateTLS(c TLSC) error {
+	if c.CertFile == "" && c.KeyFile == "" {
+		if c.ClientCAFile != "" {
+			return fmt.Errorf("client_ca_file requires cert_file and key_file")
+		}
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file must both be set")
+	}
+	if _, err := TLSVersion(c.MinVersion); err != nil {
+		return err
+	}
+	if _, err := CipherSuites(c.CipherSuites); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateUpstreamTLS(c UpstreamTLSC) error {
+	if !c.On() {
+		return nil
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	_, err := TLSVersion(c.MinVersion)
+	return err
+}
+
+// TLSVersion parses a version such as "1.2". An empty string selects TLS
+// 1.2.
+func TLSVersion(s string) (uint16, error) {
+	switch s {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported tls version %q", s)
+}
+
+// CipherSuites maps IANA suite names (TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+// to their ids. They only apply to TLS 1.2 and below.
+func CipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func validateInjection(c InjectionC) error {
+	if c.AlertThreshold < 0 || c.AlertThreshold > 100 {
+		return fmt.Errorf("alert_threshold must be between 0 and 100")
+	}
+	if c.BlockThreshold < 0 || c.BlockThreshold > 100 {
+		return fmt.Errorf("block_threshold must be between 0 and 100")
+	}
+	return nil
+}
 
+func validateRule(r RuleC) error {
+	switch r.Action {
+	case "allow", "deny", "log":
+	default:
+		return fmt.Errorf("action must be one of allow, deny, log")
+	}
+	if r.Pattern != "" {
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	for _, ip := range r.ClientIPs {
+		if _, err := ParseCIDR(ip); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// ParseCIDR accepts either a CIDR block or a bare IP address, which is
+// treated as a single host network.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if _, n, err := net.ParseCIDR(s); err == nil {
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip or cidr %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,491 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+func baseConfig() Config {
+	return Config{
+		LocalAddress:         "127.0.0.1:6432",
+		RemoteAddress:        "127.0.0.1:5432",
+		ConnectionLimit:      10,
+		PerIPConnectionLimit: 2,
+		IdleTimeoutSeconds:   30,
+		RateLimiter:          RateLimiterC{TokenBucketLimiter: TokenBucketLimiterC{Rate: 1, Capacity: 5}},
+	}
+}
+
+func TestSplitConfig_SingleRouteFromTopLevel(t *testing.T) {
+	c := baseConfig()
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := c.SplitConfig()
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(routes))
+	}
+	r := routes[0]
+	if r.Proxy.Name != "127.0.0.1:6432" || r.Proxy.RemoteAddress != "127.0.0.1:5432" || r.Connection.ConnectionLimit != 10 {
+		t.Fatalf("unexpected route %+v %+v", r.Proxy, r.Connection)
+	}
+}
+
+func TestSplitConfig_ListenersInheritDefaults(t *testing.T) {
+	c := baseConfig()
+	c.LocalAddress, c.RemoteAddress = "", ""
+	c.Protocol = "postgres"
+	c.Listeners = []ListenerC{
+		{Name: "orders", LocalAddress: "127.0.0.1:6432", RemoteAddress: "10.0.0.1:5432", ConnectionLimit: 50, PerIPConnectionLimit: 5},
+		{Name: "shop", LocalAddress: "127.0.0.1:3307", RemoteAddress: "10.0.0.2:3306", Protocol: "mysql",
+			RateLimiter: RateLimiterC{TokenBucketLimiter: TokenBucketLimiterC{Rate: 9, Capacity: 9}}},
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, _ := c.SplitConfig()
+	orders, shop := routes[0], routes[1]
+	if orders.Proxy.Protocol != "postgres" || orders.Connection.ConnectionLimit != 50 || orders.Proxy.IdleTimeoutSeconds != 30 {
+		t.Fatalf("unexpected orders route %+v %+v", orders.Proxy, orders.Connection)
+	}
+	if orders.RateLimiter.RateLimiter.TokenBucketLimiter.Rate != 1 {
+		t.Fatal("expected orders to inherit the top level rate limiter")
+	}
+	if shop.Proxy.Protocol != "mysql" || shop.Connection.ConnectionLimit != 10 || shop.RateLimiter.RateLimiter.TokenBucketLimiter.Rate != 9 {
+		t.Fatalf("unexpected shop route %+v %+v", shop.Proxy, shop.Connection)
+	}
+}
+
+func TestSplitConfig_ListenersTurnOffInheritedSettings(t *testing.T) {
+	c := baseConfig()
+	c.LocalAddress, c.RemoteAddress = "", ""
+	c.GlobalRateLimiter = RateLimiterC{FixedWindowLimiter: WindowLimiterC{Limit: 100, WindowMillis: 1000}}
+	enabled := true
+	c.TLS = TLSC{CertFile: "server.pem", KeyFile: "server-key.pem"}
+	c.UpstreamTLS = UpstreamTLSC{Enabled: &enabled, ServerName: "db.internal"}
+	if err := yaml.Unmarshal([]byte(`
+- local_address: 127.0.0.1:6433
+  remote_address: 10.0.0.1:5432
+  idle_timeout_secs: 0
+  rate_limiter: {enabled: false}
+  global_rate_limiter: {enabled: false}
+  tls: {enabled: false}
+  upstream_tls: {enabled: false}
+`), &c.Listeners); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+
+	routes, _ := c.SplitConfig()
+	off := routes[0]
+	if off.Proxy.IdleTimeoutSeconds != 0 || off.RateLimiter.RateLimiter != (RateLimiterC{}) || off.RateLimiter.Global != (RateLimiterC{}) {
+		t.Fatalf("expected the inherited idle timeout and limiters to be off, got %+v %+v", off.Proxy, off.RateLimiter)
+	}
+	if off.Proxy.TLS.CertFile != "" || off.Proxy.UpstreamTLS.On() {
+		t.Fatalf("expected the inherited TLS settings to be off, got %+v %+v", off.Proxy.TLS, off.Proxy.UpstreamTLS)
+	}
+
+	c.Listeners[0].IdleTimeoutSeconds, c.Listeners[0].RateLimiter = nil, RateLimiterC{}
+	c.Listeners[0].TLS, c.Listeners[0].UpstreamTLS = TLSC{}, UpstreamTLSC{}
+	routes, _ = c.SplitConfig()
+	on := routes[0]
+	if on.Proxy.IdleTimeoutSeconds != 30 || on.RateLimiter.RateLimiter.TokenBucketLimiter.Rate != 1 || on.RateLimiter.Global.FixedWindowLimiter.Limit != 0 {
+		t.Fatalf("expected unset settings to be inherited and the disabled one to stay off, got %+v %+v", on.Proxy, on.RateLimiter)
+	}
+	if on.Proxy.TLS.CertFile != "server.pem" || !on.Proxy.UpstreamTLS.On() {
+		t.Fatalf("expected the TLS settings to be inherited, got %+v %+v", on.Proxy.TLS, on.Proxy.UpstreamTLS)
+	}
+}
+
+func TestSplitConfig_ReadWriteSplitOnlyForSQLListeners(t *testing.T) {
+	c := baseConfig()
+	c.LocalAddress, c.RemoteAddress = "", ""
+	c.ReadWriteSplit = ReadWriteSplitC{
+		Replicas:       UpstreamC{Backends: []string{"10.0.0.3:5432"}},
+		User:           "reader",
+		SingleIdentity: true,
+	}
+	c.Listeners = []ListenerC{
+		{Name: "orders", LocalAddress: "127.0.0.1:6433", RemoteAddress: "10.0.0.1:5432", Protocol: "postgres"},
+		{Name: "cache", LocalAddress: "127.0.0.1:6380", RemoteAddress: "10.0.0.2:6379", Protocol: "tcp"},
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := c.SplitConfig()
+	if len(routes[0].Proxy.ReadWriteSplit.Replicas.Backends) != 1 || len(routes[1].Proxy.ReadWriteSplit.Replicas.Backends) != 0 {
+		t.Fatalf("expected only the postgres listener to split, got %+v %+v", routes[0].Proxy.ReadWriteSplit, routes[1].Proxy.ReadWriteSplit)
+	}
+}
+
+func TestValidateConfig_RejectsBadListeners(t *testing.T) {
+	listeners := func(ls ...ListenerC) Config {
+		c := baseConfig()
+		c.LocalAddress, c.RemoteAddress = "", ""
+		c.Listeners = ls
+		return c
+	}
+	mixed := baseConfig()
+	mixed.Listeners = []ListenerC{{LocalAddress: "127.0.0.1:1", RemoteAddress: "127.0.0.1:2"}}
+
+	bad := map[string]Config{
+		"mixed":          mixed,
+		"duplicate addr": listeners(ListenerC{LocalAddress: "127.0.0.1:1", RemoteAddress: "127.0.0.1:2"}, ListenerC{Name: "b", LocalAddress: "127.0.0.1:1", RemoteAddress: "127.0.0.1:3"}),
+		"duplicate name": listeners(ListenerC{Name: "a", LocalAddress: "127.0.0.1:1", RemoteAddress: "127.0.0.1:2"}, ListenerC{Name: "a", LocalAddress: "127.0.0.1:3", RemoteAddress: "127.0.0.1:2"}),
+		"no upstream":    listeners(ListenerC{LocalAddress: "127.0.0.1:1"}),
+		"bad protocol":   listeners(ListenerC{LocalAddress: "127.0.0.1:1", RemoteAddress: "127.0.0.1:2", Protocol: "oracle"}),
+	}
+	for name, c := range bad {
+		if err := ValidateConfig(c); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestSplitConfig_UpstreamBackends(t *testing.T) {
+	c := baseConfig()
+	c.RemoteAddress = ""
+	c.Upstream = UpstreamC{Backends: []string{"10.0.0.1:5432", "10.0.0.2:5432"}, Balance: "round_robin"}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := c.SplitConfig()
+	if u := routes[0].Proxy.Upstream; len(u.Backends) != 2 || u.Balance != "round_robin" {
+		t.Fatalf("unexpected upstream %+v", u)
+	}
+
+	single := baseConfig()
+	routes, _ = single.SplitConfig()
+	if b := routes[0].Proxy.Upstream.Backends; len(b) != 1 || b[0] != "127.0.0.1:5432" {
+		t.Fatalf("expected remote_address as the only backend, got %v", b)
+	}
+
+	both := baseConfig()
+	both.Upstream.Backends = []string{"10.0.0.1:5432"}
+	if err := ValidateConfig(both); err == nil {
+		t.Fatal("expected remote_address and backends to be rejected together")
+	}
+	balance := baseConfig()
+	balance.Upstream.Balance = "random"
+	if err := ValidateConfig(balance); err == nil {
+		t.Fatal("expected unknown balance to be rejected")
+	}
+}
+
+func TestSplitConfig_ReadWriteSplit(t *testing.T) {
+	c := baseConfig()
+	c.Protocol = "postgres"
+	c.Upstream.HealthCheck = HealthCheckC{IntervalSeconds: 5}
+	sticky := int64(2)
+	c.ReadWriteSplit = ReadWriteSplitC{
+		Replicas:       UpstreamC{Backends: []string{"10.0.0.3:5432"}},
+		User:           "reader",
+		SingleIdentity: true,
+		StickySeconds:  &sticky,
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := c.SplitConfig()
+	rw := routes[0].Proxy.ReadWriteSplit
+	if rw.User != "reader" || *rw.StickySeconds != 2 || rw.Replicas.HealthCheck.IntervalSeconds != 5 {
+		t.Fatalf("unexpected split %+v", rw)
+	}
+
+	unset := c
+	unset.ReadWriteSplit.StickySeconds = nil
+	routes, _ = unset.SplitConfig()
+	if got := *routes[0].Proxy.ReadWriteSplit.StickySeconds; got != defaultStickySeconds {
+		t.Fatalf("expected sticky_secs to default to %d, got %d", defaultStickySeconds, got)
+	}
+
+	tcp := c
+	tcp.Protocol = "tcp"
+	noUser := c
+	noUser.ReadWriteSplit.User = ""
+	badReplica := c
+	badReplica.ReadWriteSplit.Replicas.Backends = []string{"nowhere"}
+	substituted := c
+	substituted.ReadWriteSplit.SingleIdentity = false
+	for name, bad := range map[string]Config{"tcp": tcp, "no user": noUser, "bad replica": badReplica, "no single_identity": substituted} {
+		if err := ValidateConfig(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestValidateConfig_RateLimiterAlgorithms(t *testing.T) {
+	c := baseConfig()
+	c.RateLimiter = RateLimiterC{SlidingWindowCounterLimiter: WindowLimiterC{Limit: 10, WindowMillis: 1000}}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.RateLimiter.Algorithm(); got != SlidingWindowCounter {
+		t.Fatalf("expected %s, got %s", SlidingWindowCounter, got)
+	}
+	if got := (RateLimiterC{}).Algorithm(); got != TokenBucket {
+		t.Fatalf("expected %s by default, got %s", TokenBucket, got)
+	}
+
+	two := c
+	two.RateLimiter.TokenBucketLimiter = TokenBucketLimiterC{Rate: 1, Capacity: 1}
+	noWindow := c
+	noWindow.RateLimiter = RateLimiterC{FixedWindowLimiter: WindowLimiterC{Limit: 10}}
+	negative := c
+	negative.RateLimiter = RateLimiterC{SlidingWindowLogLimiter: WindowLimiterC{Limit: -1, WindowMillis: 1000}}
+	for name, bad := range map[string]Config{"two limiters": two, "no window": noWindow, "negative": negative} {
+		if err := ValidateConfig(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestSplitConfig_RateLimiterTiers(t *testing.T) {
+	var c Config
+	err := yaml.Unmarshal([]byte(`
+local_address: 127.0.0.1:6432
+remote_address: 127.0.0.1:5432
+connection_limit: 10
+per_ip_connection_limit: 2
+idle_timeout_secs: 30
+subnet_rate_limiter:
+  ipv6_prefix: 48
+  fixed_window_limiter: {limit: 20, window_ms: 1000}
+global_rate_limiter:
+  token_bucket_limiter: {rate: 100, capacity: 200}
+query_rate_limiter:
+  user: {sliding_window_counter_limiter: {limit: 500, window_ms: 1000}}
+  fingerprint: {token_bucket_limiter: {rate: 10, capacity: 20}}
+`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := c.SplitConfig()
+	rl := routes[0].RateLimiter
+	if rl.Subnet.IPv4Prefix != DefaultIPv4Prefix || rl.Subnet.IPv6Prefix != 48 || rl.Subnet.FixedWindowLimiter.Limit != 20 {
+		t.Fatalf("unexpected subnet tier %+v", rl.Subnet)
+	}
+	if rl.Global.TokenBucketLimiter.Capacity != 200 {
+		t.Fatalf("unexpected global tier %+v", rl.Global)
+	}
+	if rl.Query.User.SlidingWindowCounterLimiter.Limit != 500 || rl.Query.IP != (RateLimiterC{}) || rl.Query.Fingerprint.TokenBucketLimiter.Rate != 10 {
+		t.Fatalf("unexpected query tiers %+v", rl.Query)
+	}
+
+	badPrefix := c
+	badPrefix.SubnetRateLimiter.IPv4Prefix = 33
+	twoGlobal := c
+	twoGlobal.GlobalRateLimiter.FixedWindowLimiter = WindowLimiterC{Limit: 1, WindowMillis: 1}
+	negativeQuery := c
+	negativeQuery.QueryRateLimiter.IP.FixedWindowLimiter = WindowLimiterC{Limit: -1, WindowMillis: 1000}
+	for name, bad := range map[string]Config{"bad prefix": badPrefix, "two global limiters": twoGlobal, "negative query limit": negativeQuery} {
+		if err := ValidateConfig(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	changed := c
+	changed.SubnetRateLimiter.FixedWindowLimiter.Limit = 30
+	changed.QueryRateLimiter.User.SlidingWindowCounterLimiter.Limit = 50
+	changes := Diff(c, changed)
+	if len(changes) != 2 || changes[0].Path != "subnet_rate_limiter.fixed_window_limiter.limit" || !changes[0].Reloadable() {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+	if changes[1].Path != "query_rate_limiter.user.sliding_window_counter_limiter.limit" || !changes[1].Reloadable() {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
+
+func TestSplitConfig_IPLists(t *testing.T) {
+	c := Config{
+		IPDenylist:           []string{"203.0.113.0/24", "2001:db8::1"},
+		ConnectionLimit:      10,
+		PerIPConnectionLimit: 2,
+		Listeners: []ListenerC{
+			{Name: "inherits", LocalAddress: "127.0.0.1:6432", RemoteAddress: "127.0.0.1:5432"},
+			{Name: "own", LocalAddress: "127.0.0.1:6433", RemoteAddress: "127.0.0.1:5432", IPAllowlist: []string{"10.0.0.0/8"}, IPDenylist: []string{"10.6.6.6"}},
+		},
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	routes, _ := c.SplitConfig()
+	if f := routes[0].IPFilter; len(f.Allow) != 0 || len(f.Deny) != 2 {
+		t.Fatalf("expected the top level denylist, got %+v", f)
+	}
+	if f := routes[1].IPFilter; len(f.Allow) != 1 || len(f.Deny) != 1 || f.Deny[0] != "10.6.6.6" {
+		t.Fatalf("expected the listener's own lists, got %+v", f)
+	}
+
+	bad := c
+	bad.IPDenylist = []string{"203.0.113.0/33"}
+	if err := ValidateConfig(bad); err == nil || !strings.Contains(err.Error(), "ip_denylist") {
+		t.Fatalf("expected an invalid denylist entry to be rejected, got %v", err)
+	}
+
+	changes := Diff(c, bad)
+	if len(changes) != 1 || changes[0].Path != "ip_denylist" || !changes[0].Reloadable() {
+		t.Fatalf("unexpected changes %+v", changes)
+	}
+}
+
+func TestValidateConfig_Blocklists(t *testing.T) {
+	c := baseConfig()
+	c.Blocklists = []BlocklistC{
+		{Name: "drop", URL: "https://feeds.example.com/drop.txt", RefreshSeconds: 3600},
+		{File: "/etc/warden/blocked.txt"},
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string]BlocklistC{
+		"no source":        {Name: "empty"},
+		"both sources":     {File: "/tmp/x", URL: "http://example.com/x"},
+		"not http":         {URL: "ftp://example.com/x"},
+		"negative refresh": {File: "/tmp/x", RefreshSeconds: -1},
+	} {
+		bad := baseConfig()
+		bad.Blocklists = []BlocklistC{b}
+		if err := ValidateConfig(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestValidateConfig_Bans(t *testing.T) {
+	c := baseConfig()
+	c.Bans = BansC{
+		Thresholds: BanThresholdsC{RateLimit: 20, AuthFailure: 5},
+		BanSeconds: 60,
+		Factor:     1.5,
+		Ignore:     []string{"10.0.0.0/8", "::1"},
+		StateFile:  "/var/lib/warden/bans.json",
+	}
+	if err := ValidateConfig(c); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, b := range map[string]BansC{
+		"negative threshold": {Thresholds: BanThresholdsC{DeniedQuery: -1}},
+		"negative window":    {WindowSeconds: -1},
+		"ban above max":      {BanSeconds: 600, MaxBanSeconds: 60},
+		"shrinking factor":   {Factor: 0.5},
+		"bad ignore":         {Ignore: []string{"10.0.0.0/33"}},
+	} {
+		bad := baseConfig()
+		bad.Bans = b
+		if err := ValidateConfig(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	next := c
+	next.Bans.Thresholds.AuthFailure = 3
+	next.Bans.StateFile = "/tmp/bans.json"
+	changes := Diff(c, next)
+	if len(changes) != 2 || !changes[0].Reloadable() || changes[1].Reloadable() {
+		t.Fatalf("expected thresholds to reload and state_file to need a restart, got %+v", changes)
+	}
+}
+
+func TestValidateConfig_AdminTokenOffLoopback(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:9187": true,
+		"[::1]:9187":     true,
+		"localhost:9187": true,
+		":9187":          false,
+		"0.0.0.0:9187":   false,
+		"10.0.0.5:9187":  false,
+	} {
+		c := baseConfig()
+		c.Admin = AdminC{Address: addr}
+		if err := ValidateConfig(c); (err == nil) != ok {
+			t.Errorf("%s without a token: expected ok=%v, got %v", addr, ok, err)
+		}
+		c.Admin.Token = "secret"
+		if err := ValidateConfig(c); err != nil {
+			t.Errorf("%s with a token: %v", addr, err)
+		}
+	}
+}
+
+func TestValidateConfig_Cluster(t *testing.T) {
+	c := baseConfig()
+	c.Cluster.Redis = RedisC{Address: "127.0.0.1:6379", Password: "secret"}
+	if err := ValidateConfig(c); err != nil || !c.Cluster.Enabled() {
+		t.Fatalf("expected a valid redis cluster, got %v", err)
+	}
+
+	both := c
+	both.Cluster.Peers = PeersC{Listen: "127.0.0.1:7946"}
+	noListen := baseConfig()
+	noListen.Cluster.Peers = PeersC{Addresses: []string{"10.0.0.2:7946"}}
+	badPeer := baseConfig()
+	badPeer.Cluster.Peers = PeersC{Listen: "127.0.0.1:7946", Addresses: []string{"10.0.0.2"}}
+	openPeers := baseConfig()
+	openPeers.Cluster.Peers = PeersC{Listen: "0.0.0.0:7946", Addresses: []string{"10.0.0.2:7946"}}
+	for name, bad := range map[string]Config{"redis and peers": both, "no listen": noListen, "bad peer": badPeer, "no token off loopback": openPeers} {
+		if err := ValidateConfig(bad); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	changed := c
+	changed.Cluster.Redis.Password = "other"
+	changes := Diff(c, changed)
+	if len(changes) != 1 || changes[0].Old != "<redacted>" || changes[0].Reloadable() {
+		t.Fatalf("expected a redacted change needing a restart, got %+v", changes)
+	}
+}
+
+func TestDiff_ReportsChangedSettings(t *testing.T) {
+	old := baseConfig()
+	old.Listeners = []ListenerC{{Name: "a"}}
+	new := old
+	new.Listeners = []ListenerC{{Name: "a", ConnectionLimit: 5}, {Name: "b"}}
+	new.RateLimiter.TokenBucketLimiter.Rate = 3
+	new.LocalAddress = "127.0.0.1:7000"
+	new.Admin.Token = "secret"
+
+	got := map[string]Change{}
+	for _, c := range Diff(old, new) {
+		got[c.Path] = c
+	}
+	want := map[string]bool{
+		"listeners[0].connection_limit":          true,
+		"listeners[1]":                           false,
+		"rate_limiter.token_bucket_limiter.rate": true,
+		"local_address":                          false,
+		"admin.token":                            false,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected changes %+v", got)
+	}
+	for path, reloadable := range want {
+		c, ok := got[path]
+		if !ok {
+			t.Fatalf("missing change %s in %+v", path, got)
+		}
+		if c.Reloadable() != reloadable {
+			t.Errorf("%s: expected reloadable=%v", path, reloadable)
+		}
+	}
+	if c := got["rate_limiter.token_bucket_limiter.rate"]; c.Old != "1" || c.New != "3" {
+		t.Fatalf("unexpected values %+v", c)
+	}
+	if c := got["admin.token"]; c.New != "<redacted>" {
+		t.Fatal("expected the token to be redacted")
+	}
+	if len(Diff(old, old)) != 0 {
+		t.Fatal("expected no changes against itself")
+	}
+}
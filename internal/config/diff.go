@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Change is one setting that differs between two configurations. Path
+// uses the yaml names, e.g. listeners[1].rate_limiter.token_bucket_limiter.rate.
+type Change struct {
+	Path     string
+	Old, New string
+}
+
+// secretFields are never printed in a diff.
+var secretFields = map[string]bool{"password": true, "token": true}
+
+// Diff lists the settings that differ between old and new.
+func Diff(old, new Config) []Change {
+	var changes []Change
+	diffValue(&changes, "", reflect.ValueOf(old), reflect.ValueOf(new), false)
+	return changes
+}
+
+func diffValue(changes *[]Change, path string, a, b reflect.Value, secret bool) {
+	switch {
+	case a.Kind() == reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if field.Anonymous && opts == "inline" {
+				diffValue(changes, path, a.Field(i), b.Field(i), false)
+				continue
+			}
+			if name == "" || name == "-" {
+				continue
+			}
+			diffValue(changes, join(path, name), a.Field(i), b.Field(i), secretFields[name])
+		}
+	case a.Kind() == reflect.Slice && a.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < max(a.Len(), b.Len()); i++ {
+			p := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= b.Len():
+				*changes = append(*changes, Change{Path: p, Old: "present", New: "removed"})
+			case i >= a.Len():
+				*changes = append(*changes, Change{Path: p, Old: "absent", New: "added"})
+			default:
+				diffValue(changes, p, a.Index(i), b.Index(i), false)
+			}
+		}
+	default:
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			return
+		}
+		old, new := show(a), show(b)
+		if secret {
+			old, new = "<redacted>", "<redacted>"
+		}
+		*changes = append(*changes, Change{Path: path, Old: old, New: new})
+	}
+}
+
+// show prints v, or what a pointer v points to.
+func show(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "unset"
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// reloadable are the settings a running firewall picks up without a
+// restart, by path prefix.
+var reloadable = []string{
+	"ip_allowlist", "ip_denylist", "blocklists",
+	"bans.thresholds", "bans.window_secs", "bans.ban_secs", "bans.max_ban_secs",
+	"bans.factor", "bans.reset_secs", "bans.ignore",
+	"connection_limit", "per_ip_connection_limit",
+	"rate_limiter", "subnet_rate_limiter", "global_rate_limiter",
+	"query_rate_limiter",
+	"rules", "injection",
+}
+
+// Reloadable reports whether the change takes effect on reload; anything
+// else needs a restart.
+func (c Change) Reloadable() bool {
+	path := c.Path
+	if strings.HasPrefix(path, "listeners[") {
+		_, rest, ok := strings.Cut(path, "].")
+		if !ok {
+			return false
+		}
+		path = rest
+	}
+	for _, r := range reloadable {
+		if path == r || strings.HasPrefix(path, r+".") || strings.HasPrefix(path, r+"[") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/logging"
+)
+
+const (
+	defaultRefresh = 5 * time.Minute
+	fetchTimeout   = 30 * time.Second
+	// maxFeedSize bounds what is read from a blocklist source.
+	maxFeedSize = 64 << 20
+)
+
+// Blocklists holds the deny lists of every configured feed, each swapped
+// in whole once a new version has been read, so lookups never see a list
+// half loaded. A feed that fails to refresh keeps its last good list.
+type Blocklists struct {
+	client *http.Client
+
+	mu    sync.Mutex // serialises Reload and Close
+	feeds atomic.Pointer[[]*feed]
+}
+
+type feed struct {
+	cfg   config.BlocklistC
+	name  string
+	every time.Duration
+	list  atomic.Pointer[Trie]
+
+	// only touched by update
+	loaded, pending source
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// source identifies a version of a feed's source: by the validators a
+// URL was served with, or a file's modification time and size.
+type source struct {
+	etag, lastModified string
+	modTime            time.Time
+	size               int64
+}
+
+// NewBlocklists loads the file feeds and starts refreshing every feed;
+// URL feeds are first fetched in the background, so an unreachable one
+// does not hold up startup.
+func NewBlocklists(cfgs []config.BlocklistC) (*Blocklists, error) {
+	b := &Blocklists{client: &http.Client{Timeout: fetchTimeout}}
+	b.feeds.Store(&[]*feed{})
+	if err := b.Reload(cfgs); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reload switches to the feeds of cfgs. Feeds whose configuration did not
+// change keep their list and refresh schedule; new file feeds are loaded
+// first, and if any of them fails nothing changes.
+func (b *Blocklists) Reload(cfgs []config.BlocklistC) error {
+	apply, err := b.Prepare(cfgs)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare loads the new file feeds of cfgs and returns a function that
+// switches to them, starting the new feeds and stopping the dropped ones.
+// Prepared feeds that are never switched to are simply discarded. Only
+// one Prepare may be outstanding at a time.
+func (b *Blocklists) Prepare(cfgs []config.BlocklistC) (func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	old := *b.feeds.Load()
+	kept := make(map[*feed]bool)
+	var next, started []*feed
+	for _, cfg := range cfgs {
+		if f := find(old, cfg, kept); f != nil {
+			kept[f] = true
+			next = append(next, f)
+			continue
+		}
+		f := newFeed(cfg)
+		if cfg.File != "" {
+			if err := b.update(f); err != nil {
+				return nil, fmt.Errorf("blocklist %s: %w", f.name, err)
+			}
+		}
+		next = append(next, f)
+		started = append(started, f)
+	}
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for _, f := range started {
+			f.wg.Add(1)
+			go b.refresh(f)
+		}
+		b.feeds.Store(&next)
+		for _, f := range old {
+			if !kept[f] {
+				f.stop()
+			}
+		}
+	}, nil
+}
+
+func find(feeds []*feed, cfg config.BlocklistC, taken map[*feed]bool) *feed {
+	for _, f := range feeds {
+		if f.cfg == cfg && !taken[f] {
+			return f
+		}
+	}
+	return nil
+}
+
+func newFeed(cfg config.BlocklistC) *feed {
+	f := &feed{cfg: cfg, name: cfg.Name, every: defaultRefresh, done: make(chan struct{})}
+	if f.name == "" {
+		f.name = cfg.File + cfg.URL
+	}
+	if cfg.RefreshSeconds > 0 {
+		f.every = time.Duration(cfg.RefreshSeconds) * time.Second
+	}
+	return f
+}
+
+// Contains reports whether ip is on any feed's list.
+func (b *Blocklists) Contains(ip net.IP) bool {
+	for _, f := range *b.feeds.Load() {
+		if l := f.list.Load(); l != nil && l.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops refreshing the feeds.
+func (b *Blocklists) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range *b.feeds.Load() {
+		f.stop()
+	}
+	b.feeds.Store(&[]*feed{})
+}
+
+func (f *feed) stop() {
+	close(f.done)
+	f.wg.Wait()
+}
+
+//--------refresh--------
+
+func (b *Blocklists) refresh(f *feed) {
+	defer f.wg.Done()
+	if f.cfg.URL != "" {
+		b.update(f)
+	}
+	t := time.NewTicker(f.every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			b.update(f)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// update reads the feed's source and swaps in the new list when it has
+// changed, logging the outcome.
+func (b *Blocklists) update(f *feed) error {
+	data, changed, err := b.read(f)
+	if err == nil && changed {
+		var list *Trie
+		var invalid int
+		if list, invalid, err = Parse(data); err == nil {
+			f.list.Store(list)
+			f.loaded = f.pending
+			logging.LogEvent("INFO", "blocklist_loaded", map[string]any{
+				"blocklist": f.name,
+				"entries":   list.Len(),
+				"invalid":   invalid,
+			})
+		}
+	}
+	f.pending = source{}
+	if err != nil {
+		fields := map[string]any{"blocklist": f.name, "error": err.Error()}
+		if l := f.list.Load(); l != nil {
+			fields["entries"] = l.Len()
+		}
+		logging.LogEvent("WARN", "blocklist_update_failed", fields)
+	}
+	return err
+}
+
+// read returns the source's content, or changed false when it is the
+// same as last loaded.
+func (b *Blocklists) read(f *feed) ([]byte, bool, error) {
+	if f.cfg.File != "" {
+		return f.readFile()
+	}
+	return b.fetch(f)
+}
+
+func (f *feed) readFile() ([]byte, bool, error) {
+	fi, err := os.Stat(f.cfg.File)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.list.Load() != nil && fi.ModTime().Equal(f.loaded.modTime) && fi.Size() == f.loaded.size {
+		return nil, false, nil
+	}
+	file, err := os.Open(f.cfg.File)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	data, err := readLimited(file)
+	if err != nil {
+		return nil, false, err
+	}
+	f.pending = source{modTime: fi.ModTime(), size: fi.Size()}
+	return data, true, nil
+}
+
+// fetch downloads the list, asking the server to answer 304 Not Modified
+// if it still serves the version last loaded.
+func (b *Blocklists) fetch(f *feed) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, f.cfg.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.list.Load() != nil {
+		if f.loaded.etag != "" {
+			req.Header.Set("If-None-Match", f.loaded.etag)
+		}
+		if f.loaded.lastModified != "" {
+			req.Header.Set("If-Modified-Since", f.loaded.lastModified)
+		}
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("server answered %s", resp.Status)
+	}
+	data, err := readLimited(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	f.pending = source{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified")}
+	return data, true, nil
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxFeedSize+1))
+	if err == nil && len(data) > maxFeedSize {
+		err = fmt.Errorf("larger than %d bytes", maxFeedSize)
+	}
+	return data, err
+}
+
+//--------parse--------
+
+// Parse reads a list of addresses and CIDR blocks, either as JSON (an
+// array of strings or of objects with an ip or cidr field) or as text,
+// one per line with anything after # or ; ignored. Entries that are not
+// addresses are counted as invalid and skipped; only malformed JSON is an
+// error.
+func Parse(data []byte) (*Trie, int, error) {
+	var entries []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, 0, fmt.Errorf("invalid json: %w", err)
+		}
+		for _, item := range items {
+			var s string
+			if json.Unmarshal(item, &s) != nil {
+				var obj struct {
+					IP   string `json:"ip"`
+					CIDR string `json:"cidr"`
+				}
+				json.Unmarshal(item, &obj)
+				s = cmp.Or(obj.CIDR, obj.IP)
+			}
+			entries = append(entries, s)
+		}
+	} else {
+		sc := bufio.NewScanner(bytes.NewReader(data))
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			line := sc.Text()
+			if i := strings.IndexAny(line, "#;"); i >= 0 {
+				line = line[:i]
+			}
+			if fields := strings.Fields(line); len(fields) > 0 {
+				entries = append(entries, fields[0])
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	t := &Trie{}
+	invalid := 0
+	for _, s := range entries {
+		n, err := config.ParseCIDR(s)
+		if err != nil {
+			invalid++
+			continue
+		}
+		t.Insert(n)
+	}
+	return t, invalid, nil
+}
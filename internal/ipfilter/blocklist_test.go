@@ -0,0 +1,207 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"database_firewall/internal/config"
+)
+
+/*
+-------------------------------------------------
+Test: text lists with comments and JSON lists of
+strings or objects are read, bad entries skipped
+-------------------------------------------------
+*/
+func TestParse_TextAndJSON(t *testing.T) {
+	cases := map[string]struct {
+		data    string
+		want    []string
+		invalid int
+	}{
+		"text": {
+			data:    "; feed header\n192.0.2.0/24 ; SBL1\n\n  198.51.100.7   # scanner\nnot-an-ip\n2001:db8::/32\n",
+			want:    []string{"192.0.2.9", "198.51.100.7", "2001:db8::1"},
+			invalid: 1,
+		},
+		"json strings": {
+			data:    ` ["192.0.2.0/24", "198.51.100.7", 42]`,
+			want:    []string{"192.0.2.9", "198.51.100.7"},
+			invalid: 1,
+		},
+		"json objects": {
+			data: `[{"cidr": "192.0.2.0/24", "source": "x"}, {"ip": "198.51.100.7"}]`,
+			want: []string{"192.0.2.9", "198.51.100.7"},
+		},
+	}
+	for name, c := range cases {
+		list, invalid, err := Parse([]byte(c.data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if invalid != c.invalid || list.Len() != len(c.want) {
+			t.Fatalf("%s: expected %d entries and %d invalid, got %d and %d", name, len(c.want), c.invalid, list.Len(), invalid)
+		}
+		for _, ip := range c.want {
+			if !list.Contains(net.ParseIP(ip)) {
+				t.Fatalf("%s: expected %s to be listed", name, ip)
+			}
+		}
+	}
+	if _, _, err := Parse([]byte(`["192.0.2.1",`)); err == nil {
+		t.Fatal("expected malformed JSON to be an error")
+	}
+}
+
+// feedServer is a local stand-in for a threat intel feed, answering
+// conditional requests for the version it serves with 304.
+type feedServer struct {
+	mu          sync.Mutex
+	body        string
+	version     int
+	status      int
+	full        int
+	notModified int
+}
+
+func (s *feedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	etag := fmt.Sprintf(`"v%d"`, s.version)
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.full++
+	w.Header().Set("ETag", etag)
+	fmt.Fprint(w, s.body)
+}
+
+func (s *feedServer) publish(body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.version = body, s.version+1
+}
+
+func (s *feedServer) fail(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *feedServer) served() (full, notModified int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.full, s.notModified
+}
+
+func expectListed(t *testing.T, b *Blocklists, ip string, want bool) {
+	t.Helper()
+	if got := b.Contains(net.ParseIP(ip)); got != want {
+		t.Fatalf("%s: expected listed=%v, got %v", ip, want, got)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: a URL feed is refetched only when it changed
+and keeps its list when the server fails
+-------------------------------------------------
+*/
+func TestBlocklists_FetchesWithETag(t *testing.T) {
+	fs := &feedServer{}
+	fs.publish("192.0.2.0/24\n")
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	// driven by hand rather than by the refresh loop
+	b := &Blocklists{client: srv.Client()}
+	f := newFeed(config.BlocklistC{URL: srv.URL + "/drop.txt"})
+	b.feeds.Store(&[]*feed{f})
+
+	if err := b.update(f); err != nil {
+		t.Fatal(err)
+	}
+	expectListed(t, b, "192.0.2.1", true)
+	if err := b.update(f); err != nil {
+		t.Fatal(err)
+	}
+	if full, notModified := fs.served(); full != 1 || notModified != 1 {
+		t.Fatalf("expected one download and one 304, got %d and %d", full, notModified)
+	}
+
+	fs.publish(`["198.51.100.0/24"]`)
+	if err := b.update(f); err != nil {
+		t.Fatal(err)
+	}
+	expectListed(t, b, "192.0.2.1", false)
+	expectListed(t, b, "198.51.100.1", true)
+
+	fs.fail(http.StatusServiceUnavailable)
+	if err := b.update(f); err == nil {
+		t.Fatal("expected a failed fetch to be an error")
+	}
+	expectListed(t, b, "198.51.100.1", true)
+}
+
+/*
+-------------------------------------------------
+Test: file feeds load at start, pick up changes,
+and reload keeps the lists when a file is missing
+-------------------------------------------------
+*/
+func TestBlocklists_FileFeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfgs := []config.BlocklistC{{Name: "local", File: path}}
+	b, err := NewBlocklists(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	expectListed(t, b, "203.0.113.5", true)
+
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\n192.0.2.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.update((*b.feeds.Load())[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectListed(t, b, "192.0.2.1", true)
+
+	missing := append(cfgs, config.BlocklistC{File: path + ".missing"})
+	if err := b.Reload(missing); err == nil {
+		t.Fatal("expected a missing file to fail the reload")
+	}
+	expectListed(t, b, "192.0.2.1", true)
+
+	if err := b.Reload(nil); err != nil {
+		t.Fatal(err)
+	}
+	expectListed(t, b, "192.0.2.1", false)
+
+	f, err := New(&config.IPFilterConfig{Allow: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetBlocklists(b)
+	if err := b.Reload(cfgs); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Check(net.ParseIP("192.0.2.1")); got != ReasonBlocklisted {
+		t.Fatalf("expected a blocklisted address to be rejected even when allowed, got %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"database_firewall/internal/config"
+)
+
+// Reasons a connection is rejected with by a Filter.
+const (
+	ReasonDenied      = "ip_denied"
+	ReasonBlocklisted = "ip_blocklisted"
+	ReasonNotAllowed  = "ip_not_allowed"
+)
+
+// Filter decides which client addresses may connect at all. Addresses on
+// the denylist or a blocklist are rejected; with a non-empty allowlist,
+// so is every address not on it. The deny lists win where they overlap
+// the allowlist. Reload swaps both static lists atomically.
+type Filter struct {
+	lists      atomic.Pointer[lists]
+	blocklists *Blocklists
+}
+
+type lists struct {
+	allow, deny *Trie
+}
+
+func New(cfg *config.IPFilterConfig) (*Filter, error) {
+	f := &Filter{}
+	if err := f.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload replaces the lists. On error the current ones stay in place.
+func (f *Filter) Reload(cfg *config.IPFilterConfig) error {
+	apply, err := f.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare parses the lists of cfg and returns a function that puts them in
+// place.
+func (f *Filter) Prepare(cfg *config.IPFilterConfig) (func(), error) {
+	allow, err := build(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("ip_allowlist: %w", err)
+	}
+	deny, err := build(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("ip_denylist: %w", err)
+	}
+	return func() { f.lists.Store(&lists{allow: allow, deny: deny}) }, nil
+}
+
+func build(entries []string) (*Trie, error) {
+	t := &Trie{}
+	for _, s := range entries {
+		n, err := config.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		t.Insert(n)
+	}
+	return t, nil
+}
+
+// SetBlocklists rejects the addresses on b as well. It must be called
+// before Check.
+func (f *Filter) SetBlocklists(b *Blocklists) {
+	f.blocklists = b
+}
+
+// Check returns the reason ip is rejected for, or "" when it may connect.
+func (f *Filter) Check(ip net.IP) string {
+	l := f.lists.Load()
+	switch {
+	case l.deny.Contains(ip):
+		return ReasonDenied
+	case f.blocklists != nil && f.blocklists.Contains(ip):
+		return ReasonBlocklisted
+	case l.allow.Len() > 0 && !l.allow.Contains(ip):
+		return ReasonNotAllowed
+	}
+	return ""
+}
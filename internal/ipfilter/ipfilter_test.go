@@ -0,0 +1,143 @@
+package ipfilter
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"database_firewall/internal/config"
+)
+
+func trieOf(t *testing.T, entries ...string) *Trie {
+	t.Helper()
+	tr, err := build(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+/*
+-------------------------------------------------
+Test: lookups match IPv4 and IPv6 networks of any
+length, including nested and sibling prefixes
+-------------------------------------------------
+*/
+func TestTrie_Contains(t *testing.T) {
+	tr := trieOf(t, "10.0.0.0/8", "192.168.1.0/24", "192.168.2.7", "2001:db8::/32", "2001:db8:1::/48", "::1")
+
+	cases := map[string]bool{
+		"10.255.0.1":       true,
+		"11.0.0.1":         false,
+		"192.168.1.200":    true,
+		"192.168.2.7":      true,
+		"192.168.2.8":      false,
+		"192.168.0.1":      false,
+		"::ffff:10.1.2.3":  true,
+		"2001:db8:ffff::1": true,
+		"2001:db9::1":      false,
+		"::1":              true,
+		"::2":              false,
+	}
+	for ip, want := range cases {
+		if got := tr.Contains(net.ParseIP(ip)); got != want {
+			t.Errorf("%s: expected %v, got %v", ip, want, got)
+		}
+	}
+	if tr.Contains(nil) {
+		t.Error("expected a nil address to match nothing")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: covered networks are not stored and a
+covering network replaces them
+-------------------------------------------------
+*/
+func TestTrie_CoveredNetworks(t *testing.T) {
+	tr := trieOf(t, "10.1.0.0/16", "10.2.3.0/24", "10.2.4.0/24", "10.1.2.0/24")
+	if tr.Len() != 3 {
+		t.Fatalf("expected the /24 inside the /16 to be dropped, got %d networks", tr.Len())
+	}
+	tr.Insert(&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)})
+	if tr.Len() != 1 || !tr.Contains(net.ParseIP("10.200.0.1")) {
+		t.Fatalf("expected the /8 to replace everything, got %d networks", tr.Len())
+	}
+	if all := trieOf(t, "0.0.0.0/0"); !all.Contains(net.ParseIP("203.0.113.9")) || all.Contains(net.ParseIP("2001:db8::1")) {
+		t.Fatal("expected 0.0.0.0/0 to match every IPv4 address and no IPv6 one")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: random networks agree with a linear scan
+-------------------------------------------------
+*/
+func TestTrie_MatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func() net.IP {
+		// a small address space so networks overlap
+		return net.IPv4(10, byte(rng.Intn(4)), byte(rng.Intn(256)), byte(rng.Intn(256)))
+	}
+	tr := &Trie{}
+	var nets []*net.IPNet
+	for range 2000 {
+		n := &net.IPNet{IP: random(), Mask: net.CIDRMask(12+rng.Intn(21), 32)}
+		n.IP = n.IP.Mask(n.Mask)
+		nets = append(nets, n)
+		tr.Insert(n)
+	}
+	for range 20000 {
+		ip := random()
+		want := false
+		for _, n := range nets {
+			if n.Contains(ip) {
+				want = true
+				break
+			}
+		}
+		if got := tr.Contains(ip); got != want {
+			t.Fatalf("%s: expected %v, got %v", ip, want, got)
+		}
+	}
+}
+
+/*
+-------------------------------------------------
+Test: the denylist wins, a non-empty allowlist
+admits nothing else, and reload swaps both
+-------------------------------------------------
+*/
+func TestFilter_Check(t *testing.T) {
+	cfg := &config.IPFilterConfig{
+		Allow: []string{"10.0.0.0/8"},
+		Deny:  []string{"10.6.6.0/24", "203.0.113.0/24"},
+	}
+	f, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(ip, want string) {
+		t.Helper()
+		if got := f.Check(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s: expected %q, got %q", ip, want, got)
+		}
+	}
+	check("10.1.1.1", "")
+	check("10.6.6.6", ReasonDenied)
+	check("203.0.113.9", ReasonDenied)
+	check("192.0.2.1", ReasonNotAllowed)
+
+	cfg.Allow = nil
+	if err := f.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	check("192.0.2.1", "")
+	check("10.6.6.6", ReasonDenied)
+
+	if err := f.Reload(&config.IPFilterConfig{Deny: []string{"not-an-ip"}}); err == nil {
+		t.Fatal("expected an invalid entry to fail the reload")
+	}
+	check("10.6.6.6", ReasonDenied)
+}
@@ -0,0 +1,135 @@
+package ipfilter
+
+import (
+	"math/bits"
+	"net"
+)
+
+// Trie is a set of networks answering whether an address falls in any of
+// them. It is a binary trie over 128 bit addresses, IPv4 ones mapped into
+// ::ffff:0:0/96, with single child chains collapsed into one node, so
+// lookups take at most one step per distinct prefix on the path and
+// memory grows with the number of networks rather than their length. It
+// is not safe for concurrent writes; a Trie that is no longer modified
+// may be read from any number of goroutines.
+type Trie struct {
+	root *node
+	size int
+}
+
+type node struct {
+	key   [16]byte // bits past prefix are zero
+	bits  int
+	end   bool // key/bits itself is in the set
+	child [2]*node
+}
+
+// key returns n as a 128 bit prefix.
+func key(n *net.IPNet) ([16]byte, int) {
+	var k [16]byte
+	ones, size := n.Mask.Size()
+	copy(k[:], n.IP.Mask(n.Mask).To16())
+	if size == 8*net.IPv4len {
+		ones += 96
+	}
+	return k, ones
+}
+
+func bit(k [16]byte, i int) int {
+	return int(k[i/8]>>(7-i%8)) & 1
+}
+
+// common returns the length of the prefix a and b share, up to limit bits.
+func common(a, b [16]byte, limit int) int {
+	for i := 0; i < 16 && 8*i < limit; i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return min(8*i+bits.LeadingZeros8(x), limit)
+		}
+	}
+	return limit
+}
+
+// truncate zeroes the bits of k past n.
+func truncate(k [16]byte, n int) [16]byte {
+	for i := range k {
+		switch {
+		case 8*i >= n:
+			k[i] = 0
+		case 8*(i+1) > n:
+			k[i] &= ^byte(0) << (8 - n%8)
+		}
+	}
+	return k
+}
+
+// Insert adds n to the set. A network inside one already present is
+// covered by it and not stored; one covering networks already present
+// replaces them.
+func (t *Trie) Insert(n *net.IPNet) {
+	k, length := key(n)
+	p := &t.root
+	for {
+		cur := *p
+		if cur == nil {
+			*p = &node{key: k, bits: length, end: true}
+			t.size++
+			return
+		}
+		c := common(cur.key, k, min(cur.bits, length))
+		switch {
+		case c == length:
+			t.size -= cur.count()
+			*p = &node{key: k, bits: length, end: true}
+			t.size++
+			return
+		case c == cur.bits && cur.end:
+			return
+		case c == cur.bits:
+			p = &cur.child[bit(k, cur.bits)]
+			continue
+		}
+
+		// k branches off inside cur's prefix
+		split := &node{key: truncate(k, c), bits: c}
+		split.child[bit(cur.key, c)] = cur
+		split.child[bit(k, c)] = &node{key: k, bits: length, end: true}
+		*p = split
+		t.size++
+		return
+	}
+}
+
+// count returns the networks stored under n.
+func (n *node) count() int {
+	if n == nil {
+		return 0
+	}
+	if n.end {
+		return 1
+	}
+	return n.child[0].count() + n.child[1].count()
+}
+
+// Contains reports whether ip is in any network of the set.
+func (t *Trie) Contains(ip net.IP) bool {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false
+	}
+	k := [16]byte(ip16)
+	for n := t.root; n != nil; {
+		if common(n.key, k, n.bits) < n.bits {
+			return false
+		}
+		if n.end {
+			return true
+		}
+		n = n.child[bit(k, n.bits)]
+	}
+	return false
+}
+
+// Len returns the number of networks stored.
+func (t *Trie) Len() int {
+	return t.size
+}
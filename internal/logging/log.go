@@ -36,6 +36,8 @@ func formatValue(v any) string {
 		return quoteIfNeeded(t)
 	case int, int64, uint64, bool:
 		return fmt.Sprint(t)
+	case []string:
+		return quoteIfNeeded(strings.Join(t, ","))
 	default:
 		return quoteIfNeeded(fmt.Sprint(t))
 	}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+-------------------------------------------------
+Test: counters, gauges and histograms are written
+in the Prometheus text format
+-------------------------------------------------
+*/
+func TestRegistry_WritesTextFormat(t *testing.T) {
+	r := NewRegistry()
+	rejected := r.Counter("rejected_total", "Rejected connections.", "listener", "reason")
+	rejected.With("b", "rate_limit").Add(2)
+	rejected.With("a", "per_ip_limit").Inc()
+	r.Counter("rejected_total", "ignored", "listener", "reason").With("a", "per_ip_limit").Inc()
+	rejected.Func(func() uint64 { return 7 }, "c", "rate_limit_global")
+	r.Gauge("active", "Active connections.", "listener").Func(func() float64 { return 3 }, `we"ird`)
+	h := r.Histogram("duration_seconds", "Durations.", []float64{0.5, 1})
+	h.With().Observe(0.2)
+	h.With().Observe(0.7)
+	h.With().Observe(5)
+	r.Counter("unused_total", "Never touched.")
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP rejected_total Rejected connections.
+# TYPE rejected_total counter
+rejected_total{listener="a",reason="per_ip_limit"} 2
+rejected_total{listener="b",reason="rate_limit"} 2
+rejected_total{listener="c",reason="rate_limit_global"} 7
+# HELP active Active connections.
+# TYPE active gauge
+active{listener="we\"ird"} 3
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.5"} 1
+duration_seconds_bucket{le="1"} 2
+duration_seconds_bucket{le="+Inf"} 3
+duration_seconds_sum 5.9
+duration_seconds_count 3
+`
+	if b.String() != want {
+		t.Fatalf("unexpected exposition:\n%s", b.String())
+	}
+}
+
+func TestNilInstrumentsIgnoreUpdates(t *testing.T) {
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	c.Inc()
+	g.Add(1)
+	h.Observe(1)
+	if c.Value() != 0 || g.Value() != 0 || h.Count() != 0 {
+		t.Fatal("expected nil instruments to stay at zero")
+	}
+}
@@ -0,0 +1,670 @@
+package mysql
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/tlsconfig/tlstest"
+)
+
+/*
+-------------------------------------------------
+Helpers
+-------------------------------------------------
+*/
+
+const testCaps = ClientProtocol41 | ClientSecureConnection | ClientPluginAuth |
+	ClientConnectWithDB | ClientTransactions | ClientCompress | ClientQueryAttributes
+
+func handshakePayload(caps uint32) []byte {
+	p := []byte{10}
+	p = append(p, "8.0.36\x00"...)
+	p = binary.LittleEndian.AppendUint32(p, 42)
+	p = append(p, "abcdefgh"...)
+	p = append(p, 0)
+	p = binary.LittleEndian.AppendUint16(p, uint16(caps))
+	p = append(p, 0x21)
+	p = binary.LittleEndian.AppendUint16(p, StatusAutocommit)
+	p = binary.LittleEndian.AppendUint16(p, uint16(caps>>16))
+	p = append(p, 21)
+	p = append(p, make([]byte, 10)...)
+	p = append(p, "ijklmnopqrst\x00"...)
+	return append(p, "mysql_native_password\x00"...)
+}
+
+func handshakeResponsePayload(caps uint32, user, db string) []byte {
+	p := binary.LittleEndian.AppendUint32(nil, caps)
+	p = binary.LittleEndian.AppendUint32(p, 1<<24)
+	p = append(p, 0x21)
+	p = append(p, make([]byte, 23)...)
+	p = append(p, user...)
+	p = append(p, 0, 20)
+	p = append(p, make([]byte, 20)...)
+	p = append(p, db...)
+	p = append(p, 0)
+	return append(p, "mysql_native_password\x00"...)
+}
+
+func okPayload(status uint16) []byte {
+	p := []byte{headerOK, 0, 0}
+	p = binary.LittleEndian.AppendUint16(p, status)
+	return binary.LittleEndian.AppendUint16(p, 0)
+}
+
+func eofPayload(status uint16) []byte {
+	p := []byte{headerEOF, 0, 0}
+	return binary.LittleEndian.AppendUint16(p, status)
+}
+
+type harness struct {
+	t                      *testing.T
+	client, server         net.Conn
+	proxyClient, proxyServ net.Conn
+	session                *Session
+}
+
+func newHarness(t *testing.T, hook protocol.Hook) *harness {
+	t.Helper()
+	h := &harness{t: t, session: NewSession(protocol.Info{ClientIP: net.ParseIP("10.0.0.1")}, hook)}
+	h.client, h.proxyClient = net.Pipe()
+	h.proxyServ, h.server = net.Pipe()
+	for _, c := range []net.Conn{h.client, h.server, h.proxyClient, h.proxyServ} {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+	}
+	t.Cleanup(func() {
+		h.client.Close()
+		h.server.Close()
+		h.proxyClient.Close()
+		h.proxyServ.Close()
+	})
+	return h
+}
+
+func (h *harness) send(c net.Conn, seq byte, payload []byte) {
+	go c.Write(EncodePacket(seq, payload))
+}
+
+func (h *harness) recv(c net.Conn) Packet {
+	h.t.Helper()
+	p, err := ReadPacket(c)
+	if err != nil {
+		h.t.Fatalf("read packet: %v", err)
+	}
+	return p
+}
+
+// login runs the handshake through the session and starts both loops.
+func (h *harness) login(caps uint32) {
+	h.t.Helper()
+	h.handshake(caps)
+	h.send(h.server, 2, okPayload(StatusAutocommit))
+	h.recv(h.client)
+}
+
+// handshake relays the greeting and the client's response and starts both
+// loops, leaving the server's answer to the caller.
+func (h *harness) handshake(caps uint32) {
+	h.t.Helper()
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := h.session.Startup(h.proxyClient, h.proxyServ)
+		errc <- err
+	}()
+
+	h.send(h.server, 0, handshakePayload(caps))
+	greeting := h.recv(h.client)
+	hs, err := ParseHandshake(greeting.Payload())
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if hs.Capabilities&strippedCapabilities != 0 {
+		h.t.Fatalf("greeting still advertises stripped capabilities: %x", hs.Capabilities)
+	}
+
+	h.send(h.client, 1, handshakeResponsePayload(caps&^strippedCapabilities, "alice", "shop"))
+	h.recv(h.server)
+	if err := <-errc; err != nil {
+		h.t.Fatal(err)
+	}
+
+	go h.session.ClientToServer(h.proxyClient, h.proxyServ)
+	go h.session.ServerToClient(h.proxyServ, h.proxyClient)
+}
+
+/*
+-------------------------------------------------
+Test: decoding
+-------------------------------------------------
+*/
+func TestParseHandshake_SetCapabilitiesInPlace(t *testing.T) {
+	payload := handshakePayload(testCaps)
+	orig := append([]byte(nil), payload...)
+
+	h, err := ParseHandshake(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ServerVersion != "8.0.36" || h.ConnectionID != 42 || h.AuthPlugin != "mysql_native_password" {
+		t.Fatalf("unexpected handshake: %+v", h)
+	}
+	if string(h.AuthData) != "abcdefghijklmnopqrst" {
+		t.Fatalf("unexpected auth data %q", h.AuthData)
+	}
+
+	h.SetCapabilities(payload, testCaps&^ClientCompress)
+	again, err := ParseHandshake(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Capabilities != testCaps&^ClientCompress {
+		t.Fatalf("capabilities not rewritten: %x", again.Capabilities)
+	}
+	diff := 0
+	for i := range payload {
+		if payload[i] != orig[i] {
+			diff++
+		}
+	}
+	if diff != 1 {
+		t.Fatalf("expected exactly one byte to change, got %d", diff)
+	}
+}
+
+func TestParseHandshakeResponse(t *testing.T) {
+	r, err := ParseHandshakeResponse(handshakeResponsePayload(testCaps, "alice", "shop"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.User != "alice" || r.Database != "shop" || len(r.AuthResponse) != 20 || r.AuthPlugin != "mysql_native_password" {
+		t.Fatalf("unexpected response: %+v", r)
+	}
+}
+
+func TestERR_RoundTrip(t *testing.T) {
+	in := &ERR{Code: 1227, SQLState: "42000", Message: "denied"}
+	out, err := ParseERR(in.Encode(ClientProtocol41), ClientProtocol41)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *out != *in {
+		t.Fatalf("round trip mismatch: %+v != %+v", out, in)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: session tracking
+-------------------------------------------------
+*/
+func TestSession_QueryAttributionAndTransactionStatus(t *testing.T) {
+	var seen []*protocol.Statement
+	h := newHarness(t, protocol.HookFunc(func(st *protocol.Statement) error {
+		seen = append(seen, st)
+		return nil
+	}))
+	h.login(testCaps)
+	if !h.session.Idle() {
+		t.Fatal("expected session to be idle after login")
+	}
+
+	query := append([]byte{ComQuery}, "SELECT id FROM orders"...)
+	h.send(h.client, 0, query)
+	if got := h.recv(h.server); !bytes.Equal(got.Payload(), query) {
+		t.Fatal("query modified in transit")
+	}
+	if h.session.Idle() {
+		t.Fatal("expected session with a query in flight not to be idle")
+	}
+	if len(seen) != 1 || seen[0].User != "alice" || seen[0].Database != "shop" || seen[0].Text != "SELECT id FROM orders" {
+		t.Fatalf("unexpected statements: %+v", seen)
+	}
+
+	// one column result set, ending with an EOF that reports an open transaction
+	for i, p := range [][]byte{{1}, []byte("coldef"), eofPayload(0), {1, '7'}, eofPayload(StatusInTrans)} {
+		h.send(h.server, byte(i+1), p)
+		h.recv(h.client)
+	}
+	if !h.session.InTransaction() || h.session.Idle() {
+		t.Fatal("expected transaction status from final EOF")
+	}
+
+	// prepared statement ids are attributed back to their text
+	h.send(h.client, 0, append([]byte{ComStmtPrepare}, "DELETE FROM orders WHERE id = ?"...))
+	h.recv(h.server)
+	prepOK := []byte{headerOK}
+	prepOK = binary.LittleEndian.AppendUint32(prepOK, 7)
+	prepOK = append(prepOK, 0, 0, 1, 0, 0, 0, 0)
+	for i, p := range [][]byte{prepOK, []byte("paramdef"), eofPayload(StatusInTrans)} {
+		h.send(h.server, byte(i+1), p)
+		h.recv(h.client)
+	}
+
+	exec := []byte{ComStmtExecute}
+	exec = binary.LittleEndian.AppendUint32(exec, 7)
+	exec = append(exec, 0, 1, 0, 0, 0)
+	h.send(h.client, 0, exec)
+	h.recv(h.server)
+
+	last := seen[len(seen)-1]
+	if last.Kind != protocol.KindExecute || last.Text != "DELETE FROM orders WHERE id = ?" {
+		t.Fatalf("execute not attributed to prepared text: %+v", last)
+	}
+}
+
+func TestSession_CursorFetch(t *testing.T) {
+	h := newHarness(t, nil)
+	h.login(testCaps)
+
+	h.send(h.client, 0, append([]byte{ComStmtPrepare}, "SELECT a, b, c, d, e, f FROM t"...))
+	h.recv(h.server)
+	prepOK := []byte{headerOK}
+	prepOK = binary.LittleEndian.AppendUint32(prepOK, 7)
+	prepOK = append(prepOK, 1, 0, 0, 0, 0, 0, 0)
+	for i, p := range [][]byte{prepOK, []byte("coldef"), eofPayload(StatusAutocommit)} {
+		h.send(h.server, byte(i+1), p)
+		h.recv(h.client)
+	}
+
+	// executing with a read-only cursor answers with the columns only
+	exec := []byte{ComStmtExecute}
+	exec = binary.LittleEndian.AppendUint32(exec, 7)
+	exec = append(exec, 1, 1, 0, 0, 0)
+	h.send(h.client, 0, exec)
+	h.recv(h.server)
+	for i, p := range [][]byte{{1}, []byte("coldef"), eofPayload(StatusAutocommit | StatusCursorExists)} {
+		h.send(h.server, byte(i+1), p)
+		h.recv(h.client)
+	}
+	if !h.session.Idle() {
+		t.Fatal("expected the execute response to have ended")
+	}
+
+	// binary rows start with 0x00, and a null bitmap may look like a
+	// length-encoded NULL or an ERR
+	fetch := []byte{ComStmtFetch}
+	fetch = binary.LittleEndian.AppendUint32(fetch, 7)
+	fetch = binary.LittleEndian.AppendUint32(fetch, 2)
+	h.send(h.client, 0, fetch)
+	h.recv(h.server)
+	for i, p := range [][]byte{{0x00, 0xfb}, {0x00, 0xff}, eofPayload(StatusAutocommit | StatusCursorExists)} {
+		h.send(h.server, byte(i+1), p)
+		h.recv(h.client)
+	}
+	if !h.session.Idle() || h.session.InTransaction() {
+		t.Fatal("expected the fetch response to have ended")
+	}
+}
+
+func TestSession_RejectsOutOfOrderSequence(t *testing.T) {
+	h := newHarness(t, nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := h.session.Startup(h.proxyClient, h.proxyServ)
+		errc <- err
+	}()
+
+	h.send(h.server, 0, handshakePayload(testCaps))
+	h.recv(h.client)
+	h.send(h.client, 5, handshakeResponsePayload(testCaps, "alice", ""))
+
+	if err := <-errc; err == nil {
+		t.Fatal("expected sequence error")
+	}
+}
+
+func sslRequestPayload(caps uint32) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, caps|ClientSSL), make([]byte, 28)...)
+}
+
+func TestSession_SSLNotOfferedWithoutClientTLS(t *testing.T) {
+	h := newHarness(t, nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := h.session.Startup(h.proxyClient, h.proxyServ)
+		errc <- err
+	}()
+
+	h.send(h.server, 0, handshakePayload(testCaps|ClientSSL))
+	hs, err := ParseHandshake(h.recv(h.client).Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Capabilities&ClientSSL != 0 {
+		t.Fatal("expected CLIENT_SSL to be hidden without client TLS")
+	}
+
+	h.send(h.client, 1, sslRequestPayload(testCaps))
+	if err := <-errc; err == nil {
+		t.Fatal("expected error for SSLRequest that was not offered")
+	}
+}
+
+func TestSession_TerminatesClientTLSInBand(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	cert := ca.Issue(t, "firewall", "firewall")
+	h := newHarness(t, nil)
+	h.session.SetTLS(protocol.TLS{Client: &tls.Config{Certificates: []tls.Certificate{cert.TLS}}})
+
+	type result struct {
+		client net.Conn
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, _, err := h.session.Startup(h.proxyClient, h.proxyServ)
+		done <- result{client, err}
+	}()
+
+	h.send(h.server, 0, handshakePayload(testCaps))
+	hs, err := ParseHandshake(h.recv(h.client).Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs.Capabilities&ClientSSL == 0 {
+		t.Fatal("expected CLIENT_SSL to be offered with client TLS")
+	}
+
+	caps := uint32(testCaps&^strippedCapabilities) | ClientSSL
+	// written synchronously so the TLS handshake cannot overtake it
+	if _, err := h.client.Write(EncodePacket(1, sslRequestPayload(caps))); err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Client(h.client, &tls.Config{RootCAs: ca.Pool, ServerName: "firewall"})
+	h.send(tc, 2, handshakeResponsePayload(caps, "alice", "shop"))
+
+	resp := h.recv(h.server)
+	if resp.Seq() != 1 {
+		t.Fatalf("expected response renumbered to 1 upstream, got %d", resp.Seq())
+	}
+	r, err := ParseHandshakeResponse(resp.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Capabilities&ClientSSL != 0 || r.User != "alice" {
+		t.Fatalf("unexpected upstream response: %+v", r)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if _, ok := res.client.(*tls.Conn); !ok {
+		t.Fatalf("expected Startup to return the TLS client connection, got %T", res.client)
+	}
+
+	go h.session.ClientToServer(res.client, h.proxyServ)
+	go h.session.ServerToClient(h.proxyServ, res.client)
+
+	h.send(h.server, 2, okPayload(StatusAutocommit))
+	if ok := h.recv(tc); ok.Seq() != 3 {
+		t.Fatalf("expected auth OK renumbered to 3 for the client, got %d", ok.Seq())
+	}
+
+	query := append([]byte{ComQuery}, "SELECT 1"...)
+	h.send(tc, 0, query)
+	if got := h.recv(h.server); got.Seq() != 0 || !bytes.Equal(got.Payload(), query) {
+		t.Fatalf("expected query forwarded unchanged, got seq %d %q", got.Seq(), got.Payload())
+	}
+}
+
+func TestSession_OriginatesUpstreamTLSInBand(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	cert := ca.Issue(t, "db", "db")
+	h := newHarness(t, nil)
+	h.session.SetTLS(protocol.TLS{Upstream: &tls.Config{RootCAs: ca.Pool, ServerName: "db"}})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := h.session.Startup(h.proxyClient, h.proxyServ)
+		errc <- err
+	}()
+
+	h.send(h.server, 0, handshakePayload(testCaps|ClientSSL))
+	h.recv(h.client)
+	caps := uint32(testCaps &^ strippedCapabilities)
+	h.send(h.client, 1, handshakeResponsePayload(caps, "alice", "shop"))
+
+	ssl := h.recv(h.server)
+	if ssl.Seq() != 1 || !IsSSLRequest(ssl.Payload()) {
+		t.Fatalf("expected SSLRequest upstream, got seq %d %x", ssl.Seq(), ssl.Payload())
+	}
+	tc := tls.Server(h.server, &tls.Config{Certificates: []tls.Certificate{cert.TLS}})
+	resp := h.recv(tc)
+	if resp.Seq() != 2 {
+		t.Fatalf("expected response renumbered to 2 upstream, got %d", resp.Seq())
+	}
+	if r, err := ParseHandshakeResponse(resp.Payload()); err != nil || r.Capabilities&ClientSSL == 0 {
+		t.Fatalf("expected CLIENT_SSL in upstream response, got %+v %v", r, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDenyResponse_RateLimitedCode(t *testing.T) {
+	e := DenyResponse(&protocol.DenyError{Reason: "rate_limit_query_user", Message: "slow down", Limited: true})
+	if e.Code != 1226 || e.SQLState != "42000" || e.Message != "slow down" {
+		t.Fatalf("expected ER_USER_LIMIT_REACHED, got %+v", e)
+	}
+}
+
+func TestSession_AuthFailed(t *testing.T) {
+	for _, e := range []*ERR{
+		{Code: 1045, SQLState: "28000", Message: "Access denied for user 'alice'"},
+		{Code: 1040, SQLState: "08004", Message: "Too many connections"},
+	} {
+		h := newHarness(t, nil)
+		h.handshake(testCaps)
+		h.send(h.server, 2, e.Encode(testCaps))
+		h.recv(h.client)
+		if got, want := h.session.AuthFailed(), e.Code == 1045; got != want {
+			t.Fatalf("error %d: expected AuthFailed %v, got %v", e.Code, want, got)
+		}
+	}
+}
+
+func TestSession_DeniedCommandAnsweredWithERR(t *testing.T) {
+	h := newHarness(t, protocol.HookFunc(func(st *protocol.Statement) error {
+		if st.Text == "DROP TABLE orders" {
+			return &protocol.DenyError{Reason: "test", Message: "nope"}
+		}
+		return nil
+	}))
+	h.login(testCaps)
+
+	h.send(h.client, 0, append([]byte{ComQuery}, "DROP TABLE orders"...))
+	resp := h.recv(h.client)
+	if resp.Seq() != 1 {
+		t.Fatalf("expected ERR with sequence 1, got %d", resp.Seq())
+	}
+	e, err := ParseERR(resp.Payload(), testCaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != 1227 || e.SQLState != "42000" || e.Message != "nope" {
+		t.Fatalf("unexpected ERR: %+v", e)
+	}
+
+	// the session keeps going and the next command reaches the server
+	ping := []byte{0x0e}
+	h.send(h.client, 0, ping)
+	if got := h.recv(h.server); !bytes.Equal(got.Payload(), ping) {
+		t.Fatalf("expected ping upstream, got %x", got.Payload())
+	}
+}
+
+/*
+-------------------------------------------------
+Test: server packets are streamed whatever their
+size, and client payloads are bounded before login
+-------------------------------------------------
+*/
+func TestSession_StreamsLargeRows(t *testing.T) {
+	h := newHarness(t, nil)
+	for _, c := range []net.Conn{h.client, h.server, h.proxyClient, h.proxyServ} {
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+	h.login(testCaps)
+	h.send(h.client, 0, append([]byte{ComQuery}, "SELECT doc FROM blobs"...))
+	h.recv(h.server)
+
+	// a row larger than any command the proxy decodes, split over packets
+	row := make([]byte, MaxCommandSize+1)
+	go func() {
+		seq := byte(1)
+		for _, p := range [][]byte{{1}, []byte("coldef"), eofPayload(0)} {
+			h.server.Write(EncodePacket(seq, p))
+			seq++
+		}
+		for {
+			n := min(len(row), maxPayload)
+			h.server.Write(EncodePacket(seq, row[:n]))
+			seq++
+			if n < maxPayload {
+				break
+			}
+			row = row[n:]
+		}
+		h.server.Write(EncodePacket(seq, eofPayload(StatusAutocommit)))
+	}()
+	for range 3 {
+		h.recv(h.client)
+	}
+	var sizes []int
+	for {
+		p := h.recv(h.client)
+		sizes = append(sizes, len(p.Payload()))
+		if len(p.Payload()) < maxPayload {
+			break
+		}
+	}
+	if len(sizes) != 5 || sizes[4] != MaxCommandSize+1-4*maxPayload {
+		t.Fatalf("unexpected row packets %v", sizes)
+	}
+	if p := h.recv(h.client); p.Payload()[0] != headerEOF {
+		t.Fatalf("expected the closing EOF, got %x", p.Payload())
+	}
+	if !h.session.Idle() {
+		t.Fatal("expected the result set to have ended")
+	}
+}
+
+func TestSession_BoundsClientPayloadsBeforeLogin(t *testing.T) {
+	h := newHarness(t, nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := h.session.Startup(h.proxyClient, h.proxyServ)
+		errc <- err
+	}()
+
+	h.send(h.server, 0, handshakePayload(testCaps))
+	h.recv(h.client)
+	h.send(h.client, 1, make([]byte, maxAuthSize+1))
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected an oversized handshake response to be refused, got %v", err)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: read/write splitting
+-------------------------------------------------
+*/
+
+// fakeReplica checks the session's mysql_native_password login the way
+// the server does and answers each query with a one row result set.
+func fakeReplica(t *testing.T, conn net.Conn, queries chan<- string) {
+	conn.Write(EncodePacket(0, handshakePayload(testCaps)))
+	p, err := ReadPacket(conn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	r, err := ParseHandshakeResponse(p.Payload())
+	if err != nil || r.User != "reader" || r.Database != "shop" || r.AuthPlugin != nativePassword {
+		t.Errorf("unexpected replica login %+v (%v)", r, err)
+		return
+	}
+	// SHA1(response XOR SHA1(salt + stored)) must equal stored = SHA1(SHA1(password))
+	h1 := sha1.Sum([]byte("secret"))
+	stored := sha1.Sum(h1[:])
+	mix := sha1.Sum(append([]byte("abcdefghijklmnopqrst"), stored[:]...))
+	for i := range mix {
+		mix[i] ^= r.AuthResponse[i]
+	}
+	if sha1.Sum(mix[:]) != stored {
+		t.Error("replica login scramble does not verify")
+		return
+	}
+	conn.Write(EncodePacket(2, okPayload(StatusAutocommit)))
+
+	for {
+		p, err := ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		queries <- string(p.Payload()[1:])
+		for i, payload := range [][]byte{{1}, []byte("coldef"), eofPayload(0), {1, '7'}, eofPayload(StatusAutocommit)} {
+			conn.Write(EncodePacket(byte(i+1), payload))
+		}
+	}
+}
+
+func TestSession_RoutesReadsToReplica(t *testing.T) {
+	h := newHarness(t, nil)
+	proxyRep, rep := net.Pipe()
+	t.Cleanup(func() { proxyRep.Close(); rep.Close() })
+	rep.SetDeadline(time.Now().Add(2 * time.Second))
+	queries := make(chan string, 4)
+	go fakeReplica(t, rep, queries)
+
+	h.session.SetSplit(&protocol.Split{
+		ReadOnly: func(st *protocol.Statement) bool { return strings.HasPrefix(st.Text, "SELECT") },
+		Dial:     func() (net.Conn, *tls.Config, error) { return proxyRep, nil, nil },
+		User:     "reader",
+		Password: "secret",
+	})
+	h.login(testCaps)
+
+	expectReplicaResult := func() {
+		t.Helper()
+		for i := 1; i <= 5; i++ {
+			if p := h.recv(h.client); p.Seq() != byte(i) {
+				t.Fatalf("expected replica packet %d, got sequence %d", i, p.Seq())
+			}
+		}
+	}
+
+	read := append([]byte{ComQuery}, "SELECT id FROM orders"...)
+	h.send(h.client, 0, read)
+	expectReplicaResult()
+	if q := <-queries; q != "SELECT id FROM orders" {
+		t.Fatalf("unexpected replica query %q", q)
+	}
+
+	// a write opens a transaction on the primary, keeping reads there
+	write := append([]byte{ComQuery}, "UPDATE orders SET paid = 1"...)
+	h.send(h.client, 0, write)
+	if got := h.recv(h.server); !bytes.Equal(got.Payload(), write) {
+		t.Fatalf("expected write on the primary, got %q", got.Payload())
+	}
+	h.send(h.server, 1, okPayload(StatusInTrans|StatusAutocommit))
+	h.recv(h.client)
+
+	h.send(h.client, 0, read)
+	if got := h.recv(h.server); !bytes.Equal(got.Payload(), read) {
+		t.Fatalf("expected read inside a transaction on the primary, got %q", got.Payload())
+	}
+	h.send(h.server, 1, okPayload(StatusAutocommit))
+	h.recv(h.client)
+
+	h.send(h.client, 0, read)
+	expectReplicaResult()
+	<-queries
+}
@@ -0,0 +1,662 @@
+package mysql
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"database_firewall/internal/protocol"
+)
+
+const (
+	maxPayload = 1<<24 - 1
+
+	// maxAuthSize bounds the payloads read whole during a login: the
+	// client's until the server accepts it, and the replica's.
+	maxAuthSize = 1 << 16
+	// MaxCommandSize bounds the client commands the proxy decodes. Server
+	// packets and LOCAL INFILE data are streamed through whatever their
+	// length.
+	MaxCommandSize = 1 << 26
+	// inspectSize is how much of a server packet is read to follow the
+	// response. The rest of a longer one is streamed.
+	inspectSize = 1 << 12
+)
+
+// Capability flags.
+const (
+	ClientLongPassword     = 1 << 0
+	ClientConnectWithDB    = 1 << 3
+	ClientCompress         = 1 << 5
+	ClientLocalFiles       = 1 << 7
+	ClientProtocol41       = 1 << 9
+	ClientSSL              = 1 << 11
+	ClientTransactions     = 1 << 13
+	ClientSecureConnection = 1 << 15
+	ClientMultiStatements  = 1 << 16
+	ClientMultiResults     = 1 << 17
+	ClientPluginAuth       = 1 << 19
+	ClientConnectAttrs     = 1 << 20
+	ClientPluginAuthLenenc = 1 << 21
+	ClientSessionTrack     = 1 << 23
+	ClientDeprecateEOF     = 1 << 24
+	ClientZstdCompression  = 1 << 26
+	ClientQueryAttributes  = 1 << 27
+)
+
+// Server status flags carried by OK and EOF packets.
+const (
+	StatusInTrans         = 1 << 0
+	StatusAutocommit      = 1 << 1
+	StatusMoreResults     = 1 << 3
+	StatusCursorExists    = 1 << 6
+	StatusInTransReadonly = 1 << 13
+)
+
+// Command bytes.
+const (
+	ComQuit             = 0x01
+	ComInitDB           = 0x02
+	ComQuery            = 0x03
+	ComFieldList        = 0x04
+	ComStatistics       = 0x09
+	ComChangeUser       = 0x11
+	ComStmtPrepare      = 0x16
+	ComStmtExecute      = 0x17
+	ComStmtSendLongData = 0x18
+	ComStmtClose        = 0x19
+	ComStmtFetch        = 0x1c
+)
+
+const (
+	headerOK  = 0x00
+	headerEOF = 0xfe
+	headerERR = 0xff
+
+	headerLocalInfile = 0xfb
+)
+
+var errMalformed = errors.New("mysql: malformed packet")
+
+// Packet is one wire packet. Raw keeps the 4 byte header so the packet can
+// be forwarded untouched.
+type Packet struct {
+	Raw []byte
+}
+
+func (p Packet) Seq() byte {
+	return p.Raw[3]
+}
+
+func (p Packet) Payload() []byte {
+	return p.Raw[4:]
+}
+
+// Header is the 4 byte header of a packet: the payload length and the
+// sequence number.
+type Header [4]byte
+
+func (h Header) Len() int {
+	return int(h[0]) | int(h[1])<<8 | int(h[2])<<16
+}
+
+func (h Header) Seq() byte {
+	return h[3]
+}
+
+func ReadHeader(r io.Reader) (Header, error) {
+	var h Header
+	_, err := io.ReadFull(r, h[:])
+	return h, err
+}
+
+// readBody reads the first n bytes of the payload following h. The buffer
+// grows as the bytes arrive, so a length announced in a header commits no
+// memory the peer does not actually send.
+func readBody(r io.Reader, h Header, n int) (Packet, error) {
+	raw := h[:]
+	want := len(h) + min(n, h.Len())
+	for len(raw) < want {
+		if len(raw) == cap(raw) {
+			raw = slices.Grow(raw, min(want-len(raw), max(len(raw), 4096)))
+		}
+		n, err := r.Read(raw[len(raw):min(cap(raw), want)])
+		raw = raw[:len(raw)+n]
+		if err != nil && len(raw) < want {
+			return Packet{}, unexpected(err)
+		}
+	}
+	return Packet{Raw: raw}, nil
+}
+
+func ReadPacket(r io.Reader) (Packet, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return Packet{}, err
+	}
+	return readBody(r, h, h.Len())
+}
+
+// readInspect reads a packet up to inspectSize bytes of its payload and
+// returns the length of the whole payload, leaving the rest to be streamed.
+func readInspect(r io.Reader) (Packet, int, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return Packet{}, 0, err
+	}
+	p, err := readBody(r, h, inspectSize)
+	return p, h.Len(), err
+}
+
+// readLogical reads the packets making up one logical payload of at most
+// limit bytes. Payloads of 2^24-1 bytes or more are split over several
+// packets on the wire.
+func readLogical(r io.Reader, limit int) ([]Packet, []byte, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return readPayload(r, h, limit)
+}
+
+// readPayload is readLogical for a payload whose first header, h, has
+// already been read.
+func readPayload(r io.Reader, h Header, limit int) ([]Packet, []byte, error) {
+	var pkts []Packet
+	var payload []byte
+	for {
+		if len(pkts) > 0 {
+			var err error
+			if h, err = ReadHeader(r); err != nil {
+				return nil, nil, unexpected(err)
+			}
+		}
+		if len(payload)+h.Len() > limit {
+			return nil, nil, fmt.Errorf("mysql: payload exceeds %d bytes", limit)
+		}
+		p, err := readBody(r, h, h.Len())
+		if err != nil {
+			return nil, nil, err
+		}
+		pkts = append(pkts, p)
+		if len(pkts) == 1 {
+			payload = p.Payload()
+		} else {
+			payload = append(payload[:len(payload):len(payload)], p.Payload()...)
+		}
+		if h.Len() < maxPayload {
+			return pkts, payload, nil
+		}
+	}
+}
+
+func EncodePacket(seq byte, payload []byte) []byte {
+	n := len(payload)
+	raw := make([]byte, 4, n+4)
+	raw[0], raw[1], raw[2], raw[3] = byte(n), byte(n>>8), byte(n>>16), seq
+	return append(raw, payload...)
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//--------------connection phase----------------
+
+type Handshake struct {
+	ProtocolVersion byte
+	ServerVersion   string
+	ConnectionID    uint32
+	AuthData        []byte
+	Capabilities    uint32
+	Charset         byte
+	Status          uint16
+	AuthPlugin      string
+
+	lowerCapsAt, upperCapsAt int
+}
+
+func ParseHandshake(payload []byte) (*Handshake, error) {
+	b := &buffer{data: payload}
+	h := &Handshake{ProtocolVersion: b.byte()}
+	if b.err == nil && h.ProtocolVersion != 10 {
+		return nil, fmt.Errorf("mysql: unsupported handshake protocol %d", h.ProtocolVersion)
+	}
+	h.ServerVersion = b.cstring()
+	h.ConnectionID = b.uint32()
+	h.AuthData = append(h.AuthData, b.take(8)...)
+	b.take(1)
+	h.lowerCapsAt = b.offset(payload)
+	h.Capabilities = uint32(b.uint16())
+	if b.err != nil || len(b.data) == 0 {
+		return h, b.err
+	}
+	h.Charset = b.byte()
+	h.Status = b.uint16()
+	h.upperCapsAt = b.offset(payload)
+	h.Capabilities |= uint32(b.uint16()) << 16
+	authLen := int(b.byte())
+	b.take(10)
+	if h.Capabilities&ClientSecureConnection != 0 {
+		n := max(13, authLen-8)
+		part := b.take(n)
+		if len(part) > 0 && part[len(part)-1] == 0 {
+			part = part[:len(part)-1]
+		}
+		h.AuthData = append(h.AuthData, part...)
+	}
+	if h.Capabilities&ClientPluginAuth != 0 && b.err == nil {
+		h.AuthPlugin = b.cstringOrRest()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return h, nil
+}
+
+// SetCapabilities rewrites the capability flags of an encoded handshake in
+// place, leaving every other byte untouched.
+func (h *Handshake) SetCapabilities(payload []byte, caps uint32) {
+	binary.LittleEndian.PutUint16(payload[h.lowerCapsAt:], uint16(caps))
+	if h.upperCapsAt > 0 {
+		binary.LittleEndian.PutUint16(payload[h.upperCapsAt:], uint16(caps>>16))
+	}
+	h.Capabilities = caps
+}
+
+type HandshakeResponse struct {
+	Capabilities  uint32
+	MaxPacketSize uint32
+	Charset       byte
+	User          string
+	AuthResponse  []byte
+	Database      string
+	AuthPlugin    string
+	Attributes    map[string]string
+}
+
+// Encode builds the payload of a protocol 4.1 handshake response. The auth
+// response gets a one byte length, as with CLIENT_SECURE_CONNECTION.
+func (r *HandshakeResponse) Encode() []byte {
+	p := binary.LittleEndian.AppendUint32(nil, r.Capabilities)
+	p = binary.LittleEndian.AppendUint32(p, r.MaxPacketSize)
+	p = append(p, r.Charset)
+	p = append(p, make([]byte, 23)...)
+	p = append(p, r.User...)
+	p = append(p, 0, byte(len(r.AuthResponse)))
+	p = append(p, r.AuthResponse...)
+	if r.Capabilities&ClientConnectWithDB != 0 {
+		p = append(p, r.Database...)
+		p = append(p, 0)
+	}
+	if r.Capabilities&ClientPluginAuth != 0 {
+		p = append(p, r.AuthPlugin...)
+		p = append(p, 0)
+	}
+	return p
+}
+
+// IsSSLRequest reports whether a client's handshake response is the short
+// SSLRequest packet sent before switching the connection to TLS.
+func IsSSLRequest(payload []byte) bool {
+	return len(payload) == 32 && binary.LittleEndian.Uint32(payload)&ClientSSL != 0
+}
+
+func ParseHandshakeResponse(payload []byte) (*HandshakeResponse, error) {
+	b := &buffer{data: payload}
+	r := &HandshakeResponse{Capabilities: b.uint32()}
+	if r.Capabilities&ClientProtocol41 == 0 {
+		return nil, fmt.Errorf("mysql: pre-4.1 handshake response not supported")
+	}
+	r.MaxPacketSize = b.uint32()
+	r.Charset = b.byte()
+	b.take(23)
+	r.User = b.cstring()
+	switch {
+	case r.Capabilities&ClientPluginAuthLenenc != 0:
+		r.AuthResponse = b.lenencBytes()
+	case r.Capabilities&ClientSecureConnection != 0:
+		r.AuthResponse = b.take(int(b.byte()))
+	default:
+		r.AuthResponse = []byte(b.cstring())
+	}
+	if r.Capabilities&ClientConnectWithDB != 0 && len(b.data) > 0 {
+		r.Database = b.cstring()
+	}
+	if r.Capabilities&ClientPluginAuth != 0 && len(b.data) > 0 {
+		r.AuthPlugin = b.cstring()
+	}
+	if r.Capabilities&ClientConnectAttrs != 0 && len(b.data) > 0 {
+		attrs := &buffer{data: b.lenencBytes()}
+		r.Attributes = make(map[string]string)
+		for len(attrs.data) > 0 && attrs.err == nil {
+			k := string(attrs.lenencBytes())
+			r.Attributes[k] = string(attrs.lenencBytes())
+		}
+		if attrs.err != nil {
+			return nil, attrs.err
+		}
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return r, nil
+}
+
+//--------------generic responses----------------
+
+type OK struct {
+	AffectedRows uint64
+	LastInsertID uint64
+	Status       uint16
+	Warnings     uint16
+	Info         string
+}
+
+// ParseOK decodes an OK packet. With CLIENT_DEPRECATE_EOF the terminating
+// packet of a result set is an OK packet with a 0xfe header.
+func ParseOK(payload []byte, caps uint32) (*OK, error) {
+	b := &buffer{data: payload}
+	if h := b.byte(); h != headerOK && h != headerEOF {
+		return nil, errMalformed
+	}
+	ok := &OK{AffectedRows: b.lenenc(), LastInsertID: b.lenenc()}
+	if caps&ClientProtocol41 != 0 {
+		ok.Status = b.uint16()
+		ok.Warnings = b.uint16()
+	} else if caps&ClientTransactions != 0 {
+		ok.Status = b.uint16()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	ok.Info = string(b.data)
+	return ok, nil
+}
+
+type EOF struct {
+	Warnings uint16
+	Status   uint16
+}
+
+func ParseEOF(payload []byte, caps uint32) (*EOF, error) {
+	b := &buffer{data: payload}
+	if b.byte() != headerEOF {
+		return nil, errMalformed
+	}
+	e := &EOF{}
+	if caps&ClientProtocol41 != 0 {
+		e.Warnings = b.uint16()
+		e.Status = b.uint16()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return e, nil
+}
+
+type ERR struct {
+	Code     uint16
+	SQLState string
+	Message  string
+}
+
+func (e *ERR) Error() string {
+	return fmt.Sprintf("mysql: error %d (%s): %s", e.Code, e.SQLState, e.Message)
+}
+
+func ParseERR(payload []byte, caps uint32) (*ERR, error) {
+	b := &buffer{data: payload}
+	if b.byte() != headerERR {
+		return nil, errMalformed
+	}
+	e := &ERR{Code: b.uint16()}
+	if caps&ClientProtocol41 != 0 && len(b.data) > 0 && b.data[0] == '#' {
+		b.take(1)
+		e.SQLState = string(b.take(5))
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	e.Message = string(b.data)
+	return e, nil
+}
+
+func (e *ERR) Encode(caps uint32) []byte {
+	payload := []byte{headerERR}
+	payload = binary.LittleEndian.AppendUint16(payload, e.Code)
+	if caps&ClientProtocol41 != 0 {
+		state := e.SQLState
+		if len(state) != 5 {
+			state = "HY000"
+		}
+		payload = append(payload, '#')
+		payload = append(payload, state...)
+	}
+	return append(payload, e.Message...)
+}
+
+// DenyResponse is the ERR packet sent to a client whose command was
+// rejected by a policy hook.
+func DenyResponse(deny *protocol.DenyError) *ERR {
+	code := uint16(1227) // ER_SPECIFIC_ACCESS_DENIED_ERROR
+	if deny.Limited {
+		code = 1226 // ER_USER_LIMIT_REACHED
+	}
+	return &ERR{Code: code, SQLState: "42000", Message: deny.Message}
+}
+
+//--------------command phase----------------
+
+type Query struct {
+	SQL string
+}
+
+type InitDB struct {
+	Schema string
+}
+
+type ChangeUser struct {
+	User     string
+	Database string
+}
+
+type StmtPrepare struct {
+	SQL string
+}
+
+type StmtPrepareOK struct {
+	StatementID uint32
+	Columns     uint16
+	Params      uint16
+	Warnings    uint16
+}
+
+// StmtExecute carries the statement id only; parameter values need the
+// parameter types from the prepare response and are not decoded.
+type StmtExecute struct {
+	StatementID uint32
+	Flags       byte
+	Iterations  uint32
+}
+
+type StmtClose struct {
+	StatementID uint32
+}
+
+type Quit struct{}
+
+// DecodeCommand decodes the client commands the firewall cares about.
+// Other commands decode to nil.
+func DecodeCommand(payload []byte, caps uint32) (any, error) {
+	if len(payload) == 0 {
+		return nil, errMalformed
+	}
+	b := &buffer{data: payload[1:]}
+	var msg any
+	switch payload[0] {
+	case ComQuit:
+		msg = &Quit{}
+	case ComQuery:
+		msg = &Query{SQL: string(b.data)}
+	case ComInitDB:
+		msg = &InitDB{Schema: string(b.data)}
+	case ComStmtPrepare:
+		msg = &StmtPrepare{SQL: string(b.data)}
+	case ComStmtExecute:
+		msg = &StmtExecute{StatementID: b.uint32(), Flags: b.byte(), Iterations: b.uint32()}
+	case ComStmtClose:
+		msg = &StmtClose{StatementID: b.uint32()}
+	case ComChangeUser:
+		cu := &ChangeUser{User: b.cstring()}
+		if caps&ClientSecureConnection != 0 {
+			b.take(int(b.byte()))
+		} else {
+			b.cstring()
+		}
+		cu.Database = b.cstring()
+		msg = cu
+	default:
+		return nil, nil
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("mysql: decoding command 0x%02x: %w", payload[0], b.err)
+	}
+	return msg, nil
+}
+
+func ParseStmtPrepareOK(payload []byte) (*StmtPrepareOK, error) {
+	b := &buffer{data: payload}
+	if b.byte() != headerOK {
+		return nil, errMalformed
+	}
+	ok := &StmtPrepareOK{StatementID: b.uint32(), Columns: b.uint16(), Params: b.uint16()}
+	b.take(1)
+	if len(b.data) >= 2 {
+		ok.Warnings = b.uint16()
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	return ok, nil
+}
+
+//--------------buffer----------------
+
+type buffer struct {
+	data []byte
+	err  error
+}
+
+func (b *buffer) offset(orig []byte) int {
+	return len(orig) - len(b.data)
+}
+
+func (b *buffer) take(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(b.data) {
+		b.err = errMalformed
+		return nil
+	}
+	v := b.data[:n]
+	b.data = b.data[n:]
+	return v
+}
+
+func (b *buffer) byte() byte {
+	v := b.take(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (b *buffer) uint16() uint16 {
+	v := b.take(2)
+	if v == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(v)
+}
+
+func (b *buffer) uint32() uint32 {
+	v := b.take(4)
+	if v == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(v)
+}
+
+func (b *buffer) lenenc() uint64 {
+	first := b.byte()
+	switch first {
+	case 0xfc:
+		return uint64(b.uint16())
+	case 0xfd:
+		v := b.take(3)
+		if v == nil {
+			return 0
+		}
+		return uint64(v[0]) | uint64(v[1])<<8 | uint64(v[2])<<16
+	case 0xfe:
+		v := b.take(8)
+		if v == nil {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(v)
+	case 0xfb, 0xff:
+		if b.err == nil {
+			b.err = errMalformed
+		}
+		return 0
+	}
+	return uint64(first)
+}
+
+func (b *buffer) lenencBytes() []byte {
+	n := b.lenenc()
+	if n > uint64(len(b.data)) {
+		if b.err == nil {
+			b.err = errMalformed
+		}
+		return nil
+	}
+	return b.take(int(n))
+}
+
+func (b *buffer) cstring() string {
+	if b.err != nil {
+		return ""
+	}
+	for i, c := range b.data {
+		if c == 0 {
+			s := string(b.data[:i])
+			b.data = b.data[i+1:]
+			return s
+		}
+	}
+	b.err = errMalformed
+	return ""
+}
+
+// cstringOrRest accepts a missing terminator, which some servers omit on
+// the final field of the handshake.
+func (b *buffer) cstringOrRest() string {
+	for i, c := range b.data {
+		if c == 0 {
+			s := string(b.data[:i])
+			b.data = b.data[i+1:]
+			return s
+		}
+	}
+	s := string(b.data)
+	b.data = nil
+	return s
+}
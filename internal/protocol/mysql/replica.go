@@ -0,0 +1,453 @@
+package mysql
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"time"
+
+	"database_firewall/internal/logging"
+	"database_firewall/internal/protocol"
+)
+
+// resultCapabilities change how results are encoded. A replica is asked
+// for the ones the client negotiated with the primary so its answers can
+// be relayed as they are.
+const resultCapabilities = ClientProtocol41 | ClientTransactions | ClientMultiResults |
+	ClientSessionTrack | ClientDeprecateEOF
+
+const (
+	nativePassword      = "mysql_native_password"
+	cachingSHA2Password = "caching_sha2_password"
+
+	authMoreData      = 0x01
+	cachingRequestKey = 0x02
+	cachingFastAuthOK = 0x03
+	cachingFullAuth   = 0x04
+	scrambleLength    = 20
+)
+
+// replica is a session's connection to a read replica, opened on the
+// first statement routed to one.
+type replica struct {
+	conn net.Conn
+	r    *bufio.Reader
+	db   string
+}
+
+// SetSplit enables read/write splitting. It must be called before Startup.
+func (s *Session) SetSplit(sp *protocol.Split) {
+	s.split = sp
+}
+
+// readOnly reports whether st may go to a replica, remembering when the
+// session last sent anything else and keeping it on the primary once it
+// changed its state.
+func (s *Session) readOnly(st *protocol.Statement) bool {
+	if s.split == nil || st == nil {
+		return false
+	}
+	if s.split.Pins != nil && s.split.Pins(st) {
+		s.noReplica = true
+	}
+	if !s.split.ReadOnly(st) {
+		s.lastWrite = time.Now()
+		return false
+	}
+	return true
+}
+
+// toReplica reports whether a read-only COM_QUERY can run on the replica:
+// no response is outstanding on the primary, which is in autocommit mode
+// outside a transaction, and the sticky period after the last write has
+// passed.
+func (s *Session) toReplica() bool {
+	if s.noReplica || time.Since(s.lastWrite) < s.split.Sticky {
+		return false
+	}
+	return s.Idle()
+}
+
+// replicaQuery runs a COM_QUERY on the replica and relays its response. It
+// reports false, leaving the query to the primary, when the replica cannot
+// be reached or fails before answering; the session then stays on the
+// primary.
+func (s *Session) replicaQuery(pkts []Packet) (bool, error) {
+	s.mu.Lock()
+	caps, charset, db := s.caps, s.charset, s.info.Database
+	s.mu.Unlock()
+
+	if s.replica == nil {
+		rep, err := s.dialReplica(caps&resultCapabilities, charset, db)
+		if err != nil {
+			s.replicaFailed(err)
+			return false, nil
+		}
+		s.replica = rep
+	}
+	if db != s.replica.db {
+		if err := s.replica.initDB(db, caps); err != nil {
+			s.replicaFailed(err)
+			return false, nil
+		}
+	}
+	if err := writePackets(s.replica.conn, pkts); err != nil {
+		s.replicaFailed(err)
+		return false, nil
+	}
+
+	res := &queryResult{caps: caps}
+	relayed, cont := false, false
+	for {
+		p, n, err := readInspect(s.replica.r)
+		if err != nil && !relayed {
+			s.replicaFailed(err)
+			return false, nil
+		}
+		if err != nil {
+			return true, unexpected(err)
+		}
+		relayed = true
+		if err := s.checkSeq([]Packet{p}, false); err != nil {
+			return true, err
+		}
+		done := false
+		if !cont {
+			if n == 0 {
+				return true, errMalformed
+			}
+			if done, err = res.next(p.Payload(), n); err != nil {
+				return true, err
+			}
+		}
+		cont = n == maxPayload
+		if err := s.relay(s.replica.r, p, n, done); err != nil {
+			return true, err
+		}
+		if done {
+			return true, nil
+		}
+	}
+}
+
+func (s *Session) replicaFailed(err error) {
+	s.closeReplica()
+	s.noReplica = true
+	logging.LogEvent("WARN", "replica_unavailable", map[string]any{
+		"client_ip": s.info.ClientIP.String(),
+		"protocol":  s.info.Protocol,
+		"error":     err.Error(),
+	})
+}
+
+func (s *Session) closeReplica() {
+	if s.replica != nil {
+		s.replica.conn.Close()
+		s.replica = nil
+	}
+}
+
+func (s *Session) dialReplica(caps uint32, charset byte, db string) (*replica, error) {
+	conn, t, err := s.split.Dial()
+	if err != nil {
+		return nil, err
+	}
+	rep := &replica{conn: conn, r: bufio.NewReader(conn), db: db}
+	if err := rep.login(t, caps, charset, s.split.User, s.split.Password); err != nil {
+		rep.conn.Close()
+		return nil, err
+	}
+	return rep, nil
+}
+
+// login runs the connection phase, negotiating TLS when t is set and
+// authenticating with mysql_native_password or caching_sha2_password.
+func (rep *replica) login(t *tls.Config, caps uint32, charset byte, user, password string) error {
+	pkts, payload, err := readLogical(rep.r, maxAuthSize)
+	if err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return errMalformed
+	}
+	if payload[0] == headerERR {
+		return replicaError(payload, 0)
+	}
+	h, err := ParseHandshake(payload)
+	if err != nil {
+		return err
+	}
+	caps |= ClientProtocol41 | ClientSecureConnection | ClientPluginAuth
+	if rep.db != "" {
+		caps |= ClientConnectWithDB
+	}
+	if missing := caps &^ h.Capabilities; missing != 0 {
+		return fmt.Errorf("mysql: replica lacks capabilities %#x", missing)
+	}
+	seq := pkts[len(pkts)-1].Seq() + 1
+
+	if t != nil {
+		if h.Capabilities&ClientSSL == 0 {
+			return fmt.Errorf("mysql: replica does not support TLS")
+		}
+		caps |= ClientSSL
+		r := &HandshakeResponse{Capabilities: caps, MaxPacketSize: maxPayload, Charset: charset}
+		if err := writePackets(rep.conn, []Packet{{Raw: EncodePacket(seq, sslRequest(r))}}); err != nil {
+			return err
+		}
+		seq++
+		tc := tls.Client(rep.conn, t)
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		rep.conn, rep.r = tc, bufio.NewReader(tc)
+	}
+
+	plugin, salt := h.AuthPlugin, h.AuthData
+	if plugin == "" {
+		plugin = nativePassword
+	}
+	auth, err := scramble(plugin, password, salt)
+	if err != nil {
+		return err
+	}
+	resp := &HandshakeResponse{
+		Capabilities:  caps,
+		MaxPacketSize: maxPayload,
+		Charset:       charset,
+		User:          user,
+		AuthResponse:  auth,
+		Database:      rep.db,
+		AuthPlugin:    plugin,
+	}
+	send := func(payload []byte) error {
+		err := writePackets(rep.conn, []Packet{{Raw: EncodePacket(seq, payload)}})
+		seq++
+		return err
+	}
+	if err := send(resp.Encode()); err != nil {
+		return err
+	}
+
+	keyRequested := false
+	for {
+		pkts, payload, err := readLogical(rep.r, maxAuthSize)
+		if err != nil {
+			return unexpected(err)
+		}
+		if len(payload) == 0 {
+			return errMalformed
+		}
+		seq = pkts[len(pkts)-1].Seq() + 1
+
+		switch payload[0] {
+		case headerOK:
+			return nil
+		case headerERR:
+			return replicaError(payload, caps)
+		case headerEOF:
+			// auth switch request
+			b := &buffer{data: payload[1:]}
+			plugin = b.cstring()
+			salt = b.data
+			if n := len(salt); n > 0 && salt[n-1] == 0 {
+				salt = salt[:n-1]
+			}
+			if b.err != nil {
+				return b.err
+			}
+			if auth, err = scramble(plugin, password, salt); err != nil {
+				return err
+			}
+			if err := send(auth); err != nil {
+				return err
+			}
+		case authMoreData:
+			if plugin != cachingSHA2Password || len(payload) < 2 {
+				return errMalformed
+			}
+			switch {
+			case keyRequested:
+				keyRequested = false
+				enc, err := encryptPassword(payload[1:], password, salt)
+				if err != nil {
+					return err
+				}
+				if err := send(enc); err != nil {
+					return err
+				}
+			case payload[1] == cachingFastAuthOK:
+			case payload[1] == cachingFullAuth && t != nil:
+				if err := send(append([]byte(password), 0)); err != nil {
+					return err
+				}
+			case payload[1] == cachingFullAuth:
+				keyRequested = true
+				if err := send([]byte{cachingRequestKey}); err != nil {
+					return err
+				}
+			default:
+				return errMalformed
+			}
+		default:
+			return errMalformed
+		}
+	}
+}
+
+// initDB follows the client's COM_INIT_DB on the replica.
+func (rep *replica) initDB(db string, caps uint32) error {
+	if _, err := rep.conn.Write(EncodePacket(0, append([]byte{ComInitDB}, db...))); err != nil {
+		return err
+	}
+	_, payload, err := readLogical(rep.r, maxAuthSize)
+	if err != nil {
+		return unexpected(err)
+	}
+	if len(payload) == 0 || payload[0] != headerOK {
+		return replicaError(payload, caps)
+	}
+	rep.db = db
+	return nil
+}
+
+func replicaError(payload []byte, caps uint32) error {
+	e, err := ParseERR(payload, caps)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("mysql: replica: %w", e)
+}
+
+func scramble(plugin, password string, salt []byte) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	if len(salt) > scrambleLength {
+		salt = salt[:scrambleLength]
+	}
+	switch plugin {
+	case nativePassword:
+		// SHA1(password) XOR SHA1(salt + SHA1(SHA1(password)))
+		h1 := sha1.Sum([]byte(password))
+		h2 := sha1.Sum(h1[:])
+		h3 := sha1.Sum(append(append([]byte(nil), salt...), h2[:]...))
+		for i := range h3 {
+			h3[i] ^= h1[i]
+		}
+		return h3[:], nil
+	case cachingSHA2Password:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt)
+		h1 := sha256.Sum256([]byte(password))
+		h2 := sha256.Sum256(h1[:])
+		h3 := sha256.Sum256(append(h2[:], salt...))
+		for i := range h1 {
+			h1[i] ^= h3[i]
+		}
+		return h1[:], nil
+	}
+	return nil, fmt.Errorf("mysql: unsupported replica auth plugin %q", plugin)
+}
+
+// encryptPassword answers caching_sha2_password full authentication over
+// plaintext with the password encrypted to the server's RSA key.
+func encryptPassword(keyPEM []byte, password string, salt []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("mysql: replica sent no public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("mysql: replica public key is not RSA")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= salt[i%len(salt)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+// queryResult follows a text protocol COM_QUERY response far enough to
+// tell where it ends.
+type queryResult struct {
+	caps    uint32
+	state   int
+	columns uint64
+}
+
+// next consumes one logical packet of n bytes, starting with payload, and
+// reports whether it ended the response.
+func (q *queryResult) next(payload []byte, n int) (bool, error) {
+	h := payload[0]
+	deprecateEOF := q.caps&ClientDeprecateEOF != 0
+	switch q.state {
+	case respIdle, respFirst:
+		switch h {
+		case headerERR:
+			return true, nil
+		case headerOK:
+			ok, err := ParseOK(payload, q.caps)
+			if err != nil {
+				return false, err
+			}
+			return q.more(ok.Status), nil
+		case headerLocalInfile:
+			return false, fmt.Errorf("mysql: LOCAL INFILE requested by replica")
+		}
+		b := &buffer{data: payload}
+		q.columns = b.lenenc()
+		if b.err != nil {
+			return false, b.err
+		}
+		q.state = respColumns
+	case respColumns:
+		q.columns--
+		if q.columns > 0 {
+			break
+		}
+		if deprecateEOF {
+			q.state = respRows
+		} else {
+			q.state = respColumnsEOF
+		}
+	case respColumnsEOF:
+		q.state = respRows
+	case respRows:
+		switch {
+		case h == headerERR:
+			return true, nil
+		case h == headerEOF && !deprecateEOF && n < 9:
+			eof, err := ParseEOF(payload, q.caps)
+			if err != nil {
+				return false, err
+			}
+			return q.more(eof.Status), nil
+		case h == headerEOF && deprecateEOF && n < maxPayload:
+			ok, err := ParseOK(payload, q.caps)
+			if err != nil {
+				return false, err
+			}
+			return q.more(ok.Status), nil
+		}
+	}
+	return false, nil
+}
+
+func (q *queryResult) more(status uint16) bool {
+	if status&StatusMoreResults != 0 {
+		q.state = respFirst
+		return false
+	}
+	return true
+}
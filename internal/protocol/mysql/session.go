@@ -0,0 +1,731 @@
+package mysql
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"database_firewall/internal/protocol"
+)
+
+var _ protocol.Session = (*Session)(nil)
+
+// strippedCapabilities are hidden from the client in the server greeting
+// because they change the framing or the COM_QUERY layout in ways the
+// decoder does not follow.
+const strippedCapabilities = ClientCompress | ClientZstdCompression | ClientQueryAttributes
+
+type command struct {
+	code   byte
+	arg    string
+	cursor bool
+}
+
+const (
+	respIdle = iota
+	respFirst
+	respColumns
+	respColumnsEOF
+	respRows
+	respFetchRows
+	respPrepareParams
+	respPrepareParamsEOF
+	respPrepareColumns
+	respPrepareColumnsEOF
+)
+
+type response struct {
+	cmd     command
+	state   int
+	columns uint64
+	params  uint64
+}
+
+type Session struct {
+	hook protocol.Hook
+	tls  protocol.TLS
+
+	cr, sr      *bufio.Reader
+	passthrough bool
+
+	//------read/write splitting, client loop only--------
+	split     *protocol.Split
+	replica   *replica
+	noReplica bool
+	lastWrite time.Time
+
+	wmu sync.Mutex
+	cw  *bufio.Writer
+
+	mu            sync.Mutex
+	info          protocol.Info
+	caps          uint32
+	charset       byte
+	seq           byte
+	authenticated bool
+	authFailed    bool
+	// shift is the server's sequence number minus the client's during the
+	// connection phase, when only one side sent an SSLRequest.
+	shift      byte
+	infile     bool
+	status     uint16
+	pending    []command
+	statements map[uint32]string
+	resp       response
+}
+
+func NewSession(info protocol.Info, hook protocol.Hook) *Session {
+	info.Protocol = "mysql"
+	return &Session{
+		info:       info,
+		hook:       hook,
+		statements: make(map[uint32]string),
+	}
+}
+
+// SetTLS enables in-band TLS. It must be called before Startup.
+func (s *Session) SetTLS(t protocol.TLS) {
+	s.tls = t
+}
+
+func (s *Session) Info() protocol.Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+func (s *Session) Passthrough() bool {
+	return s.passthrough
+}
+
+// Idle treats autocommit off as an open transaction, since the server
+// does not flag one until the first statement touches a table.
+func (s *Session) Idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authenticated && len(s.pending) == 0 && s.resp.state == respIdle && !s.infile &&
+		s.status&StatusInTrans == 0 && s.status&StatusAutocommit != 0
+}
+
+func (s *Session) AuthFailed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authFailed
+}
+
+// InTransaction reports the SERVER_STATUS_IN_TRANS flag of the last OK or
+// EOF packet seen from the server.
+func (s *Session) InTransaction() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status&StatusInTrans != 0
+}
+
+// Startup relays the connection phase. CLIENT_SSL is advertised to the
+// client only when client TLS is configured, and the session performs the
+// client's TLS upgrade itself; with upstream TLS it sends its own
+// SSLRequest to the server. Either way the decoder sees plaintext.
+func (s *Session) Startup(client, server net.Conn) (net.Conn, net.Conn, error) {
+	s.cr = bufio.NewReader(client)
+	s.sr = bufio.NewReader(server)
+	s.cw = bufio.NewWriter(client)
+
+	//----------------server greeting-----------------
+	pkts, payload, err := readLogical(s.sr, maxAuthSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(payload) == 0 {
+		return nil, nil, errMalformed
+	}
+	if payload[0] == headerERR {
+		s.passthrough = true
+		return client, server, writePackets(client, pkts)
+	}
+	h, err := ParseHandshake(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.tls.Upstream != nil && h.Capabilities&ClientSSL == 0 {
+		return nil, nil, fmt.Errorf("mysql: upstream does not support TLS")
+	}
+	caps := h.Capabilities &^ (strippedCapabilities | ClientSSL)
+	if s.tls.Client != nil {
+		caps |= ClientSSL
+	}
+	h.SetCapabilities(payload, caps)
+	if err := s.checkSeq(pkts, true); err != nil {
+		return nil, nil, err
+	}
+	if err := writePackets(client, pkts); err != nil {
+		return nil, nil, err
+	}
+
+	//----------------client response-----------------
+	pkts, payload, err = readLogical(s.cr, maxAuthSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.checkSeq(pkts, false); err != nil {
+		return nil, nil, err
+	}
+	if IsSSLRequest(payload) {
+		if s.tls.Client == nil {
+			return nil, nil, fmt.Errorf("mysql: client requested TLS that was not offered")
+		}
+		if s.cr.Buffered() > 0 {
+			return nil, nil, fmt.Errorf("mysql: data received after SSLRequest")
+		}
+		tc := tls.Server(client, s.tls.Client)
+		if err := tc.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		client = tc
+		s.cr = bufio.NewReader(client)
+		s.cw = bufio.NewWriter(client)
+
+		if pkts, payload, err = readLogical(s.cr, maxAuthSize); err != nil {
+			return nil, nil, err
+		}
+		if err := s.checkSeq(pkts, false); err != nil {
+			return nil, nil, err
+		}
+	}
+	r, err := ParseHandshakeResponse(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//----------------upstream TLS--------------------
+	serverSeq := byte(1)
+	if s.tls.Upstream != nil {
+		if err := writePackets(server, []Packet{{Raw: EncodePacket(1, sslRequest(r))}}); err != nil {
+			return nil, nil, err
+		}
+		tc := tls.Client(server, s.tls.Upstream)
+		if err := tc.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		server = tc
+		s.sr = bufio.NewReader(server)
+		serverSeq = 2
+	}
+
+	// The capability flags must tell the server whether this connection is
+	// encrypted, whatever the client negotiated with the proxy.
+	respCaps := r.Capabilities &^ ClientSSL
+	if s.tls.Upstream != nil {
+		respCaps |= ClientSSL
+	}
+	binary.LittleEndian.PutUint32(pkts[0].Payload(), respCaps)
+
+	s.mu.Lock()
+	s.shift = serverSeq - pkts[0].Seq()
+	s.caps = r.Capabilities & h.Capabilities
+	s.charset = r.Charset
+	s.info.User = r.User
+	s.info.Database = r.Database
+	s.mu.Unlock()
+
+	shiftSeq(pkts, s.shift)
+	if err := writePackets(server, pkts); err != nil {
+		return nil, nil, err
+	}
+	return client, server, nil
+}
+
+// sslRequest builds the SSLRequest sent to the server on the client's
+// behalf: the fixed prefix of its handshake response with CLIENT_SSL set.
+func sslRequest(r *HandshakeResponse) []byte {
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b, r.Capabilities|ClientSSL)
+	binary.LittleEndian.PutUint32(b[4:], r.MaxPacketSize)
+	b[8] = r.Charset
+	return b
+}
+
+// shiftSeq adds delta to the sequence number of each packet in place.
+func shiftSeq(pkts []Packet, delta byte) {
+	if delta == 0 {
+		return
+	}
+	for _, p := range pkts {
+		p.Raw[3] += delta
+	}
+}
+
+func (s *Session) ClientToServer(client, server net.Conn) error {
+	if s.passthrough {
+		return copyAll(server, s.cr)
+	}
+
+	defer s.closeReplica()
+	w := bufio.NewWriter(server)
+	cont := false // the last LOCAL INFILE packet continues in the next
+	for {
+		h, err := ReadHeader(s.cr)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		infile := s.infile
+		if infile && h.Len() == 0 && !cont {
+			s.infile = false
+		}
+		isCommand := s.authenticated && !infile
+		if isCommand {
+			s.shift = 0
+		}
+		shift := s.shift
+		limit := maxAuthSize
+		if s.authenticated {
+			limit = MaxCommandSize
+		}
+		s.mu.Unlock()
+
+		// file contents are streamed packet by packet
+		if infile {
+			cont = h.Len() == maxPayload
+			if err := s.streamInfile(w, h, shift); err != nil {
+				return err
+			}
+			continue
+		}
+
+		pkts, payload, err := readPayload(s.cr, h, limit)
+		if err != nil {
+			return err
+		}
+
+		if err := s.checkSeq(pkts, isCommand); err != nil {
+			return err
+		}
+		shiftSeq(pkts, shift)
+		if isCommand {
+			cmd, st, err := s.command(payload)
+			var deny *protocol.DenyError
+			if errors.As(err, &deny) {
+				if err := s.deny(deny); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if s.readOnly(st) && cmd.code == ComQuery && s.toReplica() {
+				handled, err := s.replicaQuery(pkts)
+				if err != nil {
+					return err
+				}
+				if handled {
+					continue
+				}
+			}
+			s.enqueue(cmd)
+		}
+		if err := writePackets(w, pkts); err != nil {
+			return err
+		}
+		if s.cr.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Session) ServerToClient(server, client net.Conn) error {
+	if s.passthrough {
+		return copyAll(client, s.sr)
+	}
+
+	cont := false // the last packet's payload continues in the next
+	for {
+		p, n, err := readInspect(s.sr)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		shift := s.shift
+		s.mu.Unlock()
+		shiftSeq([]Packet{p}, -shift)
+		if err := s.checkSeq([]Packet{p}, false); err != nil {
+			return err
+		}
+		if !cont {
+			if err := s.observe(p.Payload(), n); err != nil {
+				return err
+			}
+		}
+		cont = n == maxPayload
+		if err := s.relay(s.sr, p, n, false); err != nil {
+			return err
+		}
+	}
+}
+
+// streamInfile forwards a packet of LOCAL INFILE data with header h to
+// the server without buffering it.
+func (s *Session) streamInfile(w *bufio.Writer, h Header, shift byte) error {
+	pkts := []Packet{{Raw: h[:]}}
+	if err := s.checkSeq(pkts, false); err != nil {
+		return err
+	}
+	shiftSeq(pkts, shift)
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, s.cr, int64(h.Len())); err != nil {
+		return unexpected(err)
+	}
+	if s.cr.Buffered() == 0 {
+		return w.Flush()
+	}
+	return nil
+}
+
+// relay writes p, the start of a packet with an n byte payload, to the
+// client and streams the rest of it from r.
+func (s *Session) relay(r *bufio.Reader, p Packet, n int, flush bool) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.cw.Write(p.Raw); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(s.cw, r, int64(n-len(p.Payload()))); err != nil {
+		return unexpected(err)
+	}
+	if flush || r.Buffered() == 0 {
+		return s.cw.Flush()
+	}
+	return nil
+}
+
+func (s *Session) writeClient(pkts []Packet, flush bool) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := writePackets(s.cw, pkts); err != nil {
+		return err
+	}
+	if flush {
+		return s.cw.Flush()
+	}
+	return nil
+}
+
+// deny answers a rejected command with an ERR packet in place of the
+// server's response. The command is never forwarded.
+func (s *Session) deny(deny *protocol.DenyError) error {
+	e := DenyResponse(deny)
+	s.mu.Lock()
+	pkt := Packet{Raw: EncodePacket(s.seq, e.Encode(s.caps))}
+	s.seq++
+	s.mu.Unlock()
+	return s.writeClient([]Packet{pkt}, true)
+}
+
+// checkSeq enforces the shared sequence counter. Every command starts a new
+// exchange at zero; every other packet in either direction continues it.
+func (s *Session) checkSeq(pkts []Packet, reset bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reset {
+		s.seq = 0
+	}
+	for _, p := range pkts {
+		if p.Seq() != s.seq {
+			return fmt.Errorf("mysql: packet sequence %d, expected %d", p.Seq(), s.seq)
+		}
+		s.seq++
+	}
+	return nil
+}
+
+// command inspects a client command and returns what the response to it
+// has to be decoded as.
+func (s *Session) command(payload []byte) (command, *protocol.Statement, error) {
+	s.mu.Lock()
+	msg, err := DecodeCommand(payload, s.caps)
+	if err != nil {
+		s.mu.Unlock()
+		return command{}, nil, err
+	}
+
+	var st *protocol.Statement
+	switch v := msg.(type) {
+	case *Query:
+		st = s.statement(protocol.KindQuery, v.SQL, v)
+	case *StmtPrepare:
+		st = s.statement(protocol.KindPrepare, v.SQL, v)
+	case *StmtExecute:
+		st = s.statement(protocol.KindExecute, s.statements[v.StatementID], v)
+	}
+	s.mu.Unlock()
+
+	if st != nil && s.hook != nil {
+		if err := s.hook.Inspect(st); err != nil {
+			return command{}, nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd := command{code: payload[0]}
+	switch v := msg.(type) {
+	case *Query:
+		cmd.arg = v.SQL
+	case *StmtPrepare:
+		cmd.arg = v.SQL
+	case *StmtExecute:
+		cmd.cursor = v.Flags != 0
+	case *InitDB:
+		cmd.arg = v.Schema
+	case *StmtClose:
+		delete(s.statements, v.StatementID)
+	case *ChangeUser:
+		s.info.User = v.User
+		s.info.Database = v.Database
+		s.authenticated = false
+	}
+	return cmd, st, nil
+}
+
+// enqueue records that the server owes a response to cmd.
+func (s *Session) enqueue(cmd command) {
+	switch cmd.code {
+	case ComQuit, ComStmtClose, ComStmtSendLongData, ComChangeUser:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, cmd)
+}
+
+func (s *Session) statement(kind, text string, msg any) *protocol.Statement {
+	return &protocol.Statement{
+		Info:    s.info,
+		Kind:    kind,
+		Text:    text,
+		Message: msg,
+	}
+}
+
+// observe follows server responses to learn when authentication finishes
+// or fails, which statement ids prepared statements received, when result
+// sets end and the transaction status they report. payload is at most the
+// first inspectSize bytes of a logical payload of n bytes.
+func (s *Session) observe(payload []byte, n int) error {
+	if len(payload) == 0 {
+		return errMalformed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.authenticated {
+		switch payload[0] {
+		case headerOK:
+			ok, err := ParseOK(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			s.status = ok.Status
+			s.authenticated = true
+		case headerERR:
+			e, err := ParseERR(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			// ER_ACCESS_DENIED_ERROR, or any other invalid authorization
+			s.authFailed = e.Code == 1045 || e.SQLState == "28000"
+		}
+		return nil
+	}
+
+	r := &s.resp
+	if r.state == respIdle {
+		if len(s.pending) == 0 {
+			return nil
+		}
+		r.cmd = s.pending[0]
+		s.pending = s.pending[1:]
+		r.state = respFirst
+		if r.cmd.code == ComStmtFetch {
+			r.state = respFetchRows
+		}
+	}
+
+	h := payload[0]
+	deprecateEOF := s.caps&ClientDeprecateEOF != 0
+	switch r.state {
+	case respFirst:
+		switch {
+		case h == headerERR:
+			r.state = respIdle
+		case h == headerOK && r.cmd.code == ComStmtPrepare:
+			ok, err := ParseStmtPrepareOK(payload)
+			if err != nil {
+				return err
+			}
+			s.statements[ok.StatementID] = r.cmd.arg
+			r.params, r.columns = uint64(ok.Params), uint64(ok.Columns)
+			s.prepareDefinitions()
+		case h == headerOK:
+			ok, err := ParseOK(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			if r.cmd.code == ComInitDB {
+				s.info.Database = r.cmd.arg
+			}
+			s.finish(ok.Status)
+		case h == headerLocalInfile && r.cmd.code == ComQuery:
+			s.infile = true
+		case h == headerEOF && n < 9:
+			eof, err := ParseEOF(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			s.finish(eof.Status)
+		case r.cmd.code == ComStatistics:
+			r.state = respIdle
+		case r.cmd.code == ComFieldList:
+			r.state = respRows
+		default:
+			b := &buffer{data: payload}
+			r.columns = b.lenenc()
+			if b.err != nil {
+				return b.err
+			}
+			r.state = respColumns
+		}
+	case respColumns:
+		r.columns--
+		if r.columns > 0 {
+			break
+		}
+		switch {
+		case !deprecateEOF:
+			r.state = respColumnsEOF
+		case r.cmd.cursor:
+			r.state = respIdle
+		default:
+			r.state = respRows
+		}
+	case respColumnsEOF:
+		eof, err := ParseEOF(payload, s.caps)
+		if err != nil {
+			return err
+		}
+		if eof.Status&StatusCursorExists != 0 {
+			s.finish(eof.Status)
+		} else {
+			r.state = respRows
+		}
+	case respRows:
+		switch {
+		case h == headerERR:
+			r.state = respIdle
+		case h == headerEOF && !deprecateEOF && n < 9:
+			eof, err := ParseEOF(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			s.finish(eof.Status)
+		case h == headerEOF && deprecateEOF && n < maxPayload:
+			ok, err := ParseOK(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			s.finish(ok.Status)
+		}
+	case respFetchRows:
+		// Binary rows from a cursor, which start with 0x00, up to an EOF
+		// (or OK with the EOF header) or an ERR.
+		switch {
+		case h == headerERR:
+			r.state = respIdle
+		case h == headerEOF && !deprecateEOF:
+			eof, err := ParseEOF(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			s.finish(eof.Status)
+		case h == headerEOF:
+			ok, err := ParseOK(payload, s.caps)
+			if err != nil {
+				return err
+			}
+			s.finish(ok.Status)
+		}
+	case respPrepareParams:
+		r.params--
+		if r.params == 0 {
+			if deprecateEOF {
+				s.prepareDefinitions()
+			} else {
+				r.state = respPrepareParamsEOF
+			}
+		}
+	case respPrepareParamsEOF:
+		s.prepareDefinitions()
+	case respPrepareColumns:
+		r.columns--
+		if r.columns == 0 {
+			if deprecateEOF {
+				r.state = respIdle
+			} else {
+				r.state = respPrepareColumnsEOF
+			}
+		}
+	case respPrepareColumnsEOF:
+		r.state = respIdle
+	}
+	return nil
+}
+
+// prepareDefinitions moves to the next block of definitions that follows a
+// COM_STMT_PREPARE_OK.
+func (s *Session) prepareDefinitions() {
+	r := &s.resp
+	switch {
+	case r.params > 0:
+		r.state = respPrepareParams
+	case r.columns > 0:
+		r.state = respPrepareColumns
+	default:
+		r.state = respIdle
+	}
+}
+
+func (s *Session) finish(status uint16) {
+	s.status = status
+	if status&StatusMoreResults != 0 {
+		s.resp.state = respFirst
+		return
+	}
+	s.resp.state = respIdle
+}
+
+func writePackets(w io.Writer, pkts []Packet) error {
+	for _, p := range pkts {
+		if _, err := w.Write(p.Raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyAll(dst io.Writer, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,435 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"database_firewall/internal/protocol"
+)
+
+const (
+	protocolVersion3  = 3 << 16
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+
+	maxStartupSize = 10000
+	// maxAuthMessageSize bounds client messages until the server accepts
+	// the login.
+	maxAuthMessageSize = 1 << 16
+	// MaxMessageSize bounds the messages the proxy decodes. Messages it
+	// does not decode are streamed through whatever their length.
+	MaxMessageSize = 1 << 26
+)
+
+var errMalformed = errors.New("postgres: malformed message")
+
+// Message is a single typed protocol frame. Raw holds the frame exactly as
+// read from the wire so it can be forwarded untouched.
+type Message struct {
+	Type byte
+	Raw  []byte
+}
+
+func (m Message) Body() []byte {
+	return m.Raw[5:]
+}
+
+//--------------frontend messages----------------
+
+type StartupMessage struct {
+	ProtocolVersion uint32
+	Parameters      map[string]string
+}
+
+type SSLRequest struct{}
+
+type GSSENCRequest struct{}
+
+type CancelRequest struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+type Query struct {
+	String string
+}
+
+type Parse struct {
+	Name       string
+	Query      string
+	ParamTypes []uint32
+}
+
+type Bind struct {
+	Portal        string
+	Statement     string
+	ParamFormats  []int16
+	Params        [][]byte
+	ResultFormats []int16
+}
+
+type Execute struct {
+	Portal  string
+	MaxRows uint32
+}
+
+type Close struct {
+	Target byte
+	Name   string
+}
+
+//--------------backend messages----------------
+
+type ErrorResponse struct {
+	Fields map[byte]string
+}
+
+func (e *ErrorResponse) Severity() string { return e.Fields['S'] }
+func (e *ErrorResponse) Code() string     { return e.Fields['C'] }
+func (e *ErrorResponse) Message() string  { return e.Fields['M'] }
+
+func (e *ErrorResponse) Encode() []byte {
+	codes := make([]byte, 0, len(e.Fields))
+	for c := range e.Fields {
+		codes = append(codes, c)
+	}
+	slices.Sort(codes)
+
+	var body []byte
+	for _, c := range codes {
+		body = append(body, c)
+		body = append(body, e.Fields[c]...)
+		body = append(body, 0)
+	}
+	return encode('E', append(body, 0))
+}
+
+// DenyResponse is the ErrorResponse sent to a client whose statement was
+// rejected by a policy hook.
+func DenyResponse(deny *protocol.DenyError) *ErrorResponse {
+	code := "42501" // insufficient_privilege
+	if deny.Limited {
+		code = "53400" // configuration_limit_exceeded
+	}
+	return &ErrorResponse{Fields: map[byte]string{
+		'S': "ERROR",
+		'V': "ERROR",
+		'C': code,
+		'M': deny.Message,
+	}}
+}
+
+type ReadyForQuery struct {
+	TxStatus byte
+}
+
+// Authentication request codes.
+const (
+	AuthOK           = 0
+	AuthCleartext    = 3
+	AuthMD5          = 5
+	AuthSASL         = 10
+	AuthSASLContinue = 11
+	AuthSASLFinal    = 12
+)
+
+// Authentication is a server authentication request. Data holds the
+// code-specific rest of the message: the MD5 salt, the SASL mechanism
+// list or the SASL payload.
+type Authentication struct {
+	Code uint32
+	Data []byte
+}
+
+var syncMessage = encode('S', nil)
+
+// SSLRequestMessage is the encoded SSLRequest startup packet.
+var SSLRequestMessage = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), sslRequestCode)
+
+// EncodeStartup encodes a protocol 3.0 startup packet with the given
+// parameter name/value pairs.
+func EncodeStartup(params ...string) []byte {
+	body := binary.BigEndian.AppendUint32(nil, protocolVersion3)
+	for _, p := range params {
+		body = append(body, p...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body)+4)), body...)
+}
+
+func encode(typ byte, body []byte) []byte {
+	raw := make([]byte, 5, len(body)+5)
+	raw[0] = typ
+	binary.BigEndian.PutUint32(raw[1:], uint32(len(body)+4))
+	return append(raw, body...)
+}
+
+//--------------framing----------------
+
+// ReadStartup reads an untyped startup-phase packet and returns its raw
+// bytes along with the decoded message.
+func ReadStartup(r io.Reader) ([]byte, any, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 8 || n > maxStartupSize {
+		return nil, nil, fmt.Errorf("postgres: invalid startup packet length %d", n)
+	}
+	raw := make([]byte, n)
+	copy(raw, hdr[:])
+	if _, err := io.ReadFull(r, raw[4:]); err != nil {
+		return nil, nil, unexpected(err)
+	}
+
+	code := binary.BigEndian.Uint32(raw[4:8])
+	switch code {
+	case sslRequestCode:
+		return raw, &SSLRequest{}, nil
+	case gssEncRequestCode:
+		return raw, &GSSENCRequest{}, nil
+	case cancelRequestCode:
+		if n != 16 {
+			return nil, nil, errMalformed
+		}
+		return raw, &CancelRequest{
+			ProcessID: binary.BigEndian.Uint32(raw[8:12]),
+			SecretKey: binary.BigEndian.Uint32(raw[12:16]),
+		}, nil
+	}
+
+	if code&0xffff0000 != protocolVersion3 {
+		return nil, nil, fmt.Errorf("postgres: unsupported protocol version %d.%d", code>>16, code&0xffff)
+	}
+	msg := &StartupMessage{ProtocolVersion: code, Parameters: make(map[string]string)}
+	b := &buffer{data: raw[8:]}
+	for {
+		key := b.cstring()
+		if b.err != nil || key == "" {
+			break
+		}
+		msg.Parameters[key] = b.cstring()
+	}
+	if b.err != nil {
+		return nil, nil, b.err
+	}
+	return raw, msg, nil
+}
+
+// Header is the type byte and length word every typed message starts
+// with.
+type Header [5]byte
+
+func (h Header) Type() byte {
+	return h[0]
+}
+
+// Len returns the length of the body following the header.
+func (h Header) Len() int {
+	return int(binary.BigEndian.Uint32(h[1:])) - 4
+}
+
+// ReadHeader reads the header of a message, rejecting one longer than
+// limit bytes, its type byte excluded.
+func ReadHeader(r io.Reader, limit uint32) (Header, error) {
+	var h Header
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return h, err
+	}
+	if n := binary.BigEndian.Uint32(h[1:]); n < 4 || n > limit {
+		return h, fmt.Errorf("postgres: invalid length %d for message %q", n, h[0])
+	}
+	return h, nil
+}
+
+// ReadBody reads the body following h. The buffer grows as the bytes
+// arrive, so a length announced in a header commits no memory the peer
+// does not actually send.
+func ReadBody(r io.Reader, h Header) (Message, error) {
+	raw := h[:]
+	want := len(h) + h.Len()
+	for len(raw) < want {
+		if len(raw) == cap(raw) {
+			raw = slices.Grow(raw, min(want-len(raw), max(len(raw), 4096)))
+		}
+		n, err := r.Read(raw[len(raw):min(cap(raw), want)])
+		raw = raw[:len(raw)+n]
+		if err != nil && len(raw) < want {
+			return Message{}, unexpected(err)
+		}
+	}
+	return Message{Type: h.Type(), Raw: raw}, nil
+}
+
+// CopyBody copies the body following h from r to w without buffering it.
+func CopyBody(w io.Writer, r io.Reader, h Header) error {
+	_, err := io.CopyN(w, r, int64(h.Len()))
+	return unexpected(err)
+}
+
+// ReadMessage reads a whole message of at most limit bytes.
+func ReadMessage(r io.Reader, limit uint32) (Message, error) {
+	h, err := ReadHeader(r, limit)
+	if err != nil {
+		return Message{}, err
+	}
+	return ReadBody(r, h)
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//--------------decoding----------------
+
+// DecodeFrontend decodes the client messages the firewall cares about.
+// Other message types decode to nil.
+func DecodeFrontend(m Message) (any, error) {
+	b := &buffer{data: m.Body()}
+	var msg any
+	switch m.Type {
+	case 'Q':
+		msg = &Query{String: b.cstring()}
+	case 'P':
+		p := &Parse{Name: b.cstring(), Query: b.cstring()}
+		n := b.int16()
+		for i := 0; i < int(n) && b.err == nil; i++ {
+			p.ParamTypes = append(p.ParamTypes, b.uint32())
+		}
+		msg = p
+	case 'B':
+		bind := &Bind{Portal: b.cstring(), Statement: b.cstring()}
+		bind.ParamFormats = b.int16s()
+		n := b.int16()
+		for i := 0; i < int(n) && b.err == nil; i++ {
+			size := int32(b.uint32())
+			if size < 0 {
+				bind.Params = append(bind.Params, nil)
+				continue
+			}
+			bind.Params = append(bind.Params, b.bytes(int(size)))
+		}
+		bind.ResultFormats = b.int16s()
+		msg = bind
+	case 'E':
+		msg = &Execute{Portal: b.cstring(), MaxRows: b.uint32()}
+	case 'C':
+		msg = &Close{Target: b.byte(), Name: b.cstring()}
+	default:
+		return nil, nil
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("postgres: decoding %q: %w", m.Type, b.err)
+	}
+	return msg, nil
+}
+
+// DecodeBackend decodes the server messages the firewall cares about.
+// Other message types decode to nil.
+func DecodeBackend(m Message) (any, error) {
+	b := &buffer{data: m.Body()}
+	var msg any
+	switch m.Type {
+	case 'E':
+		e := &ErrorResponse{Fields: make(map[byte]string)}
+		for {
+			code := b.byte()
+			if b.err != nil || code == 0 {
+				break
+			}
+			e.Fields[code] = b.cstring()
+		}
+		msg = e
+	case 'Z':
+		msg = &ReadyForQuery{TxStatus: b.byte()}
+	case 'R':
+		a := &Authentication{Code: b.uint32()}
+		a.Data = b.data
+		msg = a
+	default:
+		return nil, nil
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("postgres: decoding %q: %w", m.Type, b.err)
+	}
+	return msg, nil
+}
+
+type buffer struct {
+	data []byte
+	err  error
+}
+
+func (b *buffer) take(n int) []byte {
+	if b.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(b.data) {
+		b.err = errMalformed
+		return nil
+	}
+	v := b.data[:n]
+	b.data = b.data[n:]
+	return v
+}
+
+func (b *buffer) byte() byte {
+	v := b.take(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (b *buffer) int16() int16 {
+	v := b.take(2)
+	if v == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(v))
+}
+
+func (b *buffer) int16s() []int16 {
+	n := b.int16()
+	var out []int16
+	for i := 0; i < int(n) && b.err == nil; i++ {
+		out = append(out, b.int16())
+	}
+	return out
+}
+
+func (b *buffer) uint32() uint32 {
+	v := b.take(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (b *buffer) bytes(n int) []byte {
+	return b.take(n)
+}
+
+func (b *buffer) cstring() string {
+	if b.err != nil {
+		return ""
+	}
+	for i, c := range b.data {
+		if c == 0 {
+			s := string(b.data[:i])
+			b.data = b.data[i+1:]
+			return s
+		}
+	}
+	b.err = errMalformed
+	return ""
+}
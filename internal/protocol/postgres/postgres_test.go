@@ -0,0 +1,720 @@
+package postgres
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/tlsconfig/tlstest"
+)
+
+/*
+-------------------------------------------------
+Helpers
+-------------------------------------------------
+*/
+
+func startupPacket(params ...string) []byte {
+	body := binary.BigEndian.AppendUint32(nil, protocolVersion3)
+	for _, p := range params {
+		body = append(body, p...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body)+4)), body...)
+}
+
+func sslRequestPacket() []byte {
+	b := binary.BigEndian.AppendUint32(nil, 8)
+	return binary.BigEndian.AppendUint32(b, sslRequestCode)
+}
+
+func message(typ byte, parts ...[]byte) []byte {
+	body := bytes.Join(parts, nil)
+	b := append([]byte{typ}, binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	return append(b, body...)
+}
+
+func cstr(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+type pipes struct {
+	client, server         net.Conn // the peers talking to the proxy
+	proxyClient, proxyServ net.Conn // the proxy's ends
+}
+
+func newPipes(t *testing.T) *pipes {
+	t.Helper()
+	p := &pipes{}
+	p.client, p.proxyClient = net.Pipe()
+	p.proxyServ, p.server = net.Pipe()
+	t.Cleanup(func() {
+		p.client.Close()
+		p.server.Close()
+		p.proxyClient.Close()
+		p.proxyServ.Close()
+	})
+	for _, c := range []net.Conn{p.client, p.server, p.proxyClient, p.proxyServ} {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+	}
+	return p
+}
+
+func readN(t *testing.T, c net.Conn, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	return b
+}
+
+/*
+-------------------------------------------------
+Test: decoding
+-------------------------------------------------
+*/
+func TestReadStartup_StartupMessage(t *testing.T) {
+	pkt := startupPacket("user", "alice", "database", "app")
+	raw, msg, err := ReadStartup(bytes.NewReader(pkt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, pkt) {
+		t.Fatal("raw startup bytes differ from input")
+	}
+	sm, ok := msg.(*StartupMessage)
+	if !ok {
+		t.Fatalf("expected *StartupMessage, got %T", msg)
+	}
+	if sm.Parameters["user"] != "alice" || sm.Parameters["database"] != "app" {
+		t.Fatalf("unexpected parameters: %v", sm.Parameters)
+	}
+}
+
+func TestReadStartup_SSLRequest(t *testing.T) {
+	_, msg, err := ReadStartup(bytes.NewReader(sslRequestPacket()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*SSLRequest); !ok {
+		t.Fatalf("expected *SSLRequest, got %T", msg)
+	}
+}
+
+func TestDecodeFrontend_ExtendedQuery(t *testing.T) {
+	stream := bytes.Join([][]byte{
+		message('P', cstr("s1"), cstr("SELECT $1"), u16(1), u32(23)),
+		message('B', cstr("p1"), cstr("s1"), u16(0), u16(1), u32(1), []byte("7"), u16(0)),
+		message('E', cstr("p1"), u32(0)),
+	}, nil)
+	r := bytes.NewReader(stream)
+
+	var decoded []any
+	for i := 0; i < 3; i++ {
+		m, err := ReadMessage(r, MaxMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := DecodeFrontend(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, msg)
+	}
+
+	p := decoded[0].(*Parse)
+	if p.Name != "s1" || p.Query != "SELECT $1" || len(p.ParamTypes) != 1 || p.ParamTypes[0] != 23 {
+		t.Fatalf("unexpected parse: %+v", p)
+	}
+	b := decoded[1].(*Bind)
+	if b.Portal != "p1" || b.Statement != "s1" || len(b.Params) != 1 || string(b.Params[0]) != "7" {
+		t.Fatalf("unexpected bind: %+v", b)
+	}
+	e := decoded[2].(*Execute)
+	if e.Portal != "p1" {
+		t.Fatalf("unexpected execute: %+v", e)
+	}
+}
+
+func TestDecodeBackend_ErrorAndReady(t *testing.T) {
+	errMsg := message('E', []byte{'S'}, cstr("ERROR"), []byte{'C'}, cstr("42P01"), []byte{'M'}, cstr("no such table"), []byte{0})
+	m, err := ReadMessage(bytes.NewReader(errMsg), MaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := DecodeBackend(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := msg.(*ErrorResponse)
+	if e.Severity() != "ERROR" || e.Code() != "42P01" || e.Message() != "no such table" {
+		t.Fatalf("unexpected error fields: %v", e.Fields)
+	}
+
+	m, err = ReadMessage(bytes.NewReader(message('Z', []byte{'T'})), MaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = DecodeBackend(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.(*ReadyForQuery).TxStatus != 'T' {
+		t.Fatal("expected in-transaction status")
+	}
+}
+
+func TestReadMessage_RejectsOversizedLength(t *testing.T) {
+	hdr := append([]byte{'Q'}, u32(MaxMessageSize+1)...)
+	if _, err := ReadMessage(bytes.NewReader(hdr), MaxMessageSize); err == nil {
+		t.Fatal("expected error for oversized message")
+	}
+}
+
+func TestReadBody_AllocatesAsBytesArrive(t *testing.T) {
+	// a header announcing the largest message, then a few bytes and EOF
+	data := append([]byte{'Q'}, u32(MaxMessageSize)...)
+	data = append(data, "SELECT"...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadMessage(bytes.NewReader(data), MaxMessageSize)
+	runtime.ReadMemStats(&after)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected a truncated message, got %v", err)
+	}
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("expected no allocation for bytes never sent, got %d bytes", n)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: session forwarding and hooks
+-------------------------------------------------
+*/
+func TestSession_ForwardsUntouchedAndExposesStatements(t *testing.T) {
+	p := newPipes(t)
+
+	var seen []*protocol.Statement
+	s := NewSession(protocol.Info{ClientIP: net.ParseIP("10.0.0.1")}, protocol.HookFunc(func(st *protocol.Statement) error {
+		seen = append(seen, st)
+		return nil
+	}))
+
+	startup := startupPacket("user", "alice", "database", "app")
+	go p.client.Write(startup)
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := s.Startup(p.proxyClient, p.proxyServ)
+		errc <- err
+	}()
+
+	if got := readN(t, p.server, len(startup)); !bytes.Equal(got, startup) {
+		t.Fatal("startup packet modified in transit")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	go s.ClientToServer(p.proxyClient, p.proxyServ)
+	go s.ServerToClient(p.proxyServ, p.proxyClient)
+
+	query := message('Q', cstr("SELECT 1"))
+	go p.client.Write(query)
+	if got := readN(t, p.server, len(query)); !bytes.Equal(got, query) {
+		t.Fatal("query modified in transit")
+	}
+
+	if len(seen) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(seen))
+	}
+	st := seen[0]
+	if st.Kind != protocol.KindQuery || st.Text != "SELECT 1" || st.User != "alice" || st.Database != "app" || st.Protocol != "postgres" {
+		t.Fatalf("unexpected statement: %+v", st)
+	}
+}
+
+func TestSession_IdleFollowsReadyForQuery(t *testing.T) {
+	p := newPipes(t)
+	s := NewSession(protocol.Info{}, nil)
+	startup := startupPacket("user", "alice")
+	go p.client.Write(startup)
+	go io.ReadFull(p.server, make([]byte, len(startup)))
+	if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err != nil {
+		t.Fatal(err)
+	}
+	go s.ClientToServer(p.proxyClient, p.proxyServ)
+	go s.ServerToClient(p.proxyServ, p.proxyClient)
+	if s.Idle() {
+		t.Fatal("expected session not to be idle before the first ReadyForQuery")
+	}
+
+	exchange := func(sql string, status byte) {
+		t.Helper()
+		q := message('Q', cstr(sql))
+		go p.client.Write(q)
+		readN(t, p.server, len(q))
+		if s.Idle() {
+			t.Fatalf("%s: expected session with a query in flight not to be idle", sql)
+		}
+		ready := message('Z', []byte{status})
+		go p.server.Write(ready)
+		readN(t, p.client, len(ready))
+	}
+
+	ready := message('Z', []byte{'I'})
+	go p.server.Write(ready)
+	readN(t, p.client, len(ready))
+	if !s.Idle() {
+		t.Fatal("expected session to be idle")
+	}
+	exchange("BEGIN", 'T')
+	if s.Idle() {
+		t.Fatal("expected session in a transaction not to be idle")
+	}
+	exchange("COMMIT", 'I')
+	if !s.Idle() {
+		t.Fatal("expected session to be idle after COMMIT")
+	}
+}
+
+func TestSession_AuthFailed(t *testing.T) {
+	for code, want := range map[string]bool{"28P01": true, "53300": false} {
+		p := newPipes(t)
+		s := NewSession(protocol.Info{}, nil)
+		startup := startupPacket("user", "alice")
+		go p.client.Write(startup)
+		go io.ReadFull(p.server, make([]byte, len(startup)))
+		if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err != nil {
+			t.Fatal(err)
+		}
+		go s.ServerToClient(p.proxyServ, p.proxyClient)
+
+		e := message('E', []byte{'S'}, cstr("FATAL"), []byte{'C'}, cstr(code), []byte{'M'}, cstr("refused"), []byte{0})
+		go p.server.Write(e)
+		readN(t, p.client, len(e))
+		if s.AuthFailed() != want {
+			t.Fatalf("%s: expected AuthFailed %v", code, want)
+		}
+	}
+}
+
+/*
+-------------------------------------------------
+Test: messages the session does not decode are
+streamed whatever their size, and client messages
+are bounded before login
+-------------------------------------------------
+*/
+func TestSession_StreamsLargeMessages(t *testing.T) {
+	p := newPipes(t)
+	s := NewSession(protocol.Info{}, nil)
+	startup := startupPacket("user", "alice")
+	go p.client.Write(startup)
+	go io.ReadFull(p.server, make([]byte, len(startup)))
+	if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err != nil {
+		t.Fatal(err)
+	}
+	go s.ClientToServer(p.proxyClient, p.proxyServ)
+	go s.ServerToClient(p.proxyServ, p.proxyClient)
+	ready := message('Z', []byte{'I'})
+	go p.server.Write(ready)
+	readN(t, p.client, len(ready))
+
+	// a DataRow larger than anything the proxy decodes
+	size := MaxMessageSize + 1
+	go func() {
+		p.server.Write(append([]byte{'D'}, u32(uint32(size+4))...))
+		p.server.Write(make([]byte, size))
+	}()
+	h, err := ReadHeader(p.client, math.MaxUint32)
+	if err != nil || h.Type() != 'D' || h.Len() != size {
+		t.Fatalf("unexpected header %v: %v", h, err)
+	}
+	if n, err := io.CopyN(io.Discard, p.client, int64(size)); err != nil {
+		t.Fatalf("relayed %d of %d bytes: %v", n, size, err)
+	}
+}
+
+func TestSession_BoundsClientMessagesBeforeLogin(t *testing.T) {
+	p := newPipes(t)
+	s := NewSession(protocol.Info{}, nil)
+	startup := startupPacket("user", "alice")
+	go p.client.Write(startup)
+	go io.ReadFull(p.server, make([]byte, len(startup)))
+	if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err != nil {
+		t.Fatal(err)
+	}
+	go p.client.Write(append([]byte{'p'}, u32(maxAuthMessageSize+1)...))
+	if err := s.ClientToServer(p.proxyClient, p.proxyServ); err == nil || !strings.Contains(err.Error(), "invalid length") {
+		t.Fatalf("expected an oversized password message to be refused, got %v", err)
+	}
+}
+
+// startDenying runs a session whose hook rejects every statement through
+// startup and the initial ReadyForQuery.
+func startDenying(t *testing.T, p *pipes) *Session {
+	t.Helper()
+	s := NewSession(protocol.Info{}, protocol.HookFunc(func(st *protocol.Statement) error {
+		return &protocol.DenyError{Reason: "test", Message: "nope"}
+	}))
+
+	startup := startupPacket("user", "alice")
+	go p.client.Write(startup)
+	go io.ReadFull(p.server, make([]byte, len(startup)))
+	if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err != nil {
+		t.Fatal(err)
+	}
+	go s.ClientToServer(p.proxyClient, p.proxyServ)
+	go s.ServerToClient(p.proxyServ, p.proxyClient)
+
+	ready := message('Z', []byte{'I'})
+	go p.server.Write(ready)
+	readN(t, p.client, len(ready))
+	return s
+}
+
+func expectDenied(t *testing.T, p *pipes) {
+	t.Helper()
+	m, err := ReadMessage(p.client, MaxMessageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := DecodeBackend(m)
+	e, ok := msg.(*ErrorResponse)
+	if !ok || e.Code() != "42501" || e.Message() != "nope" {
+		t.Fatalf("expected deny ErrorResponse, got %q %+v", m.Type, msg)
+	}
+	if m, err = ReadMessage(p.client, MaxMessageSize); err != nil || m.Type != 'Z' {
+		t.Fatalf("expected ReadyForQuery after error, got %q err=%v", m.Type, err)
+	}
+}
+
+func TestSession_DeniedQueryAnsweredWithErrorResponse(t *testing.T) {
+	p := newPipes(t)
+	startDenying(t, p)
+
+	go p.client.Write(message('Q', cstr("DROP TABLE users")))
+	if got := readN(t, p.server, len(syncMessage)); !bytes.Equal(got, syncMessage) {
+		t.Fatalf("expected denied query to be replaced by Sync, got %q", got)
+	}
+
+	go p.server.Write(message('Z', []byte{'I'}))
+	expectDenied(t, p)
+}
+
+func TestDenyResponse_RateLimitedCode(t *testing.T) {
+	e := DenyResponse(&protocol.DenyError{Reason: "rate_limit_query_user", Message: "slow down", Limited: true})
+	if e.Code() != "53400" || e.Message() != "slow down" {
+		t.Fatalf("expected configuration_limit_exceeded, got %s %q", e.Code(), e.Message())
+	}
+}
+
+func TestSession_DeniedParseSkipsToSync(t *testing.T) {
+	p := newPipes(t)
+	startDenying(t, p)
+
+	batch := bytes.Join([][]byte{
+		message('P', cstr(""), cstr("DROP TABLE users"), u16(0)),
+		message('B', cstr(""), cstr(""), u16(0), u16(0), u16(0)),
+		message('E', cstr(""), u32(0)),
+		syncMessage,
+	}, nil)
+	go p.client.Write(batch)
+	if got := readN(t, p.server, len(syncMessage)); !bytes.Equal(got, syncMessage) {
+		t.Fatalf("expected only Sync to reach the server, got %q", got)
+	}
+
+	go p.server.Write(message('Z', []byte{'I'}))
+	expectDenied(t, p)
+}
+
+func TestSession_SSLRequestDeclinedWithoutClientTLS(t *testing.T) {
+	p := newPipes(t)
+	s := NewSession(protocol.Info{}, nil)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := s.Startup(p.proxyClient, p.proxyServ)
+		errc <- err
+	}()
+
+	go p.client.Write(sslRequestPacket())
+	if got := readN(t, p.client, 1); got[0] != 'N' {
+		t.Fatalf("expected SSLRequest to be declined, got %q", got)
+	}
+
+	startup := startupPacket("user", "alice")
+	go p.client.Write(startup)
+	if got := readN(t, p.server, len(startup)); !bytes.Equal(got, startup) {
+		t.Fatalf("expected only the startup packet upstream, got %q", got)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if s.Passthrough() || s.Info().User != "alice" {
+		t.Fatal("expected inspection to continue in plaintext")
+	}
+}
+
+func TestSession_TerminatesClientTLSInBand(t *testing.T) {
+	p := newPipes(t)
+	ca := tlstest.NewCA(t)
+	cert := ca.Issue(t, "firewall", "firewall")
+	s := NewSession(protocol.Info{}, nil)
+	s.SetTLS(protocol.TLS{Client: &tls.Config{Certificates: []tls.Certificate{cert.TLS}}})
+
+	type result struct {
+		client net.Conn
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, _, err := s.Startup(p.proxyClient, p.proxyServ)
+		done <- result{client, err}
+	}()
+
+	go p.client.Write(sslRequestPacket())
+	if got := readN(t, p.client, 1); got[0] != 'S' {
+		t.Fatalf("expected SSLRequest to be accepted, got %q", got)
+	}
+	tc := tls.Client(p.client, &tls.Config{RootCAs: ca.Pool, ServerName: "firewall"})
+	startup := startupPacket("user", "alice")
+	go tc.Write(startup)
+
+	if got := readN(t, p.server, len(startup)); !bytes.Equal(got, startup) {
+		t.Fatal("expected decrypted startup packet upstream")
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if _, ok := r.client.(*tls.Conn); !ok {
+		t.Fatalf("expected Startup to return the TLS client connection, got %T", r.client)
+	}
+}
+
+func TestSession_OriginatesUpstreamTLSInBand(t *testing.T) {
+	p := newPipes(t)
+	ca := tlstest.NewCA(t)
+	cert := ca.Issue(t, "db", "db")
+	s := NewSession(protocol.Info{}, nil)
+	s.SetTLS(protocol.TLS{Upstream: &tls.Config{RootCAs: ca.Pool, ServerName: "db"}})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := s.Startup(p.proxyClient, p.proxyServ)
+		errc <- err
+	}()
+
+	startup := startupPacket("user", "alice")
+	go p.client.Write(startup)
+	if got := readN(t, p.server, 8); !bytes.Equal(got, sslRequestPacket()) {
+		t.Fatalf("expected SSLRequest upstream, got %q", got)
+	}
+	go p.server.Write([]byte{'S'})
+	tc := tls.Server(p.server, &tls.Config{Certificates: []tls.Certificate{cert.TLS}})
+	if got := readN(t, tc, len(startup)); !bytes.Equal(got, startup) {
+		t.Fatal("expected startup packet over upstream TLS")
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSession_RejectsDataPipelinedAfterSSLRequest(t *testing.T) {
+	p := newPipes(t)
+	s := NewSession(protocol.Info{}, nil)
+
+	go p.client.Write(append(sslRequestPacket(), startupPacket("user", "mallory")...))
+	if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err == nil {
+		t.Fatal("expected error for data sent before the SSL answer")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: read/write splitting
+-------------------------------------------------
+*/
+
+// startSplit runs a session with read/write splitting through startup and
+// the initial ReadyForQuery. Statements starting with SELECT are read-only
+// and ones starting with SET pin the session to the primary.
+func startSplit(t *testing.T, p *pipes, dial func() (net.Conn, *tls.Config, error)) *Session {
+	t.Helper()
+	s := NewSession(protocol.Info{}, nil)
+	s.SetSplit(&protocol.Split{
+		ReadOnly: func(st *protocol.Statement) bool { return strings.HasPrefix(st.Text, "SELECT") },
+		Pins:     func(st *protocol.Statement) bool { return strings.HasPrefix(st.Text, "SET") },
+		Dial:     dial,
+		User:     "reader",
+		Password: "secret",
+	})
+
+	startup := startupPacket("user", "alice", "database", "app")
+	go p.client.Write(startup)
+	go io.ReadFull(p.server, make([]byte, len(startup)))
+	if _, _, err := s.Startup(p.proxyClient, p.proxyServ); err != nil {
+		t.Fatal(err)
+	}
+	go s.ClientToServer(p.proxyClient, p.proxyServ)
+	go s.ServerToClient(p.proxyServ, p.proxyClient)
+
+	ready := message('Z', []byte{'I'})
+	go p.server.Write(ready)
+	readN(t, p.client, len(ready))
+	return s
+}
+
+// fakeReplica authenticates the session with MD5 and answers each query
+// with CommandComplete and ReadyForQuery.
+func fakeReplica(t *testing.T, conn net.Conn, queries chan<- string) {
+	_, msg, err := ReadStartup(conn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	sm := msg.(*StartupMessage)
+	if sm.Parameters["user"] != "reader" || sm.Parameters["database"] != "app" {
+		t.Errorf("unexpected replica startup %v", sm.Parameters)
+	}
+	salt := []byte{1, 2, 3, 4}
+	conn.Write(message('R', u32(AuthMD5), salt))
+	m, err := ReadMessage(conn, MaxMessageSize)
+	if err != nil || string(m.Body()) != md5Password("reader", "secret", salt)+"\x00" {
+		t.Errorf("unexpected password message %q (%v)", m.Raw, err)
+		return
+	}
+	conn.Write(bytes.Join([][]byte{message('R', u32(AuthOK)), message('Z', []byte{'I'})}, nil))
+
+	for {
+		m, err := ReadMessage(conn, MaxMessageSize)
+		if err != nil {
+			return
+		}
+		q, _ := DecodeFrontend(m)
+		queries <- q.(*Query).String
+		conn.Write(bytes.Join([][]byte{message('C', cstr("SELECT 1")), message('Z', []byte{'I'})}, nil))
+	}
+}
+
+func expectReplicaAnswer(t *testing.T, p *pipes) {
+	t.Helper()
+	for _, typ := range []byte{'C', 'Z'} {
+		m, err := ReadMessage(p.client, MaxMessageSize)
+		if err != nil || m.Type != typ {
+			t.Fatalf("expected %q from the replica, got %q (%v)", typ, m.Type, err)
+		}
+	}
+}
+
+func TestSession_RoutesReadsToReplica(t *testing.T) {
+	p := newPipes(t)
+	proxyRep, rep := net.Pipe()
+	t.Cleanup(func() { proxyRep.Close(); rep.Close() })
+	rep.SetDeadline(time.Now().Add(2 * time.Second))
+	queries := make(chan string, 4)
+	go fakeReplica(t, rep, queries)
+
+	startSplit(t, p, func() (net.Conn, *tls.Config, error) { return proxyRep, nil, nil })
+
+	go p.client.Write(message('Q', cstr("SELECT * FROM orders")))
+	expectReplicaAnswer(t, p)
+	if q := <-queries; q != "SELECT * FROM orders" {
+		t.Fatalf("unexpected replica query %q", q)
+	}
+
+	// writes go to the primary, which reports an open transaction
+	write := message('Q', cstr("INSERT INTO orders VALUES (1)"))
+	go p.client.Write(write)
+	if got := readN(t, p.server, len(write)); !bytes.Equal(got, write) {
+		t.Fatalf("expected write on the primary, got %q", got)
+	}
+	inTx := message('Z', []byte{'T'})
+	go p.server.Write(inTx)
+	readN(t, p.client, len(inTx))
+
+	// so reads stay there until it ends
+	read := message('Q', cstr("SELECT * FROM orders"))
+	go p.client.Write(read)
+	if got := readN(t, p.server, len(read)); !bytes.Equal(got, read) {
+		t.Fatalf("expected read inside a transaction on the primary, got %q", got)
+	}
+	idle := message('Z', []byte{'I'})
+	go p.server.Write(idle)
+	readN(t, p.client, len(idle))
+
+	go p.client.Write(read)
+	expectReplicaAnswer(t, p)
+	<-queries
+}
+
+func TestSession_UnreachableReplicaFallsBackToPrimary(t *testing.T) {
+	p := newPipes(t)
+	startSplit(t, p, func() (net.Conn, *tls.Config, error) { return nil, nil, io.ErrClosedPipe })
+
+	read := message('Q', cstr("SELECT 1"))
+	go p.client.Write(read)
+	if got := readN(t, p.server, len(read)); !bytes.Equal(got, read) {
+		t.Fatalf("expected read on the primary, got %q", got)
+	}
+}
+
+func TestSession_StateChangePinsToPrimary(t *testing.T) {
+	p := newPipes(t)
+	startSplit(t, p, func() (net.Conn, *tls.Config, error) {
+		t.Error("expected no replica after SET")
+		return nil, nil, io.ErrClosedPipe
+	})
+
+	set := message('Q', cstr("SET search_path TO app"))
+	go p.client.Write(set)
+	if got := readN(t, p.server, len(set)); !bytes.Equal(got, set) {
+		t.Fatalf("expected SET on the primary, got %q", got)
+	}
+	idle := message('Z', []byte{'I'})
+	go p.server.Write(idle)
+	readN(t, p.client, len(idle))
+
+	read := message('Q', cstr("SELECT * FROM orders"))
+	go p.client.Write(read)
+	if got := readN(t, p.server, len(read)); !bytes.Equal(got, read) {
+		t.Fatalf("expected read after SET on the primary, got %q", got)
+	}
+}
+
+// RFC 7677 section 3.
+func TestSCRAM_RFC7677(t *testing.T) {
+	c := &scram{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if got := string(c.clientFirst()); got != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("unexpected client-first %q", got)
+	}
+	final, err := c.clientFinal([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(final) != want {
+		t.Fatalf("unexpected client-final %q", final)
+	}
+	if err := c.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verify([]byte("v=AAAA")); err == nil {
+		t.Fatal("expected a wrong server signature to fail")
+	}
+}
@@ -0,0 +1,236 @@
+package postgres
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"time"
+
+	"database_firewall/internal/logging"
+	"database_firewall/internal/protocol"
+)
+
+// replica is a session's connection to a read replica, opened on the
+// first statement routed to one.
+type replica struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// SetSplit enables read/write splitting. It must be called before Startup.
+func (s *Session) SetSplit(sp *protocol.Split) {
+	s.split = sp
+}
+
+// readOnly reports whether st may go to a replica, remembering when the
+// session last sent anything else and keeping it on the primary once it
+// changed its state.
+func (s *Session) readOnly(st *protocol.Statement) bool {
+	if s.split == nil || st == nil {
+		return false
+	}
+	if s.split.Pins != nil && s.split.Pins(st) {
+		s.noReplica = true
+	}
+	if !s.split.ReadOnly(st) {
+		s.lastWrite = time.Now()
+		return false
+	}
+	return true
+}
+
+// toReplica reports whether a read-only simple query can run on the
+// replica: nothing is outstanding on the primary, which is idle outside a
+// transaction, and the sticky period after the last write has passed.
+func (s *Session) toReplica() bool {
+	if s.noReplica || s.batch || time.Since(s.lastWrite) < s.split.Sticky {
+		return false
+	}
+	return s.Idle()
+}
+
+// replicaQuery runs a simple query on the replica and relays the response
+// up to its ReadyForQuery. It reports false, leaving the query to the
+// primary, when the replica cannot be reached or fails before answering;
+// the session then stays on the primary.
+func (s *Session) replicaQuery(m Message) (bool, error) {
+	if s.replica == nil {
+		rep, err := s.dialReplica()
+		if err != nil {
+			s.replicaFailed(err)
+			return false, nil
+		}
+		s.replica = rep
+	}
+	if _, err := s.replica.conn.Write(m.Raw); err != nil {
+		s.replicaFailed(err)
+		return false, nil
+	}
+
+	relayed := false
+	for {
+		h, err := ReadHeader(s.replica.r, math.MaxUint32)
+		if err != nil && !relayed {
+			s.replicaFailed(err)
+			return false, nil
+		}
+		if err != nil {
+			return true, unexpected(err)
+		}
+		relayed = true
+		if err := s.relay(s.replica.r, h); err != nil {
+			return true, err
+		}
+		if h.Type() == 'Z' {
+			return true, nil
+		}
+	}
+}
+
+// relay streams the message with header h from r to the client as it is
+// read, flushing at a ReadyForQuery or once r has nothing more buffered.
+func (s *Session) relay(r *bufio.Reader, h Header) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.cw.Write(h[:]); err != nil {
+		return err
+	}
+	if err := CopyBody(s.cw, r, h); err != nil {
+		return err
+	}
+	if h.Type() == 'Z' || r.Buffered() == 0 {
+		return s.cw.Flush()
+	}
+	return nil
+}
+
+func (s *Session) replicaFailed(err error) {
+	s.closeReplica()
+	s.noReplica = true
+	logging.LogEvent("WARN", "replica_unavailable", map[string]any{
+		"client_ip": s.info.ClientIP.String(),
+		"protocol":  s.info.Protocol,
+		"error":     err.Error(),
+	})
+}
+
+func (s *Session) closeReplica() {
+	if s.replica != nil {
+		s.replica.conn.Close()
+		s.replica = nil
+	}
+}
+
+func (s *Session) dialReplica() (*replica, error) {
+	conn, t, err := s.split.Dial()
+	if err != nil {
+		return nil, err
+	}
+	rep := &replica{conn: conn, r: bufio.NewReader(conn)}
+	if err := rep.login(t, s.split.User, s.split.Password, s.info.Database); err != nil {
+		rep.conn.Close()
+		return nil, err
+	}
+	return rep, nil
+}
+
+// login negotiates TLS when t is set and authenticates with cleartext,
+// MD5 or SCRAM-SHA-256, returning at the first ReadyForQuery.
+func (rep *replica) login(t *tls.Config, user, password, database string) error {
+	if t != nil {
+		if _, err := rep.conn.Write(SSLRequestMessage); err != nil {
+			return err
+		}
+		resp, err := rep.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		if resp != 'S' || rep.r.Buffered() > 0 {
+			return fmt.Errorf("postgres: replica declined TLS")
+		}
+		tc := tls.Client(rep.conn, t)
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		rep.conn, rep.r = tc, bufio.NewReader(tc)
+	}
+
+	if _, err := rep.conn.Write(EncodeStartup("user", user, "database", database)); err != nil {
+		return err
+	}
+	var sc *scram
+	for {
+		m, err := ReadMessage(rep.r, MaxMessageSize)
+		if err != nil {
+			return unexpected(err)
+		}
+		msg, err := DecodeBackend(m)
+		if err != nil {
+			return err
+		}
+
+		var resp []byte
+		switch v := msg.(type) {
+		case *ErrorResponse:
+			return fmt.Errorf("postgres: replica: %s", v.Message())
+		case *ReadyForQuery:
+			return nil
+		case *Authentication:
+			switch v.Code {
+			case AuthOK:
+			case AuthCleartext:
+				resp = append([]byte(password), 0)
+			case AuthMD5:
+				if len(v.Data) < 4 {
+					return errMalformed
+				}
+				resp = append([]byte(md5Password(user, password, v.Data[:4])), 0)
+			case AuthSASL:
+				if !slices.Contains(cstrings(v.Data), scramMechanism) {
+					return fmt.Errorf("postgres: replica offers no supported SASL mechanism")
+				}
+				sc = newSCRAM(password)
+				first := sc.clientFirst()
+				resp = append([]byte(scramMechanism), 0)
+				resp = binary.BigEndian.AppendUint32(resp, uint32(len(first)))
+				resp = append(resp, first...)
+			case AuthSASLContinue:
+				if sc == nil {
+					return errMalformed
+				}
+				if resp, err = sc.clientFinal(v.Data); err != nil {
+					return err
+				}
+			case AuthSASLFinal:
+				if sc == nil {
+					return errMalformed
+				}
+				if err := sc.verify(v.Data); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("postgres: unsupported replica authentication %d", v.Code)
+			}
+		}
+		if resp != nil {
+			if _, err := rep.conn.Write(encode('p', resp)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func cstrings(data []byte) []string {
+	b := &buffer{data: data}
+	var out []string
+	for len(b.data) > 0 && b.err == nil {
+		if s := b.cstring(); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
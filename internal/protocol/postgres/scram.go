@@ -0,0 +1,107 @@
+package postgres
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const scramMechanism = "SCRAM-SHA-256"
+
+// scram is the client side of a SCRAM-SHA-256 exchange (RFC 7677). The
+// server takes the user from the startup packet, so user is normally left
+// empty.
+type scram struct {
+	user, password string
+	nonce          string
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAM(password string) *scram {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return &scram{password: password, nonce: base64.StdEncoding.EncodeToString(b)}
+}
+
+func (c *scram) clientFirst() []byte {
+	c.clientFirstBare = "n=" + c.user + ",r=" + c.nonce
+	return []byte("n,," + c.clientFirstBare)
+}
+
+func (c *scram) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	nonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, fmt.Errorf("postgres: SCRAM server nonce mismatch")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: SCRAM salt: %w", err)
+	}
+	n, err := strconv.Atoi(iter)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("postgres: SCRAM iteration count %q", iter)
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, c.password, salt, n, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server signature, proving the server knows the
+// password too.
+func (c *scram) verify(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("postgres: SCRAM: %s", e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(sig, c.serverSignature) {
+		return fmt.Errorf("postgres: SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+func scramAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// md5Password answers an MD5 authentication request.
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
@@ -0,0 +1,487 @@
+package postgres
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"database_firewall/internal/protocol"
+)
+
+var _ protocol.Session = (*Session)(nil)
+
+type Session struct {
+	info protocol.Info
+	hook protocol.Hook
+	tls  protocol.TLS
+
+	cr, sr      *bufio.Reader
+	passthrough bool
+
+	//------client loop only--------
+	statements map[string]string
+	portals    map[string]string
+	skipping   bool
+	denied     []byte
+	batch      bool
+
+	//------read/write splitting, client loop only--------
+	split     *protocol.Split
+	replica   *replica
+	noReplica bool
+	lastWrite time.Time
+
+	wmu sync.Mutex
+	cw  *bufio.Writer
+
+	mu         sync.Mutex
+	txStatus   byte
+	ready      bool
+	authFailed bool
+	slots      [][]byte
+}
+
+func NewSession(info protocol.Info, hook protocol.Hook) *Session {
+	info.Protocol = "postgres"
+	return &Session{
+		info:       info,
+		hook:       hook,
+		statements: make(map[string]string),
+		portals:    make(map[string]string),
+	}
+}
+
+// SetTLS enables in-band TLS. It must be called before Startup.
+func (s *Session) SetTLS(t protocol.TLS) {
+	s.tls = t
+}
+
+func (s *Session) Info() protocol.Info {
+	return s.info
+}
+
+// Passthrough reports whether the handshake switched the stream to a
+// format the decoder cannot follow (cancel requests).
+func (s *Session) Passthrough() bool {
+	return s.passthrough
+}
+
+func (s *Session) TxStatus() byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txStatus
+}
+
+func (s *Session) Idle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready && len(s.slots) == 0 && s.txStatus == 'I'
+}
+
+func (s *Session) AuthFailed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authFailed
+}
+
+// Startup answers SSLRequest itself, upgrading the client connection when
+// client TLS is configured and declining it otherwise, so the stream after
+// the handshake is always plaintext to the decoder. GSSAPI encryption is
+// always declined. With upstream TLS the session sends its own SSLRequest
+// to the server before forwarding the startup packet.
+func (s *Session) Startup(client, server net.Conn) (net.Conn, net.Conn, error) {
+	s.cr = bufio.NewReader(client)
+	s.sr = bufio.NewReader(server)
+	s.cw = bufio.NewWriter(client)
+
+	for {
+		raw, msg, err := ReadStartup(s.cr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch m := msg.(type) {
+		case *SSLRequest:
+			// Bytes sent before the answer would otherwise be treated as
+			// if they had arrived over TLS (CVE-2021-23214).
+			if s.cr.Buffered() > 0 {
+				return nil, nil, fmt.Errorf("postgres: data received after SSLRequest")
+			}
+			if s.tls.Client == nil {
+				if _, err := client.Write([]byte{'N'}); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+			if _, err := client.Write([]byte{'S'}); err != nil {
+				return nil, nil, err
+			}
+			tc := tls.Server(client, s.tls.Client)
+			if err := tc.Handshake(); err != nil {
+				return nil, nil, err
+			}
+			client = tc
+			s.cr = bufio.NewReader(client)
+			s.cw = bufio.NewWriter(client)
+		case *GSSENCRequest:
+			if _, err := client.Write([]byte{'N'}); err != nil {
+				return nil, nil, err
+			}
+		case *CancelRequest:
+			if server, err = s.upgradeServer(server); err != nil {
+				return nil, nil, err
+			}
+			if _, err := server.Write(raw); err != nil {
+				return nil, nil, err
+			}
+			s.passthrough = true
+			return client, server, nil
+		case *StartupMessage:
+			if server, err = s.upgradeServer(server); err != nil {
+				return nil, nil, err
+			}
+			if _, err := server.Write(raw); err != nil {
+				return nil, nil, err
+			}
+			s.info.User = m.Parameters["user"]
+			s.info.Database = m.Parameters["database"]
+			if s.info.Database == "" {
+				s.info.Database = s.info.User
+			}
+			return client, server, nil
+		}
+	}
+}
+
+// upgradeServer negotiates TLS with the server when upstream TLS is
+// configured, failing if the server declines.
+func (s *Session) upgradeServer(server net.Conn) (net.Conn, error) {
+	if s.tls.Upstream == nil {
+		return server, nil
+	}
+	if _, err := server.Write(SSLRequestMessage); err != nil {
+		return nil, err
+	}
+	resp, err := s.sr.ReadByte()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if resp != 'S' {
+		return nil, fmt.Errorf("postgres: upstream declined TLS")
+	}
+	if s.sr.Buffered() > 0 {
+		return nil, fmt.Errorf("postgres: data received after SSL response")
+	}
+	tc := tls.Client(server, s.tls.Upstream)
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	s.sr = bufio.NewReader(tc)
+	return tc, nil
+}
+
+func (s *Session) ClientToServer(client, server net.Conn) error {
+	if s.passthrough {
+		return copyAll(server, s.cr)
+	}
+
+	defer s.closeReplica()
+	w := bufio.NewWriter(server)
+	for {
+		limit := uint32(math.MaxUint32)
+		if !s.loggedIn() {
+			limit = maxAuthMessageSize
+		}
+		h, err := ReadHeader(s.cr, limit)
+		if err != nil {
+			return err
+		}
+
+		if !clientDecodes(h.Type()) {
+			if err := s.streamClient(w, h); err != nil {
+				return err
+			}
+		} else {
+			if h.Len() > MaxMessageSize {
+				return fmt.Errorf("postgres: %q message of %d bytes exceeds %d", h.Type(), h.Len(), MaxMessageSize)
+			}
+			m, err := ReadBody(s.cr, h)
+			if err != nil {
+				return err
+			}
+			fwd, err := s.clientMessage(m)
+			if err != nil {
+				return err
+			}
+			if fwd != nil {
+				if _, err := w.Write(fwd); err != nil {
+					return err
+				}
+			}
+		}
+		if s.cr.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// clientDecodes reports whether the session parses client messages of
+// type typ. The others, like CopyData and FunctionCall, may be arbitrarily
+// large and are streamed through.
+func clientDecodes(typ byte) bool {
+	switch typ {
+	case 'Q', 'P', 'B', 'E', 'C', 'D', 'S', 'H':
+		return true
+	}
+	return false
+}
+
+// streamClient forwards a message the session does not decode without
+// buffering it, or discards it while a denied batch is skipped.
+func (s *Session) streamClient(w io.Writer, h Header) error {
+	if s.skipping {
+		return CopyBody(io.Discard, s.cr, h)
+	}
+	if h.Type() == 'F' {
+		s.expectReady(nil)
+	}
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	return CopyBody(w, s.cr, h)
+}
+
+func (s *Session) loggedIn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready
+}
+
+// clientMessage returns the bytes to forward upstream for m, or nil when m
+// is swallowed.
+//
+// A denied simple Query is replaced by a Sync so the server still answers
+// with ReadyForQuery, and the ErrorResponse is slotted in front of that
+// answer. A denied extended-protocol message discards the rest of the batch
+// up to its Sync, the same way the server does after an error.
+//
+// With read/write splitting, a read-only simple Query sent while the
+// primary is idle is answered by a replica instead.
+func (s *Session) clientMessage(m Message) ([]byte, error) {
+	if s.skipping {
+		switch m.Type {
+		case 'S':
+			s.skipping = false
+			s.expectReady(s.denied)
+			s.denied = nil
+			return m.Raw, nil
+		case 'H':
+			if s.denied != nil {
+				if err := s.writeClient(s.denied); err != nil {
+					return nil, err
+				}
+				s.denied = nil
+			}
+			return m.Raw, nil
+		}
+		return nil, nil
+	}
+
+	st, err := s.inspect(m)
+	var deny *protocol.DenyError
+	if errors.As(err, &deny) {
+		resp := DenyResponse(deny).Encode()
+		if m.Type == 'Q' {
+			s.expectReady(resp)
+			return syncMessage, nil
+		}
+		s.skipping, s.denied = true, resp
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch m.Type {
+	case 'P', 'B', 'D', 'E', 'C', 'H':
+		s.batch = true
+	case 'S':
+		s.batch = false
+	}
+	if s.readOnly(st) && m.Type == 'Q' && s.toReplica() {
+		handled, err := s.replicaQuery(m)
+		if err != nil {
+			return nil, err
+		}
+		if handled {
+			return nil, nil
+		}
+	}
+
+	switch m.Type {
+	case 'Q', 'S':
+		s.expectReady(nil)
+	}
+	return m.Raw, nil
+}
+
+// expectReady records that the server owes one more ReadyForQuery, and
+// the error (if any) to hand the client just before it.
+func (s *Session) expectReady(injected []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slots = append(s.slots, injected)
+}
+
+func (s *Session) writeClient(b []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if _, err := s.cw.Write(b); err != nil {
+		return err
+	}
+	return s.cw.Flush()
+}
+
+func (s *Session) ServerToClient(server, client net.Conn) error {
+	if s.passthrough {
+		return copyAll(client, s.sr)
+	}
+
+	for {
+		h, err := ReadHeader(s.sr, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		if h.Type() != 'Z' && (h.Type() != 'E' || s.loggedIn()) {
+			if err := s.relay(s.sr, h); err != nil {
+				return err
+			}
+			continue
+		}
+		m, err := ReadBody(s.sr, h)
+		if err != nil {
+			return err
+		}
+
+		var injected []byte
+		if m.Type == 'Z' {
+			msg, err := DecodeBackend(m)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.txStatus = msg.(*ReadyForQuery).TxStatus
+			if s.ready && len(s.slots) > 0 {
+				injected = s.slots[0]
+				s.slots = s.slots[1:]
+			}
+			s.ready = true
+			s.mu.Unlock()
+		}
+		if m.Type == 'E' {
+			if err := s.observeError(m); err != nil {
+				return err
+			}
+		}
+
+		if err := s.serverMessage(injected, m.Raw); err != nil {
+			return err
+		}
+	}
+}
+
+// observeError notes whether an error ending the startup phase refused
+// the client's credentials (SQLSTATE class 28).
+func (s *Session) observeError(m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ready {
+		return nil
+	}
+	msg, err := DecodeBackend(m)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(msg.(*ErrorResponse).Code(), "28") {
+		s.authFailed = true
+	}
+	return nil
+}
+
+func (s *Session) serverMessage(injected, raw []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if injected != nil {
+		if _, err := s.cw.Write(injected); err != nil {
+			return err
+		}
+	}
+	if _, err := s.cw.Write(raw); err != nil {
+		return err
+	}
+	if s.sr.Buffered() == 0 {
+		return s.cw.Flush()
+	}
+	return nil
+}
+
+func (s *Session) inspect(m Message) (*protocol.Statement, error) {
+	msg, err := DecodeFrontend(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var st *protocol.Statement
+	switch v := msg.(type) {
+	case *Query:
+		st = s.statement(protocol.KindQuery, v.String, v)
+	case *Parse:
+		st = s.statement(protocol.KindPrepare, v.Query, v)
+	case *Execute:
+		st = s.statement(protocol.KindExecute, s.portals[v.Portal], v)
+	}
+	if st != nil && s.hook != nil {
+		if err := s.hook.Inspect(st); err != nil {
+			return nil, err
+		}
+	}
+
+	switch v := msg.(type) {
+	case *Parse:
+		s.statements[v.Name] = v.Query
+	case *Bind:
+		s.portals[v.Portal] = s.statements[v.Statement]
+	case *Close:
+		if v.Target == 'S' {
+			delete(s.statements, v.Name)
+		} else {
+			delete(s.portals, v.Name)
+		}
+	}
+	return st, nil
+}
+
+func (s *Session) statement(kind, text string, msg any) *protocol.Statement {
+	return &protocol.Statement{
+		Info:    s.info,
+		Kind:    kind,
+		Text:    text,
+		Message: msg,
+	}
+}
+
+func copyAll(dst io.Writer, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	return io.EOF
+}
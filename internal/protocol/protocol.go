@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"database_firewall/internal/sqllex"
+)
+
+// Info identifies the client side of a proxied session. User and Database
+// are filled in by the codec once the protocol handshake reveals them.
+type Info struct {
+	Protocol string
+	ClientIP net.IP
+	User     string
+	Database string
+}
+
+// Statement is a decoded client request handed to policy hooks. Kind is one
+// of the Kind* constants; Message holds the protocol specific decoded message.
+type Statement struct {
+	Info
+	Kind    string
+	Text    string
+	Message any
+
+	tokens      []sqllex.Token
+	fingerprint string
+}
+
+// Tokens lexes Text in the dialect of the session's protocol. The result is
+// computed once and shared by every hook.
+func (st *Statement) Tokens() []sqllex.Token {
+	if st.tokens == nil {
+		st.tokens = sqllex.Tokenize(st.Text, sqllex.DialectFor(st.Protocol))
+	}
+	return st.tokens
+}
+
+func (st *Statement) Normalized() string {
+	return sqllex.NormalizeTokens(st.Tokens())
+}
+
+func (st *Statement) Fingerprint() string {
+	if st.fingerprint == "" {
+		st.fingerprint = sqllex.FingerprintTokens(st.Tokens())
+	}
+	return st.fingerprint
+}
+
+func (st *Statement) FingerprintHash() string {
+	return sqllex.Hash(st.Fingerprint())
+}
+
+const (
+	KindQuery   = "query"
+	KindPrepare = "prepare"
+	KindExecute = "execute"
+)
+
+// Hook inspects decoded statements. A non-nil error objects to the
+// statement and stops it from reaching the upstream.
+type Hook interface {
+	Inspect(st *Statement) error
+}
+
+type HookFunc func(st *Statement) error
+
+func (f HookFunc) Inspect(st *Statement) error {
+	return f(st)
+}
+
+type Hooks []Hook
+
+func (h Hooks) Inspect(st *Statement) error {
+	for _, hook := range h {
+		if hook == nil {
+			continue
+		}
+		if err := hook.Inspect(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DenyError objects to a statement. Limited marks statements refused for
+// exceeding a rate limit rather than by policy, which the codecs report
+// with their resource limit error codes.
+type DenyError struct {
+	Reason  string
+	Message string
+	Limited bool
+}
+
+func (e *DenyError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("statement denied: %s", e.Reason)
+	}
+	return fmt.Sprintf("statement denied: %s: %s", e.Reason, e.Message)
+}
+
+// TLS holds the configurations a session uses to negotiate TLS in-band:
+// Client answers the client's upgrade request, Upstream is used to request
+// one from the server. A nil field keeps that side in plaintext.
+type TLS struct {
+	Client   *tls.Config
+	Upstream *tls.Config
+}
+
+// Split enables read/write splitting. ReadOnly reports whether a statement
+// may run on a replica and Pins whether it changes session state, keeping
+// the session on the primary from then on; Dial opens a replica connection
+// and returns the TLS configuration to negotiate on it, or nil. The
+// session logs into replicas as User with Password. Only simple queries go
+// to a replica, and only outside transactions while nothing is outstanding
+// on the primary; Sticky keeps reads on the primary for that long after
+// any other statement.
+type Split struct {
+	ReadOnly func(st *Statement) bool
+	Pins     func(st *Statement) bool
+	Dial     func() (net.Conn, *tls.Config, error)
+	User     string
+	Password string
+	Sticky   time.Duration
+}
+
+// Session decodes a single proxied connection. Startup runs the connection
+// handshake synchronously and returns the connections to use from then on,
+// which wrap the ones passed in when either side was upgraded to TLS;
+// afterwards both directions are pumped concurrently until either returns.
+// Once Passthrough reports true the session forwards bytes without
+// decoding them. Idle reports whether the session is authenticated, has
+// no statement in flight and is outside a transaction, so closing it
+// loses no work. AuthFailed reports whether the server refused the
+// client's credentials.
+type Session interface {
+	Startup(client, server net.Conn) (net.Conn, net.Conn, error)
+	Passthrough() bool
+	ClientToServer(client, server net.Conn) error
+	ServerToClient(server, client net.Conn) error
+	Idle() bool
+	AuthFailed() bool
+}
@@ -1,15 +1,84 @@
 package proxy
 
-import "net"
+import (
+	"net"
 
+	"database_firewall/internal/ban"
+)
+
+// IPFilter rejects client addresses outright. Check returns the reason,
+// or "" to let ip through.
+type IPFilter interface {
+	Check(ip net.IP) string
+}
+
+// Bans keeps out client addresses banned for being rejected too often.
+// Check returns the reason ip is rejected for, or ""; Record counts a
+// rejection of kind, one of the ban kinds, that the client is to blame for.
+type Bans interface {
+	Check(ip net.IP) string
+	Record(ip net.IP, kind string)
+}
+
+// AdmissionController checks the IP filter and the bans, then the rate
+// limiting tiers, per IP, per subnet and global, before registering a
+// connection. A nil filter, ban list or limiter is skipped. Rejections by
+// the per IP tiers are recorded against the client's bans.
 type AdmissionController struct {
-	RateLimiter RateLimiter
-	ConnReg     *ConnectionRegister
+	IPFilter          IPFilter
+	Bans              Bans
+	RateLimiter       RateLimiter
+	SubnetRateLimiter RateLimiter
+	GlobalRateLimiter RateLimiter
+	ConnReg           *ConnectionRegister
+	Metrics           *Metrics
 }
 
 func (a *AdmissionController) Admit(ip net.IP) (bool, string) {
-	if a.RateLimiter != nil && !a.RateLimiter.Allow(ip) {
-		return false, "rate_limit"
+	ok, msg := a.admit(ip)
+	a.Metrics.admitted(msg)
+	if kind := offence(msg); kind != "" && a.Bans != nil {
+		a.Bans.Record(ip, kind)
+	}
+	return ok, msg
+}
+
+// offence returns the ban kind a rejection counts as, or "" for those the
+// client is not alone to blame for, like shared subnet or global limits.
+func offence(reason string) string {
+	switch reason {
+	case rateLimitPrefix + TierIP, rateLimitPrefix + TierQueryUser, rateLimitPrefix + TierQueryIP:
+		return ban.RateLimit
+	case "per_ip_limit":
+		return ban.PerIPLimit
+	}
+	return ""
+}
+
+func (a *AdmissionController) admit(ip net.IP) (bool, string) {
+	if a.IPFilter != nil {
+		if reason := a.IPFilter.Check(ip); reason != "" {
+			return false, reason
+		}
+	}
+	if a.Bans != nil {
+		if reason := a.Bans.Check(ip); reason != "" {
+			return false, reason
+		}
+	}
+
+	tiers := []struct {
+		name    string
+		limiter RateLimiter
+	}{
+		{TierIP, a.RateLimiter},
+		{TierSubnet, a.SubnetRateLimiter},
+		{TierGlobal, a.GlobalRateLimiter},
+	}
+	for _, tier := range tiers {
+		if tier.limiter != nil && !tier.limiter.Allow(ip) {
+			return false, rateLimitPrefix + tier.name
+		}
 	}
 
 	ok, msg := a.ConnReg.TryRegister(ip)
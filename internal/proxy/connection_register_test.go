@@ -82,3 +82,55 @@ func TestAdmissionController_Concurrency(t *testing.T) {
 		t.Fatalf("invariant broken: active=%d > per_ip_limit=%d", active, ccfg.PerIPConnectionLimit)
 	}
 }
+
+func TestConnectionRegister_ForgetsIPsWithoutConnections(t *testing.T) {
+	connReg := NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 10, PerIPConnectionLimit: 1})
+
+	for i := 0; i < 1000; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		if ok, _ := connReg.TryRegister(ip); !ok {
+			t.Fatal("expected connection to be allowed")
+		}
+		connReg.Unregister(ip)
+	}
+
+	if n := len(connReg.ConnectionsByIP); n != 0 {
+		t.Fatalf("expected no IPs tracked once their connections closed, got %d", n)
+	}
+}
+
+func TestConnectionRegister_SharedAcrossReplicas(t *testing.T) {
+	store := newMemStore()
+	ccfg := &config.ConnectionConfig{ConnectionLimit: 3, PerIPConnectionLimit: 2}
+	a, b := NewConnectionRegister(ccfg), NewConnectionRegister(ccfg)
+	a.Share(store, "conn:orders")
+	b.Share(store, "conn:orders")
+	ip1, ip2 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+
+	if ok, _ := a.TryRegister(ip1); !ok {
+		t.Fatal("expected first connection to be allowed")
+	}
+	if ok, _ := b.TryRegister(ip1); !ok {
+		t.Fatal("expected second connection from the ip to be allowed")
+	}
+	if ok, reason := b.TryRegister(ip1); ok || reason != "per_ip_limit" {
+		t.Fatalf("expected the per-ip limit to span replicas, got ok=%v reason=%v", ok, reason)
+	}
+	if ok, _ := a.TryRegister(ip2); !ok {
+		t.Fatal("expected a connection from another ip to be allowed")
+	}
+	if ok, reason := b.TryRegister(ip2); ok || reason != "connection_limit" {
+		t.Fatalf("expected the connection limit to span replicas, got ok=%v reason=%v", ok, reason)
+	}
+	if b.ActiveConnectionsCount() != 1 || b.ConnectionsRejected != 2 {
+		t.Fatalf("expected rejected connections to be backed out locally, got active=%d rejected=%d", b.ActiveConnectionsCount(), b.ConnectionsRejected)
+	}
+
+	a.Unregister(ip1)
+	if ok, _ := b.TryRegister(ip1); !ok {
+		t.Fatal("expected a closed connection to free a slot on every replica")
+	}
+	if n, _ := store.Total("conn:orders"); n != 3 {
+		t.Fatalf("expected 3 shared connections, got %d", n)
+	}
+}
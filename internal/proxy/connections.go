@@ -1,9 +1,12 @@
 package proxy
 
 import (
+	"cmp"
 	"net"
+	"slices"
 	"sync"
 
+	"database_firewall/internal/cluster"
 	"database_firewall/internal/config"
 )
 
@@ -12,6 +15,12 @@ type ConnectionRegister struct {
 	cfg               config.ConnectionConfig
 	ActiveConnections int64
 	ConnectionsByIP   map[string]int64
+	proxies           map[uint64]*Proxy
+
+	//--------shared counts----------
+	store    cluster.Store
+	scope    string
+	sharedBy map[string]int64
 
 	//--------metrics----------
 	ConnectionsAccepted, ConnectionsRejected int64
@@ -21,10 +30,44 @@ func NewConnectionRegister(cfg *(config.ConnectionConfig)) *ConnectionRegister {
 	return &ConnectionRegister{
 		cfg:             *cfg,
 		ConnectionsByIP: make(map[string]int64),
+		proxies:         make(map[uint64]*Proxy),
+		sharedBy:        make(map[string]int64),
 	}
 }
 
+// Share checks the limits against the connections of every replica,
+// counted in store under keys starting with scope. Connections admitted
+// while the store is unreachable are held to the local counts only.
+func (r *ConnectionRegister) Share(store cluster.Store, scope string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store, r.scope = store, scope
+}
+
+// SetConfig swaps in new limits. Connections over a lowered limit are
+// left open; new ones are refused until the count drops below it.
+func (r *ConnectionRegister) SetConfig(cfg *config.ConnectionConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfg = *cfg
+}
+
 func (r *ConnectionRegister) TryRegister(ip net.IP) (bool, string) {
+	if ok, msg := r.tryRegister(ip); !ok {
+		return false, msg
+	}
+	if ok, msg := r.tryShared(ip); !ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.ConnectionsAccepted -= 1
+		r.ConnectionsRejected += 1
+		r.unregister(ip)
+		return false, msg
+	}
+	return true, ""
+}
+
+func (r *ConnectionRegister) tryRegister(ip net.IP) (bool, string) {
 	key := ip.String()
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -53,9 +96,50 @@ func (r *ConnectionRegister) register(ip net.IP) {
 	r.ConnectionsByIP[ip.String()] = ct + 1
 }
 
+// tryShared counts the connection in the shared store, backing out when
+// it takes the replicas over a limit.
+func (r *ConnectionRegister) tryShared(ip net.IP) (bool, string) {
+	r.mu.Lock()
+	store, total, perIP := r.store, r.scope, r.scope+":"+ip.String()
+	limit, perIPLimit := r.cfg.ConnectionLimit, r.cfg.PerIPConnectionLimit
+	r.mu.Unlock()
+	if store == nil {
+		return true, ""
+	}
+
+	n, err := store.Add(total, 1, 0)
+	if err != nil {
+		return true, ""
+	}
+	if n > limit {
+		store.Add(total, -1, 0)
+		return false, "connection_limit"
+	}
+	n, err = store.Add(perIP, 1, 0)
+	if err != nil {
+		store.Add(total, -1, 0)
+		return true, ""
+	}
+	if n > perIPLimit {
+		store.Add(perIP, -1, 0)
+		store.Add(total, -1, 0)
+		return false, "per_ip_limit"
+	}
+
+	r.mu.Lock()
+	r.sharedBy[ip.String()] += 1
+	r.mu.Unlock()
+	return true, ""
+}
+
 func (r *ConnectionRegister) Unregister(ip net.IP) {
+	r.unregisterShared(ip)
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unregister(ip)
+}
+
+func (r *ConnectionRegister) unregister(ip net.IP) {
 	r.ActiveConnections -= 1
 	ct, ok := r.ConnectionsByIP[ip.String()]
 	if !ok {
@@ -68,6 +152,23 @@ func (r *ConnectionRegister) Unregister(ip net.IP) {
 	r.ConnectionsByIP[ip.String()] = ct - 1
 }
 
+func (r *ConnectionRegister) unregisterShared(ip net.IP) {
+	key := ip.String()
+	r.mu.Lock()
+	store, scope := r.store, r.scope
+	shared := r.sharedBy[key] > 0
+	if shared {
+		if r.sharedBy[key] -= 1; r.sharedBy[key] == 0 {
+			delete(r.sharedBy, key)
+		}
+	}
+	r.mu.Unlock()
+	if shared {
+		store.Add(scope+":"+key, -1, 0)
+		store.Add(scope, -1, 0)
+	}
+}
+
 func (r *ConnectionRegister) ActiveConnectionsCount() int64 {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -81,3 +182,89 @@ func (r *ConnectionRegister) IPConnectionsCount(ip net.IP) int64 {
 
 	return r.ConnectionsByIP[ip.String()]
 }
+
+//--------live connections----------
+
+// Track makes p visible to Connections and the kill methods until its
+// Start returns.
+func (r *ConnectionRegister) Track(p *Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.proxies[p.id] = p
+}
+
+func (r *ConnectionRegister) untrack(p *Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.proxies, p.id)
+}
+
+// Connections returns the tracked connections ordered by ID.
+func (r *ConnectionRegister) Connections() []ConnInfo {
+	r.mu.Lock()
+	ps := make([]*Proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		ps = append(ps, p)
+	}
+	r.mu.Unlock()
+
+	infos := make([]ConnInfo, len(ps))
+	for i, p := range ps {
+		infos[i] = p.Info()
+	}
+	slices.SortFunc(infos, func(a, b ConnInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return infos
+}
+
+// ConnectionsPerIP returns a copy of the per-IP connection counts.
+func (r *ConnectionRegister) ConnectionsPerIP() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int64, len(r.ConnectionsByIP))
+	for ip, n := range r.ConnectionsByIP {
+		counts[ip] = n
+	}
+	return counts
+}
+
+// Kill closes the connection with the given ID, reporting whether it was
+// tracked here.
+func (r *ConnectionRegister) Kill(id uint64, reason string) bool {
+	r.mu.Lock()
+	p, ok := r.proxies[id]
+	r.mu.Unlock()
+	if ok {
+		p.Kill(reason)
+	}
+	return ok
+}
+
+// KillIP closes every connection from ip and returns how many there were.
+func (r *ConnectionRegister) KillIP(ip net.IP, reason string) int {
+	return r.killWhere(reason, func(p *Proxy) bool { return p.ip.Equal(ip) })
+}
+
+// KillIdle closes the connections whose sessions are idle outside a
+// transaction.
+func (r *ConnectionRegister) KillIdle(reason string) int {
+	return r.killWhere(reason, (*Proxy).Idle)
+}
+
+func (r *ConnectionRegister) KillAll(reason string) int {
+	return r.killWhere(reason, func(*Proxy) bool { return true })
+}
+
+func (r *ConnectionRegister) killWhere(reason string, match func(*Proxy) bool) int {
+	r.mu.Lock()
+	var victims []*Proxy
+	for _, p := range r.proxies {
+		if !p.killed.Load() && match(p) {
+			victims = append(victims, p)
+		}
+	}
+	r.mu.Unlock()
+	for _, p := range victims {
+		p.Kill(reason)
+	}
+	return len(victims)
+}
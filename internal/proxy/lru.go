@@ -0,0 +1,109 @@
+package proxy
+
+import "container/list"
+
+// DefaultMaxTrackedKeys bounds the keys a limiter tracks when
+// max_tracked_keys is not set.
+const DefaultMaxTrackedKeys = 100000
+
+// LimiterStats reports how many keys a limiter tracks and how many it has
+// dropped, because they had recovered fully (Idle) or to stay under the
+// cap (Capacity).
+type LimiterStats struct {
+	Tracked                          int
+	IdleEvictions, CapacityEvictions uint64
+}
+
+// keyLRU holds per key limiter state in least recently used order. Once
+// more than max keys are tracked the least recently used one is dropped.
+// It is not safe for concurrent use.
+type keyLRU[V any] struct {
+	max   int
+	order *list.List
+	items map[string]*list.Element
+
+	idleEvictions, capacityEvictions uint64
+}
+
+type lruItem[V any] struct {
+	key string
+	val V
+}
+
+func newKeyLRU[V any](max int64) *keyLRU[V] {
+	c := &keyLRU[V]{order: list.New(), items: make(map[string]*list.Element)}
+	c.setMax(max)
+	return c
+}
+
+// setMax changes the cap, dropping the oldest keys over it. Zero means
+// DefaultMaxTrackedKeys.
+func (c *keyLRU[V]) setMax(max int64) {
+	if max <= 0 {
+		max = DefaultMaxTrackedKeys
+	}
+	c.max = int(max)
+	for c.order.Len() > c.max {
+		c.remove(c.order.Back())
+		c.capacityEvictions++
+	}
+}
+
+func (c *keyLRU[V]) get(key string) (V, bool) {
+	if e, ok := c.items[key]; ok {
+		return e.Value.(*lruItem[V]).val, true
+	}
+	var zero V
+	return zero, false
+}
+
+// put stores v as the most recently used key.
+func (c *keyLRU[V]) put(key string, v V) {
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruItem[V]).val = v
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruItem[V]{key: key, val: v})
+	if c.order.Len() > c.max {
+		c.remove(c.order.Back())
+		c.capacityEvictions++
+	}
+}
+
+// each calls fn on every value, letting it modify the value in place.
+func (c *keyLRU[V]) each(fn func(v *V)) {
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		fn(&e.Value.(*lruItem[V]).val)
+	}
+}
+
+// sweep drops the keys whose state is no different from a new key's.
+func (c *keyLRU[V]) sweep(idle func(V) bool) {
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if idle(e.Value.(*lruItem[V]).val) {
+			c.remove(e)
+			c.idleEvictions++
+		}
+		e = next
+	}
+}
+
+func (c *keyLRU[V]) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.items, e.Value.(*lruItem[V]).key)
+}
+
+func (c *keyLRU[V]) clear() {
+	c.order.Init()
+	clear(c.items)
+}
+
+func (c *keyLRU[V]) stats() LimiterStats {
+	return LimiterStats{
+		Tracked:           c.order.Len(),
+		IdleEvictions:     c.idleEvictions,
+		CapacityEvictions: c.capacityEvictions,
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"database_firewall/internal/metrics"
+)
+
+// durationBuckets are the connection duration histogram bounds in seconds.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 1800, 3600}
+
+// Metrics holds the instruments of one listener. A nil *Metrics records
+// nothing.
+type Metrics struct {
+	listener string
+
+	accepted    *metrics.Counter
+	rejected    *metrics.CounterVec
+	rateLimited *metrics.CounterVec
+	bytesIn     *metrics.Counter
+	bytesOut    *metrics.Counter
+	duration    *metrics.Histogram
+}
+
+func NewMetrics(reg *metrics.Registry, listener string, r *ConnectionRegister) *Metrics {
+	reg.Gauge("warden_active_connections", "Connections currently proxied.", "listener").
+		Func(func() float64 { return float64(r.ActiveConnectionsCount()) }, listener)
+	return &Metrics{
+		listener:    listener,
+		accepted:    reg.Counter("warden_connections_accepted_total", "Connections admitted.", "listener").With(listener),
+		rejected:    reg.Counter("warden_connections_rejected_total", "Connections refused at admission, by reason.", "listener", "reason"),
+		rateLimited: reg.Counter("warden_rate_limit_denials_total", "Connections and statements denied by a rate limiting tier.", "listener", "tier"),
+		bytesIn:     reg.Counter("warden_bytes_total", "Bytes read (in) and written (out) on client and upstream connections.", "listener", "direction").With(listener, "in"),
+		bytesOut:    reg.Counter("warden_bytes_total", "", "listener", "direction").With(listener, "out"),
+		duration:    reg.Histogram("warden_connection_duration_seconds", "Lifetime of admitted connections.", durationBuckets, "listener").With(listener),
+	}
+}
+
+// WatchLimiter reports the keys tracked by the rate limiter of tier and
+// the keys it evicted, by cause: idle or capacity.
+func (m *Metrics) WatchLimiter(reg *metrics.Registry, tier string, l interface{ Stats() LimiterStats }) {
+	reg.Gauge("warden_rate_limit_tracked_keys", "Clients a rate limiter keeps state for.", "listener", "tier").
+		Func(func() float64 { return float64(l.Stats().Tracked) }, m.listener, tier)
+	evictions := reg.Counter("warden_rate_limit_evictions_total", "Rate limiter keys dropped after recovering fully (idle) or to stay under max_tracked_keys (capacity).", "listener", "tier", "cause")
+	evictions.Func(func() uint64 { return l.Stats().IdleEvictions }, m.listener, tier, "idle")
+	evictions.Func(func() uint64 { return l.Stats().CapacityEvictions }, m.listener, tier, "capacity")
+}
+
+func (m *Metrics) admitted(reason string) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		m.accepted.Inc()
+		return
+	}
+	m.rejected.With(m.listener, reason).Inc()
+	if tier, ok := strings.CutPrefix(reason, rateLimitPrefix); ok {
+		m.rateLimitedBy(tier)
+	}
+}
+
+func (m *Metrics) rateLimitedBy(tier string) {
+	if m != nil {
+		m.rateLimited.With(m.listener, tier).Inc()
+	}
+}
+
+func (m *Metrics) bytes(in, out int) {
+	if m == nil {
+		return
+	}
+	m.bytesIn.Add(uint64(in))
+	m.bytesOut.Add(uint64(out))
+}
+
+func (m *Metrics) closed(d time.Duration) {
+	if m != nil {
+		m.duration.Observe(d.Seconds())
+	}
+}
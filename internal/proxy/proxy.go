@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -8,52 +10,193 @@ import (
 	"sync/atomic"
 	"time"
 
+	"database_firewall/internal/ban"
 	"database_firewall/internal/config"
 	"database_firewall/internal/logging"
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/protocol/mysql"
+	"database_firewall/internal/protocol/postgres"
+	"database_firewall/internal/upstream"
 )
 
 type Proxy struct {
+	id                uint64
 	cfg               config.ProxyConfig
 	ip                net.IP
-	laddr, raddr      *net.TCPAddr
-	lconn, rconn      *net.TCPConn
+	conn              net.Conn
+	laddr             *net.TCPAddr
+	dialer            upstream.Dialer
+	lconn, rconn      net.Conn
 	startTime         time.Time
 	inBytes, outBytes int64
+	hook              protocol.Hook
+	bans              Bans
+	split             *protocol.Split
+	metrics           *Metrics
+	clientTLS         *tls.Config
+	upstreamTLS       *tls.Config
+
+	//------admin--------
+	mu       sync.Mutex
+	upstream string
+	session  protocol.Session
+	killed   atomic.Bool
 
 	//------error handling--------
 	errOnce sync.Once
 	errsig  chan struct{}
 }
 
-func NewProxy(cfg *config.ProxyConfig, ip net.IP, lconn *net.TCPConn, laddr, raddr *net.TCPAddr) *Proxy {
+// ConnInfo is a snapshot of a live connection.
+type ConnInfo struct {
+	ID       uint64    `json:"id"`
+	Listener string    `json:"listener"`
+	ClientIP string    `json:"client_ip"`
+	Started  time.Time `json:"started"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Upstream string    `json:"upstream,omitempty"`
+}
+
+var lastID atomic.Uint64
+
+// tlsHandshakeTimeout bounds the client TLS handshake when no idle timeout
+// is configured.
+const tlsHandshakeTimeout = 10 * time.Second
+
+func NewProxy(cfg *config.ProxyConfig, ip net.IP, lconn net.Conn, laddr *net.TCPAddr, dialer upstream.Dialer) *Proxy {
 	return &Proxy{
+		id:        lastID.Add(1),
 		cfg:       *cfg,
 		ip:        ip,
+		conn:      lconn,
 		lconn:     lconn,
 		laddr:     laddr,
-		raddr:     raddr,
+		dialer:    dialer,
 		startTime: time.Now(),
 		errsig:    make(chan struct{}),
 	}
 }
 
+// SetHook installs the policy hook consulted for every decoded statement.
+// It has no effect for the raw tcp protocol.
+func (p *Proxy) SetHook(h protocol.Hook) {
+	p.hook = h
+}
+
+// SetBans records the client's refused logins and denied statements in b.
+func (p *Proxy) SetBans(b Bans) {
+	p.bans = b
+}
+
+// SetSplit enables read/write splitting for postgres and mysql sessions.
+func (p *Proxy) SetSplit(sp *protocol.Split) {
+	p.split = sp
+}
+
+// SetMetrics records this connection's bytes and duration in m.
+func (p *Proxy) SetMetrics(m *Metrics) {
+	p.metrics = m
+}
+
+// SetTLS sets the TLS configuration for the client side; nil leaves it in
+// plaintext. The upstream side uses the configuration of the backend the
+// dialer picked. The raw tcp protocol wraps the connections directly, while
+// postgres and mysql negotiate TLS in-band the way their clients and
+// servers expect.
+func (p *Proxy) SetTLS(client *tls.Config) {
+	p.clientTLS = client
+}
+
+func (p *Proxy) ID() uint64 {
+	return p.id
+}
+
+func (p *Proxy) Info() ConnInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ConnInfo{
+		ID:       p.id,
+		Listener: p.cfg.Name,
+		ClientIP: p.ip.String(),
+		Started:  p.startTime,
+		BytesIn:  atomic.LoadInt64(&p.inBytes),
+		BytesOut: atomic.LoadInt64(&p.outBytes),
+		Upstream: p.upstream,
+	}
+}
+
+// Idle reports whether a decoded session is between statements outside a
+// transaction. Raw tcp and passthrough connections are never idle.
+func (p *Proxy) Idle() bool {
+	p.mu.Lock()
+	s := p.session
+	p.mu.Unlock()
+	return s != nil && s.Idle()
+}
+
+// Kill closes the client connection, which ends the session.
+func (p *Proxy) Kill(reason string) {
+	if p.killed.Swap(true) {
+		return
+	}
+	logging.LogEvent("WARN", "connection_killed", map[string]any{
+		"listener":  p.cfg.Name,
+		"client_ip": p.ip.String(),
+		"id":        p.id,
+		"reason":    reason,
+	})
+	p.conn.Close()
+}
+
+func (p *Proxy) inBandTLS() bool {
+	return p.cfg.Protocol == "postgres" || p.cfg.Protocol == "mysql"
+}
+
 func (p *Proxy) Start(r *ConnectionRegister) {
 	defer p.lconn.Close()
-	log.Printf("Connecting to %s...", p.raddr)
 
 	//--------------registration logic-----------------
 	defer r.Unregister(p.ip)
+	defer r.untrack(p)
+	defer func() { p.metrics.closed(time.Since(p.startTime)) }()
+
+	//--------------client TLS handshake-----------------
+	if p.clientTLS != nil && !p.inBandTLS() {
+		p.lconn = tls.Server(p.lconn, p.clientTLS)
+	}
+	if tc, ok := p.lconn.(*tls.Conn); ok && !p.handshake(tc) {
+		return
+	}
 
 	//--------------Dial and copy------------------------
-	var err error
-	p.rconn, err = net.DialTCP("tcp", nil, p.raddr)
+	rc, err := p.dialer.Dial()
 	if err != nil {
 		log.Printf("Remote connection failed: %s", err)
 		return
 	}
+	log.Printf("Connected to %s", rc.Address)
+	p.mu.Lock()
+	p.upstream = rc.Address
+	p.mu.Unlock()
+	p.rconn, p.upstreamTLS = rc, rc.TLS
 
 	defer p.rconn.Close()
 
+	//--------------upstream TLS handshake---------------
+	if p.upstreamTLS != nil && !p.inBandTLS() {
+		tc := tls.Client(p.rconn, p.upstreamTLS)
+		if err := p.handshakeTimeout(tc); err != nil {
+			logging.LogEvent("WARN", "upstream_tls_failed", map[string]any{
+				"client_ip": p.ip.String(),
+				"upstream":  rc.Address,
+				"error":     err.Error(),
+			})
+			return
+		}
+		p.rconn = tc
+	}
+
 	//----------setting  idle timeout------------------
 	if p.cfg.IdleTimeoutSeconds > 0 {
 		deadline := time.Now().Add(time.Duration(p.cfg.IdleTimeoutSeconds) * time.Second)
@@ -61,19 +204,65 @@ func (p *Proxy) Start(r *ConnectionRegister) {
 		p.rconn.SetDeadline(deadline)
 	}
 
-	go p.pipe(p.lconn, p.rconn)
-	go p.pipe(p.rconn, p.lconn)
+	if s := p.newSession(); s != nil {
+		go p.inspect(s)
+	} else {
+		go p.pipe(p.lconn, p.rconn)
+		go p.pipe(p.rconn, p.lconn)
+	}
 
 	<-p.errsig
+	p.recordAuthFailure()
 	logging.LogEvent("INFO", "connection_closed", map[string]any{
+		"listener":    p.cfg.Name,
 		"client_ip":   p.ip.String(),
 		"duration_ms": time.Since(p.startTime),
-		"bytes_in":    p.inBytes,
-		"bytes_out":   p.outBytes,
+		"bytes_in":    atomic.LoadInt64(&p.inBytes),
+		"bytes_out":   atomic.LoadInt64(&p.outBytes),
 	})
 
 }
 
+// handshake completes the client TLS handshake before the upstream is
+// dialed, so clients that fail it never reach the database.
+func (p *Proxy) handshake(tc *tls.Conn) bool {
+	if err := p.handshakeTimeout(tc); err != nil {
+		logging.LogEvent("WARN", "tls_handshake_failed", map[string]any{
+			"client_ip": p.ip.String(),
+			"error":     err.Error(),
+		})
+		return false
+	}
+
+	p.logTLS(tc)
+	return true
+}
+
+func (p *Proxy) logTLS(tc *tls.Conn) {
+	st := tc.ConnectionState()
+	fields := map[string]any{
+		"client_ip": p.ip.String(),
+		"version":   tls.VersionName(st.Version),
+		"cipher":    tls.CipherSuiteName(st.CipherSuite),
+	}
+	if len(st.PeerCertificates) > 0 {
+		fields["client_cert"] = st.PeerCertificates[0].Subject.String()
+	}
+	logging.LogEvent("INFO", "tls_established", fields)
+}
+
+func (p *Proxy) handshakeTimeout(tc *tls.Conn) error {
+	timeout := tlsHandshakeTimeout
+	if p.cfg.IdleTimeoutSeconds > 0 {
+		timeout = time.Duration(p.cfg.IdleTimeoutSeconds) * time.Second
+	}
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
 func (p *Proxy) pipe(src, dst io.ReadWriter) {
 	buff := make([]byte, 0xffff)
 	for {
@@ -82,17 +271,131 @@ func (p *Proxy) pipe(src, dst io.ReadWriter) {
 			p.err("Read failed: %s\n", err)
 			return
 		}
-		atomic.AddInt64(&p.inBytes, int64(n))
-		p.refreshDeadline()
+		p.countIn(n)
 		b := buff[:n]
 		n, err = dst.Write(b)
 		if err != nil {
 			p.err("Write failed: %s\n", err)
 			return
 		}
-		atomic.AddInt64(&p.outBytes, int64(n))
-		p.refreshDeadline()
+		p.countOut(n)
+	}
+}
+
+func (p *Proxy) countIn(n int) {
+	atomic.AddInt64(&p.inBytes, int64(n))
+	p.metrics.bytes(n, 0)
+	p.refreshDeadline()
+}
+
+func (p *Proxy) countOut(n int) {
+	atomic.AddInt64(&p.outBytes, int64(n))
+	p.metrics.bytes(0, n)
+	p.refreshDeadline()
+}
+
+func (p *Proxy) newSession() protocol.Session {
+	info := protocol.Info{ClientIP: p.ip}
+	t := protocol.TLS{Client: p.clientTLS, Upstream: p.upstreamTLS}
+	hook := p.sessionHook()
+	switch p.cfg.Protocol {
+	case "postgres":
+		s := postgres.NewSession(info, hook)
+		s.SetTLS(t)
+		if sp := p.meteredSplit(); sp != nil {
+			s.SetSplit(sp)
+		}
+		return s
+	case "mysql":
+		s := mysql.NewSession(info, hook)
+		s.SetTLS(t)
+		if sp := p.meteredSplit(); sp != nil {
+			s.SetSplit(sp)
+		}
+		return s
+	}
+	return nil
+}
+
+// sessionHook returns the hook with the statements it denies recorded
+// against the client's bans: rate limited ones as the limiter's offence,
+// the others as denied queries.
+func (p *Proxy) sessionHook() protocol.Hook {
+	if p.bans == nil || p.hook == nil {
+		return p.hook
+	}
+	return protocol.HookFunc(func(st *protocol.Statement) error {
+		err := p.hook.Inspect(st)
+		var deny *protocol.DenyError
+		if errors.As(err, &deny) {
+			kind := ban.DeniedQuery
+			if deny.Limited {
+				kind = offence(deny.Reason)
+			}
+			if kind != "" {
+				p.bans.Record(p.ip, kind)
+			}
+		}
+		return err
+	})
+}
+
+// recordAuthFailure records a login the server refused against the
+// client's bans.
+func (p *Proxy) recordAuthFailure() {
+	p.mu.Lock()
+	s := p.session
+	p.mu.Unlock()
+	if p.bans != nil && s != nil && s.AuthFailed() {
+		p.bans.Record(p.ip, ban.AuthFailure)
+	}
+}
+
+// meteredSplit returns the split configuration with replica connections
+// counted in this connection's bytes and idle deadline.
+func (p *Proxy) meteredSplit() *protocol.Split {
+	if p.split == nil {
+		return nil
+	}
+	sp := *p.split
+	sp.Dial = func() (net.Conn, *tls.Config, error) {
+		c, t, err := p.split.Dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		return &meteredConn{Conn: c, p: p}, t, nil
 	}
+	return &sp
+}
+
+func (p *Proxy) inspect(s protocol.Session) {
+	var client, server net.Conn = &meteredConn{Conn: p.lconn, p: p}, &meteredConn{Conn: p.rconn, p: p}
+
+	client, server, err := s.Startup(client, server)
+	if err != nil {
+		p.err("Startup failed", err)
+		return
+	}
+	if tc, ok := client.(*tls.Conn); ok {
+		p.logTLS(tc)
+	}
+	if s.Passthrough() {
+		logging.LogEvent("INFO", "inspection_disabled", map[string]any{
+			"client_ip": p.ip.String(),
+			"protocol":  p.cfg.Protocol,
+		})
+	} else {
+		p.mu.Lock()
+		p.session = s
+		p.mu.Unlock()
+	}
+
+	go func() {
+		p.err("Client stream failed", s.ClientToServer(client, server))
+	}()
+	go func() {
+		p.err("Server stream failed", s.ServerToClient(server, client))
+	}()
 }
 
 func (p *Proxy) err(s string, err error) {
@@ -119,3 +422,26 @@ func (p *Proxy) refreshDeadline() {
 	p.rconn.SetDeadline(deadline)
 
 }
+
+// meteredConn accounts bytes and refreshes the idle deadline the same way
+// pipe does, for codecs that read and write the connections themselves.
+type meteredConn struct {
+	net.Conn
+	p *Proxy
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.p.countIn(n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.p.countOut(n)
+	}
+	return n, err
+}
@@ -1,12 +1,17 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"database_firewall/internal/config"
+	"database_firewall/internal/tlsconfig/tlstest"
+	"database_firewall/internal/upstream"
 )
 
 /*
@@ -105,7 +110,7 @@ func TestProxy_NoLeakOnImmediateClientClose(t *testing.T) {
 		ip,
 		lconn,
 		nil,
-		upAddr,
+		upstream.Static{Address: upAddr.String()},
 	)
 
 	done := make(chan struct{})
@@ -181,7 +186,7 @@ func TestProxy_NoLeakOnUpstreamDialFailure(t *testing.T) {
 		ip,
 		serverConn,
 		nil,
-		badAddr,
+		upstream.Static{Address: badAddr.String()},
 	)
 
 	done := make(chan struct{})
@@ -236,7 +241,7 @@ func TestProxy_IdleTimeoutTriggersUnregister(t *testing.T) {
 		ip,
 		lconn,
 		nil,
-		upAddr,
+		upstream.Static{Address: upAddr.String()},
 	)
 
 	done := make(chan struct{})
@@ -300,7 +305,7 @@ func TestProxy_NoLeaksUnderConcurrency(t *testing.T) {
 				ip,
 				lconn,
 				nil,
-				upAddr,
+				upstream.Static{Address: upAddr.String()},
 			)
 
 			done := make(chan struct{})
@@ -320,3 +325,243 @@ func TestProxy_NoLeaksUnderConcurrency(t *testing.T) {
 		t.Fatalf("leak after concurrency: active=%d", reg.ActiveConnectionsCount())
 	}
 }
+
+// startEchoUpstream starts a TCP listener echoing everything it reads and
+// reports how many connections it accepted.
+func startEchoUpstream(t *testing.T) (*net.TCPAddr, *atomic.Int64) {
+	t.Helper()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func(c *net.TCPConn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr), &accepted
+}
+
+// acceptedPair returns both ends of a loopback TCP connection.
+func acceptedPair(t *testing.T) (client, server *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *net.TCPConn)
+	go func() {
+		conn, _ := ln.AcceptTCP()
+		accepted <- conn
+	}()
+	client = dialClient(t, ln.Addr().(*net.TCPAddr))
+	server = <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+/*
+-------------------------------------------------
+Test: TLS listener terminates TLS and forwards plaintext
+-------------------------------------------------
+*/
+func TestProxy_TerminatesClientTLS(t *testing.T) {
+	reg := NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 1, PerIPConnectionLimit: 1})
+	ip := net.ParseIP("10.0.0.1")
+	reg.TryRegister(ip)
+
+	ca := tlstest.NewCA(t)
+	srv := ca.Issue(t, "firewall", "127.0.0.1")
+	upAddr, _ := startEchoUpstream(t)
+
+	raw, accepted := acceptedPair(t)
+	lconn := tls.Server(accepted, &tls.Config{Certificates: []tls.Certificate{srv.TLS}})
+	p := NewProxy(testProxyConfig(0), ip, lconn, nil, upstream.Static{Address: upAddr.String()})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start(reg)
+	}()
+
+	client := tls.Client(raw, &tls.Config{RootCAs: ca.Pool, ServerName: "127.0.0.1"})
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echoed ping, got %q (%v)", buf, err)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not exit")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: failed mTLS handshake never reaches upstream
+-------------------------------------------------
+*/
+func TestProxy_FailedHandshakeSkipsUpstream(t *testing.T) {
+	reg := NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 1, PerIPConnectionLimit: 1})
+	ip := net.ParseIP("10.0.0.1")
+	reg.TryRegister(ip)
+
+	ca := tlstest.NewCA(t)
+	srv := ca.Issue(t, "firewall", "127.0.0.1")
+	upAddr, upstreamConns := startEchoUpstream(t)
+
+	raw, accepted := acceptedPair(t)
+	lconn := tls.Server(accepted, &tls.Config{
+		Certificates: []tls.Certificate{srv.TLS},
+		ClientCAs:    ca.Pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	p := NewProxy(testProxyConfig(0), ip, lconn, nil, upstream.Static{Address: upAddr.String()})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start(reg)
+	}()
+
+	client := tls.Client(raw, &tls.Config{RootCAs: ca.Pool, ServerName: "127.0.0.1"})
+	client.Handshake()
+	client.Read(make([]byte, 1))
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not exit after failed handshake")
+	}
+	if n := upstreamConns.Load(); n != 0 {
+		t.Fatalf("expected no upstream connection, got %d", n)
+	}
+	if reg.ActiveConnectionsCount() != 0 {
+		t.Fatalf("leak after failed handshake: active=%d", reg.ActiveConnectionsCount())
+	}
+}
+
+// startTLSEchoUpstream is startEchoUpstream behind TLS.
+func startTLSEchoUpstream(t *testing.T, c *tls.Config) *net.TCPAddr {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+/*
+-------------------------------------------------
+Test: upstream TLS re-encrypts client plaintext
+-------------------------------------------------
+*/
+func TestProxy_OriginatesUpstreamTLS(t *testing.T) {
+	reg := NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 1, PerIPConnectionLimit: 1})
+	ip := net.ParseIP("10.0.0.1")
+	reg.TryRegister(ip)
+
+	ca := tlstest.NewCA(t)
+	db := ca.Issue(t, "db.internal", "db.internal")
+	fw := ca.Issue(t, "firewall")
+	upAddr := startTLSEchoUpstream(t, &tls.Config{
+		Certificates: []tls.Certificate{db.TLS},
+		ClientCAs:    ca.Pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+
+	client, accepted := acceptedPair(t)
+	p := NewProxy(testProxyConfig(0), ip, accepted, nil, upstream.Static{
+		Address: upAddr.String(),
+		TLS: &tls.Config{
+			RootCAs:      ca.Pool,
+			ServerName:   "db.internal",
+			Certificates: []tls.Certificate{fw.TLS},
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start(reg)
+	}()
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected echoed ping, got %q (%v)", buf, err)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("proxy did not exit")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: untrusted upstream certificate closes the client
+-------------------------------------------------
+*/
+func TestProxy_UntrustedUpstreamClosesClient(t *testing.T) {
+	reg := NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 1, PerIPConnectionLimit: 1})
+	ip := net.ParseIP("10.0.0.1")
+	reg.TryRegister(ip)
+
+	db := tlstest.NewCA(t).Issue(t, "db.internal")
+	upAddr := startTLSEchoUpstream(t, &tls.Config{Certificates: []tls.Certificate{db.TLS}})
+
+	client, accepted := acceptedPair(t)
+	p := NewProxy(testProxyConfig(0), ip, accepted, nil, upstream.Static{
+		Address: upAddr.String(),
+		TLS:     &tls.Config{RootCAs: tlstest.NewCA(t).Pool, ServerName: "db.internal"},
+	})
+	go p.Start(reg)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected client to be closed, got %v", err)
+	}
+	if reg.ActiveConnectionsCount() != 0 {
+		t.Fatalf("leak after upstream handshake failure: active=%d", reg.ActiveConnectionsCount())
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"database_firewall/internal/cluster"
+	"database_firewall/internal/config"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/metrics"
+	"database_firewall/internal/protocol"
+)
+
+// Query rate limiting tiers, checked in this order once the rules and
+// allowlist passed the statement. A denied statement's reason is
+// rate_limit_ followed by the tier.
+const (
+	TierQueryUser        = "query_user"
+	TierQueryIP          = "query_ip"
+	TierQueryFingerprint = "query_fingerprint"
+)
+
+// queryFlush is how often a shared query tier adds each key's locally
+// counted statements to the store.
+const queryFlush = 100 * time.Millisecond
+
+var _ protocol.Hook = (*QueryLimiter)(nil)
+
+// QueryLimiter is a statement hook rate limiting queries per database
+// user, per client IP and per query fingerprint. Statements over a limit
+// are answered with a protocol error and the session stays open.
+type QueryLimiter struct {
+	listener string
+	tiers    []queryTier
+	metrics  *Metrics
+}
+
+type queryTier struct {
+	name    string
+	what    func(st *protocol.Statement) string
+	key     func(st *protocol.Statement) string
+	limiter *ConfiguredLimiter
+}
+
+func NewQueryLimiter(listener string, cfg *config.RateLimiterConfig) *QueryLimiter {
+	q := &QueryLimiter{
+		listener: listener,
+		tiers: []queryTier{
+			{
+				name: TierQueryUser,
+				what: func(st *protocol.Statement) string { return fmt.Sprintf("user %q", st.User) },
+				key:  func(st *protocol.Statement) string { return st.User },
+			},
+			{
+				name: TierQueryIP,
+				what: func(st *protocol.Statement) string { return "client " + st.ClientIP.String() },
+				key:  func(st *protocol.Statement) string { return st.ClientIP.String() },
+			},
+			{
+				name: TierQueryFingerprint,
+				what: func(*protocol.Statement) string { return "this statement" },
+				key:  (*protocol.Statement).FingerprintHash,
+			},
+		},
+	}
+	for i := range q.tiers {
+		q.tiers[i].limiter = NewRateLimiter(queryConfig(cfg, q.tiers[i].name))
+	}
+	return q
+}
+
+func queryConfig(cfg *config.RateLimiterConfig, tier string) *config.RateLimiterConfig {
+	r := cfg.Query.User
+	switch tier {
+	case TierQueryIP:
+		r = cfg.Query.IP
+	case TierQueryFingerprint:
+		r = cfg.Query.Fingerprint
+	}
+	return &config.RateLimiterConfig{RateLimiter: r}
+}
+
+func (q *QueryLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	for _, t := range q.tiers {
+		t.limiter.SetConfig(queryConfig(cfg, t.name))
+	}
+}
+
+// Share counts every tier in store, under scope followed by the tier.
+// Counts are batched, so a statement costs no store round trip between
+// flushes.
+func (q *QueryLimiter) Share(store cluster.Store, scope string) {
+	for _, t := range q.tiers {
+		t.limiter.ShareBatched(store, scope+":"+t.name, queryFlush)
+	}
+}
+
+// SetMetrics reports denials to m and registers the tiers' tracked keys
+// and evictions in reg.
+func (q *QueryLimiter) SetMetrics(reg *metrics.Registry, m *Metrics) {
+	q.metrics = m
+	for _, t := range q.tiers {
+		m.WatchLimiter(reg, t.name, t.limiter)
+	}
+}
+
+func (q *QueryLimiter) Sweep() {
+	for _, t := range q.tiers {
+		t.limiter.Sweep()
+	}
+}
+
+// Inspect implements protocol.Hook. Only statements that run count:
+// queries and executions of prepared statements.
+func (q *QueryLimiter) Inspect(st *protocol.Statement) error {
+	if st.Kind == protocol.KindPrepare {
+		return nil
+	}
+	for _, t := range q.tiers {
+		if t.limiter.AllowKey(t.key(st)) {
+			continue
+		}
+		q.metrics.rateLimitedBy(t.name)
+		logging.LogEvent("WARN", "query_rate_limited", map[string]any{
+			"listener":    q.listener,
+			"client_ip":   st.ClientIP.String(),
+			"user":        st.User,
+			"database":    st.Database,
+			"tier":        t.name,
+			"fingerprint": st.FingerprintHash(),
+		})
+		return &protocol.DenyError{
+			Reason:  rateLimitPrefix + t.name,
+			Message: "query rate limit exceeded for " + t.what(st),
+			Limited: true,
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"database_firewall/internal/cluster"
 	"database_firewall/internal/config"
 )
 
@@ -12,14 +13,133 @@ type RateLimiter interface {
 	Allow(net.IP) bool
 }
 
-var _ RateLimiter = (*TokenBucketLimiter)(nil)
+// reconfigurable limiters adjust their parameters in place on reload and
+// drop the state of clients that have fully recovered on Sweep. AllowKey
+// counts any key, such as a user name, the way Allow counts client IPs.
+type reconfigurable interface {
+	RateLimiter
+	AllowKey(string) bool
+	SetConfig(*config.RateLimiterConfig)
+	Sweep()
+	Stats() LimiterStats
+}
+
+var (
+	_ reconfigurable = (*TokenBucketLimiter)(nil)
+	_ reconfigurable = (*SlidingWindowLogLimiter)(nil)
+	_ reconfigurable = (*SlidingWindowCounterLimiter)(nil)
+	_ reconfigurable = (*FixedWindowLimiter)(nil)
+	_ reconfigurable = (*SharedLimiter)(nil)
+)
+
+// ConfiguredLimiter runs the algorithm selected by its configuration.
+// SetConfig adjusts the running limiter in place, or starts the newly
+// selected algorithm with empty state. Once shared, counts are kept in a
+// store common to all replicas.
+type ConfiguredLimiter struct {
+	mu        sync.RWMutex
+	cfg       config.RateLimiterConfig
+	algorithm string
+	limiter   reconfigurable
+	retired   LimiterStats
+
+	store cluster.Store
+	scope string
+	flush time.Duration
+}
+
+func NewRateLimiter(cfg *config.RateLimiterConfig) *ConfiguredLimiter {
+	l := &ConfiguredLimiter{}
+	l.SetConfig(cfg)
+	return l
+}
+
+func newLimiter(cfg *config.RateLimiterConfig) reconfigurable {
+	switch cfg.RateLimiter.Algorithm() {
+	case config.SlidingWindowLog:
+		return NewSlidingWindowLogLimiter(cfg)
+	case config.SlidingWindowCounter:
+		return NewSlidingWindowCounterLimiter(cfg)
+	case config.FixedWindow:
+		return NewFixedWindowLimiter(cfg)
+	}
+	return NewTokenBucketLimiter(cfg)
+}
+
+func (l *ConfiguredLimiter) Algorithm() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.algorithm
+}
+
+func (l *ConfiguredLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = *cfg
+	if algorithm := cfg.RateLimiter.Algorithm(); algorithm != l.algorithm {
+		if l.limiter != nil {
+			old := l.limiter.Stats()
+			l.retired.IdleEvictions += old.IdleEvictions
+			l.retired.CapacityEvictions += old.CapacityEvictions
+		}
+		l.algorithm, l.limiter = algorithm, newLimiter(cfg)
+		if l.store != nil {
+			l.limiter = newSharedLimiter(l.store, l.scope, cfg, l.limiter, l.flush)
+		}
+		return
+	}
+	l.limiter.SetConfig(cfg)
+}
+
+// Share moves the counts to store, under keys starting with scope, which
+// must name the same limiter on every replica. The local limiter takes
+// over while the store is unreachable.
+func (l *ConfiguredLimiter) Share(store cluster.Store, scope string) {
+	l.ShareBatched(store, scope, 0)
+}
+
+// ShareBatched is Share, but counts are added to the store at most once
+// per flush for each key, and checked against the totals seen at the
+// last flush plus the keys admitted locally since.
+func (l *ConfiguredLimiter) ShareBatched(store cluster.Store, scope string, flush time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store, l.scope, l.flush = store, scope, flush
+	l.limiter = newSharedLimiter(store, scope, &l.cfg, l.limiter, flush)
+}
+
+func (l *ConfiguredLimiter) Allow(ip net.IP) bool {
+	return l.AllowKey(ip.String())
+}
+
+func (l *ConfiguredLimiter) AllowKey(key string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.limiter.AllowKey(key)
+}
+
+func (l *ConfiguredLimiter) Sweep() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	l.limiter.Sweep()
+}
+
+// Stats counts evictions across algorithm switches.
+func (l *ConfiguredLimiter) Stats() LimiterStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	st := l.limiter.Stats()
+	st.IdleEvictions += l.retired.IdleEvictions
+	st.CapacityEvictions += l.retired.CapacityEvictions
+	return st
+}
 
 type TokenBucketLimiter struct {
 	mu       sync.Mutex
 	cfg      config.RateLimiterConfig
 	rate     int64
 	capacity int64
-	buckets  map[string]bucket
+	buckets  *keyLRU[bucket]
 }
 
 type bucket struct {
@@ -32,19 +152,53 @@ func NewTokenBucketLimiter(cfg *config.RateLimiterConfig) *TokenBucketLimiter {
 		cfg:      *cfg,
 		rate:     cfg.RateLimiter.TokenBucketLimiter.Rate,
 		capacity: cfg.RateLimiter.TokenBucketLimiter.Capacity,
-		buckets:  make(map[string]bucket),
+		buckets:  newKeyLRU[bucket](cfg.RateLimiter.MaxTrackedKeys),
 	}
 }
 
+// SetConfig swaps in new rate and capacity, trimming existing buckets to
+// the new capacity.
+func (t *TokenBucketLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cfg = *cfg
+	t.rate = cfg.RateLimiter.TokenBucketLimiter.Rate
+	t.capacity = cfg.RateLimiter.TokenBucketLimiter.Capacity
+	t.buckets.setMax(cfg.RateLimiter.MaxTrackedKeys)
+	t.buckets.each(func(b *bucket) {
+		b.tokens = min(b.tokens, t.capacity)
+	})
+}
+
+// Sweep drops buckets that have refilled to capacity, which a new bucket
+// would start with anyway.
+func (t *TokenBucketLimiter) Sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.buckets.sweep(func(b bucket) bool {
+		return b.tokens+int64(now.Sub(b.lastRefill).Seconds()*float64(t.rate)) >= t.capacity
+	})
+}
+
+func (t *TokenBucketLimiter) Stats() LimiterStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buckets.stats()
+}
+
 func (t *TokenBucketLimiter) Allow(ip net.IP) bool {
-	if t.rate == 0 {
-		return true
-	}
+	return t.AllowKey(ip.String())
+}
 
+func (t *TokenBucketLimiter) AllowKey(key string) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	if t.rate == 0 {
+		return true
+	}
 	now := time.Now()
-	b, ok := t.buckets[ip.String()]
+	b, ok := t.buckets.get(key)
 	if !ok {
 		b = bucket{
 			tokens:     t.capacity,
@@ -65,11 +219,11 @@ func (t *TokenBucketLimiter) Allow(ip net.IP) bool {
 
 	//-------------allow/deny------------
 	if b.tokens <= 0 {
-		t.buckets[ip.String()] = b
+		t.buckets.put(key, b)
 		return false
 	}
 
 	b.tokens -= 1
-	t.buckets[ip.String()] = b
+	t.buckets.put(key, b)
 	return true
 }
@@ -0,0 +1,584 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"database_firewall/internal/ban"
+	"database_firewall/internal/config"
+	"database_firewall/internal/protocol"
+)
+
+func testRateLimiter(rate, capacity int64) *TokenBucketLimiter {
+	cfg := &config.RateLimiterConfig{
+		RateLimiter: config.RateLimiterC{
+			TokenBucketLimiter: config.TokenBucketLimiterC{
+				Rate:     rate,
+				Capacity: capacity,
+			},
+		},
+	}
+	return NewTokenBucketLimiter(cfg)
+}
+
+func windowConfig(algorithm string, limit int64, window time.Duration) *config.RateLimiterConfig {
+	w := config.WindowLimiterC{Limit: limit, WindowMillis: window.Milliseconds()}
+	cfg := &config.RateLimiterConfig{}
+	switch algorithm {
+	case config.SlidingWindowLog:
+		cfg.RateLimiter.SlidingWindowLogLimiter = w
+	case config.SlidingWindowCounter:
+		cfg.RateLimiter.SlidingWindowCounterLimiter = w
+	case config.FixedWindow:
+		cfg.RateLimiter.FixedWindowLimiter = w
+	}
+	return cfg
+}
+
+// algorithms builds each limiter allowing a burst of limit connections,
+// recovering within period; a zero limit disables it.
+var algorithms = map[string]func(limit int64, period time.Duration) reconfigurable{
+	config.TokenBucket: func(limit int64, period time.Duration) reconfigurable {
+		if limit == 0 {
+			return testRateLimiter(0, 0)
+		}
+		// a zero rate means unlimited, so long periods refill once a second
+		return testRateLimiter(max(int64(time.Second/period), 1), limit)
+	},
+	config.SlidingWindowLog: func(limit int64, period time.Duration) reconfigurable {
+		return NewSlidingWindowLogLimiter(windowConfig(config.SlidingWindowLog, limit, period))
+	},
+	config.SlidingWindowCounter: func(limit int64, period time.Duration) reconfigurable {
+		return NewSlidingWindowCounterLimiter(windowConfig(config.SlidingWindowCounter, limit, period))
+	},
+	config.FixedWindow: func(limit int64, period time.Duration) reconfigurable {
+		return NewFixedWindowLimiter(windowConfig(config.FixedWindow, limit, period))
+	},
+}
+
+/*
+-------------------------------------------------
+Conformance: every algorithm behind RateLimiter
+-------------------------------------------------
+*/
+func TestRateLimiters_Conformance(t *testing.T) {
+	for name, newLimiter := range algorithms {
+		t.Run(name, func(t *testing.T) {
+			t.Run("BurstCapacity", func(t *testing.T) { testBurstCapacity(t, newLimiter) })
+			t.Run("ZeroLimitUnlimited", func(t *testing.T) { testZeroLimitUnlimited(t, newLimiter) })
+			t.Run("Recovers", func(t *testing.T) { testRecovers(t, newLimiter) })
+			t.Run("PerIPIsolation", func(t *testing.T) { testPerIPIsolation(t, newLimiter) })
+			t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, newLimiter) })
+			t.Run("SweepsRecovered", func(t *testing.T) { testSweepsRecovered(t, newLimiter) })
+		})
+	}
+}
+
+func testBurstCapacity(t *testing.T, newLimiter func(int64, time.Duration) reconfigurable) {
+	rl := newLimiter(3, time.Hour)
+	ip := net.ParseIP("10.0.0.1")
+
+	for i := 0; i < 3; i++ {
+		if !rl.Allow(ip) {
+			t.Fatalf("expected allow at token %d", i)
+		}
+	}
+
+	if rl.Allow(ip) {
+		t.Fatal("expected rejection after capacity exhausted")
+	}
+}
+
+func testZeroLimitUnlimited(t *testing.T, newLimiter func(int64, time.Duration) reconfigurable) {
+	rl := newLimiter(0, time.Second)
+	ip := net.ParseIP("10.0.0.1")
+
+	for i := 0; i < 1000; i++ {
+		if !rl.Allow(ip) {
+			t.Fatal("expected unlimited allows when the limiter is disabled")
+		}
+	}
+}
+
+func testRecovers(t *testing.T, newLimiter func(int64, time.Duration) reconfigurable) {
+	const period = 100 * time.Millisecond
+	rl := newLimiter(1, period)
+	ip := net.ParseIP("10.0.0.1")
+
+	if !rl.Allow(ip) {
+		t.Fatal("expected initial allow")
+	}
+
+	if rl.Allow(ip) {
+		t.Fatal("expected rejection before refill")
+	}
+
+	// the sliding window counter still weighs in the previous window for
+	// up to one more period
+	time.Sleep(2*period + 20*time.Millisecond)
+
+	if !rl.Allow(ip) {
+		t.Fatal("expected allow after refill")
+	}
+}
+
+func testPerIPIsolation(t *testing.T, newLimiter func(int64, time.Duration) reconfigurable) {
+	rl := newLimiter(1, time.Hour)
+
+	ip1 := net.ParseIP("10.0.0.1")
+	ip2 := net.ParseIP("10.0.0.2")
+
+	if !rl.Allow(ip1) {
+		t.Fatal("ip1 should be allowed")
+	}
+
+	if !rl.Allow(ip2) {
+		t.Fatal("ip2 should be allowed independently")
+	}
+
+	if rl.Allow(ip1) {
+		t.Fatal("ip1 should now be rate-limited")
+	}
+}
+
+func testConcurrency(t *testing.T, newLimiter func(int64, time.Duration) reconfigurable) {
+	rl := newLimiter(1, time.Hour)
+	ip := net.ParseIP("10.0.0.1")
+
+	const goroutines = 100
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+
+	var allowed int64
+
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if rl.Allow(ip) {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Fatalf("expected exactly 1 allow, got %d", allowed)
+	}
+}
+
+func testSweepsRecovered(t *testing.T, newLimiter func(int64, time.Duration) reconfigurable) {
+	const period = 100 * time.Millisecond
+	rl := newLimiter(1, period)
+	ip1 := net.ParseIP("10.0.0.1")
+	ip2 := net.ParseIP("10.0.0.2")
+
+	rl.Allow(ip1)
+	time.Sleep(2*period + 20*time.Millisecond)
+	rl.Allow(ip2)
+	rl.Sweep()
+
+	if st := rl.Stats(); st.Tracked != 1 || st.IdleEvictions != 1 {
+		t.Fatalf("expected only the recovered key to be swept, got %+v", st)
+	}
+	if rl.Allow(ip2) {
+		t.Fatal("expected the limited key to keep its state")
+	}
+}
+
+/*
+-------------------------------------------------
+Algorithm specifics
+-------------------------------------------------
+*/
+func TestSlidingWindowLog_NoBoundaryBurst(t *testing.T) {
+	const window = 200 * time.Millisecond
+	rl := NewSlidingWindowLogLimiter(windowConfig(config.SlidingWindowLog, 2, window))
+	ip := net.ParseIP("10.0.0.1")
+
+	rl.Allow(ip)
+	time.Sleep(window / 2)
+	rl.Allow(ip)
+	time.Sleep(window/2 + 20*time.Millisecond)
+
+	// the first entry has left the window, the second has not
+	if !rl.Allow(ip) {
+		t.Fatal("expected the expired entry to free a slot")
+	}
+	if rl.Allow(ip) {
+		t.Fatal("expected the limit to hold across the window boundary")
+	}
+}
+
+func TestConfiguredLimiter_SwitchesAlgorithm(t *testing.T) {
+	rl := NewRateLimiter(&config.RateLimiterConfig{})
+	ip := net.ParseIP("10.0.0.1")
+	if rl.Algorithm() != config.TokenBucket || !rl.Allow(ip) || !rl.Allow(ip) {
+		t.Fatal("expected an unconfigured limiter to allow everything")
+	}
+
+	rl.SetConfig(windowConfig(config.FixedWindow, 1, time.Hour))
+	if rl.Algorithm() != config.FixedWindow || !rl.Allow(ip) || rl.Allow(ip) {
+		t.Fatal("expected the fixed window limit to apply")
+	}
+
+	rl.SetConfig(windowConfig(config.FixedWindow, 2, time.Hour))
+	if !rl.Allow(ip) || rl.Allow(ip) {
+		t.Fatal("expected the raised limit to apply to the running window")
+	}
+}
+
+/*
+-------------------------------------------------
+Tiers: subnet and global limits
+-------------------------------------------------
+*/
+func TestSubnetLimiter_SharesBudgetPerPrefix(t *testing.T) {
+	cfg := &config.RateLimiterConfig{Subnet: config.SubnetLimiterC{
+		IPv4Prefix:   24,
+		IPv6Prefix:   64,
+		RateLimiterC: windowConfig(config.FixedWindow, 1, time.Hour).RateLimiter,
+	}}
+	rl := NewSubnetLimiter(cfg)
+
+	if !rl.Allow(net.ParseIP("10.0.0.1")) {
+		t.Fatal("expected the first address of the /24 to be allowed")
+	}
+	if rl.Allow(net.ParseIP("10.0.0.200")) {
+		t.Fatal("expected another address of the same /24 to be limited")
+	}
+	if !rl.Allow(net.ParseIP("10.0.1.1")) {
+		t.Fatal("expected a different /24 to be allowed")
+	}
+
+	if !rl.Allow(net.ParseIP("2001:db8::1")) {
+		t.Fatal("expected the first address of the /64 to be allowed")
+	}
+	if rl.Allow(net.ParseIP("2001:db8::ffff:1")) {
+		t.Fatal("expected another address of the same /64 to be limited")
+	}
+
+	cfg.Subnet.IPv4Prefix = 32
+	rl.SetConfig(cfg)
+	if !rl.Allow(net.ParseIP("10.0.0.2")) {
+		t.Fatal("expected a /32 prefix to limit single addresses")
+	}
+}
+
+func TestAdmissionController_ReasonNamesTier(t *testing.T) {
+	cfg := &config.RateLimiterConfig{
+		RateLimiter: windowConfig(config.FixedWindow, 2, time.Hour).RateLimiter,
+		Subnet: config.SubnetLimiterC{
+			IPv4Prefix:   24,
+			RateLimiterC: windowConfig(config.FixedWindow, 3, time.Hour).RateLimiter,
+		},
+		Global: windowConfig(config.FixedWindow, 4, time.Hour).RateLimiter,
+	}
+	ac := &AdmissionController{
+		RateLimiter:       NewRateLimiter(cfg),
+		SubnetRateLimiter: NewSubnetLimiter(cfg),
+		GlobalRateLimiter: NewGlobalLimiter(cfg),
+		ConnReg:           NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 100, PerIPConnectionLimit: 100}),
+	}
+
+	admit := func(ip, want string) {
+		t.Helper()
+		ok, reason := ac.Admit(net.ParseIP(ip))
+		if ok != (want == "") || reason != want {
+			t.Fatalf("%s: expected reason %q, got ok=%v reason=%q", ip, want, ok, reason)
+		}
+	}
+	admit("10.0.0.1", "")
+	admit("10.0.0.1", "")
+	admit("10.0.0.1", "rate_limit_ip")
+	admit("10.0.0.2", "")
+	admit("10.0.0.3", "rate_limit_subnet")
+	admit("10.0.1.1", "")
+	admit("10.0.2.1", "rate_limit_global")
+}
+
+type denyFilter string
+
+func (d denyFilter) Check(ip net.IP) string {
+	if ip.String() == string(d) {
+		return "ip_denied"
+	}
+	return ""
+}
+
+func TestAdmissionController_FilterBeforeRateLimits(t *testing.T) {
+	cfg := windowConfig(config.FixedWindow, 1, time.Hour)
+	ac := &AdmissionController{
+		IPFilter:    denyFilter("10.0.0.1"),
+		RateLimiter: NewRateLimiter(cfg),
+		ConnReg:     NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 100, PerIPConnectionLimit: 100}),
+	}
+	for range 3 {
+		if ok, reason := ac.Admit(net.ParseIP("10.0.0.1")); ok || reason != "ip_denied" {
+			t.Fatalf("expected ip_denied, got ok=%v reason=%q", ok, reason)
+		}
+	}
+	if ok, reason := ac.Admit(net.ParseIP("10.0.0.2")); !ok {
+		t.Fatalf("expected another address to be admitted, got %q", reason)
+	}
+	if ac.ConnReg.ActiveConnectionsCount() != 1 {
+		t.Fatalf("expected only the admitted connection to be registered")
+	}
+}
+
+/*
+-------------------------------------------------
+Test: repeated per IP rejections and denied
+statements ban the client
+-------------------------------------------------
+*/
+func TestAdmissionController_BansRepeatOffenders(t *testing.T) {
+	bans, err := ban.New(config.BansC{Thresholds: config.BanThresholdsC{RateLimit: 1, PerIPLimit: 2, DeniedQuery: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bans.Close()
+	ac := &AdmissionController{
+		Bans:    bans,
+		ConnReg: NewConnectionRegister(&config.ConnectionConfig{ConnectionLimit: 100, PerIPConnectionLimit: 1}),
+	}
+	admit := func(ip, want string) {
+		t.Helper()
+		if _, reason := ac.Admit(net.ParseIP(ip)); reason != want {
+			t.Fatalf("%s: expected %q, got %q", ip, want, reason)
+		}
+	}
+	admit("10.0.0.1", "")
+	admit("10.0.0.1", "per_ip_limit")
+	admit("10.0.0.1", "per_ip_limit")
+	admit("10.0.0.1", ban.ReasonBanned)
+	admit("10.0.0.2", "")
+
+	inspect := func(ip string, deny *protocol.DenyError) {
+		t.Helper()
+		p := NewProxy(testProxyConfig(0), net.ParseIP(ip), nil, nil, nil)
+		p.SetHook(protocol.HookFunc(func(*protocol.Statement) error { return deny }))
+		p.SetBans(bans)
+		if err := p.sessionHook().Inspect(&protocol.Statement{}); err != deny {
+			t.Fatalf("expected the hook's denial, got %v", err)
+		}
+	}
+	inspect("10.0.0.3", &protocol.DenyError{Reason: "rule"})
+	admit("10.0.0.3", "")
+	inspect("10.0.0.3", &protocol.DenyError{Reason: "rule"})
+	admit("10.0.0.3", ban.ReasonBanned)
+
+	inspect("10.0.0.4", &protocol.DenyError{Reason: "rate_limit_query_fingerprint", Limited: true})
+	admit("10.0.0.4", "")
+	inspect("10.0.0.4", &protocol.DenyError{Reason: "rate_limit_query_ip", Limited: true})
+	admit("10.0.0.4", ban.ReasonBanned)
+}
+
+/*
+-------------------------------------------------
+Test: statements are limited per user, IP and
+fingerprint, preparing a statement is free
+-------------------------------------------------
+*/
+func TestQueryLimiter_DeniesPerTier(t *testing.T) {
+	cfg := &config.RateLimiterConfig{Query: config.QueryLimiterC{
+		User:        windowConfig(config.FixedWindow, 3, time.Hour).RateLimiter,
+		IP:          windowConfig(config.FixedWindow, 4, time.Hour).RateLimiter,
+		Fingerprint: windowConfig(config.FixedWindow, 2, time.Hour).RateLimiter,
+	}}
+	q := NewQueryLimiter("test", cfg)
+
+	inspect := func(kind, user, ip, text, want string) {
+		t.Helper()
+		st := &protocol.Statement{
+			Info: protocol.Info{Protocol: "postgres", ClientIP: net.ParseIP(ip), User: user},
+			Kind: kind,
+			Text: text,
+		}
+		err := q.Inspect(st)
+		var deny *protocol.DenyError
+		switch {
+		case want == "" && err != nil:
+			t.Fatalf("%s %s %q: expected allowed, got %v", user, ip, text, err)
+		case want == "":
+		case !errors.As(err, &deny) || deny.Reason != want || !deny.Limited:
+			t.Fatalf("%s %s %q: expected %s, got %v", user, ip, text, want, err)
+		}
+	}
+	inspect(protocol.KindQuery, "alice", "10.0.0.1", "SELECT 1", "")
+	inspect(protocol.KindQuery, "alice", "10.0.0.1", "SELECT 2", "")
+	inspect(protocol.KindQuery, "alice", "10.0.0.1", "SELECT 3", "rate_limit_query_fingerprint")
+	inspect(protocol.KindPrepare, "alice", "10.0.0.1", "SELECT * FROM t WHERE id = $1", "")
+	inspect(protocol.KindExecute, "alice", "10.0.0.1", "SELECT * FROM t WHERE id = $1", "rate_limit_query_user")
+	inspect(protocol.KindQuery, "bob", "10.0.0.1", "DELETE FROM t", "")
+	inspect(protocol.KindQuery, "bob", "10.0.0.1", "DELETE FROM t", "rate_limit_query_ip")
+	inspect(protocol.KindQuery, "bob", "10.0.0.2", "DELETE FROM t", "")
+
+	cfg.Query.User = config.RateLimiterC{}
+	q.SetConfig(cfg)
+	inspect(protocol.KindQuery, "alice", "10.0.0.3", "UPDATE t SET a = 1", "")
+}
+
+/*
+-------------------------------------------------
+Memory bounds: least recently used keys are
+dropped beyond max_tracked_keys
+-------------------------------------------------
+*/
+func TestConfiguredLimiter_CapsTrackedKeys(t *testing.T) {
+	cfg := windowConfig(config.FixedWindow, 1, time.Hour)
+	cfg.RateLimiter.MaxTrackedKeys = 2
+	rl := NewRateLimiter(cfg)
+	ip1, ip2, ip3 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")
+
+	rl.Allow(ip1)
+	rl.Allow(ip2)
+	rl.Allow(ip1)
+	rl.Allow(ip3)
+
+	if st := rl.Stats(); st.Tracked != 2 || st.CapacityEvictions != 1 {
+		t.Fatalf("expected one key evicted at the cap, got %+v", st)
+	}
+	if rl.Allow(ip1) {
+		t.Fatal("expected the recently used key to be kept")
+	}
+	if !rl.Allow(ip2) {
+		t.Fatal("expected the least recently used key to start afresh")
+	}
+
+	cfg.RateLimiter.MaxTrackedKeys = 1
+	rl.SetConfig(cfg)
+	if st := rl.Stats(); st.Tracked != 1 || st.CapacityEvictions != 3 {
+		t.Fatalf("expected a lowered cap to trim keys, got %+v", st)
+	}
+
+	rl.SetConfig(windowConfig(config.SlidingWindowLog, 1, time.Hour))
+	if st := rl.Stats(); st.Tracked != 0 || st.CapacityEvictions != 3 {
+		t.Fatalf("expected evictions to survive an algorithm switch, got %+v", st)
+	}
+}
+
+/*
+-------------------------------------------------
+Shared state: replicas enforce one limit between
+them
+-------------------------------------------------
+*/
+
+// memStore is a cluster.Store kept in memory, shared by the limiters of
+// simulated replicas. Setting down makes every call fail.
+type memStore struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	down   bool
+	calls  int
+}
+
+func newMemStore() *memStore {
+	return &memStore{counts: make(map[string]int64)}
+}
+
+func (m *memStore) Add(key string, delta int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if m.down {
+		return 0, errors.New("store down")
+	}
+	m.counts[key] += delta
+	return m.counts[key], nil
+}
+
+func (m *memStore) AddTotal(key string, delta int64, ttl time.Duration, other string) (int64, int64, error) {
+	total, err := m.Add(key, delta, ttl)
+	if err != nil {
+		return 0, 0, err
+	}
+	otherTotal, err := m.Total(other)
+	return total, otherTotal, err
+}
+
+func (m *memStore) Total(key string) (int64, error) {
+	return m.Add(key, 0, 0)
+}
+
+func (m *memStore) Close() error { return nil }
+
+func TestConfiguredLimiter_SharedAcrossReplicas(t *testing.T) {
+	store := newMemStore()
+	cfg := windowConfig(config.FixedWindow, 3, time.Hour)
+	a, b := NewRateLimiter(cfg), NewRateLimiter(cfg)
+	a.Share(store, "rate:orders:ip")
+	b.Share(store, "rate:orders:ip")
+	ip := net.ParseIP("10.0.0.1")
+
+	allowed := 0
+	for i := 0; i < 4; i++ {
+		for _, rl := range []*ConfiguredLimiter{a, b} {
+			if rl.Allow(ip) {
+				allowed++
+			}
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected the replicas to allow 3 together, got %d", allowed)
+	}
+
+	// the local limiter has seen nothing, so it takes over with a full
+	// budget while the store is down
+	store.down = true
+	if !a.Allow(ip) {
+		t.Fatal("expected the local limiter to take over")
+	}
+
+	store.down = false
+	b.SetConfig(windowConfig(config.SlidingWindowCounter, 3, time.Hour))
+	if b.Allow(ip) {
+		t.Fatal("expected the shared count to carry over an algorithm switch")
+	}
+}
+
+func TestConfiguredLimiter_SharedBatched(t *testing.T) {
+	store := newMemStore()
+	cfg := windowConfig(config.FixedWindow, 3, time.Hour)
+	a := NewRateLimiter(cfg)
+	a.ShareBatched(store, "rate:orders:query_user", time.Hour)
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if a.AllowKey("app") {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected 3 allowed, got %d", allowed)
+	}
+	// one AddTotal, counted as two calls, to learn the shared total
+	if store.calls != 2 {
+		t.Fatalf("expected a single store round trip, got %d calls", store.calls)
+	}
+
+	// flushing on every statement, replicas see each other's counts
+	store = newMemStore()
+	a, b := NewRateLimiter(cfg), NewRateLimiter(cfg)
+	a.ShareBatched(store, "rate:orders:query_user", time.Nanosecond)
+	b.ShareBatched(store, "rate:orders:query_user", time.Nanosecond)
+	allowed = 0
+	for i := 0; i < 4; i++ {
+		for _, rl := range []*ConfiguredLimiter{a, b} {
+			if rl.AllowKey("app") {
+				allowed++
+			}
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected the replicas to allow 3 together, got %d", allowed)
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"database_firewall/internal/cluster"
+	"database_firewall/internal/config"
+)
+
+// SharedLimiter counts connections in a store shared by every replica,
+// as a sliding window counter over the configured limit and window. A
+// token bucket allows capacity connections per capacity/rate seconds. It
+// falls back to the local limiter while the store is unreachable.
+//
+// With a flush interval, each key's admissions are pre-aggregated
+// locally and added to the store at most once per interval, so replicas
+// may together exceed the limit by what they admit in one interval.
+type SharedLimiter struct {
+	store cluster.Store
+	scope string
+	local reconfigurable
+	flush time.Duration
+
+	mu     sync.RWMutex
+	limit  int64
+	window time.Duration
+
+	keysMu sync.Mutex
+	keys   map[string]*sharedKey
+}
+
+// sharedKey is a key's batched count in the window starting at start.
+type sharedKey struct {
+	mu      sync.Mutex
+	start   time.Time
+	cur     string
+	synced  bool
+	count   int64 // in the store at the last flush
+	before  int64 // previous window, in the store at the last flush
+	pending int64 // admitted here, less denials counted, since the last flush
+	flushed time.Time
+}
+
+func newSharedLimiter(store cluster.Store, scope string, cfg *config.RateLimiterConfig, local reconfigurable, flush time.Duration) *SharedLimiter {
+	l := &SharedLimiter{store: store, scope: scope, local: local, flush: flush}
+	if flush > 0 {
+		l.keys = make(map[string]*sharedKey)
+	}
+	l.setWindow(cfg)
+	return l
+}
+
+// sharedWindow returns the limit per window the algorithm of r enforces.
+func sharedWindow(r config.RateLimiterC) (int64, time.Duration) {
+	var w config.WindowLimiterC
+	switch r.Algorithm() {
+	case config.SlidingWindowLog:
+		w = r.SlidingWindowLogLimiter
+	case config.SlidingWindowCounter:
+		w = r.SlidingWindowCounterLimiter
+	case config.FixedWindow:
+		w = r.FixedWindowLimiter
+	default:
+		tb := r.TokenBucketLimiter
+		if tb.Rate == 0 {
+			return 0, 0
+		}
+		return tb.Capacity, time.Duration(tb.Capacity) * time.Second / time.Duration(tb.Rate)
+	}
+	return w.Limit, time.Duration(w.WindowMillis) * time.Millisecond
+}
+
+func (l *SharedLimiter) setWindow(cfg *config.RateLimiterConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.window = sharedWindow(cfg.RateLimiter)
+}
+
+func (l *SharedLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.setWindow(cfg)
+	l.local.SetConfig(cfg)
+}
+
+func (l *SharedLimiter) Allow(ip net.IP) bool {
+	return l.AllowKey(ip.String())
+}
+
+func (l *SharedLimiter) AllowKey(key string) bool {
+	l.mu.RLock()
+	limit, window := l.limit, l.window
+	l.mu.RUnlock()
+	if limit == 0 || window <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	start := now.Truncate(window)
+	prefix := l.scope + ":" + key + ":"
+	cur := prefix + strconv.FormatInt(start.UnixMilli(), 10)
+	prev := prefix + strconv.FormatInt(start.Add(-window).UnixMilli(), 10)
+	overlap := 1 - float64(now.Sub(start))/float64(window)
+	if l.flush > 0 {
+		return l.allowBatched(key, limit, window, now, start, cur, prev, overlap)
+	}
+
+	count, before, err := l.store.AddTotal(cur, 1, 2*window, prev)
+	if err != nil {
+		return l.local.AllowKey(key)
+	}
+
+	if float64(before)*overlap+float64(count) > float64(limit) {
+		l.store.Add(cur, -1, 2*window)
+		return false
+	}
+	return true
+}
+
+func (l *SharedLimiter) allowBatched(key string, limit int64, window time.Duration, now, start time.Time, cur, prev string, overlap float64) bool {
+	l.keysMu.Lock()
+	k, ok := l.keys[key]
+	if !ok {
+		k = &sharedKey{}
+		l.keys[key] = k
+	}
+	l.keysMu.Unlock()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.start.Equal(start) {
+		if k.pending != 0 {
+			l.store.Add(k.cur, k.pending, 2*window)
+		}
+		k.start, k.cur, k.synced, k.count, k.before, k.pending = start, cur, false, 0, 0, 0
+	}
+
+	if k.synced && now.Sub(k.flushed) < l.flush {
+		if float64(k.before)*overlap+float64(k.count+k.pending+1) > float64(limit) {
+			return false
+		}
+		k.pending++
+		return true
+	}
+
+	// A flush is due: count this statement with it and decide on the
+	// fresh totals. A denial is taken back with the next flush.
+	k.pending++
+	if err := l.sync(k, prev, window, now); err != nil {
+		k.pending--
+		return l.local.AllowKey(key)
+	}
+	if float64(k.before)*overlap+float64(k.count) > float64(limit) {
+		k.pending = -1
+		return false
+	}
+	return true
+}
+
+// sync adds k's pending count to the store and refreshes its totals.
+func (l *SharedLimiter) sync(k *sharedKey, prev string, window time.Duration, now time.Time) error {
+	count, before, err := l.store.AddTotal(k.cur, k.pending, 2*window, prev)
+	if err != nil {
+		return err
+	}
+	k.synced, k.count, k.before, k.pending, k.flushed = true, count, before, 0, now
+	return nil
+}
+
+// Sweep covers the local fallback and drops batched keys no longer
+// counted by any window; shared counts expire in the store.
+func (l *SharedLimiter) Sweep() {
+	l.local.Sweep()
+	if l.flush <= 0 {
+		return
+	}
+	l.mu.RLock()
+	window := l.window
+	l.mu.RUnlock()
+	stale := time.Now().Truncate(max(window, time.Millisecond)).Add(-window)
+
+	l.keysMu.Lock()
+	defer l.keysMu.Unlock()
+	for key, k := range l.keys {
+		k.mu.Lock()
+		if k.start.Before(stale) {
+			delete(l.keys, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// Stats covers the local fallback.
+func (l *SharedLimiter) Stats() LimiterStats { return l.local.Stats() }
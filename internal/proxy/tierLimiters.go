@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	"database_firewall/internal/cluster"
+	"database_firewall/internal/config"
+)
+
+// Rate limiting tiers, checked from the most specific. A connection must
+// pass all of them; the rejection reason is rate_limit_ followed by the
+// first tier that trips.
+const (
+	TierIP     = "ip"
+	TierSubnet = "subnet"
+	TierGlobal = "global"
+
+	rateLimitPrefix = "rate_limit_"
+)
+
+//--------subnet--------
+
+// SubnetLimiter rate limits client networks: every IP is masked to the
+// configured prefix length before it reaches the limiter, so addresses
+// of one /24 or IPv6 /64 share a budget.
+type SubnetLimiter struct {
+	mu      sync.RWMutex
+	v4, v6  net.IPMask
+	limiter *ConfiguredLimiter
+}
+
+func NewSubnetLimiter(cfg *config.RateLimiterConfig) *SubnetLimiter {
+	l := &SubnetLimiter{limiter: NewRateLimiter(subnetConfig(cfg))}
+	l.setMasks(cfg.Subnet)
+	return l
+}
+
+func subnetConfig(cfg *config.RateLimiterConfig) *config.RateLimiterConfig {
+	return &config.RateLimiterConfig{RateLimiter: cfg.Subnet.RateLimiterC}
+}
+
+func (l *SubnetLimiter) setMasks(s config.SubnetLimiterC) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.v4 = net.CIDRMask(s.IPv4Prefix, 8*net.IPv4len)
+	l.v6 = net.CIDRMask(s.IPv6Prefix, 8*net.IPv6len)
+}
+
+func (l *SubnetLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.setMasks(cfg.Subnet)
+	l.limiter.SetConfig(subnetConfig(cfg))
+}
+
+// network returns the network ip is counted against.
+func (l *SubnetLimiter) network(ip net.IP) net.IP {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(l.v4)
+	}
+	return ip.Mask(l.v6)
+}
+
+func (l *SubnetLimiter) Allow(ip net.IP) bool {
+	return l.limiter.Allow(l.network(ip))
+}
+
+func (l *SubnetLimiter) Share(store cluster.Store, scope string) {
+	l.limiter.Share(store, scope)
+}
+
+func (l *SubnetLimiter) Sweep()              { l.limiter.Sweep() }
+func (l *SubnetLimiter) Stats() LimiterStats { return l.limiter.Stats() }
+
+//--------global--------
+
+// GlobalLimiter applies a single budget to every client of a listener.
+type GlobalLimiter struct {
+	limiter *ConfiguredLimiter
+}
+
+func NewGlobalLimiter(cfg *config.RateLimiterConfig) *GlobalLimiter {
+	return &GlobalLimiter{limiter: NewRateLimiter(globalConfig(cfg))}
+}
+
+func globalConfig(cfg *config.RateLimiterConfig) *config.RateLimiterConfig {
+	return &config.RateLimiterConfig{RateLimiter: cfg.Global}
+}
+
+func (l *GlobalLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.limiter.SetConfig(globalConfig(cfg))
+}
+
+func (l *GlobalLimiter) Allow(net.IP) bool {
+	return l.limiter.Allow(net.IPv4zero)
+}
+
+func (l *GlobalLimiter) Share(store cluster.Store, scope string) {
+	l.limiter.Share(store, scope)
+}
+
+func (l *GlobalLimiter) Sweep()              { l.limiter.Sweep() }
+func (l *GlobalLimiter) Stats() LimiterStats { return l.limiter.Stats() }
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"database_firewall/internal/config"
+)
+
+// The window limiters allow a number of connections per client IP in a
+// window of time. A zero limit disables them.
+
+//--------sliding window log--------
+
+// SlidingWindowLogLimiter keeps the time of every connection in the last
+// window, so the limit holds exactly over any window at the cost of memory
+// proportional to the limit.
+type SlidingWindowLogLimiter struct {
+	mu     sync.Mutex
+	limit  int64
+	window time.Duration
+	logs   *keyLRU[[]time.Time]
+}
+
+func NewSlidingWindowLogLimiter(cfg *config.RateLimiterConfig) *SlidingWindowLogLimiter {
+	l := &SlidingWindowLogLimiter{logs: newKeyLRU[[]time.Time](cfg.RateLimiter.MaxTrackedKeys)}
+	l.SetConfig(cfg)
+	return l
+}
+
+func (l *SlidingWindowLogLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := cfg.RateLimiter.SlidingWindowLogLimiter
+	l.limit, l.window = w.Limit, time.Duration(w.WindowMillis)*time.Millisecond
+	l.logs.setMax(cfg.RateLimiter.MaxTrackedKeys)
+}
+
+// Sweep drops logs whose entries have all left the window.
+func (l *SlidingWindowLogLimiter) Sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-l.window)
+	l.logs.sweep(func(log []time.Time) bool {
+		return len(log) == 0 || !log[len(log)-1].After(cutoff)
+	})
+}
+
+func (l *SlidingWindowLogLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.logs.stats()
+}
+
+func (l *SlidingWindowLogLimiter) Allow(ip net.IP) bool {
+	return l.AllowKey(ip.String())
+}
+
+func (l *SlidingWindowLogLimiter) AllowKey(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return true
+	}
+
+	now := time.Now()
+	log, _ := l.logs.get(key)
+	cutoff := now.Add(-l.window)
+	i := 0
+	for i < len(log) && !log[i].After(cutoff) {
+		i++
+	}
+	log = log[i:]
+
+	if int64(len(log)) >= l.limit {
+		l.logs.put(key, log)
+		return false
+	}
+	l.logs.put(key, append(log, now))
+	return true
+}
+
+//--------sliding window counter--------
+
+// SlidingWindowCounterLimiter counts connections in fixed windows and
+// weighs the previous window's count by how much of it still overlaps the
+// sliding one, approximating the log with two counters per IP.
+type SlidingWindowCounterLimiter struct {
+	mu       sync.Mutex
+	limit    int64
+	window   time.Duration
+	counters *keyLRU[slidingCounter]
+}
+
+type slidingCounter struct {
+	start     time.Time
+	prev, cur int64
+}
+
+func NewSlidingWindowCounterLimiter(cfg *config.RateLimiterConfig) *SlidingWindowCounterLimiter {
+	l := &SlidingWindowCounterLimiter{counters: newKeyLRU[slidingCounter](cfg.RateLimiter.MaxTrackedKeys)}
+	l.SetConfig(cfg)
+	return l
+}
+
+func (l *SlidingWindowCounterLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := cfg.RateLimiter.SlidingWindowCounterLimiter
+	window := time.Duration(w.WindowMillis) * time.Millisecond
+	if window != l.window {
+		l.counters.clear()
+	}
+	l.limit, l.window = w.Limit, window
+	l.counters.setMax(cfg.RateLimiter.MaxTrackedKeys)
+}
+
+// Sweep drops counters that no longer weigh in: those last used before
+// the previous window.
+func (l *SlidingWindowCounterLimiter) Sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := time.Now().Truncate(l.window).Add(-l.window)
+	l.counters.sweep(func(c slidingCounter) bool {
+		return c.start.Before(prev)
+	})
+}
+
+func (l *SlidingWindowCounterLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counters.stats()
+}
+
+func (l *SlidingWindowCounterLimiter) Allow(ip net.IP) bool {
+	return l.AllowKey(ip.String())
+}
+
+func (l *SlidingWindowCounterLimiter) AllowKey(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return true
+	}
+
+	now := time.Now()
+	c, _ := l.counters.get(key)
+
+	//-------------roll windows--------------
+	start := now.Truncate(l.window)
+	switch {
+	case start.Equal(c.start):
+	case start.Equal(c.start.Add(l.window)):
+		c.prev, c.cur = c.cur, 0
+	default:
+		c.prev, c.cur = 0, 0
+	}
+	c.start = start
+
+	//-------------allow/deny------------
+	overlap := 1 - float64(now.Sub(start))/float64(l.window)
+	if float64(c.prev)*overlap+float64(c.cur) >= float64(l.limit) {
+		l.counters.put(key, c)
+		return false
+	}
+	c.cur++
+	l.counters.put(key, c)
+	return true
+}
+
+//--------fixed window--------
+
+// FixedWindowLimiter counts connections per window aligned to the clock.
+// It is the cheapest, but allows up to twice the limit across a window
+// boundary.
+type FixedWindowLimiter struct {
+	mu      sync.Mutex
+	limit   int64
+	window  time.Duration
+	windows *keyLRU[fixedWindow]
+}
+
+type fixedWindow struct {
+	start time.Time
+	count int64
+}
+
+func NewFixedWindowLimiter(cfg *config.RateLimiterConfig) *FixedWindowLimiter {
+	l := &FixedWindowLimiter{windows: newKeyLRU[fixedWindow](cfg.RateLimiter.MaxTrackedKeys)}
+	l.SetConfig(cfg)
+	return l
+}
+
+func (l *FixedWindowLimiter) SetConfig(cfg *config.RateLimiterConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := cfg.RateLimiter.FixedWindowLimiter
+	window := time.Duration(w.WindowMillis) * time.Millisecond
+	if window != l.window {
+		l.windows.clear()
+	}
+	l.limit, l.window = w.Limit, window
+	l.windows.setMax(cfg.RateLimiter.MaxTrackedKeys)
+}
+
+// Sweep drops the counts of past windows.
+func (l *FixedWindowLimiter) Sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := time.Now().Truncate(l.window)
+	l.windows.sweep(func(w fixedWindow) bool {
+		return w.start.Before(start)
+	})
+}
+
+func (l *FixedWindowLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.windows.stats()
+}
+
+func (l *FixedWindowLimiter) Allow(ip net.IP) bool {
+	return l.AllowKey(ip.String())
+}
+
+func (l *FixedWindowLimiter) AllowKey(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return true
+	}
+
+	start := time.Now().Truncate(l.window)
+	w, _ := l.windows.get(key)
+	if !w.start.Equal(start) {
+		w = fixedWindow{start: start}
+	}
+	if w.count >= l.limit {
+		l.windows.put(key, w)
+		return false
+	}
+	w.count++
+	l.windows.put(key, w)
+	return true
+}
@@ -0,0 +1,286 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/sqli"
+)
+
+type Action string
+
+const (
+	ActionAllow Action = "allow"
+	ActionDeny  Action = "deny"
+	ActionLog   Action = "log"
+)
+
+// InjectionRule names the decision made by the injection detector.
+const InjectionRule = "sql_injection"
+
+var _ protocol.Hook = (*Engine)(nil)
+
+type Rule struct {
+	name    string
+	action  Action
+	verbs   map[string]bool
+	tables  map[string]bool
+	pattern *regexp.Regexp
+	nets    []*net.IPNet
+	users   map[string]bool
+	message string
+}
+
+type Decision struct {
+	Action Action
+	Rule   string
+	// Logged lists the log-only rules matched before the decision was made.
+	Logged  []string
+	Message string
+	// Injection is the detector result, set when injection scoring is
+	// enabled.
+	Injection sqli.Result
+}
+
+// Engine evaluates rules in order. Allow and deny rules stop evaluation at
+// the first match; log rules record the match and evaluation continues.
+// Statements no rule decides are scored for injection and blocked when the
+// score reaches the block threshold; an explicit allow rule skips scoring.
+// Reload swaps the rule set atomically, so in-flight statements finish
+// against the one they started with.
+type Engine struct {
+	set atomic.Pointer[ruleSet]
+}
+
+type ruleSet struct {
+	rules     []Rule
+	injection config.InjectionC
+}
+
+func NewEngine(cfg *config.RulesConfig) (*Engine, error) {
+	e := &Engine{}
+	if err := e.Reload(cfg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload replaces the rules and injection thresholds. On error the current
+// rule set stays in place.
+func (e *Engine) Reload(cfg *config.RulesConfig) error {
+	apply, err := e.Prepare(cfg)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare compiles the rules of cfg and returns a function that puts them
+// in place, so a reload can check every component before applying any.
+func (e *Engine) Prepare(cfg *config.RulesConfig) (func(), error) {
+	rs := &ruleSet{injection: cfg.Injection}
+	for i, rc := range cfg.Rules {
+		r, err := newRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		if r.name == "" {
+			r.name = fmt.Sprintf("rule_%d", i)
+		}
+		rs.rules = append(rs.rules, r)
+	}
+	return func() { e.set.Store(rs) }, nil
+}
+
+func newRule(rc config.RuleC) (Rule, error) {
+	r := Rule{
+		name:    rc.Name,
+		action:  Action(rc.Action),
+		verbs:   set(rc.Verbs, strings.ToUpper),
+		tables:  set(rc.Tables, strings.ToLower),
+		users:   set(rc.Users, nil),
+		message: rc.Message,
+	}
+	switch r.action {
+	case ActionAllow, ActionDeny, ActionLog:
+	default:
+		return Rule{}, fmt.Errorf("unknown action %q", rc.Action)
+	}
+	if rc.Pattern != "" {
+		re, err := regexp.Compile(rc.Pattern)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.pattern = re
+	}
+	for _, s := range rc.ClientIPs {
+		n, err := config.ParseCIDR(s)
+		if err != nil {
+			return Rule{}, err
+		}
+		r.nets = append(r.nets, n)
+	}
+	return r, nil
+}
+
+func set(values []string, norm func(string) string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		if norm != nil {
+			v = norm(v)
+		}
+		m[v] = true
+	}
+	return m
+}
+
+func (e *Engine) Evaluate(st *protocol.Statement) Decision {
+	return e.set.Load().evaluate(st)
+}
+
+func (e *ruleSet) evaluate(st *protocol.Statement) Decision {
+	d := Decision{Action: ActionAllow}
+	parsed := parse(st.Tokens())
+	for _, r := range e.rules {
+		if !r.matches(st, parsed) {
+			continue
+		}
+		if r.action == ActionLog {
+			d.Logged = append(d.Logged, r.name)
+			continue
+		}
+		d.Action, d.Rule, d.Message = r.action, r.name, r.message
+		break
+	}
+	if d.Rule != "" || (e.injection.AlertThreshold == 0 && e.injection.BlockThreshold == 0) {
+		return d
+	}
+
+	d.Injection = sqli.DetectTokens(st.Text, st.Tokens())
+	if e.injection.BlockThreshold > 0 && d.Injection.Score >= e.injection.BlockThreshold {
+		d.Action, d.Rule = ActionDeny, InjectionRule
+		d.Message = "statement blocked as likely SQL injection"
+	}
+	return d
+}
+
+// Inspect implements protocol.Hook. Executions of prepared statements are
+// judged by their prepared text against the current rules, so a reload
+// applies to statements prepared before it; they are only logged when
+// denied, having been logged when prepared.
+func (e *Engine) Inspect(st *protocol.Statement) error {
+	execute := st.Kind == protocol.KindExecute
+	rs := e.set.Load()
+	d := rs.evaluate(st)
+	if !execute {
+		for _, name := range d.Logged {
+			logging.LogEvent("INFO", "query_logged", queryFields(st, name))
+		}
+	}
+	if d.Action != ActionDeny {
+		if !execute && rs.injection.AlertThreshold > 0 && d.Injection.Score >= rs.injection.AlertThreshold {
+			logging.LogEvent("WARN", "query_suspicious", injectionFields(st, d))
+		}
+		return nil
+	}
+
+	if d.Rule == InjectionRule {
+		logging.LogEvent("WARN", "query_denied", injectionFields(st, d))
+	} else {
+		logging.LogEvent("WARN", "query_denied", queryFields(st, d.Rule))
+	}
+	msg := d.Message
+	if msg == "" {
+		msg = fmt.Sprintf("statement denied by firewall rule %q", d.Rule)
+	}
+	return &protocol.DenyError{Reason: "rule:" + d.Rule, Message: msg}
+}
+
+func queryFields(st *protocol.Statement, rule string) map[string]any {
+	return map[string]any{
+		"client_ip":   st.ClientIP.String(),
+		"user":        st.User,
+		"database":    st.Database,
+		"rule":        rule,
+		"fingerprint": st.FingerprintHash(),
+		"query":       truncate(st.Normalized(), 200),
+	}
+}
+
+func injectionFields(st *protocol.Statement, d Decision) map[string]any {
+	f := queryFields(st, d.Rule)
+	if d.Rule == "" {
+		delete(f, "rule")
+	}
+	f["score"] = d.Injection.Score
+	f["indicators"] = d.Injection.Indicators
+	return f
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+func (r *Rule) matches(st *protocol.Statement, p parsed) bool {
+	if r.users != nil && !r.users[st.User] {
+		return false
+	}
+	if r.nets != nil && !containsIP(r.nets, st.ClientIP) {
+		return false
+	}
+	if r.verbs != nil && !anyIn(r.verbs, p.verbs) {
+		return false
+	}
+	if r.tables != nil && !anyTable(r.tables, p.tables) {
+		return false
+	}
+	if r.pattern != nil && !r.pattern.MatchString(st.Normalized()) {
+		return false
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyIn(want map[string]bool, have []string) bool {
+	for _, h := range have {
+		if want[h] {
+			return true
+		}
+	}
+	return false
+}
+
+// anyTable matches either the qualified name or its last component, so a
+// rule on "users" also covers "public.users".
+func anyTable(want map[string]bool, have []string) bool {
+	for _, h := range have {
+		if want[h] {
+			return true
+		}
+		if i := strings.LastIndexByte(h, '.'); i >= 0 && want[h[i+1:]] {
+			return true
+		}
+	}
+	return false
+}
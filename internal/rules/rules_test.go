@@ -0,0 +1,257 @@
+package rules
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/protocol"
+)
+
+func testEngine(t *testing.T, rules ...config.RuleC) *Engine {
+	t.Helper()
+	e, err := NewEngine(&config.RulesConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func stmt(text string) *protocol.Statement {
+	return &protocol.Statement{
+		Info: protocol.Info{ClientIP: net.ParseIP("10.0.0.1"), User: "app"},
+		Kind: protocol.KindQuery,
+		Text: text,
+	}
+}
+
+func TestEngine_MatchesVerbsAndTables(t *testing.T) {
+	e := testEngine(t,
+		config.RuleC{Name: "no-drop", Action: "deny", Verbs: []string{"drop", "TRUNCATE"}},
+		config.RuleC{Name: "no-users", Action: "deny", Tables: []string{"users"}},
+	)
+
+	cases := []struct {
+		sql  string
+		rule string
+	}{
+		{"drop table orders", "no-drop"},
+		{"TRUNCATE TABLE orders", "no-drop"},
+		{"SELECT 1; DROP TABLE orders", "no-drop"},
+		{"SELECT * FROM public.users WHERE id = 1", "no-users"},
+		{"SELECT * FROM orders o JOIN \"Users\" u ON u.id = o.uid", "no-users"},
+		{"SELECT * FROM orders", ""},
+	}
+	for _, c := range cases {
+		d := e.Evaluate(stmt(c.sql))
+		if c.rule == "" {
+			if d.Action != ActionAllow {
+				t.Errorf("%q: expected allow, got %s by %s", c.sql, d.Action, d.Rule)
+			}
+			continue
+		}
+		if d.Action != ActionDeny || d.Rule != c.rule {
+			t.Errorf("%q: expected deny by %s, got %s by %s", c.sql, c.rule, d.Action, d.Rule)
+		}
+	}
+}
+
+func TestEngine_FirstDecidingRuleWins(t *testing.T) {
+	e := testEngine(t,
+		config.RuleC{Name: "audit", Action: "log", Verbs: []string{"GRANT"}},
+		config.RuleC{Name: "dba", Action: "allow", Users: []string{"dba"}},
+		config.RuleC{Name: "no-grant", Action: "deny", Verbs: []string{"GRANT"}},
+	)
+
+	st := stmt("GRANT ALL ON orders TO bob")
+	d := e.Evaluate(st)
+	if d.Action != ActionDeny || d.Rule != "no-grant" {
+		t.Fatalf("expected deny by no-grant, got %s by %s", d.Action, d.Rule)
+	}
+	if len(d.Logged) != 1 || d.Logged[0] != "audit" {
+		t.Fatalf("expected log rule to be recorded, got %v", d.Logged)
+	}
+
+	st.User = "dba"
+	if d := e.Evaluate(st); d.Action != ActionAllow || d.Rule != "dba" {
+		t.Fatalf("expected allow by dba, got %s by %s", d.Action, d.Rule)
+	}
+}
+
+func TestEngine_ClientIPAndPattern(t *testing.T) {
+	e := testEngine(t, config.RuleC{
+		Name:      "office-no-sleep",
+		Action:    "deny",
+		ClientIPs: []string{"10.0.0.0/8", "192.168.1.5"},
+		Pattern:   `(?i)pg_sleep`,
+	})
+
+	if d := e.Evaluate(stmt("SELECT pg_sleep(10)")); d.Action != ActionDeny {
+		t.Fatal("expected deny for matching ip and pattern")
+	}
+
+	st := stmt("SELECT pg_sleep(10)")
+	st.ClientIP = net.ParseIP("172.16.0.1")
+	if d := e.Evaluate(st); d.Action != ActionAllow {
+		t.Fatal("expected allow outside configured networks")
+	}
+
+	st.ClientIP = net.ParseIP("192.168.1.5")
+	if d := e.Evaluate(st); d.Action != ActionDeny {
+		t.Fatal("expected deny for single host entry")
+	}
+}
+
+func TestEngine_InspectReturnsDenyError(t *testing.T) {
+	e := testEngine(t, config.RuleC{Name: "no-drop", Action: "deny", Verbs: []string{"DROP"}, Message: "drops are not allowed"})
+
+	err := e.Inspect(stmt("DROP TABLE orders"))
+	var deny *protocol.DenyError
+	if !errors.As(err, &deny) {
+		t.Fatalf("expected DenyError, got %v", err)
+	}
+	if deny.Message != "drops are not allowed" {
+		t.Fatalf("unexpected message %q", deny.Message)
+	}
+
+	if err := e.Inspect(stmt("SELECT 1")); err != nil {
+		t.Fatalf("expected allow, got %v", err)
+	}
+}
+
+func TestNewEngine_RejectsBadConfig(t *testing.T) {
+	bad := []config.RuleC{
+		{Action: "block"},
+		{Action: "deny", Pattern: "("},
+		{Action: "deny", ClientIPs: []string{"not-an-ip"}},
+	}
+	for _, r := range bad {
+		if _, err := NewEngine(&config.RulesConfig{Rules: []config.RuleC{r}}); err == nil {
+			t.Errorf("expected error for %+v", r)
+		}
+	}
+}
+
+func TestEngine_ReloadSwapsRules(t *testing.T) {
+	e := testEngine(t, config.RuleC{Action: "deny", Verbs: []string{"DROP"}})
+	if err := e.Reload(&config.RulesConfig{Rules: []config.RuleC{{Action: "deny", Verbs: []string{"DELETE"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if d := e.Evaluate(stmt("DROP TABLE orders")); d.Action != ActionAllow {
+		t.Fatal("expected the old rule to be gone")
+	}
+	if d := e.Evaluate(stmt("DELETE FROM orders")); d.Action != ActionDeny {
+		t.Fatal("expected the new rule to apply")
+	}
+
+	if err := e.Reload(&config.RulesConfig{Rules: []config.RuleC{{Action: "block"}}}); err == nil {
+		t.Fatal("expected bad rules to be rejected")
+	}
+	if d := e.Evaluate(stmt("DELETE FROM orders")); d.Action != ActionDeny {
+		t.Fatal("expected a failed reload to keep the current rules")
+	}
+
+	apply, err := e.Prepare(&config.RulesConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := e.Evaluate(stmt("DELETE FROM orders")); d.Action != ActionDeny {
+		t.Fatal("expected prepared rules not to apply before the swap")
+	}
+	apply()
+	if d := e.Evaluate(stmt("DELETE FROM orders")); d.Action != ActionAllow {
+		t.Fatal("expected the prepared rules to apply after the swap")
+	}
+}
+
+func TestEngine_ReloadAppliesToPreparedStatements(t *testing.T) {
+	e := testEngine(t)
+	prepare := stmt("DELETE FROM orders WHERE id = $1")
+	prepare.Kind = protocol.KindPrepare
+	if err := e.Inspect(prepare); err != nil {
+		t.Fatalf("expected the prepare to pass, got %v", err)
+	}
+	exec := stmt("DELETE FROM orders WHERE id = $1")
+	exec.Kind = protocol.KindExecute
+	if err := e.Inspect(exec); err != nil {
+		t.Fatalf("expected the execution to pass, got %v", err)
+	}
+
+	if err := e.Reload(&config.RulesConfig{Rules: []config.RuleC{{Name: "no-delete", Action: "deny", Verbs: []string{"DELETE"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	var deny *protocol.DenyError
+	if err := e.Inspect(exec); !errors.As(err, &deny) || deny.Reason != "rule:no-delete" {
+		t.Fatalf("expected the reloaded rule to deny the execution, got %v", err)
+	}
+}
+
+func TestEngine_SeesThroughCommentsAndCase(t *testing.T) {
+	e := testEngine(t,
+		config.RuleC{Name: "no-drop", Action: "deny", Verbs: []string{"DROP"}},
+		config.RuleC{Name: "no-delete", Action: "deny", Verbs: []string{"DELETE"}},
+		config.RuleC{Name: "no-union", Action: "deny", Pattern: `UNION SELECT`},
+	)
+
+	cases := []struct {
+		sql   string
+		proto string
+		rule  string
+	}{
+		{"DrOp/**/TaBlE orders", "postgres", "no-drop"},
+		{"/* x */ drop -- y\n table orders", "postgres", "no-drop"},
+		{"WITH gone AS (DELETE FROM orders RETURNING *) SELECT * FROM gone", "postgres", "no-delete"},
+		{"EXPLAIN ANALYZE DELETE FROM orders", "postgres", "no-delete"},
+		{"SELECT 1 /*!50000 union*/ /**/select 2", "mysql", "no-union"},
+		{"SELECT 1--1; DROP TABLE users", "mysql", "no-drop"},
+		{"SELECT 1 -- ; DROP TABLE users", "mysql", ""},
+		{"SELECT 'DROP TABLE orders'", "postgres", ""},
+	}
+	for _, c := range cases {
+		st := stmt(c.sql)
+		st.Protocol = c.proto
+		d := e.Evaluate(st)
+		if c.rule == "" {
+			if d.Action != ActionAllow {
+				t.Errorf("%q: expected allow, got %s by %s", c.sql, d.Action, d.Rule)
+			}
+			continue
+		}
+		if d.Action != ActionDeny || d.Rule != c.rule {
+			t.Errorf("%q: expected deny by %s, got %s by %s", c.sql, c.rule, d.Action, d.Rule)
+		}
+	}
+}
+
+func TestEngine_InjectionThresholds(t *testing.T) {
+	e, err := NewEngine(&config.RulesConfig{
+		Rules:     []config.RuleC{{Name: "trusted", Action: "allow", Users: []string{"dba"}}},
+		Injection: config.InjectionC{AlertThreshold: 20, BlockThreshold: 40},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := e.Evaluate(stmt("SELECT * FROM users WHERE name = '' OR '1'='1'"))
+	if d.Action != ActionDeny || d.Rule != InjectionRule {
+		t.Fatalf("expected injection deny, got %s by %s (score %d)", d.Action, d.Rule, d.Injection.Score)
+	}
+
+	d = e.Evaluate(stmt("SELECT a FROM t1 UNION SELECT b FROM t2"))
+	if d.Action != ActionAllow || d.Injection.Score != 20 {
+		t.Fatalf("expected allow with alert score, got %s score %d", d.Action, d.Injection.Score)
+	}
+
+	st := stmt("SELECT * FROM users WHERE name = '' OR '1'='1'")
+	st.User = "dba"
+	if d := e.Evaluate(st); d.Action != ActionAllow || d.Injection.Score != 0 {
+		t.Fatalf("expected explicit allow to skip scoring, got %s score %d", d.Action, d.Injection.Score)
+	}
+
+	err = e.Inspect(stmt("SELECT 1; DELETE FROM users WHERE 1=1 OR 1=1"))
+	var deny *protocol.DenyError
+	if !errors.As(err, &deny) || deny.Reason != "rule:"+InjectionRule {
+		t.Fatalf("expected injection DenyError, got %v", err)
+	}
+}
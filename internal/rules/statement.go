@@ -0,0 +1,194 @@
+package rules
+
+import (
+	"strings"
+
+	"database_firewall/internal/sqllex"
+)
+
+type parsed struct {
+	verbs  []string
+	tables []string
+}
+
+var tableKeywords = map[string]bool{
+	"FROM":     true,
+	"JOIN":     true,
+	"INTO":     true,
+	"UPDATE":   true,
+	"TABLE":    true,
+	"TABLES":   true,
+	"TRUNCATE": true,
+}
+
+var tableModifiers = map[string]bool{
+	"TABLE":        true,
+	"ONLY":         true,
+	"IF":           true,
+	"NOT":          true,
+	"EXISTS":       true,
+	"IGNORE":       true,
+	"LOW_PRIORITY": true,
+	"QUICK":        true,
+}
+
+var dmlVerbs = map[string]bool{
+	"SELECT": true,
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+	"VALUES": true,
+	"TABLE":  true,
+}
+
+// parse extracts the verbs and tables of every statement in a token
+// stream. Besides the leading verb, the verbs of CTE bodies and of the
+// statement an EXPLAIN runs are reported, since both execute.
+func parse(tokens []sqllex.Token) parsed {
+	var p parsed
+	for _, stmt := range sqllex.Split(tokens) {
+		p.verbs = append(p.verbs, verbs(stmt)...)
+		p.tables = append(p.tables, tables(stmt)...)
+	}
+	return p
+}
+
+func verbs(stmt []sqllex.Token) []string {
+	i := 0
+	for i < len(stmt) && stmt[i].IsPunct("(") {
+		i++
+	}
+	if i >= len(stmt) || stmt[i].Kind != sqllex.Word {
+		return nil
+	}
+	first := stmt[i].Upper()
+	out := []string{first}
+
+	switch first {
+	case "WITH":
+		depth := 0
+		for j := i + 1; j < len(stmt); j++ {
+			t := stmt[j]
+			switch {
+			case t.IsPunct("("):
+				depth++
+				if depth == 1 && j+1 < len(stmt) && stmt[j+1].Kind == sqllex.Word && dmlVerbs[stmt[j+1].Upper()] && precededByAs(stmt, j) {
+					out = append(out, stmt[j+1].Upper())
+				}
+			case t.IsPunct(")"):
+				depth--
+			case depth == 0 && t.Kind == sqllex.Word && dmlVerbs[t.Upper()]:
+				return append(out, t.Upper())
+			}
+		}
+	case "EXPLAIN":
+		for _, t := range stmt[i+1:] {
+			if t.Kind == sqllex.Word && dmlVerbs[t.Upper()] {
+				return append(out, t.Upper())
+			}
+		}
+	}
+	return out
+}
+
+// precededByAs reports whether the "(" at i opens a CTE body, i.e. follows
+// AS with optional [NOT] MATERIALIZED in between.
+func precededByAs(stmt []sqllex.Token, i int) bool {
+	for j := i - 1; j >= 0; j-- {
+		switch {
+		case stmt[j].IsWord("MATERIALIZED"), stmt[j].IsWord("NOT"):
+			continue
+		case stmt[j].IsWord("AS"):
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+func tables(stmt []sqllex.Token) []string {
+	var out []string
+	grant := len(stmt) > 0 && (stmt[0].IsWord("GRANT") || stmt[0].IsWord("REVOKE"))
+
+	// parens tracks whether each open parenthesis is a function call, where
+	// FROM is syntax (EXTRACT(x FROM y)) rather than a table reference.
+	var parens []bool
+	for i, t := range stmt {
+		switch {
+		case t.IsPunct("("):
+			call := i > 0 && stmt[i-1].Kind == sqllex.Word && !sqllex.IsKeyword(stmt[i-1].Text)
+			parens = append(parens, call)
+			continue
+		case t.IsPunct(")"):
+			if len(parens) > 0 {
+				parens = parens[:len(parens)-1]
+			}
+			continue
+		case t.Kind != sqllex.Word:
+			continue
+		}
+
+		kw := t.Upper()
+		switch {
+		case kw == "ON" && grant:
+		case !tableKeywords[kw]:
+			continue
+		case len(parens) > 0 && parens[len(parens)-1]:
+			continue
+		case kw == "UPDATE" && i > 0 && (stmt[i-1].IsWord("FOR") || stmt[i-1].IsWord("KEY")):
+			continue
+		}
+		out = append(out, tableList(stmt, i+1)...)
+	}
+	return out
+}
+
+// tableList reads a comma separated list of possibly qualified and aliased
+// table names starting at i.
+func tableList(stmt []sqllex.Token, i int) []string {
+	var out []string
+	for {
+		for i < len(stmt) && tableModifiers[stmt[i].Upper()] {
+			i++
+		}
+		name, next := qualifiedName(stmt, i)
+		if name == "" {
+			return out
+		}
+		out = append(out, name)
+		i = next
+
+		if i < len(stmt) && stmt[i].IsWord("AS") {
+			i += 2
+		} else if i < len(stmt) && (stmt[i].Kind == sqllex.QuotedIdent || (stmt[i].Kind == sqllex.Word && !sqllex.IsKeyword(stmt[i].Text))) {
+			i++
+		}
+		if i >= len(stmt) || !stmt[i].IsPunct(",") {
+			return out
+		}
+		i++
+	}
+}
+
+func qualifiedName(stmt []sqllex.Token, i int) (string, int) {
+	var parts []string
+	for i < len(stmt) {
+		t := stmt[i]
+		switch {
+		case t.Kind == sqllex.QuotedIdent:
+			q := t.Text[:1]
+			parts = append(parts, strings.ReplaceAll(strings.Trim(t.Text, q), q+q, q))
+		case t.Kind == sqllex.Word && (len(parts) > 0 || !sqllex.IsKeyword(t.Text)):
+			parts = append(parts, t.Text)
+		default:
+			return strings.ToLower(strings.Join(parts, ".")), i
+		}
+		i++
+		if i >= len(stmt) || !stmt[i].IsPunct(".") {
+			break
+		}
+		i++
+	}
+	return strings.ToLower(strings.Join(parts, ".")), i
+}
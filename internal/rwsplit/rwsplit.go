@@ -0,0 +1,108 @@
+package rwsplit
+
+import (
+	"strings"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/sqllex"
+)
+
+var defaultReadVerbs = []string{"SELECT", "WITH", "SHOW"}
+
+// writeWords mark a statement that starts like a read as one that writes or
+// takes locks: data-modifying CTEs, SELECT ... INTO, FOR UPDATE / FOR
+// SHARE, LOCK IN SHARE MODE and the sequence and lock functions.
+var writeWords = map[string]bool{
+	"INSERT":       true,
+	"UPDATE":       true,
+	"DELETE":       true,
+	"MERGE":        true,
+	"INTO":         true,
+	"SHARE":        true,
+	"LOCK":         true,
+	"NEXTVAL":      true,
+	"SETVAL":       true,
+	"GET_LOCK":     true,
+	"RELEASE_LOCK": true,
+}
+
+// pinVerbs start, and pinWords appear in, statements that change session
+// state replicas would not share: settings and roles, the current
+// database, prepared statements, temporary tables and set_config.
+var (
+	pinVerbs = map[string]bool{
+		"SET":     true,
+		"RESET":   true,
+		"USE":     true,
+		"PREPARE": true,
+	}
+	pinWords = map[string]bool{
+		"TEMP":       true,
+		"TEMPORARY":  true,
+		"SET_CONFIG": true,
+	}
+)
+
+// Policy decides which statements are safe to run on a replica. It errs
+// towards the primary: anything it does not recognise as a single plain
+// read stays there.
+type Policy struct {
+	verbs map[string]bool
+}
+
+func NewPolicy(c config.ReadWriteSplitC) *Policy {
+	verbs := c.ReadVerbs
+	if len(verbs) == 0 {
+		verbs = defaultReadVerbs
+	}
+	p := &Policy{verbs: make(map[string]bool)}
+	for _, v := range verbs {
+		p.verbs[strings.ToUpper(v)] = true
+	}
+	return p
+}
+
+func (p *Policy) ReadOnly(st *protocol.Statement) bool {
+	stmts := sqllex.Split(st.Tokens())
+	if len(stmts) != 1 {
+		return false
+	}
+	stmt := stmts[0]
+	i := 0
+	for i < len(stmt) && stmt[i].IsPunct("(") {
+		i++
+	}
+	if i >= len(stmt) || stmt[i].Kind != sqllex.Word || !p.verbs[stmt[i].Upper()] {
+		return false
+	}
+	for _, t := range stmt[i+1:] {
+		if t.Kind != sqllex.Word {
+			continue
+		}
+		w := t.Upper()
+		if writeWords[w] || strings.HasPrefix(w, "PG_ADVISORY") {
+			return false
+		}
+	}
+	return true
+}
+
+// Pins reports whether st changes session state, after which the session's
+// reads must stay on the primary.
+func (p *Policy) Pins(st *protocol.Statement) bool {
+	for _, stmt := range sqllex.Split(st.Tokens()) {
+		first := true
+		for _, t := range stmt {
+			if t.Kind != sqllex.Word {
+				continue
+			}
+			w := t.Upper()
+			if first && pinVerbs[w] || pinWords[w] {
+				return true
+			}
+			first = false
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package rwsplit
+
+import (
+	"testing"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/protocol"
+)
+
+func stmt(protocolName, text string) *protocol.Statement {
+	return &protocol.Statement{
+		Info: protocol.Info{Protocol: protocolName},
+		Kind: protocol.KindQuery,
+		Text: text,
+	}
+}
+
+func TestPolicy_ReadOnly(t *testing.T) {
+	p := NewPolicy(config.ReadWriteSplitC{})
+
+	reads := []string{
+		"SELECT * FROM orders WHERE id = 1",
+		"select count(*) from orders;",
+		"(SELECT 1) UNION (SELECT 2)",
+		"WITH recent AS (SELECT * FROM orders) SELECT * FROM recent",
+		"/* report */ SELECT 'insert into x' AS label",
+		"SHOW search_path",
+	}
+	for _, sql := range reads {
+		if !p.ReadOnly(stmt("postgres", sql)) {
+			t.Errorf("%q: expected read-only", sql)
+		}
+	}
+
+	writes := []string{
+		"INSERT INTO orders VALUES (1)",
+		"BEGIN",
+		"SELECT 1; DELETE FROM orders",
+		"SELECT * FROM orders FOR UPDATE",
+		"SELECT * FROM orders FOR SHARE",
+		"SELECT * INTO archive FROM orders",
+		"WITH gone AS (DELETE FROM orders RETURNING *) SELECT * FROM gone",
+		"SELECT nextval('orders_id_seq')",
+		"SELECT pg_advisory_lock(1)",
+		"EXPLAIN ANALYZE SELECT 1",
+	}
+	for _, sql := range writes {
+		if p.ReadOnly(stmt("postgres", sql)) {
+			t.Errorf("%q: expected primary", sql)
+		}
+	}
+
+	for _, sql := range []string{"SELECT * FROM t LOCK IN SHARE MODE", "SELECT GET_LOCK('a', 1)", "SELECT 1 INTO @x"} {
+		if p.ReadOnly(stmt("mysql", sql)) {
+			t.Errorf("%q: expected primary", sql)
+		}
+	}
+}
+
+func TestPolicy_ConfiguredVerbs(t *testing.T) {
+	p := NewPolicy(config.ReadWriteSplitC{ReadVerbs: []string{"select"}})
+	if p.ReadOnly(stmt("mysql", "SHOW TABLES")) {
+		t.Fatal("expected SHOW to stay on the primary")
+	}
+	if !p.ReadOnly(stmt("mysql", "SELECT 1")) {
+		t.Fatal("expected SELECT to be read-only")
+	}
+}
+
+func TestPolicy_Pins(t *testing.T) {
+	p := NewPolicy(config.ReadWriteSplitC{})
+
+	pins := []string{
+		"SET search_path TO app",
+		"SET ROLE auditor",
+		"RESET ALL",
+		"USE orders",
+		"PREPARE q AS SELECT 1",
+		"CREATE TEMP TABLE scratch (id int)",
+		"CREATE TEMPORARY TABLE scratch (id int)",
+		"SELECT set_config('app.user', 'alice', false)",
+		"SELECT 1; SET x = 1",
+	}
+	for _, sql := range pins {
+		if !p.Pins(stmt("postgres", sql)) {
+			t.Errorf("%q: expected to pin the session", sql)
+		}
+	}
+
+	for _, sql := range []string{"SELECT * FROM orders", "UPDATE orders SET paid = true", "BEGIN"} {
+		if p.Pins(stmt("postgres", sql)) {
+			t.Errorf("%q: expected not to pin the session", sql)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"database_firewall/internal/ban"
+	"database_firewall/internal/cluster"
+	"database_firewall/internal/config"
+	"database_firewall/internal/ipfilter"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/metrics"
+	"database_firewall/internal/protocol"
+	"database_firewall/internal/proxy"
+	"database_firewall/internal/rwsplit"
+	"database_firewall/internal/tlsconfig"
+	"database_firewall/internal/upgrade"
+	"database_firewall/internal/upstream"
+)
+
+// Listener accepts connections for one route and proxies them to its
+// upstream. Each listener has its own connection register and rate
+// limiters, for connections and for the statements run on them.
+type Listener struct {
+	cfg       config.ProxyConfig
+	laddr     *net.TCPAddr
+	ln        *net.TCPListener
+	hook      protocol.Hook
+	clientTLS *tls.Config
+	pool      *upstream.Pool
+	replicas  *upstream.Pool
+	split     *protocol.Split
+
+	filter    *ipfilter.Filter
+	ConnReg   *proxy.ConnectionRegister
+	limiter   *proxy.ConfiguredLimiter
+	subnet    *proxy.SubnetLimiter
+	global    *proxy.GlobalLimiter
+	queries   *proxy.QueryLimiter
+	bans      proxy.Bans
+	admission proxy.AdmissionController
+	metrics   *proxy.Metrics
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	admitMu   sync.Mutex
+	draining  bool
+	admitting sync.WaitGroup // accepted connections not yet admitted
+}
+
+func NewListener(route config.RouteConfig, hook protocol.Hook) (*Listener, error) {
+	pcfg := route.Proxy
+	l := &Listener{cfg: *pcfg, hook: hook, done: make(chan struct{})}
+
+	var err error
+	if l.clientTLS, err = tlsconfig.Server(&pcfg.TLS); err != nil {
+		return nil, fmt.Errorf("%s: tls: %w", pcfg.Name, err)
+	}
+	if l.pool, err = upstream.NewPool(pcfg); err != nil {
+		return nil, fmt.Errorf("%s: upstream: %w", pcfg.Name, err)
+	}
+	if rw := pcfg.ReadWriteSplit; len(rw.Replicas.Backends) > 0 {
+		rcfg := *pcfg
+		rcfg.Name = pcfg.Name + "/replicas"
+		rcfg.Upstream = rw.Replicas
+		if l.replicas, err = upstream.NewPool(&rcfg); err != nil {
+			return nil, fmt.Errorf("%s: replicas: %w", pcfg.Name, err)
+		}
+		policy := rwsplit.NewPolicy(rw)
+		l.split = &protocol.Split{
+			ReadOnly: policy.ReadOnly,
+			Pins:     policy.Pins,
+			Dial:     l.dialReplica,
+			User:     rw.User,
+			Password: rw.Password,
+			Sticky:   time.Duration(*rw.StickySeconds) * time.Second,
+		}
+	}
+	if l.laddr, err = net.ResolveTCPAddr("tcp", pcfg.LocalAddress); err != nil {
+		return nil, fmt.Errorf("%s: resolving local address: %w", pcfg.Name, err)
+	}
+
+	if l.filter, err = ipfilter.New(route.IPFilter); err != nil {
+		return nil, fmt.Errorf("%s: %w", pcfg.Name, err)
+	}
+	l.ConnReg = proxy.NewConnectionRegister(route.Connection)
+	l.limiter = proxy.NewRateLimiter(route.RateLimiter)
+	l.subnet = proxy.NewSubnetLimiter(route.RateLimiter)
+	l.global = proxy.NewGlobalLimiter(route.RateLimiter)
+	l.queries = proxy.NewQueryLimiter(pcfg.Name, route.RateLimiter)
+	l.hook = protocol.Hooks{hook, l.queries}
+	l.admission = proxy.AdmissionController{
+		IPFilter:          l.filter,
+		RateLimiter:       l.limiter,
+		SubnetRateLimiter: l.subnet,
+		GlobalRateLimiter: l.global,
+		ConnReg:           l.ConnReg,
+	}
+	return l, nil
+}
+
+// SetMetrics registers the listener's instruments in reg. It must be
+// called before Serve.
+func (l *Listener) SetMetrics(reg *metrics.Registry) {
+	l.metrics = proxy.NewMetrics(reg, l.cfg.Name, l.ConnReg)
+	l.metrics.WatchLimiter(reg, proxy.TierIP, l.limiter)
+	l.metrics.WatchLimiter(reg, proxy.TierSubnet, l.subnet)
+	l.metrics.WatchLimiter(reg, proxy.TierGlobal, l.global)
+	l.queries.SetMetrics(reg, l.metrics)
+	l.admission.Metrics = l.metrics
+}
+
+// SetCluster counts the listener's rate limits and connection limits
+// across every replica sharing store, keyed by the listener name. It must
+// be called before Serve.
+func (l *Listener) SetCluster(store cluster.Store) {
+	l.limiter.Share(store, "rate:"+l.cfg.Name+":"+proxy.TierIP)
+	l.subnet.Share(store, "rate:"+l.cfg.Name+":"+proxy.TierSubnet)
+	l.global.Share(store, "rate:"+l.cfg.Name+":"+proxy.TierGlobal)
+	l.queries.Share(store, "rate:"+l.cfg.Name)
+	l.ConnReg.Share(store, "conn:"+l.cfg.Name)
+}
+
+// SetBlocklists rejects clients on any of the blocklist feeds b. It must
+// be called before Serve.
+func (l *Listener) SetBlocklists(b *ipfilter.Blocklists) {
+	l.filter.SetBlocklists(b)
+}
+
+// SetBans rejects clients banned by b and records their rejections,
+// refused logins and denied statements in it. It must be called before
+// Serve.
+func (l *Listener) SetBans(b *ban.Manager) {
+	l.bans = b
+	l.admission.Bans = b
+}
+
+// Reload applies the IP lists, connection limits and rate limiters of
+// route without touching open connections. Other settings take effect on
+// restart. On error nothing is applied.
+func (l *Listener) Reload(route config.RouteConfig) error {
+	apply, err := l.Prepare(route)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
+
+// Prepare checks the settings Reload applies and returns a function that
+// applies them.
+func (l *Listener) Prepare(route config.RouteConfig) (func(), error) {
+	filter, err := l.filter.Prepare(route.IPFilter)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", l.cfg.Name, err)
+	}
+	return func() {
+		filter()
+		l.ConnReg.SetConfig(route.Connection)
+		l.limiter.SetConfig(route.RateLimiter)
+		l.subnet.SetConfig(route.RateLimiter)
+		l.global.SetConfig(route.RateLimiter)
+		l.queries.SetConfig(route.RateLimiter)
+	}, nil
+}
+
+func (l *Listener) Name() string {
+	return l.cfg.Name
+}
+
+// Listen opens the listening socket, or adopts the one handed over by an
+// upgrading parent, and starts the upstream health checks and the rate
+// limiter sweeps.
+func (l *Listener) Listen() error {
+	ln, err := upgrade.Listen(l.cfg.LocalAddress)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.cfg.Name, err)
+	}
+	l.ln = ln
+	l.pool.Start()
+	if l.replicas != nil {
+		l.replicas.Start()
+	}
+	l.wg.Add(1)
+	go l.sweepLimiters()
+	return nil
+}
+
+// sweepInterval is how often rate limiters drop the state of clients that
+// have fully recovered.
+const sweepInterval = 30 * time.Second
+
+func (l *Listener) sweepLimiters() {
+	defer l.wg.Done()
+	t := time.NewTicker(sweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.limiter.Sweep()
+			l.subnet.Sweep()
+			l.global.Sweep()
+			l.queries.Sweep()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *Listener) dialReplica() (net.Conn, *tls.Config, error) {
+	c, err := l.replicas.Dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, c.TLS, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Socket returns the configured local address and the socket listening on
+// it, for handing over to an upgrade.
+func (l *Listener) Socket() (string, *net.TCPListener) {
+	return l.cfg.LocalAddress, l.ln
+}
+
+// Serve runs the accept loop until the listener is closed. Connections
+// are admitted off the loop, so a slow shared store does not hold up
+// accepting the next.
+func (l *Listener) Serve() {
+	log.Printf("Listening on %s (%s) -> %s", l.ln.Addr(), l.cfg.Name, strings.Join(l.cfg.Upstream.Backends, ","))
+	for {
+		conn, err := l.ln.AcceptTCP()
+		if err != nil {
+			log.Printf("Accept stopped on %s: %s", l.cfg.Name, err)
+			return
+		}
+		if !l.startAdmit() {
+			conn.Close()
+			continue
+		}
+		go l.admit(conn)
+	}
+}
+
+// startAdmit counts a connection as being admitted, unless a drain has
+// started.
+func (l *Listener) startAdmit() bool {
+	l.admitMu.Lock()
+	defer l.admitMu.Unlock()
+	if l.draining {
+		return false
+	}
+	l.admitting.Add(1)
+	return true
+}
+
+func (l *Listener) admit(conn *net.TCPConn) {
+	defer l.admitting.Done()
+	remoteIP := net.IP(conn.RemoteAddr().(*net.TCPAddr).IP)
+	l.admitMu.Lock()
+	draining := l.draining
+	l.admitMu.Unlock()
+	if draining {
+		conn.Close()
+		return
+	}
+	ok, msg := l.admission.Admit(remoteIP)
+	if !ok {
+		conn.Close()
+		logging.LogEvent("WARN", "connection_rejected", map[string]any{
+			"listener":  l.cfg.Name,
+			"client_ip": remoteIP.String(),
+			"reason":    msg,
+		})
+		return
+	}
+	logging.LogEvent("INFO", "connection_accepted", map[string]any{
+		"listener":           l.cfg.Name,
+		"client_ip":          remoteIP.String(),
+		"active_connections": l.ConnReg.ActiveConnectionsCount() + 1,
+	})
+	p := proxy.NewProxy(&l.cfg, remoteIP, conn, l.laddr, l.pool)
+	p.SetHook(l.hook)
+	p.SetBans(l.bans)
+	p.SetTLS(l.clientTLS)
+	p.SetSplit(l.split)
+	p.SetMetrics(l.metrics)
+	l.ConnReg.Track(p)
+	go p.Start(l.ConnReg)
+}
+
+// drainPoll is how often Drain looks for sessions that have gone idle.
+const drainPoll = 50 * time.Millisecond
+
+// DrainResult summarises a drain: connections open when it started, those
+// closed at a transaction boundary and those still open when it gave up.
+type DrainResult struct {
+	Active, Idle, Forced int
+}
+
+// Drain stops accepting and waits for open connections to finish until
+// ctx is done, closing postgres and mysql sessions as soon as they are
+// idle outside a transaction. Whatever is still open then is closed.
+func (l *Listener) Drain(ctx context.Context) DrainResult {
+	l.admitMu.Lock()
+	l.draining = true
+	l.admitMu.Unlock()
+	l.ln.Close()
+	l.admitting.Wait()
+	res := DrainResult{Active: int(l.ConnReg.ActiveConnectionsCount())}
+
+	tick := time.NewTicker(drainPoll)
+	defer tick.Stop()
+	for l.ConnReg.ActiveConnectionsCount() > 0 {
+		res.Idle += l.ConnReg.KillIdle("drained")
+		select {
+		case <-ctx.Done():
+			res.Forced = l.ConnReg.KillAll("shutdown")
+			l.Close()
+			return res
+		case <-tick.C:
+		}
+	}
+	l.Close()
+	return res
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	l.wg.Wait()
+	l.pool.Close()
+	if l.replicas != nil {
+		l.replicas.Close()
+	}
+	return l.ln.Close()
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/metrics"
+)
+
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func startListener(t *testing.T, l config.ListenerC) *Listener {
+	t.Helper()
+	return startListenerMetrics(t, l, metrics.NewRegistry())
+}
+
+func startListenerMetrics(t *testing.T, l config.ListenerC, reg *metrics.Registry) *Listener {
+	t.Helper()
+	c := config.Config{Listeners: []config.ListenerC{l}}
+	routes, _ := c.SplitConfig()
+	sl, err := NewListener(routes[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl.SetMetrics(reg)
+	if err := sl.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go sl.Serve()
+	t.Cleanup(func() { sl.Close() })
+	return sl
+}
+
+func roundTrip(t *testing.T, addr, msg string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != msg {
+		t.Fatalf("expected %q back through %s, got %q (%v)", msg, addr, buf, err)
+	}
+	return c
+}
+
+/*
+-------------------------------------------------
+Test: each listener routes to its own upstream
+with its own connection limits
+-------------------------------------------------
+*/
+func TestListeners_RouteIndependently(t *testing.T) {
+	a := startListener(t, config.ListenerC{Name: "a", LocalAddress: "127.0.0.1:0", RemoteAddress: startEcho(t), ConnectionLimit: 1, PerIPConnectionLimit: 1})
+	b := startListener(t, config.ListenerC{Name: "b", LocalAddress: "127.0.0.1:0", RemoteAddress: startEcho(t), ConnectionLimit: 1, PerIPConnectionLimit: 1})
+
+	roundTrip(t, a.Addr().String(), "to a")
+	roundTrip(t, b.Addr().String(), "to b")
+
+	if a.ConnReg.ActiveConnectionsCount() != 1 || b.ConnReg.ActiveConnectionsCount() != 1 {
+		t.Fatalf("expected one connection per register, got a=%d b=%d",
+			a.ConnReg.ActiveConnectionsCount(), b.ConnReg.ActiveConnectionsCount())
+	}
+
+	// a is full, so a second client is rejected there
+	c, err := net.Dial("tcp", a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected rejected connection to be closed, got %v", err)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: a dead primary fails over to the next backend
+-------------------------------------------------
+*/
+func TestListener_FailsOverToNextBackend(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	l := startListener(t, config.ListenerC{
+		LocalAddress:         "127.0.0.1:0",
+		Upstream:             config.UpstreamC{Backends: []string{dead, startEcho(t)}},
+		ConnectionLimit:      2,
+		PerIPConnectionLimit: 2,
+	})
+	roundTrip(t, l.Addr().String(), "first")
+	roundTrip(t, l.Addr().String(), "second")
+}
+
+/*
+-------------------------------------------------
+Test: admissions, rejections and bytes show up
+in the metrics exposition
+-------------------------------------------------
+*/
+func TestListener_ExportsMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	l := startListenerMetrics(t, config.ListenerC{
+		Name:                 "orders",
+		LocalAddress:         "127.0.0.1:0",
+		RemoteAddress:        startEcho(t),
+		ConnectionLimit:      1,
+		PerIPConnectionLimit: 1,
+	}, reg)
+
+	c := roundTrip(t, l.Addr().String(), "ping")
+	rejected, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rejected.Read(make([]byte, 1))
+	rejected.Close()
+	c.Close()
+
+	want := []string{
+		`warden_connections_accepted_total{listener="orders"} 1`,
+		`warden_connections_rejected_total{listener="orders",reason="connection_limit"} 1`,
+		`warden_bytes_total{listener="orders",direction="in"} 8`,
+		`warden_connection_duration_seconds_count{listener="orders"} 1`,
+		`warden_active_connections{listener="orders"} 0`,
+		`warden_rate_limit_tracked_keys{listener="orders",tier="ip"} 0`,
+		`warden_rate_limit_evictions_total{listener="orders",tier="subnet",cause="capacity"} 0`,
+	}
+	var out string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var b strings.Builder
+		reg.WriteTo(&b)
+		if out = b.String(); containsAll(out, want) {
+			return
+		}
+	}
+	t.Fatalf("expected %q in\n%s", want, out)
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+-------------------------------------------------
+Test: reloading limits keeps open connections and
+applies to new ones
+-------------------------------------------------
+*/
+func TestListener_ReloadKeepsConnections(t *testing.T) {
+	lc := config.ListenerC{LocalAddress: "127.0.0.1:0", RemoteAddress: startEcho(t), ConnectionLimit: 1, PerIPConnectionLimit: 1}
+	l := startListener(t, lc)
+	c := roundTrip(t, l.Addr().String(), "before")
+
+	lc.ConnectionLimit, lc.PerIPConnectionLimit = 2, 2
+	cfg := config.Config{Listeners: []config.ListenerC{lc}}
+	routes, _ := cfg.SplitConfig()
+	if err := l.Reload(routes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip(t, l.Addr().String(), "second")
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("still"))
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatalf("expected the open connection to survive the reload: %v", err)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: a denied address is turned away and the
+lists are swapped on reload
+-------------------------------------------------
+*/
+func TestListener_FiltersClientIPs(t *testing.T) {
+	lc := config.ListenerC{
+		LocalAddress:         "127.0.0.1:0",
+		RemoteAddress:        startEcho(t),
+		ConnectionLimit:      10,
+		PerIPConnectionLimit: 10,
+		IPAllowlist:          []string{"127.0.0.0/8"},
+		IPDenylist:           []string{"127.0.0.1"},
+	}
+	l := startListener(t, lc)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected a denied address to be closed, got %v", err)
+	}
+
+	lc.IPDenylist = nil
+	cfg := config.Config{Listeners: []config.ListenerC{lc}}
+	routes, _ := cfg.SplitConfig()
+	if err := l.Reload(routes[0]); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, l.Addr().String(), "allowed")
+}
+
+/*
+-------------------------------------------------
+Test: draining waits for connections that finish
+and force-closes the rest at the deadline
+-------------------------------------------------
+*/
+func TestListener_DrainForcesStragglers(t *testing.T) {
+	l := startListener(t, config.ListenerC{LocalAddress: "127.0.0.1:0", RemoteAddress: startEcho(t), ConnectionLimit: 2, PerIPConnectionLimit: 2})
+	finishing := roundTrip(t, l.Addr().String(), "done soon")
+	straggler := roundTrip(t, l.Addr().String(), "stays")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		finishing.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	res := l.Drain(ctx)
+	if res != (DrainResult{Active: 2, Forced: 1}) {
+		t.Fatalf("unexpected drain result %+v", res)
+	}
+
+	straggler.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := straggler.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected straggler to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expected listener to stop accepting")
+	}
+	if l.startAdmit() {
+		t.Fatal("expected no admissions once the drain started")
+	}
+}
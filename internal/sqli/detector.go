@@ -0,0 +1,201 @@
+package sqli
+
+import (
+	"strings"
+
+	"database_firewall/internal/sqllex"
+)
+
+// Indicator weights. A statement's score is the sum of the weights of the
+// indicators it shows, capped at MaxScore.
+const (
+	Tautology         = "tautology"
+	StackedQuery      = "stacked_query"
+	UnionSelect       = "union_select"
+	CatalogProbe      = "catalog_probe"
+	TimeDelay         = "time_delay"
+	CommentTruncation = "comment_truncation"
+	UnbalancedQuote   = "unbalanced_quote"
+
+	MaxScore = 100
+)
+
+var weights = map[string]int{
+	Tautology:         40,
+	StackedQuery:      30,
+	UnionSelect:       20,
+	CatalogProbe:      30,
+	TimeDelay:         40,
+	CommentTruncation: 20,
+	UnbalancedQuote:   20,
+}
+
+var delayFuncs = map[string]bool{
+	"SLEEP":          true,
+	"PG_SLEEP":       true,
+	"PG_SLEEP_FOR":   true,
+	"PG_SLEEP_UNTIL": true,
+	"BENCHMARK":      true,
+}
+
+var catalogs = map[string]bool{
+	"information_schema": true,
+	"pg_catalog":         true,
+	"pg_shadow":          true,
+	"pg_authid":          true,
+	"pg_user":            true,
+	"pg_roles":           true,
+	"mysql":              true,
+	"performance_schema": true,
+}
+
+type Result struct {
+	Score      int
+	Indicators []string
+}
+
+func (r *Result) add(indicator string) {
+	for _, i := range r.Indicators {
+		if i == indicator {
+			return
+		}
+	}
+	r.Indicators = append(r.Indicators, indicator)
+	r.Score = min(r.Score+weights[indicator], MaxScore)
+}
+
+// Detect scores sql for classic injection indicators.
+func Detect(sql string, d sqllex.Dialect) Result {
+	return DetectTokens(sql, sqllex.Tokenize(sql, d))
+}
+
+// DetectTokens scores an already tokenized statement. sql must be the text
+// the tokens were produced from, since comments are only visible there.
+func DetectTokens(sql string, tokens []sqllex.Token) Result {
+	var r Result
+	if len(sqllex.Split(tokens)) > 1 {
+		r.add(StackedQuery)
+	}
+
+	union, catalog := false, false
+	for i, t := range tokens {
+		switch {
+		case t.IsWord("OR") && tautology(tokens[i+1:]):
+			r.add(Tautology)
+		case t.IsWord("UNION") && unionSelect(tokens[i+1:]):
+			union = true
+		case t.Kind == sqllex.Word && delayFuncs[t.Upper()] && next(tokens, i).IsPunct("("):
+			r.add(TimeDelay)
+		case t.IsWord("WAITFOR") && next(tokens, i).IsWord("DELAY"):
+			r.add(TimeDelay)
+		case t.Kind == sqllex.Word && catalogs[strings.ToLower(t.Text)]:
+			catalog = true
+		}
+	}
+	if union {
+		r.add(UnionSelect)
+		if catalog {
+			r.add(CatalogProbe)
+		}
+	}
+
+	if len(tokens) > 0 {
+		last := tokens[len(tokens)-1]
+		if last.Kind == sqllex.String && !closed(last.Text) {
+			r.add(UnbalancedQuote)
+		}
+		if truncated(sql[last.Pos+len(last.Text):]) {
+			r.add(CommentTruncation)
+		}
+	}
+	return r
+}
+
+func next(tokens []sqllex.Token, i int) sqllex.Token {
+	if i+1 < len(tokens) {
+		return tokens[i+1]
+	}
+	return sqllex.Token{}
+}
+
+// tautology reports whether the condition following an OR is always true:
+// a comparison of two constants (1=1, 'a'='a', 2>1), a column compared to
+// itself (x=x) or a bare true constant.
+func tautology(rest []sqllex.Token) bool {
+	for len(rest) > 0 && rest[0].IsPunct("(") {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return false
+	}
+	a := rest[0]
+	if a.IsWord("TRUE") || (a.Kind == sqllex.Number && a.Text != "0") {
+		if len(rest) == 1 || rest[1].Kind == sqllex.Punct || rest[1].IsWord("OR") || rest[1].IsWord("AND") {
+			return true
+		}
+	}
+	if len(rest) < 3 {
+		return false
+	}
+	op, b := rest[1], rest[2]
+	if !comparison(op) {
+		return false
+	}
+	if constant(a) && constant(b) {
+		return true
+	}
+	return a.Kind == b.Kind && a.Kind == sqllex.Word && strings.EqualFold(a.Text, b.Text) && !sqllex.IsKeyword(a.Text)
+}
+
+func comparison(t sqllex.Token) bool {
+	switch {
+	case t.Kind == sqllex.Operator:
+		switch t.Text {
+		case "=", "==", "<=>", "<>", "!=", "<", ">", "<=", ">=":
+			return true
+		}
+	case t.IsWord("LIKE"), t.IsWord("IS"):
+		return true
+	}
+	return false
+}
+
+func constant(t sqllex.Token) bool {
+	return t.Kind == sqllex.String || t.Kind == sqllex.Number || t.IsWord("NULL") || t.IsWord("TRUE") || t.IsWord("FALSE")
+}
+
+func unionSelect(rest []sqllex.Token) bool {
+	for _, t := range rest {
+		switch {
+		case t.IsWord("ALL"), t.IsWord("DISTINCT"), t.IsPunct("("):
+			continue
+		case t.IsWord("SELECT"):
+			return true
+		}
+		return false
+	}
+	return false
+}
+
+func closed(s string) bool {
+	if i := strings.IndexAny(s, `'"`); i >= 0 {
+		body := s[i:]
+		return len(body) >= 2 && body[len(body)-1] == body[0]
+	}
+	// Dollar quoted strings.
+	return true
+}
+
+// truncated reports whether the text after the last token is a comment
+// that cuts off the rest of the statement: a line comment, or a block
+// comment that is never closed.
+func truncated(tail string) bool {
+	tail = strings.TrimSpace(tail)
+	switch {
+	case strings.HasPrefix(tail, "--"), strings.HasPrefix(tail, "#"):
+		return true
+	case strings.HasPrefix(tail, "/*"):
+		return !strings.Contains(tail[2:], "*/")
+	}
+	return false
+}
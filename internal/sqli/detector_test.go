@@ -0,0 +1,62 @@
+package sqli
+
+import (
+	"slices"
+	"testing"
+
+	"database_firewall/internal/sqllex"
+)
+
+func TestDetect_Indicators(t *testing.T) {
+	cases := []struct {
+		sql       string
+		d         sqllex.Dialect
+		indicator string
+	}{
+		{"SELECT * FROM users WHERE name = '' OR '1'='1'", sqllex.Postgres, Tautology},
+		{"SELECT * FROM users WHERE id = 5 OR 1=1", sqllex.Postgres, Tautology},
+		{"SELECT * FROM users WHERE id = 5 or (2 > 1)", sqllex.Postgres, Tautology},
+		{"SELECT * FROM users WHERE id = 5 OR id = id", sqllex.Postgres, Tautology},
+		{"SELECT * FROM users WHERE id = 5 OR TRUE", sqllex.Postgres, Tautology},
+		{"SELECT * FROM users WHERE id = 5; DROP TABLE users", sqllex.Postgres, StackedQuery},
+		{"SELECT name FROM items WHERE id = 1 UNION ALL SELECT password FROM users", sqllex.Postgres, UnionSelect},
+		{"SELECT a FROM t UNION SELECT table_name FROM information_schema.tables", sqllex.MySQL, CatalogProbe},
+		{"SELECT * FROM users WHERE id = 1 AND pg_sleep(5) IS NOT NULL", sqllex.Postgres, TimeDelay},
+		{"SELECT * FROM users WHERE id = 1 AND SLEEP(5)", sqllex.MySQL, TimeDelay},
+		{"SELECT * FROM users WHERE name = 'admin' -- ' AND password = 'x'", sqllex.Postgres, CommentTruncation},
+		{"SELECT * FROM users WHERE name = 'admin' #", sqllex.MySQL, CommentTruncation},
+		{"SELECT * FROM users WHERE name = 'admin' /* AND password = 'x'", sqllex.Postgres, CommentTruncation},
+		{"SELECT * FROM users WHERE name = 'admin", sqllex.Postgres, UnbalancedQuote},
+	}
+	for _, c := range cases {
+		r := Detect(c.sql, c.d)
+		if !slices.Contains(r.Indicators, c.indicator) {
+			t.Errorf("%q: expected %s, got %v", c.sql, c.indicator, r.Indicators)
+		}
+		if r.Score < weights[c.indicator] {
+			t.Errorf("%q: score %d below indicator weight", c.sql, r.Score)
+		}
+	}
+}
+
+func TestDetect_BenignQueriesScoreZero(t *testing.T) {
+	benign := []string{
+		"SELECT * FROM users WHERE id = 5 OR email = 'a@b.c'",
+		"SELECT * FROM users WHERE status = 'active' OR status = 'pending'",
+		"SELECT table_name FROM information_schema.tables",
+		"SELECT 'it''s -- fine' FROM t /* trailing note */",
+		"INSERT INTO log (msg) VALUES ('sleep(5)')",
+	}
+	for _, sql := range benign {
+		if r := Detect(sql, sqllex.Postgres); r.Score != 0 {
+			t.Errorf("%q: expected score 0, got %d %v", sql, r.Score, r.Indicators)
+		}
+	}
+}
+
+func TestDetect_ScoreIsCapped(t *testing.T) {
+	r := Detect("SELECT 1 FROM t WHERE a='' OR 1=1 UNION SELECT pg_sleep(9) FROM pg_catalog.pg_user; --", sqllex.Postgres)
+	if r.Score != MaxScore {
+		t.Fatalf("expected capped score, got %d %v", r.Score, r.Indicators)
+	}
+}
@@ -0,0 +1,182 @@
+package sqllex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+var keywords = toSet(`
+	ADD ALL ALTER ANALYZE AND ANY AS ASC BEGIN BETWEEN BY CALL CASCADE CASE CAST
+	CHECK COLUMN COMMIT CONSTRAINT COPY CREATE CROSS CURRENT DATABASE DEALLOCATE
+	DECLARE DEFAULT DELETE DESC DESCRIBE DISTINCT DO DROP ELSE END EXCEPT EXECUTE
+	EXISTS EXPLAIN FALSE FETCH FOR FOREIGN FROM FULL FUNCTION GRANT GROUP HANDLER
+	HAVING IF IGNORE ILIKE IN INDEX INNER INSERT INTERSECT INTERVAL INTO IS JOIN
+	KEY KILL LATERAL LEFT LIKE LIMIT LOAD LOCK MERGE NATURAL NOT NULL OFFSET ON
+	ONLY OR ORDER OUTER OUTFILE OVER PARTITION PREPARE PRIMARY PROCEDURE RECURSIVE
+	REFERENCES RELEASE RENAME REPLACE RESET RETURNING REVOKE RIGHT ROLLBACK SAVEPOINT
+	SCHEMA SELECT SET SHOW START TABLE TABLES THEN TO TRANSACTION TRIGGER TRUE
+	TRUNCATE UNION UNIQUE UPDATE USE USING VACUUM VALUES VIEW WHEN WHERE WINDOW WITH
+`)
+
+func toSet(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+func IsKeyword(w string) bool {
+	return keywords[strings.ToUpper(w)]
+}
+
+// Normalize renders sql without comments and with canonical whitespace,
+// upper-case keywords and lower-case unquoted identifiers. Literals are
+// kept.
+func Normalize(sql string, d Dialect) string {
+	return NormalizeTokens(Tokenize(sql, d))
+}
+
+func NormalizeTokens(tokens []Token) string {
+	return render(tokens, false)
+}
+
+// Fingerprint renders sql like Normalize but with every literal replaced
+// by ?, lists of literals collapsed to (?+) and repeated VALUES rows
+// collapsed to one, so executions differing only in parameters share a
+// fingerprint.
+func Fingerprint(sql string, d Dialect) string {
+	return FingerprintTokens(Tokenize(sql, d))
+}
+
+func FingerprintTokens(tokens []Token) string {
+	return render(tokens, true)
+}
+
+// Hash returns the short stable hash identifying a fingerprint.
+func Hash(fingerprint string) string {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return hex.EncodeToString(sum[:8])
+}
+
+func render(tokens []Token, fingerprint bool) string {
+	var parts []string
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		var text string
+		switch {
+		case fingerprint && signedNumber(tokens, i):
+			continue
+		case fingerprint && t.Literal():
+			text = "?"
+		case t.Kind == Word && keywords[t.Upper()]:
+			text = t.Upper()
+		case t.Kind == Word:
+			text = strings.ToLower(t.Text)
+		default:
+			text = t.Text
+		}
+
+		if fingerprint && t.IsPunct("(") {
+			if end, ok := literalList(tokens, i); ok {
+				text = "(?+)"
+				i = end
+				if n := len(parts); n >= 2 && parts[n-1] == "," && parts[n-2] == "(?+)" {
+					parts = parts[:n-1]
+					continue
+				}
+			}
+		}
+		parts = append(parts, text)
+	}
+
+	var b strings.Builder
+	for i, p := range parts {
+		if i > 0 && space(parts[i-1], p) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+func space(prev, next string) bool {
+	switch next {
+	case ",", ")", ".", ";":
+		return false
+	case "(":
+		return keywords[prev] || !isWordText(prev)
+	}
+	switch prev {
+	case "(", ".":
+		return false
+	}
+	return true
+}
+
+func isWordText(s string) bool {
+	return s != "" && isIdentByte(s[0]) && !isDigit(s[0])
+}
+
+// signedNumber reports whether tokens[i] is a unary sign in front of a
+// number, which fingerprinting folds into the literal.
+func signedNumber(tokens []Token, i int) bool {
+	t := tokens[i]
+	if t.Kind != Operator || (t.Text != "-" && t.Text != "+") || i+1 >= len(tokens) || tokens[i+1].Kind != Number {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	prev := tokens[i-1]
+	switch prev.Kind {
+	case Operator:
+		return true
+	case Punct:
+		return prev.Text != ")" && prev.Text != "]"
+	case Word:
+		return keywords[prev.Upper()]
+	}
+	return false
+}
+
+// literalList reports whether the parenthesised group opening at i holds
+// only literals separated by commas, returning the index of its ")".
+func literalList(tokens []Token, i int) (int, bool) {
+	expectLiteral := true
+	for j := i + 1; j < len(tokens); j++ {
+		t := tokens[j]
+		switch {
+		case expectLiteral && signedNumber(tokens, j):
+			continue
+		case expectLiteral && (t.Literal() || t.IsWord("NULL")):
+			expectLiteral = false
+		case !expectLiteral && t.IsPunct(","):
+			expectLiteral = true
+		case !expectLiteral && t.IsPunct(")"):
+			return j, true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Split separates tokens into statements at top-level semicolons.
+func Split(tokens []Token) [][]Token {
+	var out [][]Token
+	start := 0
+	for i, t := range tokens {
+		if t.IsPunct(";") {
+			if i > start {
+				out = append(out, tokens[start:i])
+			}
+			start = i + 1
+		}
+	}
+	if start < len(tokens) {
+		out = append(out, tokens[start:])
+	}
+	return out
+}
@@ -0,0 +1,334 @@
+package sqllex
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	MySQL
+)
+
+// DialectFor maps a protocol name to the SQL dialect spoken over it.
+func DialectFor(protocol string) Dialect {
+	if protocol == "mysql" {
+		return MySQL
+	}
+	return Postgres
+}
+
+type Kind int
+
+const (
+	Word Kind = iota
+	QuotedIdent
+	String
+	Number
+	Param
+	Operator
+	Punct
+)
+
+type Token struct {
+	Kind Kind
+	Text string
+	Pos  int
+}
+
+// Upper returns the token text upper-cased for unquoted words and as-is
+// for everything else.
+func (t Token) Upper() string {
+	if t.Kind == Word {
+		return strings.ToUpper(t.Text)
+	}
+	return t.Text
+}
+
+func (t Token) IsWord(w string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, w)
+}
+
+func (t Token) IsPunct(p string) bool {
+	return t.Kind == Punct && t.Text == p
+}
+
+// Literal reports whether the token is a value that fingerprinting
+// replaces with a placeholder.
+func (t Token) Literal() bool {
+	switch t.Kind {
+	case String, Number, Param:
+		return true
+	}
+	return false
+}
+
+// Tokenize splits sql into tokens, dropping whitespace and comments. MySQL
+// executable comments (/*! ... */) are not comments to the server, so
+// their content is tokenized like the surrounding text.
+func Tokenize(sql string, d Dialect) []Token {
+	l := &lexer{src: sql, dialect: d}
+	l.run()
+	return l.tokens
+}
+
+type lexer struct {
+	src     string
+	pos     int
+	dialect Dialect
+	tokens  []Token
+	// inExec is set while inside a MySQL /*! ... */ comment.
+	inExec bool
+}
+
+func (l *lexer) run() {
+	for l.pos < len(l.src) {
+		start := l.pos
+		c := l.src[l.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			l.pos++
+		case l.dashComment():
+			l.lineComment()
+		case c == '#' && l.dialect == MySQL:
+			l.lineComment()
+		case c == '/' && l.peek(1) == '*':
+			l.blockComment()
+		case c == '*' && l.peek(1) == '/' && l.inExec:
+			l.inExec = false
+			l.pos += 2
+		case c == '\'':
+			l.quoted(start, '\'', String, l.dialect == MySQL)
+		case c == '"':
+			if l.dialect == MySQL {
+				l.quoted(start, '"', String, true)
+			} else {
+				l.quoted(start, '"', QuotedIdent, false)
+			}
+		case c == '`' && l.dialect == MySQL:
+			l.quoted(start, '`', QuotedIdent, false)
+		case c == '$' && l.dialect == Postgres && l.dollarQuote(start):
+		case c == '$' && isDigit(l.peek(1)):
+			l.pos++
+			l.digits()
+			l.emit(Param, start)
+		case c == '?':
+			l.pos++
+			l.emit(Param, start)
+		case isDigit(c) || (c == '.' && isDigit(l.peek(1))):
+			l.number(start)
+		case strings.IndexByte("(),;[]", c) >= 0:
+			l.pos++
+			l.emit(Punct, start)
+		case c == '.':
+			l.pos++
+			l.emit(Punct, start)
+		case isOperator(c, l.dialect):
+			for l.pos < len(l.src) && isOperator(l.src[l.pos], l.dialect) && !l.commentStart() {
+				l.pos++
+				// MySQL's 1--1 is a minus and a negation, never "--".
+				if l.src[l.pos-1] == '-' && l.peek(0) == '-' {
+					break
+				}
+			}
+			l.emit(Operator, start)
+		default:
+			l.word(start)
+		}
+	}
+}
+
+func (l *lexer) peek(n int) byte {
+	if l.pos+n < len(l.src) {
+		return l.src[l.pos+n]
+	}
+	return 0
+}
+
+func (l *lexer) emit(k Kind, start int) {
+	l.tokens = append(l.tokens, Token{Kind: k, Text: l.src[start:l.pos], Pos: start})
+}
+
+func (l *lexer) commentStart() bool {
+	c, n := l.src[l.pos], l.peek(1)
+	return l.dashComment() || (c == '/' && n == '*') || (c == '*' && n == '/' && l.inExec)
+}
+
+// dashComment reports whether a -- comment starts here. MySQL requires
+// whitespace, a control character or the end of input after the dashes,
+// so 1--1 is 1 - -1 there.
+func (l *lexer) dashComment() bool {
+	if l.src[l.pos] != '-' || l.peek(1) != '-' {
+		return false
+	}
+	if l.dialect != MySQL {
+		return true
+	}
+	n := l.peek(2)
+	return n <= ' ' || n == 0x7f
+}
+
+func (l *lexer) lineComment() {
+	for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+		l.pos++
+	}
+}
+
+func (l *lexer) blockComment() {
+	if l.dialect == MySQL && l.peek(2) == '!' {
+		l.pos += 3
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		l.inExec = true
+		return
+	}
+
+	// Postgres block comments nest, MySQL ones do not.
+	depth := 0
+	for l.pos < len(l.src) {
+		switch {
+		case l.src[l.pos] == '/' && l.peek(1) == '*':
+			depth++
+			l.pos += 2
+		case l.src[l.pos] == '*' && l.peek(1) == '/':
+			depth--
+			l.pos += 2
+			if depth == 0 || l.dialect == MySQL {
+				return
+			}
+		default:
+			l.pos++
+		}
+	}
+}
+
+// quoted consumes a quoted token whose opening quote is at l.pos. start
+// may point earlier to include a literal prefix such as E or X.
+func (l *lexer) quoted(start int, q byte, k Kind, backslash bool) {
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case backslash && c == '\\':
+			l.pos += 2
+			continue
+		case c == q && l.peek(1) == q:
+			l.pos += 2
+			continue
+		case c == q:
+			l.pos++
+			l.emit(k, start)
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.src)
+	l.emit(k, start)
+}
+
+// dollarQuote consumes a Postgres $tag$...$tag$ string. It reports false
+// when the dollar sign does not open one.
+func (l *lexer) dollarQuote(start int) bool {
+	end := l.pos + 1
+	if end < len(l.src) && isDigit(l.src[end]) {
+		return false
+	}
+	for end < len(l.src) && isIdentByte(l.src[end]) {
+		end++
+	}
+	if end >= len(l.src) || l.src[end] != '$' {
+		return false
+	}
+	tag := l.src[l.pos : end+1]
+	body := strings.Index(l.src[end+1:], tag)
+	if body < 0 {
+		l.pos = len(l.src)
+	} else {
+		l.pos = end + 1 + body + len(tag)
+	}
+	l.emit(String, start)
+	return true
+}
+
+func (l *lexer) digits() {
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+}
+
+func (l *lexer) number(start int) {
+	if l.src[l.pos] == '0' && (l.peek(1) == 'x' || l.peek(1) == 'X') {
+		l.pos += 2
+		for l.pos < len(l.src) && isHex(l.src[l.pos]) {
+			l.pos++
+		}
+		l.emit(Number, start)
+		return
+	}
+	l.digits()
+	if l.pos < len(l.src) && l.src[l.pos] == '.' && l.peek(1) != '.' {
+		l.pos++
+		l.digits()
+	}
+	if l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		n := 1
+		if p := l.peek(1); p == '+' || p == '-' {
+			n = 2
+		}
+		if isDigit(l.peek(n)) {
+			l.pos += n
+			l.digits()
+		}
+	}
+	l.emit(Number, start)
+}
+
+func (l *lexer) word(start int) {
+	for l.pos < len(l.src) {
+		r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			break
+		}
+		l.pos += size
+	}
+	if l.pos == start {
+		_, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += size
+		l.emit(Operator, start)
+		return
+	}
+
+	// B'0101', X'ff', N'text' and E'\n' are single literals.
+	if l.pos-start == 1 && l.pos < len(l.src) && l.src[l.pos] == '\'' {
+		switch l.src[start] {
+		case 'b', 'B', 'x', 'X', 'n', 'N':
+			l.quoted(start, '\'', String, l.dialect == MySQL)
+			return
+		case 'e', 'E':
+			l.quoted(start, '\'', String, true)
+			return
+		}
+	}
+	l.emit(Word, start)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHex(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isOperator(c byte, d Dialect) bool {
+	if c == '#' {
+		return d == Postgres
+	}
+	return strings.IndexByte("+-*/<>=~!@%^&|:", c) >= 0
+}
@@ -0,0 +1,76 @@
+package sqllex
+
+import "testing"
+
+func TestNormalize_StripsCommentsAndCanonicalizes(t *testing.T) {
+	cases := []struct {
+		sql  string
+		d    Dialect
+		want string
+	}{
+		{"drop/**/table   Orders", Postgres, "DROP TABLE orders"},
+		{"SeLeCt  *\n\tFROM t -- trailing", Postgres, "SELECT * FROM t"},
+		{"SELECT /* outer /* inner */ still */ 1", Postgres, "SELECT 1"},
+		{"SELECT 1 # comment", MySQL, "SELECT 1"},
+		{"SELECT 1--1", MySQL, "SELECT 1 - - 1"},
+		{"SELECT 1 --\tcomment", MySQL, "SELECT 1"},
+		{"SELECT 1 /*! UNION SELECT 2 */", MySQL, "SELECT 1 UNION SELECT 2"},
+		{"SELECT 'a -- b', \"Col\" FROM x", Postgres, "SELECT 'a -- b', \"Col\" FROM x"},
+		{"SELECT count(*) FROM t WHERE a IN (1, 2)", Postgres, "SELECT count(*) FROM t WHERE a IN (1, 2)"},
+	}
+	for _, c := range cases {
+		if got := Normalize(c.sql, c.d); got != c.want {
+			t.Errorf("Normalize(%q) = %q, want %q", c.sql, got, c.want)
+		}
+	}
+}
+
+func TestTokenize_DialectQuoting(t *testing.T) {
+	pg := Tokenize(`SELECT $body$ it's -- here $body$, "a""b", E'\'x'`, Postgres)
+	kinds := []Kind{Word, String, Punct, QuotedIdent, Punct, String}
+	if len(pg) != len(kinds) {
+		t.Fatalf("expected %d tokens, got %v", len(kinds), pg)
+	}
+	for i, k := range kinds {
+		if pg[i].Kind != k {
+			t.Fatalf("token %d (%q): expected kind %d, got %d", i, pg[i].Text, k, pg[i].Kind)
+		}
+	}
+
+	my := Tokenize("SELECT \"a\\\"b\", `t`#x", MySQL)
+	if len(my) != 4 || my[1].Kind != String || my[3].Kind != QuotedIdent {
+		t.Fatalf("unexpected mysql tokens %v", my)
+	}
+}
+
+func TestFingerprint_IgnoresLiterals(t *testing.T) {
+	same := [][]string{
+		{"SELECT * FROM t WHERE id IN (1, 2, 3)", "select * from T where ID in (4)"},
+		{"SELECT * FROM t WHERE a = 'x' AND b = -5", "SELECT * FROM t WHERE a = $1 AND b = $2"},
+		{"INSERT INTO t VALUES (1, 'a'), (2, 'b')", "INSERT INTO t VALUES (3, 'c')"},
+		{"SELECT 1 /* hint */", "SELECT 2"},
+	}
+	for _, s := range same {
+		a, b := Fingerprint(s[0], Postgres), Fingerprint(s[1], Postgres)
+		if a != b {
+			t.Errorf("expected equal fingerprints:\n  %q -> %q\n  %q -> %q", s[0], a, s[1], b)
+		}
+		if Hash(a) != Hash(b) {
+			t.Errorf("expected equal hashes for %q", s[0])
+		}
+	}
+
+	if got := Fingerprint("SELECT * FROM t WHERE id IN (1, 2)", Postgres); got != "SELECT * FROM t WHERE id IN (?+)" {
+		t.Fatalf("unexpected fingerprint %q", got)
+	}
+	if Fingerprint("SELECT a FROM t", Postgres) == Fingerprint("SELECT b FROM t", Postgres) {
+		t.Fatal("expected different columns to give different fingerprints")
+	}
+}
+
+func TestHash_Stable(t *testing.T) {
+	h := Hash("SELECT ?")
+	if len(h) != 16 || h != Hash("SELECT ?") {
+		t.Fatalf("unexpected hash %q", h)
+	}
+}
@@ -0,0 +1,96 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"database_firewall/internal/config"
+)
+
+// Server builds the listener TLS configuration. It returns nil when TLS is
+// not configured.
+func Server(c *config.TLSC) (*tls.Config, error) {
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	minVersion, err := config.TLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := config.CipherSuites(c.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: suites,
+	}
+	if c.ClientCAFile != "" {
+		pool, err := loadPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.ClientCAs = pool
+		t.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return t, nil
+}
+
+func loadPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Client builds the TLS configuration used towards the upstream at
+// remoteAddress. It returns nil when upstream TLS is disabled.
+func Client(c *config.UpstreamTLSC, remoteAddress string) (*tls.Config, error) {
+	if !c.On() {
+		return nil, nil
+	}
+	minVersion, err := config.TLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tls.Config{
+		ServerName:         c.ServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if t.ServerName == "" {
+		host, _, err := net.SplitHostPort(remoteAddress)
+		if err != nil {
+			return nil, err
+		}
+		t.ServerName = host
+	}
+	if c.CAFile != "" {
+		if t.RootCAs, err = loadPool(c.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
@@ -0,0 +1,90 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/tlsconfig/tlstest"
+)
+
+func TestServer_DisabledWithoutCertificate(t *testing.T) {
+	c, err := Server(&config.TLSC{})
+	if err != nil || c != nil {
+		t.Fatalf("expected nil config, got %v, %v", c, err)
+	}
+}
+
+func TestServer_Options(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	leaf := ca.Issue(t, "firewall", "localhost")
+
+	c, err := Server(&config.TLSC{
+		CertFile:     leaf.CertFile,
+		KeyFile:      leaf.KeyFile,
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		ClientCAFile: ca.File,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("unexpected min version %x", c.MinVersion)
+	}
+	if len(c.CipherSuites) != 1 || c.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected cipher suites %v", c.CipherSuites)
+	}
+	if c.ClientAuth != tls.RequireAndVerifyClientCert || c.ClientCAs == nil {
+		t.Fatal("expected client certificates to be required")
+	}
+}
+
+func TestServer_RejectsBadFiles(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	leaf := ca.Issue(t, "firewall", "localhost")
+
+	bad := []config.TLSC{
+		{CertFile: leaf.CertFile, KeyFile: ca.File},
+		{CertFile: leaf.CertFile, KeyFile: leaf.KeyFile, ClientCAFile: leaf.KeyFile},
+		{CertFile: leaf.CertFile, KeyFile: leaf.KeyFile, MinVersion: "2.0"},
+	}
+	for _, c := range bad {
+		if _, err := Server(&c); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestClient_Options(t *testing.T) {
+	if c, err := Client(&config.UpstreamTLSC{}, "db:5432"); err != nil || c != nil {
+		t.Fatalf("expected nil config when disabled, got %v, %v", c, err)
+	}
+
+	enabled := true
+	ca := tlstest.NewCA(t)
+	leaf := ca.Issue(t, "firewall")
+	c, err := Client(&config.UpstreamTLSC{
+		Enabled:  &enabled,
+		CAFile:   ca.File,
+		CertFile: leaf.CertFile,
+		KeyFile:  leaf.KeyFile,
+	}, "db.internal:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerName != "db.internal" {
+		t.Fatalf("expected server name from remote address, got %q", c.ServerName)
+	}
+	if c.RootCAs == nil || len(c.Certificates) != 1 || c.InsecureSkipVerify {
+		t.Fatalf("unexpected client config %+v", c)
+	}
+
+	c, err = Client(&config.UpstreamTLSC{Enabled: &enabled, ServerName: "override", InsecureSkipVerify: true}, "10.0.0.5:3306")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ServerName != "override" || !c.InsecureSkipVerify {
+		t.Fatalf("unexpected client config %+v", c)
+	}
+}
@@ -0,0 +1,181 @@
+package upgrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A parent hands its listening sockets to the child as extra files, in the
+// order of the addresses in envListeners, followed by the write end of a
+// pipe the child closes once it is serving.
+const (
+	envListeners = "WARDEN_LISTENERS"
+	envReady     = "WARDEN_READY_FD"
+)
+
+var (
+	once      sync.Once
+	inherited map[string]*net.TCPListener
+	readyFile *os.File
+	loadErr   error
+
+	mu      sync.Mutex
+	adopted = make(map[string]bool)
+)
+
+func load() {
+	var addrs []string
+	if v := os.Getenv(envListeners); v != "" {
+		if loadErr = json.Unmarshal([]byte(v), &addrs); loadErr != nil {
+			return
+		}
+	}
+	inherited = make(map[string]*net.TCPListener, len(addrs))
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			loadErr = fmt.Errorf("inherited listener %s: %w", addr, err)
+			return
+		}
+		tl, ok := ln.(*net.TCPListener)
+		if !ok {
+			ln.Close()
+			loadErr = fmt.Errorf("inherited listener %s is not TCP", addr)
+			return
+		}
+		inherited[addr] = tl
+	}
+	if v := os.Getenv(envReady); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			loadErr = fmt.Errorf("%s: %w", envReady, err)
+			return
+		}
+		readyFile = os.NewFile(uintptr(fd), "ready")
+	}
+	os.Unsetenv(envListeners)
+	os.Unsetenv(envReady)
+}
+
+// Listen returns the socket the parent process handed over for addr, or
+// opens a new one.
+func Listen(addr string) (*net.TCPListener, error) {
+	once.Do(load)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ln, ok := inherited[addr]; ok && !adopted[addr] {
+		adopted[addr] = true
+		return ln, nil
+	}
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", laddr)
+}
+
+// Inherited reports whether the process was started by an upgrade.
+func Inherited() bool {
+	once.Do(load)
+	return readyFile != nil
+}
+
+// Ready tells the parent that this process is serving, so it can start
+// draining. Handed over sockets no listener asked for are closed.
+func Ready() error {
+	once.Do(load)
+	mu.Lock()
+	defer mu.Unlock()
+	for addr, ln := range inherited {
+		if !adopted[addr] {
+			ln.Close()
+		}
+	}
+	if readyFile == nil {
+		return nil
+	}
+	defer readyFile.Close()
+	_, err := readyFile.Write([]byte{1})
+	readyFile = nil
+	return err
+}
+
+// Upgrade starts a new copy of the running binary with the same arguments,
+// handing it sockets, and waits up to timeout for it to report ready. The
+// binary is looked up again so a replaced file on disk is picked up. On
+// error the child, if started, is killed and the caller keeps serving.
+func Upgrade(sockets map[string]*net.TCPListener, timeout time.Duration) (int, error) {
+	addrs := make([]string, 0, len(sockets))
+	for addr := range sockets {
+		addrs = append(addrs, addr)
+	}
+	slices.Sort(addrs)
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		f, err := sockets[addr].File()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", addr, err)
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	names, _ := json.Marshal(addrs)
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(slices.DeleteFunc(os.Environ(), func(kv string) bool {
+		return strings.HasPrefix(kv, envListeners+"=") || strings.HasPrefix(kv, envReady+"=")
+	}), envListeners+"="+string(names), envReady+"="+strconv.Itoa(3+len(addrs)))
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	w.Close()
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err == nil {
+			return cmd.Process.Pid, nil
+		}
+		<-exited
+		return 0, errors.New("child exited before it was ready")
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return 0, fmt.Errorf("child not ready after %s", timeout)
+	}
+}
@@ -0,0 +1,87 @@
+package upgrade
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain doubles as the upgraded child when started by Upgrade: it
+// adopts the socket, reports ready, answers one connection and exits.
+func TestMain(m *testing.M) {
+	if os.Getenv(envReady) == "" {
+		os.Exit(m.Run())
+	}
+	if os.Getenv("UPGRADE_TEST_FAIL") != "" {
+		os.Exit(1)
+	}
+	ln, err := Listen("test")
+	if err != nil {
+		os.Exit(2)
+	}
+	if err := Ready(); err != nil {
+		os.Exit(3)
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		os.Exit(4)
+	}
+	c.Write([]byte("child"))
+	c.Close()
+	os.Exit(0)
+}
+
+/*
+-------------------------------------------------
+Test: the child takes over the listening socket
+-------------------------------------------------
+*/
+func TestUpgrade_ChildAcceptsOnHandedOverSocket(t *testing.T) {
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	pid, err := Upgrade(map[string]*net.TCPListener{"test": ln}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	})
+	ln.Close()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the child to hold the socket: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(c)
+	if string(got) != "child" {
+		t.Fatalf("expected answer from the child, got %q", got)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: a child that dies before it is ready fails
+the upgrade
+-------------------------------------------------
+*/
+func TestUpgrade_FailsWhenChildExits(t *testing.T) {
+	t.Setenv("UPGRADE_TEST_FAIL", "1")
+	ln, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := Upgrade(map[string]*net.TCPListener{"test": ln}, 10*time.Second); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+}
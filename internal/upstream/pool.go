@@ -0,0 +1,297 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/logging"
+	"database_firewall/internal/protocol/postgres"
+	"database_firewall/internal/tlsconfig"
+)
+
+const (
+	BalanceFailover         = "failover"
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastConnections = "least_connections"
+)
+
+const (
+	defaultMaxFails      = 3
+	defaultEjectSeconds  = 30
+	defaultCheckTimeout  = 2 * time.Second
+	defaultRise          = 2
+	defaultFall          = 3
+	mysqlHandshakeV10    = 0x0a
+	mysqlErrPacketHeader = 0xff
+)
+
+var _ Dialer = (*Pool)(nil)
+
+// Pool balances connections over the backends of one listener. Backends
+// are taken out of rotation by failed health checks or, passively, after
+// MaxFails dials in a row fail. When every backend is out, all of them are
+// tried in order rather than refusing the client outright.
+type Pool struct {
+	name     string
+	protocol string
+	balance  string
+	maxFails int
+	eject    time.Duration
+	hc       config.HealthCheckC
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	backends []*backend
+	next     int
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+type backend struct {
+	Static
+
+	healthy      bool
+	active       int
+	fails        int
+	ejectedUntil time.Time
+
+	//------health check counters--------
+	rise, fall int
+}
+
+func NewPool(cfg *config.ProxyConfig) (*Pool, error) {
+	u := cfg.Upstream
+	p := &Pool{
+		name:     cfg.Name,
+		protocol: cfg.Protocol,
+		balance:  u.Balance,
+		maxFails: u.MaxFails,
+		eject:    time.Duration(u.EjectSeconds) * time.Second,
+		hc:       u.HealthCheck,
+		timeout:  time.Duration(u.HealthCheck.TimeoutMillis) * time.Millisecond,
+		done:     make(chan struct{}),
+	}
+	if p.balance == "" {
+		p.balance = BalanceFailover
+	}
+	if p.maxFails == 0 {
+		p.maxFails = defaultMaxFails
+	}
+	if p.eject == 0 {
+		p.eject = defaultEjectSeconds * time.Second
+	}
+	if p.timeout == 0 {
+		p.timeout = defaultCheckTimeout
+	}
+	if p.hc.Rise == 0 {
+		p.hc.Rise = defaultRise
+	}
+	if p.hc.Fall == 0 {
+		p.hc.Fall = defaultFall
+	}
+
+	for _, addr := range u.Backends {
+		t, err := tlsconfig.Client(&cfg.UpstreamTLS, addr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addr, err)
+		}
+		p.backends = append(p.backends, &backend{Static: Static{Address: addr, TLS: t}, healthy: true})
+	}
+	if len(p.backends) == 0 {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	return p, nil
+}
+
+// Start runs the active health checks, if configured, until Close.
+func (p *Pool) Start() {
+	if p.hc.IntervalSeconds <= 0 {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(time.Duration(p.hc.IntervalSeconds) * time.Second)
+		defer t.Stop()
+		for {
+			p.checkAll()
+			select {
+			case <-t.C:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+	p.wg.Wait()
+}
+
+// Dial connects to the first backend that accepts, in balancing order.
+func (p *Pool) Dial() (*Conn, error) {
+	var errs []error
+	for _, b := range p.candidates() {
+		c, err := b.Dial()
+		if err != nil {
+			p.dialFailed(b, err)
+			errs = append(errs, err)
+			continue
+		}
+		p.dialed(b)
+		c.release = func() {
+			p.mu.Lock()
+			b.active--
+			p.mu.Unlock()
+		}
+		return c, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (p *Pool) candidates() []*backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var up []*backend
+	for _, b := range p.backends {
+		if b.healthy && !now.Before(b.ejectedUntil) {
+			up = append(up, b)
+		}
+	}
+	if len(up) == 0 {
+		return append([]*backend(nil), p.backends...)
+	}
+
+	switch p.balance {
+	case BalanceRoundRobin:
+		i := p.next % len(up)
+		p.next++
+		up = append(up[i:], up[:i]...)
+	case BalanceLeastConnections:
+		sort.SliceStable(up, func(i, j int) bool { return up[i].active < up[j].active })
+	}
+	return up
+}
+
+func (p *Pool) dialed(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.active++
+	b.fails = 0
+	if !b.ejectedUntil.IsZero() {
+		b.ejectedUntil = time.Time{}
+		p.logEvent("INFO", "upstream_restored", b, nil)
+	}
+}
+
+func (p *Pool) dialFailed(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.fails++
+	if b.fails < p.maxFails {
+		return
+	}
+	b.fails = 0
+	b.ejectedUntil = time.Now().Add(p.eject)
+	p.logEvent("WARN", "upstream_ejected", b, map[string]any{
+		"error":     err.Error(),
+		"eject_sec": int64(p.eject / time.Second),
+	})
+}
+
+//--------active health checks--------
+
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.record(b, p.check(b.Address))
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pool) record(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		b.rise++
+		b.fall = 0
+		if !b.healthy && b.rise >= p.hc.Rise {
+			b.healthy = true
+			p.logEvent("INFO", "upstream_up", b, nil)
+		}
+		return
+	}
+	b.fall++
+	b.rise = 0
+	if b.healthy && b.fall >= p.hc.Fall {
+		b.healthy = false
+		p.logEvent("WARN", "upstream_down", b, map[string]any{"error": err.Error()})
+	}
+}
+
+// check connects to addr and, with protocol checks on, waits for the
+// server to speak its protocol. Postgres is sent an SSLRequest, which any
+// server answers with a single byte without authentication; MySQL servers
+// greet first and send an ERR packet instead when they refuse clients.
+func (p *Pool) check(addr string) error {
+	c, err := net.DialTimeout("tcp", addr, p.timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !p.hc.Protocol {
+		return nil
+	}
+	c.SetDeadline(time.Now().Add(p.timeout))
+
+	switch p.protocol {
+	case "postgres":
+		if _, err := c.Write(postgres.SSLRequestMessage); err != nil {
+			return err
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		if b[0] != 'S' && b[0] != 'N' {
+			return fmt.Errorf("unexpected SSLRequest response %q", b[0])
+		}
+	case "mysql":
+		hdr := make([]byte, 5)
+		if _, err := io.ReadFull(c, hdr); err != nil {
+			return err
+		}
+		switch hdr[4] {
+		case mysqlHandshakeV10:
+		case mysqlErrPacketHeader:
+			return fmt.Errorf("server refused connection")
+		default:
+			return fmt.Errorf("unexpected greeting 0x%02x", hdr[4])
+		}
+	}
+	return nil
+}
+
+func (p *Pool) logEvent(level, event string, b *backend, fields map[string]any) {
+	if fields == nil {
+		fields = map[string]any{}
+	}
+	fields["listener"] = p.name
+	fields["upstream"] = b.Address
+	logging.LogEvent(level, event, fields)
+}
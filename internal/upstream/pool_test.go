@@ -0,0 +1,182 @@
+package upstream
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"database_firewall/internal/config"
+	"database_firewall/internal/protocol/postgres"
+)
+
+// startBackend accepts connections and hands each to serve, or holds it
+// open until the client goes away when serve is nil.
+func startBackend(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if serve != nil {
+					serve(c)
+					return
+				}
+				io.Copy(io.Discard, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// deadAddress returns an address nothing listens on.
+func deadAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func newPool(t *testing.T, protocol string, u config.UpstreamC) *Pool {
+	t.Helper()
+	p, err := NewPool(&config.ProxyConfig{Name: "test", Protocol: protocol, Upstream: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func dial(t *testing.T, p *Pool) *Conn {
+	t.Helper()
+	c, err := p.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+/*
+-------------------------------------------------
+Test: failover skips a dead primary and ejects it
+-------------------------------------------------
+*/
+func TestPool_FailoverEjectsDeadBackend(t *testing.T) {
+	dead, live := deadAddress(t), startBackend(t, nil)
+	p := newPool(t, "", config.UpstreamC{Backends: []string{dead, live}, MaxFails: 1})
+
+	if c := dial(t, p); c.Address != live {
+		t.Fatalf("expected %s, got %s", live, c.Address)
+	}
+	if p.backends[0].ejectedUntil.IsZero() {
+		t.Fatal("expected dead backend to be ejected")
+	}
+	if cs := p.candidates(); len(cs) != 1 || cs[0].Address != live {
+		t.Fatalf("expected only the live backend in rotation, got %d", len(cs))
+	}
+}
+
+/*
+-------------------------------------------------
+Test: every backend ejected → all are still tried
+-------------------------------------------------
+*/
+func TestPool_TriesAllWhenAllEjected(t *testing.T) {
+	live := startBackend(t, nil)
+	p := newPool(t, "", config.UpstreamC{Backends: []string{deadAddress(t), live}})
+	for _, b := range p.backends {
+		b.healthy = false
+	}
+	if c := dial(t, p); c.Address != live {
+		t.Fatalf("expected %s, got %s", live, c.Address)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: round robin alternates between backends
+-------------------------------------------------
+*/
+func TestPool_RoundRobin(t *testing.T) {
+	a, b := startBackend(t, nil), startBackend(t, nil)
+	p := newPool(t, "", config.UpstreamC{Backends: []string{a, b}, Balance: BalanceRoundRobin})
+
+	want := []string{a, b, a, b}
+	for i, w := range want {
+		if c := dial(t, p); c.Address != w {
+			t.Fatalf("dial %d: expected %s, got %s", i, w, c.Address)
+		}
+	}
+}
+
+/*
+-------------------------------------------------
+Test: least connections follows open connections
+-------------------------------------------------
+*/
+func TestPool_LeastConnections(t *testing.T) {
+	a, b := startBackend(t, nil), startBackend(t, nil)
+	p := newPool(t, "", config.UpstreamC{Backends: []string{a, b}, Balance: BalanceLeastConnections})
+
+	first := dial(t, p)
+	if first.Address != a {
+		t.Fatalf("expected %s, got %s", a, first.Address)
+	}
+	if c := dial(t, p); c.Address != b {
+		t.Fatalf("expected %s while %s is busy, got %s", b, a, c.Address)
+	}
+	first.Close()
+	if c := dial(t, p); c.Address != a {
+		t.Fatalf("expected %s after its connection closed, got %s", a, c.Address)
+	}
+}
+
+/*
+-------------------------------------------------
+Test: protocol health checks take a backend down
+and bring it back after it recovers
+-------------------------------------------------
+*/
+func TestPool_ProtocolHealthCheck(t *testing.T) {
+	answer := make(chan byte, 1)
+	addr := startBackend(t, func(c net.Conn) {
+		c.Read(make([]byte, len(postgres.SSLRequestMessage)))
+		select {
+		case b := <-answer:
+			c.Write([]byte{b})
+		default:
+		}
+	})
+	p := newPool(t, "postgres", config.UpstreamC{
+		Backends:    []string{addr},
+		HealthCheck: config.HealthCheckC{Protocol: true, Rise: 1, Fall: 2},
+	})
+
+	p.checkAll()
+	if !p.backends[0].healthy {
+		t.Fatal("expected one failed check to stay under fall")
+	}
+	p.checkAll()
+	if p.backends[0].healthy {
+		t.Fatal("expected backend that never answers the SSLRequest to be down")
+	}
+
+	answer <- 'N'
+	p.checkAll()
+	if !p.backends[0].healthy {
+		t.Fatal("expected backend to be back up")
+	}
+}
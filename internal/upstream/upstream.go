@@ -0,0 +1,53 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// dialTimeout bounds a single backend dial so a dead primary does not hold
+// the client until the OS gives up.
+const dialTimeout = 5 * time.Second
+
+// Dialer hands the proxy a connection to a backend.
+type Dialer interface {
+	Dial() (*Conn, error)
+}
+
+// Conn is a connection to one backend. TLS is the configuration to
+// originate TLS with towards it, or nil for plaintext.
+type Conn struct {
+	net.Conn
+	Address string
+	TLS     *tls.Config
+
+	once    sync.Once
+	release func()
+}
+
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return c.Conn.Close()
+}
+
+var _ Dialer = Static{}
+
+// Static always dials the same address.
+type Static struct {
+	Address string
+	TLS     *tls.Config
+}
+
+func (s Static) Dial() (*Conn, error) {
+	c, err := net.DialTimeout("tcp", s.Address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c, Address: s.Address, TLS: s.TLS}, nil
+}